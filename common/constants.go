@@ -1,8 +1,11 @@
 package common
 
+import "fmt"
+
 const (
 	REAL_MODE = iota
 	PROTECTED_MODE
+	VIRTUAL_8086_MODE
 )
 
 const (
@@ -22,6 +25,31 @@ const (
 	MODULE_DEBUG_MONITOR
 )
 
+var moduleNames = map[uint8]string{
+	MODULE_PRIMARY_PROCESSOR:         "cpu",
+	MODULE_MATH_CO_PROCESSOR:         "fpu",
+	MODULE_INTERRUPT_CONTROLLER_1:    "pic1",
+	MODULE_INTERRUPT_CONTROLLER_2:    "pic2",
+	MODULE_PIT:                       "pit",
+	MODULE_MEMORY_ACCESS_CONTROLLER:  "memory",
+	MODULE_IO_PORT_ACCESS_CONTROLLER: "io",
+	MODULE_PS2_CONTROLLER:            "ps2",
+	MODULE_INTEL_82335:               "82335",
+	MODULE_CGA:                       "cga",
+	MODULE_CMOS:                      "cmos",
+	MODULE_DMA_CONTROLLER:            "dma1",
+	MODULE_DMA_CONTROLLER_2:          "dma2",
+	MODULE_DEBUG_MONITOR:             "monitor",
+}
+
+// ModuleName returns the short name devices of a module type are known by
+func ModuleName(module uint8) string {
+	if name, ok := moduleNames[module]; ok {
+		return name
+	}
+	return fmt.Sprintf("module%d", module)
+}
+
 const (
 	SEGMENT_ES = iota + 1
 	SEGMENT_CS
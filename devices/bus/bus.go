@@ -2,15 +2,20 @@ package bus
 
 import (
 	"container/list"
-	"github.com/google/uuid"
-	"log"
+	"fmt"
 )
 
 type DeviceType uint8
 
 type Bus struct {
-	deviceMap     map[DeviceType]*list.List
-	devicePortMap map[uint16]*DevicePort
+	deviceMap map[DeviceType]*list.List
+	devices   []*registeredDevice // in registration order
+
+	// port routes, indexed by port number
+	readPorts  []*PortRoute
+	writePorts []*PortRoute
+
+	signals Signals
 }
 
 type BusMessage struct {
@@ -19,11 +24,6 @@ type BusMessage struct {
 	Data    []byte
 }
 
-type DevicePortMap struct {
-	ReadPorts  []uint16
-	WritePorts []uint16
-}
-
 type BusDevice interface {
 	GetDeviceBusId() uint32
 	SetDeviceBusId(id uint32)
@@ -35,116 +35,124 @@ type BusDevice interface {
 	WriteAddr8(addr uint16, data uint8)
 }
 
+// Checkpointable devices can capture and restore their internal state, which is
+// what reverse execution uses to take machine checkpoints
+type Checkpointable interface {
+	SaveState() interface{}
+	RestoreState(state interface{})
+}
+
 func NewDeviceBus() *Bus {
 	bus := &Bus{}
 
 	bus.deviceMap = make(map[DeviceType]*list.List)
-	bus.devicePortMap = make(map[uint16]*DevicePort)
+	bus.readPorts = make([]*PortRoute, PORT_COUNT)
+	bus.writePorts = make([]*PortRoute, PORT_COUNT)
 
 	return bus
 }
 
-type DevicePortMode uint8
-
-const DEVICE_PORT_READ = DevicePortMode(0)
-const DEVICE_PORT_WRITE = DevicePortMode(1)
-
-type DevicePort struct {
-	Device BusDevice
-	Port   uint16
-	Mode   DevicePortMode
-}
-
-func (bus *Bus) GetDeviceOnPort(addr uint16) *DevicePort {
-	if dev, ok := bus.devicePortMap[addr]; ok {
-		return dev
-	}
-
-	return nil
-
-}
-
-func (bus *Bus) RegisterDevice(device BusDevice, deviceType DeviceType) {
+func (bus *Bus) RegisterDevice(device BusDevice, deviceType DeviceType) error {
 	if _, ok := bus.deviceMap[deviceType]; !ok {
 		bus.deviceMap[deviceType] = list.New()
 	}
+	deviceList := bus.deviceMap[deviceType]
 
-	// register the device ports
-	portMap := device.GetPortMap()
-	if portMap != nil {
-		for _, port := range portMap.ReadPorts {
-			bus.devicePortMap[port] = &DevicePort{Device: device, Port: port, Mode: DEVICE_PORT_READ}
-		}
+	registered := &registeredDevice{
+		device:     device,
+		deviceType: deviceType,
+		instance:   deviceList.Len(),
+	}
+	registered.name = DeviceName(deviceType, registered.instance)
 
-		for _, port := range portMap.WritePorts {
-			bus.devicePortMap[port] = &DevicePort{Device: device, Port: port, Mode: DEVICE_PORT_WRITE}
-		}
+	// claim the device ports first so a conflicting device is not left half registered
+	if err := bus.registerPorts(registered); err != nil {
+		return err
 	}
 
-	deviceList := bus.deviceMap[deviceType]
-	device.SetDeviceBusId(getRandomUUID())
+	device.SetDeviceBusId(DeviceId(deviceType, registered.instance))
+	bus.devices = append(bus.devices, registered)
 	device.SetBus(bus)
 
 	deviceList.PushBack(device)
+
+	return nil
+}
+
+// DeviceNotFoundError is returned when no device of a type is registered on the bus
+type DeviceNotFoundError struct {
+	DeviceType DeviceType
+}
+
+func (err DeviceNotFoundError) Error() string {
+	return fmt.Sprintf("could not find device on bus of type %v", err.DeviceType)
 }
 
-func getRandomUUID() uint32 {
-	uuid, _ := uuid.NewRandom()
-	return uuid.ID()
+func (bus *Bus) FindDevice(deviceType DeviceType) (*list.List, error) {
+	if device, ok := bus.deviceMap[deviceType]; ok && device.Len() > 0 {
+		return device, nil
+	}
+	return nil, DeviceNotFoundError{DeviceType: deviceType}
 }
 
-func (bus *Bus) FindDevice(deviceType DeviceType) *list.List {
-	if device, ok := bus.deviceMap[deviceType]; ok {
-		return device
-	} else {
-		log.Fatalf("Could not find device on bus of type %v", deviceType)
-		return nil
+func (bus *Bus) FindSingleDevice(deviceType DeviceType) (BusDevice, error) {
+	deviceList, err := bus.FindDevice(deviceType)
+	if err != nil {
+		return nil, err
 	}
+	return deviceList.Front().Value.(BusDevice), nil
 }
 
-func (bus *Bus) FindSingleDevice(deviceType DeviceType) BusDevice {
-	deviceList := bus.FindDevice(deviceType)
-	return deviceList.Front().Value.(BusDevice)
+// FindSingleDeviceAs finds the first device of a type on the bus as its concrete type
+func FindSingleDeviceAs[T BusDevice](bus *Bus, deviceType DeviceType) (T, error) {
+	var none T
+	device, err := bus.FindSingleDevice(deviceType)
+	if err != nil {
+		return none, err
+	}
+	typed, ok := device.(T)
+	if !ok {
+		return none, fmt.Errorf("device on bus of type %v is a %T, not a %T", deviceType, device, none)
+	}
+	return typed, nil
 }
 
-// Sends a message to all devices on the bus
+// Sends a message to all devices on the bus. Signals that fire often should use a Line instead.
 func (bus *Bus) SendMessage(message BusMessage) {
-	for e, _ := range bus.deviceMap {
-		devList := bus.deviceMap[e]
-		for dev := devList.Front(); dev != nil; dev = dev.Next() {
-			dev.Value.(BusDevice).OnReceiveMessage(message)
-		}
+	for _, registered := range bus.devices {
+		registered.device.OnReceiveMessage(message)
 	}
 }
 
 func (bus *Bus) SendMessageToAll(deviceType DeviceType, message BusMessage) error {
-	if devList, ok := bus.deviceMap[deviceType]; ok {
-		for dev := devList.Front(); dev != nil; dev = dev.Next() {
-			dev.Value.(BusDevice).OnReceiveMessage(message)
-		}
-	} else {
-		log.Fatalf("Could not find device on bus of type %v", deviceType)
+	devList, err := bus.FindDevice(deviceType)
+	if err != nil {
+		return err
+	}
+	for dev := devList.Front(); dev != nil; dev = dev.Next() {
+		dev.Value.(BusDevice).OnReceiveMessage(message)
 	}
 
 	return nil
 }
 
 func (bus *Bus) SendMessageSingle(deviceType DeviceType, message BusMessage) error {
-	bus.FindSingleDevice(deviceType).OnReceiveMessage(message)
+	device, err := bus.FindSingleDevice(deviceType)
+	if err != nil {
+		return err
+	}
+	device.OnReceiveMessage(message)
 
 	return nil
 }
+
 func (bus *Bus) SendMessageToDeviceById(deviceId uint32, message BusMessage) error {
-	for e, _ := range bus.deviceMap {
-		devList := bus.deviceMap[e]
-		for dev := devList.Front(); dev != nil; dev = dev.Next() {
-			if dev.Value.(BusDevice).GetDeviceBusId() == deviceId {
-				dev.Value.(BusDevice).OnReceiveMessage(message)
-				return nil
-			}
+	for _, registered := range bus.devices {
+		if registered.device.GetDeviceBusId() == deviceId {
+			registered.device.OnReceiveMessage(message)
+			return nil
 		}
 	}
 
 	return nil
-
 }
@@ -0,0 +1,158 @@
+package bus
+
+import (
+	"fmt"
+)
+
+/*
+	Port registration
+	Devices declare the I/O ports they decode as ranges, each with independent
+	read and write handlers. Ports are claimed when the device is registered, and
+	a port already claimed for the same direction is a registration error.
+*/
+
+// PORT_COUNT - size of the x86 I/O port address space
+const PORT_COUNT = 0x10000
+
+// PortRange is an inclusive range of I/O ports
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func Port(port uint16) PortRange {
+	return PortRange{First: port, Last: port}
+}
+
+func Ports(first uint16, last uint16) PortRange {
+	return PortRange{First: first, Last: last}
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("%#04x", r.First)
+	}
+	return fmt.Sprintf("%#04x-%#04x", r.First, r.Last)
+}
+
+// PortMapping attaches handlers to a range of ports. A nil Read or Write leaves that
+// direction unclaimed. The wide handlers are optional; without them 16 and 32 bit
+// accesses are split into byte accesses on consecutive ports.
+type PortMapping struct {
+	Ports PortRange
+
+	Read  func(port uint16) uint8
+	Write func(port uint16, value uint8)
+
+	Read16  func(port uint16) uint16
+	Write16 func(port uint16, value uint16)
+	Read32  func(port uint16) uint32
+	Write32 func(port uint16, value uint32)
+}
+
+type DevicePortMap struct {
+	Mappings []PortMapping
+}
+
+// ReadWrite maps a range of ports to the byte handlers of a device in both directions
+func ReadWrite(ports PortRange, device BusDevice) PortMapping {
+	return PortMapping{Ports: ports, Read: device.ReadAddr8, Write: device.WriteAddr8}
+}
+
+// ReadOnly maps a range of ports to the byte read handler of a device
+func ReadOnly(ports PortRange, device BusDevice) PortMapping {
+	return PortMapping{Ports: ports, Read: device.ReadAddr8}
+}
+
+// WriteOnly maps a range of ports to the byte write handler of a device
+func WriteOnly(ports PortRange, device BusDevice) PortMapping {
+	return PortMapping{Ports: ports, Write: device.WriteAddr8}
+}
+
+// PortRoute is the device and mapping a port is routed to
+type PortRoute struct {
+	Device  BusDevice
+	Name    string // registered name of the device
+	Mapping *PortMapping
+}
+
+type PortConflictError struct {
+	Port     uint16
+	Write    bool
+	Device   string
+	Existing string
+}
+
+func (err *PortConflictError) Error() string {
+	direction := "read"
+	if err.Write {
+		direction = "write"
+	}
+	return fmt.Sprintf("port %#04x %s is claimed by both %s and %s", err.Port, direction, err.Existing, err.Device)
+}
+
+func (bus *Bus) registerPorts(registered *registeredDevice) error {
+	device := registered.device
+	portMap := device.GetPortMap()
+	if portMap == nil {
+		return nil
+	}
+
+	// check the whole map before claiming anything, including overlaps within the device itself
+	reads := make(map[uint16]bool)
+	writes := make(map[uint16]bool)
+	for _, mapping := range portMap.Mappings {
+		for port := uint32(mapping.Ports.First); port <= uint32(mapping.Ports.Last); port++ {
+			if mapping.Read != nil {
+				if route := bus.readPorts[port]; route != nil || reads[uint16(port)] {
+					return conflict(uint16(port), false, registered, route)
+				}
+				reads[uint16(port)] = true
+			}
+			if mapping.Write != nil {
+				if route := bus.writePorts[port]; route != nil || writes[uint16(port)] {
+					return conflict(uint16(port), true, registered, route)
+				}
+				writes[uint16(port)] = true
+			}
+		}
+	}
+
+	for i := range portMap.Mappings {
+		mapping := &portMap.Mappings[i]
+		route := &PortRoute{Device: device, Name: registered.name, Mapping: mapping}
+		for port := uint32(mapping.Ports.First); port <= uint32(mapping.Ports.Last); port++ {
+			if mapping.Read != nil {
+				bus.readPorts[port] = route
+			}
+			if mapping.Write != nil {
+				bus.writePorts[port] = route
+			}
+		}
+	}
+
+	return nil
+}
+
+func conflict(port uint16, write bool, registered *registeredDevice, existing *PortRoute) error {
+	// a nil existing route means the device overlaps with itself
+	err := &PortConflictError{Port: port, Write: write, Device: registered.name, Existing: registered.name}
+	if existing != nil {
+		err.Existing = existing.Name
+	}
+	return err
+}
+
+// GetPortReadRoute returns where reads of a port go, or nil if no device claims it
+func (bus *Bus) GetPortReadRoute(port uint16) *PortRoute {
+	return bus.readPorts[port]
+}
+
+// GetPortWriteRoute returns where writes to a port go, or nil if no device claims it
+func (bus *Bus) GetPortWriteRoute(port uint16) *PortRoute {
+	return bus.writePorts[port]
+}
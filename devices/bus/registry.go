@@ -0,0 +1,122 @@
+package bus
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+	"sort"
+)
+
+/*
+	Device registry
+	Devices get a stable ID and name from their type and the order they were
+	registered in, so logs and tools can refer to the same device across runs.
+	The registry also describes the ports and memory each device decodes.
+*/
+
+// MemoryWindow is a range of the physical address space a device responds to
+type MemoryWindow struct {
+	Name  string
+	Start uint32
+	Size  uint32
+}
+
+// End returns the last address in the window
+func (window MemoryWindow) End() uint32 {
+	return window.Start + window.Size - 1
+}
+
+func (window MemoryWindow) Overlaps(other MemoryWindow) bool {
+	return window.Start <= other.End() && other.Start <= window.End()
+}
+
+func (window MemoryWindow) String() string {
+	return fmt.Sprintf("%#08x-%#08x %s", window.Start, window.End(), window.Name)
+}
+
+// MemoryMappedDevice is implemented by devices that decode physical memory addresses
+type MemoryMappedDevice interface {
+	GetMemoryMap() []MemoryWindow
+}
+
+type registeredDevice struct {
+	device     BusDevice
+	deviceType DeviceType
+	instance   int
+	name       string
+}
+
+// DeviceInfo describes a registered device
+type DeviceInfo struct {
+	Id       uint32
+	Name     string
+	Type     DeviceType
+	Instance int
+	Device   BusDevice
+	Ports    []PortMapping
+	Memory   []MemoryWindow
+}
+
+// DeviceId is the bus ID of the instance'th device of a type
+func DeviceId(deviceType DeviceType, instance int) uint32 {
+	return uint32(deviceType)<<8 | uint32(instance)
+}
+
+// DeviceName is the name of the instance'th device of a type, e.g. "pit.0"
+func DeviceName(deviceType DeviceType, instance int) string {
+	return fmt.Sprintf("%s.%d", common.ModuleName(uint8(deviceType)), instance)
+}
+
+func (bus *Bus) describe(registered *registeredDevice) DeviceInfo {
+	info := DeviceInfo{
+		Id:       registered.device.GetDeviceBusId(),
+		Name:     registered.name,
+		Type:     registered.deviceType,
+		Instance: registered.instance,
+		Device:   registered.device,
+	}
+	if portMap := registered.device.GetPortMap(); portMap != nil {
+		info.Ports = portMap.Mappings
+	}
+	if mapped, ok := registered.device.(MemoryMappedDevice); ok {
+		info.Memory = mapped.GetMemoryMap()
+	}
+	return info
+}
+
+// Devices lists every registered device in registration order
+func (bus *Bus) Devices() []DeviceInfo {
+	devices := make([]DeviceInfo, len(bus.devices))
+	for i, registered := range bus.devices {
+		devices[i] = bus.describe(registered)
+	}
+	return devices
+}
+
+func (bus *Bus) FindDeviceByName(name string) (DeviceInfo, bool) {
+	for _, registered := range bus.devices {
+		if registered.name == name {
+			return bus.describe(registered), true
+		}
+	}
+	return DeviceInfo{}, false
+}
+
+// GetDeviceName returns the registered name of a device, or "" if it is not on the bus
+func (bus *Bus) GetDeviceName(device BusDevice) string {
+	for _, registered := range bus.devices {
+		if registered.device == device {
+			return registered.name
+		}
+	}
+	return ""
+}
+
+// MemoryMap returns the memory windows of every device ordered by start address
+func (bus *Bus) MemoryMap() []MemoryWindow {
+	windows := make([]MemoryWindow, 0)
+	for _, info := range bus.Devices() {
+		windows = append(windows, info.Memory...)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start < windows[j].Start })
+	return windows
+}
@@ -0,0 +1,59 @@
+package bus
+
+/*
+	Signal lines
+	Typed point to point wiring between devices for signals that change often
+	enough that broadcasting a BusMessage to every device is too expensive, like
+	interrupt requests. Driving a line calls each subscriber directly, so there
+	is no device lookup and nothing is allocated.
+*/
+
+// IRQ_LINES - number of ISA interrupt request lines across both interrupt controllers
+const IRQ_LINES = 16
+
+// Line carries values of type T from whichever device drives it to every subscriber
+type Line[T any] struct {
+	subscribers []func(value T)
+}
+
+func (line *Line[T]) Subscribe(fn func(value T)) {
+	line.subscribers = append(line.subscribers, fn)
+}
+
+func (line *Line[T]) Drive(value T) {
+	for _, fn := range line.subscribers {
+		fn(value)
+	}
+}
+
+// Connected reports whether anything listens to the line, so drivers can skip preparing values nobody reads
+func (line *Line[T]) Connected() bool {
+	return len(line.subscribers) > 0
+}
+
+// MemoryConfig is how the chipset decodes the shadowable rom areas and the top of base memory
+type MemoryConfig struct {
+	BiosShadow     bool   // reads from F0000-FFFFF come from shadow ram instead of the bios rom
+	BiosReadOnly   bool   // writes to F0000-FFFFF are dropped instead of going to shadow ram
+	VideoShadow    bool   // reads from C0000-C7FFF come from shadow ram instead of the video bios
+	VideoReadOnly  bool   // writes to C0000-C7FFF are dropped
+	AdapterShadow  bool   // reads from C8000-DFFFF come from shadow ram instead of adapter roms
+	BaseMemorySize uint32 // 0x80000 or 0xA0000, base memory above it is left to the ISA bus
+}
+
+type Signals struct {
+	IRQ        [IRQ_LINES]Line[bool] // interrupt requests, driven true on the rising edge
+	INTR       Line[bool]            // interrupt controller output to the processor
+	A20        Line[bool]            // A20 gate output of the 8042 keyboard controller, true when enabled
+	Reset      Line[bool]            // pulsed true to reset the processor
+	ModeSwitch Line[uint8]           // processor mode changes, common.REAL_MODE, PROTECTED_MODE or VIRTUAL_8086_MODE
+
+	MemoryConfig Line[MemoryConfig] // driven by the chipset whenever its memory configuration is written
+
+	InstructionLog Line[string]
+	DebugLog       Line[string]
+}
+
+func (bus *Bus) Signals() *Signals {
+	return &bus.signals
+}
@@ -63,7 +63,13 @@ func (c *Motorola6845) OnReceiveMessage(message bus.BusMessage) {
 }
 
 func (c *Motorola6845) GetPortMap() *bus.DevicePortMap {
-	return nil
+	return &bus.DevicePortMap{
+		Mappings: []bus.PortMapping{
+			bus.WriteOnly(bus.Ports(0x03D4, 0x03D5), c),
+			bus.WriteOnly(bus.Ports(0x03D8, 0x03D9), c),
+			bus.ReadOnly(bus.Port(0x03DA), c),
+		},
+	}
 }
 
 func (c *Motorola6845) WriteAddr8(port_addr uint16, value uint8) {
@@ -167,6 +173,15 @@ func (c *Motorola6845) GetBus() *bus.Bus {
 func (c *Motorola6845) SetBus(bus *bus.Bus) {
 }
 
+func (c *Motorola6845) SaveState() interface{} {
+	state := *c
+	return &state
+}
+
+func (c *Motorola6845) RestoreState(state interface{}) {
+	*c = *state.(*Motorola6845)
+}
+
 func (c *Motorola6845) isInVerticalRetrace() bool {
 	// Get the current scanline number
 	scanline := c.getCurrentScanline()
@@ -3,14 +3,29 @@ package cmos
 import (
 	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/replay"
 	"log"
 )
 
+// CMOS registers the BIOS reads the installed memory from, all in KB
+const (
+	CMOS_BASE_MEMORY_LOW      = 0x15
+	CMOS_BASE_MEMORY_HIGH     = 0x16
+	CMOS_EXTENDED_MEMORY_LOW  = 0x17
+	CMOS_EXTENDED_MEMORY_HIGH = 0x18
+	CMOS_POST_EXTENDED_LOW    = 0x30 // extended memory found by POST
+	CMOS_POST_EXTENDED_HIGH   = 0x31
+
+	CMOS_CHECKSUM_HIGH = 0x2E // sum of registers 0x10-0x2D
+	CMOS_CHECKSUM_LOW  = 0x2F
+)
+
 type Motorola146818 struct {
 	bus      *bus.Bus
 	busId    uint32
 	cmosData [128]uint8
 	index    uint8
+	journal  *replay.Journal
 }
 
 func NewMotorola146818() *Motorola146818 {
@@ -29,24 +44,62 @@ func (d *Motorola146818) SetBus(bus *bus.Bus) {
 	d.bus = bus
 }
 
+func (d *Motorola146818) SaveState() interface{} {
+	state := *d
+	return &state
+}
+
+func (d *Motorola146818) RestoreState(state interface{}) {
+	*d = *state.(*Motorola146818)
+}
+
+// SetMemorySize stores the installed memory in the CMOS registers and fixes up the checksum that covers them
+func (d *Motorola146818) SetMemorySize(baseKB uint16, extendedKB uint16) {
+	d.cmosData[CMOS_BASE_MEMORY_LOW] = uint8(baseKB)
+	d.cmosData[CMOS_BASE_MEMORY_HIGH] = uint8(baseKB >> 8)
+	d.cmosData[CMOS_EXTENDED_MEMORY_LOW] = uint8(extendedKB)
+	d.cmosData[CMOS_EXTENDED_MEMORY_HIGH] = uint8(extendedKB >> 8)
+	d.cmosData[CMOS_POST_EXTENDED_LOW] = uint8(extendedKB)
+	d.cmosData[CMOS_POST_EXTENDED_HIGH] = uint8(extendedKB >> 8)
+	d.updateChecksum()
+}
+
+func (d *Motorola146818) updateChecksum() {
+	var sum uint16
+	for i := 0x10; i < CMOS_CHECKSUM_HIGH; i++ {
+		sum += uint16(d.cmosData[i])
+	}
+	d.cmosData[CMOS_CHECKSUM_HIGH] = uint8(sum >> 8)
+	d.cmosData[CMOS_CHECKSUM_LOW] = uint8(sum)
+}
+
+func (d *Motorola146818) SetJournal(journal *replay.Journal) {
+	d.journal = journal
+}
+
 func (d *Motorola146818) OnReceiveMessage(message bus.BusMessage) {
 }
 
 func (d *Motorola146818) GetPortMap() *bus.DevicePortMap {
 	return &bus.DevicePortMap{
-		ReadPorts:  []uint16{0x71},
-		WritePorts: []uint16{0x70, 71},
+		Mappings: []bus.PortMapping{
+			bus.WriteOnly(bus.Port(0x70), d),
+			bus.ReadWrite(bus.Port(0x71), d),
+		},
 	}
-	return nil
 }
 
 func (d *Motorola146818) ReadAddr8(addr uint16) uint8 {
 	switch addr {
 	case 0x71: // Data port read
 		if d.index < 128 {
-			friendlyCmosString := common.CmosRegisterWriteToFriendlyString(d.index, d.cmosData[d.index])
-			log.Printf("CMOS RAM: %#02x -> %#02x (%s)", d.index, d.cmosData[d.index], friendlyCmosString)
-			return d.cmosData[d.index]
+			value := d.cmosData[d.index]
+			if d.journal != nil {
+				value = uint8(d.journal.Sample(replay.EVENT_RTC_READ, uint64(value)))
+			}
+			friendlyCmosString := common.CmosRegisterWriteToFriendlyString(d.index, value)
+			log.Printf("CMOS RAM: %#02x -> %#02x (%s)", d.index, value, friendlyCmosString)
+			return value
 		}
 	default:
 		log.Printf("Motorola6845: Unsupported read from address 0x%04X", addr)
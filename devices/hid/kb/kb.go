@@ -28,6 +28,18 @@ func (kb *Ps2Keyboard) Disconnect() {
 	// Perform any necessary cleanup or teardown
 }
 
+func (kb *Ps2Keyboard) SaveState() interface{} {
+	state := *kb
+	state.scanCodes = append([]uint8(nil), kb.scanCodes...)
+	return &state
+}
+
+func (kb *Ps2Keyboard) RestoreState(state interface{}) {
+	saved := *state.(*Ps2Keyboard)
+	saved.scanCodes = append([]uint8(nil), saved.scanCodes...)
+	*kb = saved
+}
+
 func (kb *Ps2Keyboard) SendData(data uint8) {
 	// Send the data to the PS/2 controller's input buffer
 	kb.controller.BufferInputData(data)
@@ -0,0 +1,457 @@
+package intel80387
+
+import (
+	"math"
+	"math/big"
+)
+
+// the arithmetic operations, numbered as the reg field of D8 and DC encodes them
+const (
+	opAdd  = 0
+	opMul  = 1
+	opSub  = 4
+	opSubR = 5
+	opDiv  = 6
+	opDivR = 7
+)
+
+// intermediatePrecision is how many bits results are computed to before rounding to the
+// precision control, comfortably more than the 64 bit significands need
+const intermediatePrecision = 256
+
+func intermediate() *big.Float {
+	return new(big.Float).SetPrec(intermediatePrecision).SetMode(big.ToZero)
+}
+
+// sticky marks a truncated intermediate result by placing it halfway to the next value, so that
+// rounding it to the destination precision goes the same way as rounding the exact result
+func sticky(z *big.Float, inexact bool) *big.Float {
+	if !inexact || z.IsInf() || z.Sign() == 0 {
+		return z
+	}
+	half := new(big.Float).SetMantExp(big.NewFloat(1), z.MantExp(nil)-intermediatePrecision-1)
+	if z.Signbit() {
+		half.Neg(half)
+	}
+	return z.SetPrec(intermediatePrecision+1).Add(z, half)
+}
+
+// nanOperand handles operands arithmetic can't compute with. An unsupported format or a
+// signaling NaN is an invalid operation, and any NaN makes the result a NaN, the one with the
+// larger significand when there are two. It reports whether there was such an operand.
+func nanOperand(values ...Float80) (Float80, uint16, bool) {
+	var exceptions uint16
+	var result Float80
+	found := false
+	for _, value := range values {
+		switch {
+		case value.isUnsupported():
+			return indefinite, STATUS_IE, true
+		case value.IsNaN():
+			if value.isSignaling() {
+				exceptions |= STATUS_IE
+			}
+			if !found || value.Significand > result.Significand {
+				result = value.quiet()
+			}
+			found = true
+		}
+	}
+	return result, exceptions, found
+}
+
+// denormalOperand raises the denormal exception for denormal operands
+func denormalOperand(values ...Float80) uint16 {
+	for _, value := range values {
+		if value.isDenormal() {
+			return STATUS_DE
+		}
+	}
+	return 0
+}
+
+// arithmetic computes a op b, rounded as the control word says, and the exceptions it raised
+func (fpu *Intel80387) arithmetic(operation uint8, a Float80, b Float80) (Float80, uint16) {
+	if operation == opSubR || operation == opDivR {
+		a, b = b, a
+		operation--
+	}
+	if nan, exceptions, ok := nanOperand(a, b); ok {
+		return nan, exceptions
+	}
+	exceptions := denormalOperand(a, b)
+
+	x, y := a.toBig(), b.toBig()
+	z := intermediate()
+	switch operation {
+	case opAdd, opSub:
+		if operation == opSub {
+			y.Neg(y)
+		}
+		if x.IsInf() && y.IsInf() && x.Signbit() != y.Signbit() {
+			return indefinite, exceptions | STATUS_IE
+		}
+		z.Add(x, y)
+		if z.Sign() == 0 && fpu.roundingMode() == big.ToNegativeInf && (x.Signbit() || y.Signbit()) {
+			// an exact zero sum is -0 when rounding down
+			z.Neg(z)
+		}
+	case opMul:
+		if x.IsInf() && y.Sign() == 0 || y.IsInf() && x.Sign() == 0 {
+			return indefinite, exceptions | STATUS_IE
+		}
+		z.Mul(x, y)
+	case opDiv:
+		if x.IsInf() && y.IsInf() || x.Sign() == 0 && y.Sign() == 0 {
+			return indefinite, exceptions | STATUS_IE
+		}
+		if y.Sign() == 0 && !x.IsInf() {
+			exceptions |= STATUS_ZE
+		}
+		z.Quo(x, y)
+	}
+
+	result, roundingExceptions := fpu.result(sticky(z, z.Acc() != big.Exact))
+	return result, exceptions | roundingExceptions
+}
+
+// compare returns C3, C2 and C0 for the ordering of a and b, all three when they are unordered.
+// An ordered compare raises the invalid operation for any NaN, an unordered one only for a
+// signaling NaN.
+func compare(a Float80, b Float80, unordered bool) (uint16, uint16) {
+	if _, exceptions, ok := nanOperand(a, b); ok {
+		if !unordered || a.isUnsupported() || b.isUnsupported() {
+			exceptions = STATUS_IE
+		}
+		return STATUS_C3 | STATUS_C2 | STATUS_C0, exceptions
+	}
+	exceptions := denormalOperand(a, b)
+	switch a.toBig().Cmp(b.toBig()) {
+	case -1:
+		return STATUS_C0, exceptions
+	case 0:
+		return STATUS_C3, exceptions
+	}
+	return 0, exceptions
+}
+
+// loadInteger converts an integer, always exactly
+func loadInteger(value int64) Float80 {
+	return fromBig(new(big.Float).SetInt64(value))
+}
+
+// storeInteger converts to a signed integer of size bits, rounding as the control word says. A
+// NaN, an infinity or a value out of range is an invalid operation, whose masked response stores
+// the integer indefinite, the most negative value.
+func (fpu *Intel80387) storeInteger(value Float80, size uint) (int64, uint16) {
+	indefiniteInteger := int64(-1) << (size - 1)
+	if !value.isFinite() {
+		return indefiniteInteger, STATUS_IE
+	}
+	exceptions := denormalOperand(value)
+	exact := value.toBig()
+	rounded := roundToInteger(exact, fpu.roundingMode())
+	limit := new(big.Float).SetMantExp(big.NewFloat(1), int(size)-1)
+	if rounded.Cmp(limit) >= 0 || rounded.Cmp(limit.Neg(limit)) < 0 {
+		return indefiniteInteger, exceptions | STATUS_IE
+	}
+	if rounded.Cmp(exact) != 0 {
+		exceptions |= STATUS_PE
+	}
+	integer, _ := rounded.Int64()
+	return integer, exceptions
+}
+
+// loadBCD converts an 18 digit packed decimal, whose top byte has the sign
+func loadBCD(bcd [10]uint8) Float80 {
+	var integer int64
+	for i := 8; i >= 0; i-- {
+		integer = integer*100 + int64(bcd[i]>>4)*10 + int64(bcd[i]&0xF)
+	}
+	value := new(big.Float).SetInt64(integer)
+	if bcd[9]&0x80 != 0 {
+		value.Neg(value)
+	}
+	return fromBig(value)
+}
+
+// storeBCD converts to an 18 digit packed decimal, rounding as the control word says. What
+// doesn't fit is an invalid operation, which stores the decimal indefinite when masked.
+func (fpu *Intel80387) storeBCD(value Float80) ([10]uint8, uint16) {
+	bcdIndefinite := [10]uint8{7: 0xC0, 8: 0xFF, 9: 0xFF}
+	if !value.isFinite() {
+		return bcdIndefinite, STATUS_IE
+	}
+	exceptions := denormalOperand(value)
+	exact := value.toBig()
+	rounded := roundToInteger(exact, fpu.roundingMode())
+	magnitude, _ := new(big.Float).Abs(rounded).Int64()
+	if magnitude > 999999999999999999 {
+		return bcdIndefinite, exceptions | STATUS_IE
+	}
+	if rounded.Cmp(exact) != 0 {
+		exceptions |= STATUS_PE
+	}
+
+	var bcd [10]uint8
+	for i := 0; i < 9; i++ {
+		bcd[i] = uint8(magnitude%10) | uint8(magnitude/10%10)<<4
+		magnitude /= 100
+	}
+	if value.Sign() {
+		bcd[9] = 0x80
+	}
+	return bcd, exceptions
+}
+
+// squareRoot computes FSQRT. The root of a negative value other than -0 is invalid.
+func (fpu *Intel80387) squareRoot(a Float80) (Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(a); ok {
+		return nan, exceptions
+	}
+	exceptions := denormalOperand(a)
+	switch {
+	case a.IsZero():
+		return a, exceptions
+	case a.Sign():
+		return indefinite, exceptions | STATUS_IE
+	case a.IsInf():
+		return a, exceptions
+	}
+
+	x := a.toBig()
+	z := intermediate().Sqrt(x)
+	// Sqrt doesn't report its accuracy, squaring the root does
+	square := new(big.Float).SetPrec(2*intermediatePrecision).Mul(z, z)
+	result, roundingExceptions := fpu.result(sticky(z, square.Cmp(x) != 0))
+	return result, exceptions | roundingExceptions
+}
+
+// roundInteger computes FRNDINT, rounding to an integer as the control word says
+func (fpu *Intel80387) roundInteger(a Float80) (Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(a); ok {
+		return nan, exceptions
+	}
+	exceptions := denormalOperand(a)
+	if !a.isFinite() || a.IsZero() {
+		return a, exceptions
+	}
+	exact := a.toBig()
+	rounded := roundToInteger(exact, fpu.roundingMode())
+	if rounded.Cmp(exact) != 0 {
+		exceptions |= STATUS_PE
+	}
+	if rounded.Sign() == 0 && a.Sign() {
+		rounded.Neg(rounded)
+	}
+	return fromBig(rounded), exceptions
+}
+
+// scale computes FSCALE, a times two to the power of b truncated to an integer
+func (fpu *Intel80387) scale(a Float80, b Float80) (Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(a, b); ok {
+		return nan, exceptions
+	}
+	exceptions := denormalOperand(a, b)
+	if b.IsInf() {
+		switch {
+		case !b.Sign() && a.IsZero() || b.Sign() && a.IsInf():
+			return indefinite, exceptions | STATUS_IE
+		case !b.Sign() && !a.IsZero():
+			return fromBig(new(big.Float).SetInf(a.Sign())), exceptions
+		}
+		return Float80{SignExponent: a.SignExponent & 0x8000}, exceptions
+	}
+	if a.IsInf() || a.IsZero() {
+		return a, exceptions
+	}
+
+	power, _ := roundToInteger(b.toBig(), big.ToZero).Int64()
+	// anything beyond the exponent range is an overflow or underflow either way
+	power = max(min(power, 1<<16), -(1 << 16))
+	z := a.toBig()
+	result, roundingExceptions := fpu.result(z.SetMantExp(z, int(power)))
+	return result, exceptions | roundingExceptions
+}
+
+// extract computes FXTRACT, splitting a into its unbiased exponent and its significand
+func extract(a Float80) (Float80, Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(a); ok {
+		return nan, nan, exceptions
+	}
+	switch {
+	case a.IsZero():
+		return fromBig(new(big.Float).SetInf(true)), a, STATUS_ZE
+	case a.IsInf():
+		return fromBig(new(big.Float).SetInf(false)), a, 0
+	}
+
+	exceptions := denormalOperand(a)
+	mantissa := new(big.Float)
+	exponent := a.toBig().MantExp(mantissa) - 1
+	significand := fromBig(mantissa.SetMantExp(mantissa, 1))
+	return loadInteger(int64(exponent)), significand, exceptions
+}
+
+// partialRemainder computes FPREM and FPREM1, whose quotient is truncated or rounded to nearest.
+// When the exponents are too far apart for one go the reduction is partial and C2 is set, and
+// otherwise C0, C3 and C1 get the low three bits of the quotient.
+func (fpu *Intel80387) partialRemainder(a Float80, b Float80, nearest bool) (Float80, uint16, uint16) {
+	if nan, exceptions, ok := nanOperand(a, b); ok {
+		return nan, 0, exceptions
+	}
+	exceptions := denormalOperand(a, b)
+	switch {
+	case a.IsInf() || b.IsZero():
+		return indefinite, 0, exceptions | STATUS_IE
+	case a.IsZero() || b.IsInf():
+		return a, 0, exceptions
+	}
+
+	x, y := a.toBig(), b.toBig()
+	difference := x.MantExp(nil) - y.MantExp(nil)
+	z := intermediate().Quo(x, y)
+	z = sticky(z, z.Acc() != big.Exact)
+
+	var condition uint16
+	mode := big.ToZero
+	if difference >= 64 {
+		// reduce the exponent difference by 63 bits this time
+		z.SetMantExp(z, -(difference - 63))
+		condition = STATUS_C2
+	} else if nearest {
+		mode = big.ToNearestEven
+	}
+	quotient := roundToInteger(z, mode)
+	if condition == 0 {
+		q, _ := quotient.Int(nil)
+		low := new(big.Int).Abs(q).Uint64()
+		if low&1 != 0 {
+			condition |= STATUS_C1
+		}
+		if low&2 != 0 {
+			condition |= STATUS_C3
+		}
+		if low&4 != 0 {
+			condition |= STATUS_C0
+		}
+	} else {
+		quotient.SetMantExp(quotient, difference-63)
+	}
+
+	// the remainder is always exact
+	product := new(big.Float).SetPrec(4*intermediatePrecision).Mul(quotient, y)
+	remainder := new(big.Float).SetPrec(4*intermediatePrecision).Sub(x, product)
+	if remainder.Sign() == 0 && a.Sign() != remainder.Signbit() {
+		remainder.Neg(remainder)
+	}
+	return fromBig(remainder), condition, exceptions
+}
+
+// toFloat64 is the nearest float64, for the instructions computed at double precision
+func (f Float80) toFloat64() float64 {
+	value, _ := f.toBig().Float64()
+	return value
+}
+
+// outOfTrigonometricRange is true for operands FSIN, FCOS, FSINCOS and FPTAN leave to software
+// to reduce, those of 2^63 or more
+func outOfTrigonometricRange(a Float80) bool {
+	return a.isFinite() && a.exponent() >= EXPONENT_BIAS+63
+}
+
+// transcendental computes a double precision function of an operand for the trigonometric and
+// exponential instructions. An infinity is invalid for them.
+func transcendental(a Float80, fn func(float64) float64) (Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(a); ok {
+		return nan, exceptions
+	}
+	if a.IsInf() {
+		return indefinite, STATUS_IE
+	}
+	exceptions := denormalOperand(a)
+	if a.IsZero() {
+		result := fromFloat64(fn(0))
+		if result.IsZero() {
+			// sin and tan keep the sign of zero
+			return a, exceptions
+		}
+		return result, exceptions
+	}
+	return fromFloat64(fn(a.toFloat64())), exceptions | STATUS_PE
+}
+
+// twoToXMinusOne computes F2XM1, defined for operands between -1 and 1
+func twoToXMinusOne(a Float80) (Float80, uint16) {
+	if a.IsInf() {
+		if a.Sign() {
+			return one.neg(), 0
+		}
+		return a, 0
+	}
+	return transcendental(a, func(x float64) float64 {
+		return math.Expm1(x * math.Ln2)
+	})
+}
+
+// arctangent computes FPATAN, the angle of the point (x, y)
+func arctangent(y Float80, x Float80) (Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(y, x); ok {
+		return nan, exceptions
+	}
+	exceptions := denormalOperand(y, x)
+	result := math.Atan2(y.toFloat64(), x.toFloat64())
+	if result == 0 {
+		return fromFloat64(result), exceptions
+	}
+	return fromFloat64(result), exceptions | STATUS_PE
+}
+
+// logarithm computes FYL2X, y times the base 2 logarithm of x, and FYL2XP1, where the logarithm
+// is of x+1 and x is small
+func (fpu *Intel80387) logarithm(y Float80, x Float80, plusOne bool) (Float80, uint16) {
+	if nan, exceptions, ok := nanOperand(y, x); ok {
+		return nan, exceptions
+	}
+	exceptions := denormalOperand(y, x)
+
+	// the logarithm goes to infinity at zero, or at -1 for FYL2XP1
+	pole := x.IsZero()
+	if plusOne {
+		pole = x.Sign() && x.isFinite() && x.toBig().Cmp(big.NewFloat(-1)) == 0
+	}
+	var log2 *big.Float
+	switch {
+	case pole:
+		if y.IsZero() {
+			return indefinite, exceptions | STATUS_IE
+		}
+		if !y.IsInf() {
+			exceptions |= STATUS_ZE
+		}
+		log2 = new(big.Float).SetInf(true)
+	case x.IsInf() && !x.Sign():
+		log2 = new(big.Float).SetInf(false)
+	case plusOne && x.toBig().Cmp(big.NewFloat(-1)) < 0, !plusOne && x.Sign():
+		return indefinite, exceptions | STATUS_IE
+	case plusOne:
+		log2 = big.NewFloat(math.Log1p(x.toFloat64()) / math.Ln2)
+	default:
+		// the exponent is exact, only the significand's logarithm is computed in double precision
+		mantissa := new(big.Float)
+		exponent := x.toBig().MantExp(mantissa)
+		m, _ := mantissa.Float64()
+		log2 = big.NewFloat(float64(exponent) + math.Log2(m))
+	}
+
+	value := y.toBig()
+	if value.IsInf() && log2.Sign() == 0 || log2.IsInf() && value.Sign() == 0 {
+		return indefinite, exceptions | STATUS_IE
+	}
+	z := intermediate().Mul(value, log2)
+	result, roundingExceptions := fpu.result(z)
+	if !z.IsInf() && z.Sign() != 0 {
+		roundingExceptions |= STATUS_PE
+	}
+	return result, exceptions | roundingExceptions
+}
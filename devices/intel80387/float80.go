@@ -0,0 +1,385 @@
+package intel80387
+
+import (
+	"math"
+	"math/big"
+)
+
+// Float80 is an extended real as the coprocessor holds it, a sign bit and 15 bit biased exponent
+// above a 64 bit significand whose integer bit is explicit
+type Float80 struct {
+	SignExponent uint16
+	Significand  uint64
+}
+
+const (
+	EXPONENT_BIAS = 16383
+	EXPONENT_MAX  = 0x7FFF
+
+	integerBit = 1 << 63
+	quietBit   = 1 << 62
+)
+
+var (
+	// indefinite is the quiet NaN a masked invalid operation returns
+	indefinite = Float80{0xFFFF, 0xC000000000000000}
+	one        = Float80{EXPONENT_BIAS, integerBit}
+)
+
+func (f Float80) Sign() bool {
+	return f.SignExponent&0x8000 != 0
+}
+
+func (f Float80) exponent() int {
+	return int(f.SignExponent & EXPONENT_MAX)
+}
+
+func (f Float80) IsZero() bool {
+	return f.exponent() == 0 && f.Significand == 0
+}
+
+func (f Float80) IsInf() bool {
+	return f.exponent() == EXPONENT_MAX && f.Significand == integerBit
+}
+
+func (f Float80) IsNaN() bool {
+	return f.exponent() == EXPONENT_MAX && f.Significand&integerBit != 0 && f.Significand != integerBit
+}
+
+func (f Float80) isSignaling() bool {
+	return f.IsNaN() && f.Significand&quietBit == 0
+}
+
+func (f Float80) isDenormal() bool {
+	return f.exponent() == 0 && f.Significand != 0
+}
+
+// isUnsupported is true for the unnormals, pseudo infinities and pseudo NaNs the 287 accepted
+// but the 387 treats as invalid operands, anything with a non zero exponent and no integer bit
+func (f Float80) isUnsupported() bool {
+	return f.exponent() != 0 && f.Significand&integerBit == 0
+}
+
+func (f Float80) isFinite() bool {
+	return f.exponent() != EXPONENT_MAX && !f.isUnsupported()
+}
+
+func (f Float80) neg() Float80 {
+	f.SignExponent ^= 0x8000
+	return f
+}
+
+func (f Float80) abs() Float80 {
+	f.SignExponent &^= 0x8000
+	return f
+}
+
+func (f Float80) quiet() Float80 {
+	f.Significand |= quietBit
+	return f
+}
+
+// tag is the tag word encoding for a register holding the value
+func (f Float80) tag() uint8 {
+	switch {
+	case f.IsZero():
+		return TAG_ZERO
+	case f.exponent() == 0 || f.exponent() == EXPONENT_MAX || f.isUnsupported():
+		return TAG_SPECIAL
+	}
+	return TAG_VALID
+}
+
+// examine is the C3, C2 and C0 class FXAM reports for the value
+func (f Float80) examine() uint16 {
+	switch {
+	case f.isUnsupported():
+		return 0
+	case f.IsNaN():
+		return STATUS_C0
+	case f.IsInf():
+		return STATUS_C2 | STATUS_C0
+	case f.IsZero():
+		return STATUS_C3
+	case f.isDenormal():
+		return STATUS_C3 | STATUS_C2
+	}
+	return STATUS_C2
+}
+
+// toBig converts a finite value or an infinity, exactly
+func (f Float80) toBig() *big.Float {
+	if f.IsInf() {
+		return new(big.Float).SetInf(f.Sign())
+	}
+	exponent := f.exponent()
+	if exponent == 0 {
+		// denormals have the exponent of the smallest normal
+		exponent = 1
+	}
+	value := new(big.Float).SetPrec(64).SetUint64(f.Significand)
+	value.SetMantExp(value, exponent-EXPONENT_BIAS-63)
+	if f.Sign() {
+		value.Neg(value)
+	}
+	return value
+}
+
+// fromBig packs a value that is already rounded to extended precision
+func fromBig(value *big.Float) Float80 {
+	var sign uint16
+	if value.Signbit() {
+		sign = 0x8000
+	}
+	if value.IsInf() {
+		return Float80{sign | EXPONENT_MAX, integerBit}
+	}
+	exponent, significand := extendedReal.encode(value)
+	return Float80{sign | uint16(exponent), significand}
+}
+
+// fromFloat64 converts the result of a float64 calculation
+func fromFloat64(value float64) Float80 {
+	if math.IsNaN(value) {
+		return indefinite
+	}
+	return fromBig(big.NewFloat(value))
+}
+
+// realFormat is one of the binary real formats, described by the precision of its significand and
+// the exponent range of its normal values
+type realFormat struct {
+	precision   uint
+	minExponent int
+	maxExponent int
+}
+
+var (
+	singleReal   = realFormat{24, -126, 127}
+	doubleReal   = realFormat{53, -1022, 1023}
+	extendedReal = realFormat{64, -16382, 16383}
+)
+
+// round rounds a value to the format's precision and exponent range, returning the result and the
+// precision, underflow and overflow exceptions rounding raised. Values too small for a normal
+// lose precision as denormals, values too large become infinity or the largest finite value,
+// depending on which way the mode rounds.
+func (format realFormat) round(value *big.Float, mode big.RoundingMode) (*big.Float, uint16) {
+	if value.IsInf() || value.Sign() == 0 {
+		return value, 0
+	}
+
+	negative := value.Signbit()
+	precision := int(format.precision)
+	exponent := value.MantExp(nil) - 1
+	tiny := exponent < format.minExponent
+	if tiny {
+		precision -= format.minExponent - exponent
+	}
+
+	var rounded *big.Float
+	exact := false
+	if precision < 1 {
+		rounded = format.roundTiny(value, mode)
+	} else {
+		rounded = new(big.Float).SetMode(mode).SetPrec(uint(precision)).Set(value)
+		exact = rounded.Acc() == big.Exact
+	}
+
+	var exceptions uint16
+	if !exact {
+		exceptions |= STATUS_PE
+		if tiny {
+			exceptions |= STATUS_UE
+		}
+	}
+	if rounded.Sign() != 0 && rounded.MantExp(nil)-1 > format.maxExponent {
+		exceptions |= STATUS_OE | STATUS_PE
+		if mode == big.ToZero || mode == big.ToNegativeInf && !negative || mode == big.ToPositiveInf && negative {
+			rounded = format.largest(negative)
+		} else {
+			rounded = new(big.Float).SetInf(negative)
+		}
+	}
+	return rounded, exceptions
+}
+
+// roundTiny rounds a value below half the smallest denormal to zero or to the smallest denormal
+func (format realFormat) roundTiny(value *big.Float, mode big.RoundingMode) *big.Float {
+	negative := value.Signbit()
+	smallest := new(big.Float).SetMantExp(big.NewFloat(1), format.minExponent-int(format.precision)+1)
+	half := new(big.Float).SetMantExp(smallest, -1)
+
+	awayFromZero := false
+	switch mode {
+	case big.ToPositiveInf:
+		awayFromZero = !negative
+	case big.ToNegativeInf:
+		awayFromZero = negative
+	case big.ToNearestEven:
+		awayFromZero = new(big.Float).Abs(value).Cmp(half) > 0
+	}
+
+	result := new(big.Float)
+	if awayFromZero {
+		result.Set(smallest)
+	}
+	if negative {
+		result.Neg(result)
+	}
+	return result
+}
+
+// largest is the largest finite value of the format
+func (format realFormat) largest(negative bool) *big.Float {
+	significand := new(big.Float).SetUint64(math.MaxUint64 >> (64 - format.precision))
+	largest := new(big.Float).SetMantExp(significand, format.maxExponent-int(format.precision)+1)
+	if negative {
+		largest.Neg(largest)
+	}
+	return largest
+}
+
+// encode packs the magnitude of a rounded, finite value into the biased exponent and the
+// significand of the format, the integer bit included. Denormals have a zero exponent.
+func (format realFormat) encode(value *big.Float) (int, uint64) {
+	magnitude := new(big.Float).Abs(value)
+	if magnitude.Sign() == 0 {
+		return 0, 0
+	}
+	mantissa := new(big.Float)
+	exponent := magnitude.MantExp(mantissa) - 1
+	if exponent < format.minExponent {
+		significand, _ := magnitude.SetMantExp(magnitude, int(format.precision)-1-format.minExponent).Uint64()
+		return 0, significand
+	}
+	significand, _ := mantissa.SetMantExp(mantissa, int(format.precision)).Uint64()
+	return exponent - format.minExponent + 1, significand
+}
+
+// decode unpacks a finite value from its biased exponent and the significand bits it stores,
+// which leave out the integer bit
+func (format realFormat) decode(negative bool, exponent int, fraction uint64) *big.Float {
+	significand := new(big.Float).SetUint64(fraction)
+	if exponent == 0 {
+		exponent = 1
+	} else {
+		significand.Add(significand, new(big.Float).SetMantExp(big.NewFloat(1), int(format.precision)-1))
+	}
+	value := significand.SetMantExp(significand, exponent+format.minExponent-1-int(format.precision)+1)
+	if negative {
+		value.Neg(value)
+	}
+	return value
+}
+
+// loadReal converts a single or double real from memory, which is exact. A denormal source
+// raises the denormal exception and a signaling NaN the invalid one.
+func loadReal(format realFormat, bits uint64) (Float80, uint16) {
+	fractionBits := format.precision - 1
+	exponentMax := format.maxExponent - format.minExponent + 2
+	negative := bits>>(fractionBits+uint(bitsFor(format))) != 0
+	exponent := int(bits >> fractionBits & uint64(exponentMax))
+	fraction := bits & (1<<fractionBits - 1)
+
+	var sign uint16
+	if negative {
+		sign = 0x8000
+	}
+	switch {
+	case exponent == exponentMax && fraction == 0:
+		return Float80{sign | EXPONENT_MAX, integerBit}, 0
+	case exponent == exponentMax:
+		nan := Float80{sign | EXPONENT_MAX, integerBit | fraction<<(64-fractionBits-1)}
+		if !nan.isSignaling() {
+			return nan, 0
+		}
+		return nan.quiet(), STATUS_IE
+	}
+
+	var exceptions uint16
+	if exponent == 0 && fraction != 0 {
+		exceptions = STATUS_DE
+	}
+	return fromBig(format.decode(negative, exponent, fraction)), exceptions
+}
+
+// storeReal converts to a single or double real for memory, rounding with the given mode
+func storeReal(format realFormat, value Float80, mode big.RoundingMode) (uint64, uint16) {
+	fractionBits := format.precision - 1
+	exponentMax := uint64(format.maxExponent - format.minExponent + 2)
+	var sign uint64
+	if value.Sign() {
+		sign = 1 << (fractionBits + uint(bitsFor(format)))
+	}
+
+	switch {
+	case value.isUnsupported():
+		return storeReal(format, indefinite, mode)
+	case value.IsNaN():
+		// the NaN keeps the top of its payload, and is quieted
+		var exceptions uint16
+		if value.isSignaling() {
+			exceptions = STATUS_IE
+		}
+		fraction := value.quiet().Significand &^ integerBit >> (64 - fractionBits - 1)
+		return sign | exponentMax<<fractionBits | fraction, exceptions
+	}
+
+	var exceptions uint16
+	if value.isDenormal() {
+		exceptions = STATUS_DE
+	}
+	rounded, roundingExceptions := format.round(value.toBig(), mode)
+	exceptions |= roundingExceptions
+	if rounded.IsInf() {
+		return sign | exponentMax<<fractionBits, exceptions
+	}
+	exponent, significand := format.encode(rounded)
+	return sign | uint64(exponent)<<fractionBits | significand&(1<<fractionBits-1), exceptions
+}
+
+// bitsFor is the width of the format's exponent field
+func bitsFor(format realFormat) int {
+	bits := 0
+	for span := format.maxExponent - format.minExponent + 2; span > 0; span >>= 1 {
+		bits++
+	}
+	return bits
+}
+
+// roundToInteger rounds a finite value to an integer in the given mode
+func roundToInteger(value *big.Float, mode big.RoundingMode) *big.Float {
+	if value.IsInf() || value.Sign() == 0 {
+		return value
+	}
+	exponent := value.MantExp(nil)
+	if exponent >= int(value.MinPrec()) {
+		// no fraction bits
+		return new(big.Float).Set(value)
+	}
+	if exponent > 0 {
+		// keeping as many significant bits as there are integer bits leaves an integer
+		return new(big.Float).SetMode(mode).SetPrec(uint(exponent)).Set(value)
+	}
+
+	// below one, the result is zero or one
+	negative := value.Signbit()
+	up := false
+	switch mode {
+	case big.ToPositiveInf:
+		up = !negative
+	case big.ToNegativeInf:
+		up = negative
+	case big.ToNearestEven:
+		up = new(big.Float).Abs(value).Cmp(big.NewFloat(0.5)) > 0
+	}
+	result := new(big.Float)
+	if up {
+		result.SetInt64(1)
+	}
+	if negative {
+		result.Neg(result)
+	}
+	return result
+}
@@ -0,0 +1,884 @@
+package intel80387
+
+import (
+	"fmt"
+	"log"
+	"math"
+)
+
+// Memory is the memory operand of an ESC instruction. The processor resolves its segment and
+// offset and checks every access, offsets are from the start of the operand.
+type Memory interface {
+	Read(offset uint32, size uint8) (uint32, error)
+	Write(offset uint32, size uint8, value uint32) error
+}
+
+// Instruction is an ESC instruction as the processor hands it over
+type Instruction struct {
+	Opcode uint16 // low 3 bits of the escape opcode above the modrm byte, as FSTENV stores it
+
+	CS uint16 // where the instruction is, for the exception pointers
+	IP uint32
+
+	Operand       Memory // nil for the register forms
+	DataSelector  uint16
+	DataOffset    uint32
+	Operand32     bool // FSTENV and FSAVE use the 32 bit environment layout
+	ProtectedMode bool // and the protected mode one, with selectors rather than linear addresses
+}
+
+// FNSTSW_AX - DF E0, the only instruction with a processor register as its destination
+const FNSTSW_AX = 0x7E0
+
+// IsControlInstruction is true for the instructions that don't wait for pending errors and don't
+// replace the exception pointers: FNINIT, FNCLEX, FNSTENV, FNSAVE, FNSTCW, FNSTSW and the 8087
+// and 287 leftovers FNENI, FNDISI and FNSETPM. FLDCW, FLDENV and FRSTOR wait, but also leave the
+// pointers alone.
+func IsControlInstruction(opcode uint16) bool {
+	escape, modrm := opcode>>8, uint8(opcode)
+	if modrm >= 0xC0 {
+		return escape == 3 && modrm >= 0xE0 && modrm <= 0xE4 || opcode == FNSTSW_AX
+	}
+	switch reg := modrm >> 3 & 7; escape {
+	case 1:
+		return reg == 6 || reg == 7
+	case 5:
+		return reg == 6 || reg == 7
+	}
+	return false
+}
+
+func isPointerPreserving(opcode uint16) bool {
+	escape, modrm := opcode>>8, uint8(opcode)
+	if IsControlInstruction(opcode) {
+		return true
+	}
+	reg := modrm >> 3 & 7
+	return modrm < 0xC0 && (escape == 1 && (reg == 4 || reg == 5) || escape == 5 && reg == 4)
+}
+
+// Execute runs an ESC instruction. An error is a fault accessing the memory operand, which the
+// processor delivers, anything the coprocessor raises itself ends up in the status word.
+func (fpu *Intel80387) Execute(instruction Instruction) error {
+	if !isPointerPreserving(instruction.Opcode) {
+		fpu.instructionSelector, fpu.instructionOffset = instruction.CS, instruction.IP
+		fpu.opcode = instruction.Opcode & 0x7FF
+		if instruction.Operand != nil {
+			fpu.dataSelector, fpu.dataOffset = instruction.DataSelector, instruction.DataOffset
+		}
+	}
+
+	escape, modrm := uint8(instruction.Opcode>>8&7), uint8(instruction.Opcode)
+	if modrm >= 0xC0 {
+		fpu.executeRegister(escape, modrm>>3&7, modrm&7)
+		return nil
+	}
+	return fpu.executeMemory(escape, modrm>>3&7, instruction)
+}
+
+// executeMemory runs the forms with a memory operand
+func (fpu *Intel80387) executeMemory(escape uint8, reg uint8, instruction Instruction) error {
+	memory := instruction.Operand
+	switch {
+	case escape&1 == 0:
+		// D8, DA, DC and DE: arithmetic with a single real, short integer, double real or word
+		// integer operand
+		value, exceptions, err := loadOperand(escape, memory)
+		if err != nil {
+			return err
+		}
+		fpu.arithmeticWith(reg, value, exceptions)
+		return nil
+	}
+
+	switch uint16(escape)<<3 | uint16(reg) {
+	case 1<<3 | 0, 5<<3 | 0, 3<<3 | 5, 3<<3 | 0, 7<<3 | 0, 7<<3 | 5, 7<<3 | 4:
+		// FLD, FILD and FBLD
+		value, exceptions, err := loadValue(escape, reg, memory)
+		if err != nil {
+			return err
+		}
+		fpu.deliver(exceptions, func() {
+			fpu.push(value)
+		})
+	case 1<<3 | 2, 1<<3 | 3, 5<<3 | 2, 5<<3 | 3, 3<<3 | 7, 3<<3 | 2, 3<<3 | 3, 7<<3 | 2, 7<<3 | 3, 7<<3 | 7, 7<<3 | 6:
+		// FST, FSTP, FIST, FISTP and FBSTP
+		return fpu.store(escape, reg, memory)
+	case 1<<3 | 4:
+		return fpu.loadEnvironment(instruction)
+	case 1<<3 | 5:
+		control, err := memory.Read(0, 16)
+		if err != nil {
+			return err
+		}
+		fpu.control = uint16(control)
+		fpu.updateErrorSummary()
+	case 1<<3 | 6:
+		if err := fpu.storeEnvironment(instruction); err != nil {
+			return err
+		}
+		// FSTENV masks every exception once it has stored the environment
+		fpu.control |= CONTROL_MASKS
+	case 1<<3 | 7:
+		return memory.Write(0, 16, uint32(fpu.control))
+	case 5<<3 | 4:
+		return fpu.restore(instruction)
+	case 5<<3 | 6:
+		if err := fpu.save(instruction); err != nil {
+			return err
+		}
+		fpu.initialize()
+	case 5<<3 | 7:
+		return memory.Write(0, 16, uint32(fpu.status))
+	default:
+		log.Printf("Intel80387: Unsupported instruction %#04x", uint16(0xD8+escape)<<8|uint16(reg)<<3)
+	}
+	return nil
+}
+
+// loadOperand reads the memory operand of D8, DA, DC and DE
+func loadOperand(escape uint8, memory Memory) (Float80, uint16, error) {
+	switch escape {
+	case 0:
+		bits, err := memory.Read(0, 32)
+		value, exceptions := loadReal(singleReal, uint64(bits))
+		return value, exceptions, err
+	case 2:
+		integer, err := memory.Read(0, 32)
+		return loadInteger(int64(int32(integer))), 0, err
+	case 4:
+		bits, err := read64(memory, 0)
+		value, exceptions := loadReal(doubleReal, bits)
+		return value, exceptions, err
+	}
+	integer, err := memory.Read(0, 16)
+	return loadInteger(int64(int16(integer))), 0, err
+}
+
+// loadValue reads the operand of FLD, FILD or FBLD
+func loadValue(escape uint8, reg uint8, memory Memory) (Float80, uint16, error) {
+	switch uint16(escape)<<3 | uint16(reg) {
+	case 1<<3 | 0:
+		return loadOperand(0, memory)
+	case 5<<3 | 0:
+		return loadOperand(4, memory)
+	case 3<<3 | 0:
+		return loadOperand(2, memory)
+	case 7<<3 | 0:
+		return loadOperand(6, memory)
+	case 3<<3 | 5:
+		value, err := read80(memory, 0)
+		return value, 0, err
+	case 7<<3 | 5:
+		integer, err := read64(memory, 0)
+		return loadInteger(int64(integer)), 0, err
+	}
+	var bcd [10]uint8
+	for i := range bcd {
+		b, err := memory.Read(uint32(i), 8)
+		if err != nil {
+			return Float80{}, 0, err
+		}
+		bcd[i] = uint8(b)
+	}
+	return loadBCD(bcd), 0, nil
+}
+
+// store runs FST, FSTP, FIST, FISTP and FBSTP to memory. Nothing is written or popped when an
+// unmasked exception stops the store.
+func (fpu *Intel80387) store(escape uint8, reg uint8, memory Memory) error {
+	values, ok := fpu.operands(0)
+	if !ok {
+		return nil
+	}
+	value := values[0]
+	pop := reg == 3 || reg == 7 || escape == 7 && reg == 6
+
+	var exceptions uint16
+	var write func() error
+	switch uint16(escape)<<3 | uint16(reg) {
+	case 1<<3 | 2, 1<<3 | 3:
+		var bits uint64
+		bits, exceptions = storeReal(singleReal, value, fpu.roundingMode())
+		write = func() error {
+			return memory.Write(0, 32, uint32(bits))
+		}
+	case 5<<3 | 2, 5<<3 | 3:
+		var bits uint64
+		bits, exceptions = storeReal(doubleReal, value, fpu.roundingMode())
+		write = func() error {
+			return write64(memory, 0, bits)
+		}
+	case 3<<3 | 7:
+		write = func() error {
+			return write80(memory, 0, value)
+		}
+	case 3<<3 | 2, 3<<3 | 3:
+		var integer int64
+		integer, exceptions = fpu.storeInteger(value, 32)
+		write = func() error {
+			return memory.Write(0, 32, uint32(integer))
+		}
+	case 7<<3 | 2, 7<<3 | 3:
+		var integer int64
+		integer, exceptions = fpu.storeInteger(value, 16)
+		write = func() error {
+			return memory.Write(0, 16, uint32(integer))
+		}
+	case 7<<3 | 7:
+		var integer int64
+		integer, exceptions = fpu.storeInteger(value, 64)
+		write = func() error {
+			return write64(memory, 0, uint64(integer))
+		}
+	default:
+		var bcd [10]uint8
+		bcd, exceptions = fpu.storeBCD(value)
+		write = func() error {
+			for i, b := range bcd {
+				if err := memory.Write(uint32(i), 8, uint32(b)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	var err error
+	fpu.deliver(exceptions, func() {
+		if err = write(); err == nil && pop {
+			fpu.pop()
+		}
+	})
+	return err
+}
+
+// arithmeticWith runs D8, DA, DC and DE with a memory operand, where ST(0) is the destination
+func (fpu *Intel80387) arithmeticWith(reg uint8, value Float80, loadExceptions uint16) {
+	st, ok := fpu.operands(0)
+	if !ok {
+		return
+	}
+	if reg == 2 || reg == 3 {
+		condition, exceptions := compare(st[0], value, false)
+		fpu.compared(condition, exceptions|loadExceptions, reg == 3, false)
+		return
+	}
+	result, exceptions := fpu.arithmetic(reg, st[0], value)
+	fpu.deliver(exceptions|loadExceptions, func() {
+		fpu.setST(0, result)
+	})
+}
+
+// compared finishes a compare, setting the condition codes and popping once or twice
+func (fpu *Intel80387) compared(condition uint16, exceptions uint16, pop bool, popTwice bool) {
+	fpu.deliver(exceptions, func() {
+		fpu.setCondition(condition)
+		if pop || popTwice {
+			fpu.pop()
+		}
+		if popTwice {
+			fpu.pop()
+		}
+	})
+}
+
+// executeRegister runs the forms without a memory operand
+func (fpu *Intel80387) executeRegister(escape uint8, reg uint8, i uint8) {
+	switch escape {
+	case 0:
+		// D8: ST(0) = ST(0) op ST(i), and compares
+		st, ok := fpu.operands(0, i)
+		if !ok {
+			return
+		}
+		if reg == 2 || reg == 3 {
+			condition, exceptions := compare(st[0], st[1], false)
+			fpu.compared(condition, exceptions, reg == 3, false)
+			return
+		}
+		result, exceptions := fpu.arithmetic(reg, st[0], st[1])
+		fpu.deliver(exceptions, func() {
+			fpu.setST(0, result)
+		})
+	case 4, 6:
+		// DC and DE: ST(i) = ST(i) op ST(0), DE popping afterwards, and FCOMPP
+		if escape == 6 && reg == 3 && i == 1 {
+			// FCOMPP
+			fpu.compareRegisters(1, false, 2)
+			return
+		}
+		if reg == 2 || reg == 3 {
+			fpu.compareRegisters(i, false, 1)
+			return
+		}
+		st, ok := fpu.operands(i, 0)
+		if !ok {
+			return
+		}
+		if reg >= 4 {
+			// the reversed forms swap places here
+			reg ^= 1
+		}
+		result, exceptions := fpu.arithmetic(reg, st[0], st[1])
+		fpu.deliver(exceptions, func() {
+			fpu.setST(i, result)
+			if escape == 6 {
+				fpu.pop()
+			}
+		})
+	case 1:
+		fpu.executeD9(reg, i)
+	case 2:
+		if reg == 5 && i == 1 {
+			// FUCOMPP
+			fpu.compareRegisters(1, true, 2)
+			return
+		}
+		log.Printf("Intel80387: Unsupported instruction DA %#02x", 0xC0|reg<<3|i)
+	case 3:
+		fpu.executeDB(reg, i)
+	case 5:
+		fpu.executeDD(reg, i)
+	case 7:
+		if reg == 4 && i == 0 {
+			// FNSTSW AX, which the processor normally handles itself
+			return
+		}
+		log.Printf("Intel80387: Unsupported instruction DF %#02x", 0xC0|reg<<3|i)
+	}
+}
+
+// compareRegisters compares ST(0) with ST(i), then pops as many times as the instruction does
+func (fpu *Intel80387) compareRegisters(i uint8, unordered bool, pops int) {
+	st, ok := fpu.operands(0, i)
+	if !ok {
+		return
+	}
+	condition, exceptions := compare(st[0], st[1], unordered)
+	fpu.compared(condition, exceptions, pops > 0, pops > 1)
+}
+
+func (fpu *Intel80387) executeD9(reg uint8, i uint8) {
+	switch reg {
+	case 0:
+		// FLD ST(i)
+		st, ok := fpu.operands(i)
+		if !ok {
+			return
+		}
+		fpu.push(st[0])
+		return
+	case 1:
+		fpu.exchange(i)
+		return
+	case 2:
+		if i == 0 {
+			// FNOP
+			return
+		}
+	case 4:
+		fpu.executeD9E0(i)
+		return
+	case 5:
+		fpu.loadConstant(i)
+		return
+	case 6:
+		fpu.executeD9F0(i)
+		return
+	case 7:
+		fpu.executeD9F8(i)
+		return
+	}
+	log.Printf("Intel80387: Unsupported instruction D9 %#02x", 0xC0|reg<<3|i)
+}
+
+// exchange runs FXCH. An empty register is an underflow, the masked response exchanges the
+// indefinite NaN instead.
+func (fpu *Intel80387) exchange(i uint8) {
+	st, ok := fpu.operands(0, i)
+	if !ok {
+		return
+	}
+	fpu.setST(0, st[1])
+	fpu.setST(i, st[0])
+	fpu.status &^= STATUS_C1
+}
+
+// executeD9E0 runs FCHS, FABS, FTST and FXAM
+func (fpu *Intel80387) executeD9E0(i uint8) {
+	if i == 5 {
+		// FXAM looks at empty registers too
+		value, ok := fpu.ST(0)
+		condition := value.examine()
+		if !ok {
+			condition = STATUS_C3 | STATUS_C0
+		}
+		if value.Sign() {
+			condition |= STATUS_C1
+		}
+		fpu.setCondition(condition)
+		return
+	}
+
+	st, ok := fpu.operands(0)
+	if !ok {
+		return
+	}
+	switch i {
+	case 0:
+		fpu.setST(0, st[0].neg())
+	case 1:
+		fpu.setST(0, st[0].abs())
+	case 4:
+		condition, exceptions := compare(st[0], Float80{}, false)
+		fpu.compared(condition, exceptions, false, false)
+	default:
+		log.Printf("Intel80387: Unsupported instruction D9 %#02x", 0xE0|i)
+	}
+}
+
+// the constants FLD1, FLDL2T, FLDL2E, FLDPI, FLDLG2, FLDLN2 and FLDZ load, rounded to nearest
+var constants = [7]Float80{
+	one,
+	{0x4000, 0xD49A784BCD1B8AFE}, // log2(10)
+	{0x3FFF, 0xB8AA3B295C17F0BC}, // log2(e)
+	{0x4000, 0xC90FDAA22168C235}, // pi
+	{0x3FFD, 0x9A209A84FBCFF799}, // log10(2)
+	{0x3FFE, 0xB17217F7D1CF79AC}, // ln(2)
+	{},
+}
+
+func (fpu *Intel80387) loadConstant(i uint8) {
+	if int(i) >= len(constants) {
+		log.Printf("Intel80387: Unsupported instruction D9 %#02x", 0xE8|i)
+		return
+	}
+	fpu.push(constants[i])
+}
+
+// executeD9F0 runs F2XM1, FYL2X, FPTAN, FPATAN, FXTRACT, FPREM1, FDECSTP and FINCSTP
+func (fpu *Intel80387) executeD9F0(i uint8) {
+	switch i {
+	case 0:
+		fpu.unary(twoToXMinusOne)
+	case 1, 3:
+		st, ok := fpu.operands(0, 1)
+		if !ok {
+			return
+		}
+		var result Float80
+		var exceptions uint16
+		if i == 1 {
+			result, exceptions = fpu.logarithm(st[1], st[0], false)
+		} else {
+			result, exceptions = arctangent(st[1], st[0])
+		}
+		fpu.deliver(exceptions, func() {
+			fpu.setST(1, result)
+			fpu.pop()
+		})
+	case 2:
+		fpu.trigonometric(func(x float64) (float64, float64) {
+			return math.Tan(x), 1
+		}, true)
+	case 4:
+		st, ok := fpu.operands(0)
+		if !ok {
+			return
+		}
+		if !fpu.isEmpty(7) {
+			fpu.pushOverflow()
+			return
+		}
+		exponent, significand, exceptions := extract(st[0])
+		fpu.deliver(exceptions, func() {
+			fpu.setST(0, exponent)
+			fpu.push(significand)
+		})
+	case 5:
+		fpu.remainder(true)
+	case 6:
+		fpu.setTop(fpu.top() - 1)
+		fpu.status &^= STATUS_C1
+	case 7:
+		fpu.setTop(fpu.top() + 1)
+		fpu.status &^= STATUS_C1
+	}
+}
+
+// executeD9F8 runs FPREM, FYL2XP1, FSQRT, FSINCOS, FRNDINT, FSCALE, FSIN and FCOS
+func (fpu *Intel80387) executeD9F8(i uint8) {
+	switch i {
+	case 0:
+		fpu.remainder(false)
+	case 1:
+		st, ok := fpu.operands(0, 1)
+		if !ok {
+			return
+		}
+		result, exceptions := fpu.logarithm(st[1], st[0], true)
+		fpu.deliver(exceptions, func() {
+			fpu.setST(1, result)
+			fpu.pop()
+		})
+	case 2:
+		fpu.unary(fpu.squareRoot)
+	case 3:
+		fpu.trigonometric(func(x float64) (float64, float64) {
+			return math.Sincos(x)
+		}, true)
+	case 4:
+		fpu.unary(fpu.roundInteger)
+	case 5:
+		st, ok := fpu.operands(0, 1)
+		if !ok {
+			return
+		}
+		result, exceptions := fpu.scale(st[0], st[1])
+		fpu.deliver(exceptions, func() {
+			fpu.setST(0, result)
+		})
+	case 6:
+		fpu.trigonometric(func(x float64) (float64, float64) {
+			return math.Sin(x), 0
+		}, false)
+	case 7:
+		fpu.trigonometric(func(x float64) (float64, float64) {
+			return math.Cos(x), 0
+		}, false)
+	}
+}
+
+// unary replaces ST(0) with a function of it
+func (fpu *Intel80387) unary(fn func(Float80) (Float80, uint16)) {
+	st, ok := fpu.operands(0)
+	if !ok {
+		return
+	}
+	result, exceptions := fn(st[0])
+	fpu.deliver(exceptions, func() {
+		fpu.setST(0, result)
+	})
+}
+
+// trigonometric runs FSIN, FCOS, FSINCOS and FPTAN. fn returns ST(0)'s replacement and, for
+// FSINCOS and FPTAN, the value pushed after it. An operand of 2^63 or more is left for software
+// to reduce, with C2 set.
+func (fpu *Intel80387) trigonometric(fn func(float64) (float64, float64), pushes bool) {
+	st, ok := fpu.operands(0)
+	if !ok {
+		return
+	}
+	if outOfTrigonometricRange(st[0]) {
+		fpu.status |= STATUS_C2
+		return
+	}
+	if pushes && !fpu.isEmpty(7) {
+		fpu.pushOverflow()
+		return
+	}
+	fpu.status &^= STATUS_C2
+
+	result, exceptions := transcendental(st[0], func(x float64) float64 {
+		first, _ := fn(x)
+		return first
+	})
+	second, secondExceptions := transcendental(st[0], func(x float64) float64 {
+		_, second := fn(x)
+		return second
+	})
+	fpu.deliver(exceptions|secondExceptions, func() {
+		fpu.setST(0, result)
+		if pushes {
+			fpu.push(second)
+		}
+	})
+}
+
+// pushOverflow is the stack overflow of an instruction that replaces ST(0) and pushes a second
+// result, whose masked response leaves the indefinite NaN in both
+func (fpu *Intel80387) pushOverflow() {
+	if fpu.stackFault(true) {
+		fpu.setST(0, indefinite)
+		fpu.setTop(fpu.top() - 1)
+		fpu.setST(0, indefinite)
+	}
+}
+
+// remainder runs FPREM and FPREM1 on ST(0) and ST(1)
+func (fpu *Intel80387) remainder(nearest bool) {
+	st, ok := fpu.operands(0, 1)
+	if !ok {
+		return
+	}
+	result, condition, exceptions := fpu.partialRemainder(st[0], st[1], nearest)
+	fpu.deliver(exceptions, func() {
+		fpu.setST(0, result)
+		fpu.setCondition(condition)
+	})
+}
+
+// executeDB runs FNCLEX and FNINIT, the 8087's FNENI and FNDISI and the 287's FNSETPM, which
+// the 387 ignores
+func (fpu *Intel80387) executeDB(reg uint8, i uint8) {
+	switch {
+	case reg == 4 && i == 2:
+		fpu.status &^= STATUS_EXCEPTIONS | STATUS_SF | STATUS_ES | STATUS_B
+	case reg == 4 && i == 3:
+		fpu.initialize()
+	case reg == 4 && (i == 0 || i == 1 || i == 4):
+	default:
+		log.Printf("Intel80387: Unsupported instruction DB %#02x", 0xC0|reg<<3|i)
+	}
+}
+
+// executeDD runs FFREE, FST ST(i), FSTP ST(i), FUCOM and FUCOMP
+func (fpu *Intel80387) executeDD(reg uint8, i uint8) {
+	switch reg {
+	case 0:
+		fpu.setTag(fpu.physical(i), TAG_EMPTY)
+	case 2, 3:
+		st, ok := fpu.operands(0)
+		if !ok {
+			return
+		}
+		fpu.setST(i, st[0])
+		if reg == 3 {
+			fpu.pop()
+		}
+	case 4, 5:
+		pops := 0
+		if reg == 5 {
+			pops = 1
+		}
+		fpu.compareRegisters(i, true, pops)
+	default:
+		log.Printf("Intel80387: Unsupported instruction DD %#02x", 0xC0|reg<<3|i)
+	}
+}
+
+// the environment is the control, status and tag words and the exception pointers. Each takes a
+// word in the 14 byte 16 bit layout and a doubleword in the 28 byte 32 bit one.
+func environmentSize(instruction Instruction) uint32 {
+	if instruction.Operand32 {
+		return 28
+	}
+	return 14
+}
+
+// storeEnvironment runs FNSTENV, and the first part of FNSAVE
+func (fpu *Intel80387) storeEnvironment(instruction Instruction) error {
+	fpu.refreshTags()
+	fields := []uint32{uint32(fpu.control), uint32(fpu.status), uint32(fpu.tags)}
+	if instruction.ProtectedMode {
+		fields = append(fields, fpu.instructionOffset)
+		if instruction.Operand32 {
+			fields = append(fields, uint32(fpu.instructionSelector)|uint32(fpu.opcode)<<16, fpu.dataOffset, uint32(fpu.dataSelector))
+		} else {
+			fields = append(fields, uint32(fpu.instructionSelector), fpu.dataOffset, uint32(fpu.dataSelector))
+		}
+	} else {
+		// real mode stores 20 bit linear addresses, 32 bit ones in the 32 bit layout
+		instructionAddress := uint32(fpu.instructionSelector)<<4 + fpu.instructionOffset
+		dataAddress := uint32(fpu.dataSelector)<<4 + fpu.dataOffset
+		fields = append(fields, instructionAddress&0xFFFF, instructionAddress>>16<<12|uint32(fpu.opcode), dataAddress&0xFFFF, dataAddress>>16<<12)
+	}
+
+	size, width := uint8(16), uint32(2)
+	if instruction.Operand32 {
+		size, width = 32, 4
+	}
+	for n, field := range fields {
+		if err := instruction.Operand.Write(uint32(n)*width, size, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEnvironment runs FLDENV, and the first part of FRSTOR
+func (fpu *Intel80387) loadEnvironment(instruction Instruction) error {
+	size, width := uint8(16), uint32(2)
+	if instruction.Operand32 {
+		size, width = 32, 4
+	}
+	var fields [7]uint32
+	for n := range fields {
+		field, err := instruction.Operand.Read(uint32(n)*width, size)
+		if err != nil {
+			return err
+		}
+		fields[n] = field
+	}
+
+	fpu.control = uint16(fields[0])
+	fpu.status = uint16(fields[1])
+	fpu.tags = uint16(fields[2])
+	if instruction.ProtectedMode {
+		fpu.instructionOffset = fields[3]
+		fpu.instructionSelector = uint16(fields[4])
+		if instruction.Operand32 {
+			fpu.opcode = uint16(fields[4]>>16) & 0x7FF
+		}
+		fpu.dataOffset, fpu.dataSelector = fields[5], uint16(fields[6])
+	} else {
+		fpu.instructionSelector, fpu.dataSelector = 0, 0
+		fpu.instructionOffset = fields[3]&0xFFFF | fields[4]>>12<<16
+		fpu.opcode = uint16(fields[4]) & 0x7FF
+		fpu.dataOffset = fields[5]&0xFFFF | fields[6]>>12<<16
+	}
+	fpu.updateErrorSummary()
+	return nil
+}
+
+// save runs FNSAVE, the environment followed by ST(0) to ST(7)
+func (fpu *Intel80387) save(instruction Instruction) error {
+	if err := fpu.storeEnvironment(instruction); err != nil {
+		return err
+	}
+	offset := environmentSize(instruction)
+	for i := uint8(0); i < 8; i++ {
+		if err := write80(instruction.Operand, offset+uint32(i)*10, fpu.registers[fpu.physical(i)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore runs FRSTOR
+func (fpu *Intel80387) restore(instruction Instruction) error {
+	offset := environmentSize(instruction)
+	var registers [8]Float80
+	for i := range registers {
+		value, err := read80(instruction.Operand, offset+uint32(i)*10)
+		if err != nil {
+			return err
+		}
+		registers[i] = value
+	}
+	if err := fpu.loadEnvironment(instruction); err != nil {
+		return err
+	}
+	for i, value := range registers {
+		fpu.registers[fpu.physical(uint8(i))] = value
+	}
+	return nil
+}
+
+// refreshTags retags the registers that aren't empty from what they hold
+func (fpu *Intel80387) refreshTags() {
+	for physical := uint8(0); physical < 8; physical++ {
+		if fpu.tags>>(physical*2)&3 != TAG_EMPTY {
+			fpu.setTag(physical, fpu.registers[physical].tag())
+		}
+	}
+}
+
+func read64(memory Memory, offset uint32) (uint64, error) {
+	low, err := memory.Read(offset, 32)
+	if err != nil {
+		return 0, err
+	}
+	high, err := memory.Read(offset+4, 32)
+	return uint64(high)<<32 | uint64(low), err
+}
+
+func write64(memory Memory, offset uint32, value uint64) error {
+	if err := memory.Write(offset, 32, uint32(value)); err != nil {
+		return err
+	}
+	return memory.Write(offset+4, 32, uint32(value>>32))
+}
+
+func read80(memory Memory, offset uint32) (Float80, error) {
+	significand, err := read64(memory, offset)
+	if err != nil {
+		return Float80{}, err
+	}
+	signExponent, err := memory.Read(offset+8, 16)
+	return Float80{uint16(signExponent), significand}, err
+}
+
+func write80(memory Memory, offset uint32, value Float80) error {
+	if err := write64(memory, offset, value.Significand); err != nil {
+		return err
+	}
+	return memory.Write(offset+8, 16, uint32(value.SignExponent))
+}
+
+// Mnemonic names an ESC instruction for the instruction log
+func Mnemonic(opcode uint16) string {
+	escape, modrm := uint8(opcode>>8&7), uint8(opcode)
+	reg, i := modrm>>3&7, modrm&7
+	arithmetic := [8]string{"FADD", "FMUL", "FCOM", "FCOMP", "FSUB", "FSUBR", "FDIV", "FDIVR"}
+
+	if modrm < 0xC0 {
+		names := [8][8]string{
+			arithmetic,
+			{"FLD", "", "FST", "FSTP", "FLDENV", "FLDCW", "FNSTENV", "FNSTCW"},
+			{"FIADD", "FIMUL", "FICOM", "FICOMP", "FISUB", "FISUBR", "FIDIV", "FIDIVR"},
+			{"FILD", "", "FIST", "FISTP", "", "FLD", "", "FSTP"},
+			arithmetic,
+			{"FLD", "", "FST", "FSTP", "FRSTOR", "", "FNSAVE", "FNSTSW"},
+			{"FIADD", "FIMUL", "FICOM", "FICOMP", "FISUB", "FISUBR", "FIDIV", "FIDIVR"},
+			{"FILD", "", "FIST", "FISTP", "FBLD", "FILD", "FBSTP", "FISTP"},
+		}
+		if name := names[escape][reg]; name != "" {
+			return name
+		}
+		return fmt.Sprintf("ESC %#04x", opcode)
+	}
+
+	switch escape {
+	case 0:
+		return fmt.Sprintf("%s ST, ST(%d)", arithmetic[reg], i)
+	case 4, 6:
+		if escape == 6 && modrm == 0xD9 {
+			return "FCOMPP"
+		}
+		if reg >= 4 {
+			reg ^= 1
+		}
+		name := arithmetic[reg]
+		if escape == 6 {
+			name += "P"
+		}
+		return fmt.Sprintf("%s ST(%d), ST", name, i)
+	case 1:
+		switch reg {
+		case 0:
+			return fmt.Sprintf("FLD ST(%d)", i)
+		case 1:
+			return fmt.Sprintf("FXCH ST(%d)", i)
+		case 2:
+			return "FNOP"
+		}
+		names := []string{
+			"FCHS", "FABS", "", "", "FTST", "FXAM", "", "",
+			"FLD1", "FLDL2T", "FLDL2E", "FLDPI", "FLDLG2", "FLDLN2", "FLDZ", "",
+			"F2XM1", "FYL2X", "FPTAN", "FPATAN", "FXTRACT", "FPREM1", "FDECSTP", "FINCSTP",
+			"FPREM", "FYL2XP1", "FSQRT", "FSINCOS", "FRNDINT", "FSCALE", "FSIN", "FCOS",
+		}
+		if index := int(modrm) - 0xE0; index >= 0 && names[index] != "" {
+			return names[index]
+		}
+	case 2:
+		if modrm == 0xE9 {
+			return "FUCOMPP"
+		}
+	case 3:
+		if names := []string{"FNENI", "FNDISI", "FNCLEX", "FNINIT", "FNSETPM"}; modrm >= 0xE0 && modrm <= 0xE4 {
+			return names[modrm-0xE0]
+		}
+	case 5:
+		if names := []string{"FFREE", "", "FST", "FSTP", "FUCOM", "FUCOMP"}; int(reg) < len(names) && names[reg] != "" {
+			return fmt.Sprintf("%s ST(%d)", names[reg], i)
+		}
+	case 7:
+		if modrm == 0xE0 {
+			return "FNSTSW AX"
+		}
+	}
+	return fmt.Sprintf("ESC %#04x", opcode)
+}
@@ -0,0 +1,355 @@
+package intel80387
+
+import (
+	"github.com/andrewjc/threeatesix/devices/bus"
+	"log"
+	"math/big"
+)
+
+/*
+Simulated 80387 numeric coprocessor
+The processor decodes each ESC instruction and hands it over with its memory operand resolved.
+The coprocessor keeps a stack of eight 80 bit extended reals and computes with math/big at the
+precision and rounding the control word selects. The transcendental instructions go through
+float64 and are only accurate to double precision.
+An unmasked exception is reported the way the PC/AT wires the coprocessor's error output, on
+IRQ 13 until software clears the latch by writing port F0, unless CR0.NE is set and the
+processor raises #MF on the next waiting instruction instead.
+*/
+
+// status word bits
+const (
+	STATUS_IE  = 0x0001 // invalid operation
+	STATUS_DE  = 0x0002 // denormal operand
+	STATUS_ZE  = 0x0004 // zero divide
+	STATUS_OE  = 0x0008 // overflow
+	STATUS_UE  = 0x0010 // underflow
+	STATUS_PE  = 0x0020 // precision
+	STATUS_SF  = 0x0040 // stack fault, the invalid operation was a stack overflow or underflow
+	STATUS_ES  = 0x0080 // error summary, an unmasked exception is pending
+	STATUS_C0  = 0x0100
+	STATUS_C1  = 0x0200
+	STATUS_C2  = 0x0400
+	STATUS_TOP = 0x3800 // the physical register ST(0) is
+	STATUS_C3  = 0x4000
+	STATUS_B   = 0x8000 // busy, follows ES on the 387
+
+	STATUS_EXCEPTIONS = 0x003F
+	STATUS_CONDITION  = STATUS_C0 | STATUS_C1 | STATUS_C2 | STATUS_C3
+)
+
+// control word fields
+const (
+	CONTROL_MASKS     = 0x003F // one mask bit per exception, in status word order
+	CONTROL_PRECISION = 0x0300 // 24, 53 or 64 bit significands
+	CONTROL_ROUNDING  = 0x0C00 // nearest, down, up or toward zero
+	CONTROL_INFINITY  = 0x1000 // projective infinity on the 287, the 387 ignores it
+
+	// CONTROL_RESET_VALUE - every exception masked, 64 bit precision, round to nearest
+	CONTROL_RESET_VALUE = 0x037F
+)
+
+// register tags
+const (
+	TAG_VALID   = 0
+	TAG_ZERO    = 1
+	TAG_SPECIAL = 2 // NaN, infinity, denormal or unsupported
+	TAG_EMPTY   = 3
+)
+
+type Intel80387 struct {
+	busId uint32
+	bus   *bus.Bus
+
+	registers [8]Float80 // physical registers, ST(i) is registers[(TOP+i)&7]
+	control   uint16
+	status    uint16 // TOP is kept in its status word bits
+	tags      uint16
+
+	// the last non control instruction and its memory operand, which FSTENV and FSAVE store
+	// for exception handlers
+	instructionSelector uint16
+	instructionOffset   uint32
+	opcode              uint16
+	dataSelector        uint16
+	dataOffset          uint32
+
+	nativeErrors bool // CR0.NE is set, errors are the processor's #MF rather than IRQ 13
+	errorLatch   bool // IRQ 13 is asserted, until a write to port F0
+}
+
+func NewIntel80387() *Intel80387 {
+	fpu := &Intel80387{}
+	fpu.initialize()
+	return fpu
+}
+
+// initialize puts the coprocessor in the state FNINIT and a hardware reset leave it in
+func (fpu *Intel80387) initialize() {
+	fpu.control = CONTROL_RESET_VALUE
+	fpu.status = 0
+	fpu.tags = 0xFFFF
+	fpu.instructionSelector, fpu.instructionOffset, fpu.opcode = 0, 0, 0
+	fpu.dataSelector, fpu.dataOffset = 0, 0
+}
+
+func (fpu *Intel80387) GetBus() *bus.Bus {
+	return fpu.bus
+}
+
+func (fpu *Intel80387) SetBus(bus *bus.Bus) {
+	fpu.bus = bus
+
+	// the coprocessor shares the processor's reset line
+	bus.Signals().Reset.Subscribe(func(level bool) {
+		if level {
+			fpu.Reset()
+		}
+	})
+}
+
+func (fpu *Intel80387) SaveState() interface{} {
+	state := *fpu
+	return &state
+}
+
+func (fpu *Intel80387) RestoreState(state interface{}) {
+	*fpu = *state.(*Intel80387)
+}
+
+func (fpu *Intel80387) GetDeviceBusId() uint32 {
+	return fpu.busId
+}
+
+func (fpu *Intel80387) SetDeviceBusId(id uint32) {
+	fpu.busId = id
+}
+
+func (fpu *Intel80387) OnReceiveMessage(message bus.BusMessage) {
+}
+
+// GetPortMap - 0xF0 clears the error latch driving IRQ 13, 0xF1 resets the coprocessor
+func (fpu *Intel80387) GetPortMap() *bus.DevicePortMap {
+	return &bus.DevicePortMap{
+		Mappings: []bus.PortMapping{bus.WriteOnly(bus.Ports(0x00F0, 0x00F1), fpu)},
+	}
+}
+
+func (fpu *Intel80387) ReadAddr8(addr uint16) uint8 {
+	log.Printf("Intel80387: Invalid read address: %#04x", addr)
+	return 0xFF
+}
+
+func (fpu *Intel80387) WriteAddr8(addr uint16, data uint8) {
+	switch addr {
+	case 0x00F0:
+		fpu.clearErrorLatch()
+	case 0x00F1:
+		fpu.Reset()
+	default:
+		log.Printf("Intel80387: Invalid write address: %#04x", addr)
+	}
+}
+
+// Reset is a hardware reset, which also drops the error latch
+func (fpu *Intel80387) Reset() {
+	fpu.initialize()
+	fpu.clearErrorLatch()
+}
+
+// SetNativeErrorReporting follows CR0.NE. With it set, errors are left for the processor to
+// raise as #MF and IRQ 13 isn't used.
+func (fpu *Intel80387) SetNativeErrorReporting(native bool) {
+	fpu.nativeErrors = native
+}
+
+// ErrorPending reports an unmasked exception the next waiting instruction must raise
+func (fpu *Intel80387) ErrorPending() bool {
+	return fpu.status&STATUS_ES != 0
+}
+
+func (fpu *Intel80387) ControlWord() uint16 {
+	return fpu.control
+}
+
+func (fpu *Intel80387) StatusWord() uint16 {
+	return fpu.status
+}
+
+func (fpu *Intel80387) TagWord() uint16 {
+	return fpu.tags
+}
+
+// ST returns stack register i, and whether it holds a value
+func (fpu *Intel80387) ST(i uint8) (Float80, bool) {
+	return fpu.registers[fpu.physical(i)], !fpu.isEmpty(i)
+}
+
+func (fpu *Intel80387) top() uint8 {
+	return uint8(fpu.status >> 11 & 7)
+}
+
+func (fpu *Intel80387) setTop(top uint8) {
+	fpu.status = fpu.status&^STATUS_TOP | uint16(top&7)<<11
+}
+
+// physical is the physical register stack register i is in
+func (fpu *Intel80387) physical(i uint8) uint8 {
+	return (fpu.top() + i) & 7
+}
+
+func (fpu *Intel80387) setTag(physical uint8, tag uint8) {
+	shift := physical * 2
+	fpu.tags = fpu.tags&^(3<<shift) | uint16(tag)<<shift
+}
+
+func (fpu *Intel80387) isEmpty(i uint8) bool {
+	return fpu.tags>>(fpu.physical(i)*2)&3 == TAG_EMPTY
+}
+
+// setST writes stack register i and tags it for its new value
+func (fpu *Intel80387) setST(i uint8, value Float80) {
+	physical := fpu.physical(i)
+	fpu.registers[physical] = value
+	fpu.setTag(physical, value.tag())
+}
+
+// push loads a value onto the stack. Pushing onto a full stack is a stack overflow, whose masked
+// response pushes the indefinite NaN instead.
+func (fpu *Intel80387) push(value Float80) {
+	if !fpu.isEmpty(7) {
+		if !fpu.stackFault(true) {
+			return
+		}
+		value = indefinite
+	}
+	fpu.setTop(fpu.top() - 1)
+	fpu.setST(0, value)
+}
+
+// pop empties ST(0) and moves the top of the stack past it
+func (fpu *Intel80387) pop() {
+	fpu.setTag(fpu.physical(0), TAG_EMPTY)
+	fpu.setTop(fpu.top() + 1)
+}
+
+// stackFault raises the invalid operation for a stack overflow, or an underflow, which is
+// reading an empty register. It reports whether the exception is masked, in which case the
+// instruction goes on with the indefinite NaN.
+func (fpu *Intel80387) stackFault(overflow bool) bool {
+	fpu.status &^= STATUS_C1
+	if overflow {
+		fpu.status |= STATUS_C1
+	}
+	return fpu.raise(STATUS_IE | STATUS_SF)
+}
+
+// operands reads the stack registers an instruction uses. An empty one is a stack underflow,
+// and when that is masked the instruction sees the indefinite NaN in its place.
+func (fpu *Intel80387) operands(registers ...uint8) ([]Float80, bool) {
+	values := make([]Float80, len(registers))
+	for n, i := range registers {
+		value, ok := fpu.ST(i)
+		if !ok {
+			if !fpu.stackFault(false) {
+				return nil, false
+			}
+			value = indefinite
+		}
+		values[n] = value
+	}
+	return values, true
+}
+
+// raise records exceptions in the status word. An unmasked one sets the error summary and
+// reports the error. It returns whether they were all masked.
+func (fpu *Intel80387) raise(exceptions uint16) bool {
+	fpu.status |= exceptions
+	if exceptions&STATUS_EXCEPTIONS&^fpu.control == 0 {
+		return true
+	}
+	fpu.status |= STATUS_ES | STATUS_B
+	fpu.reportError()
+	return false
+}
+
+// deliver finishes an instruction that computed a result and raised exceptions doing so. The
+// result is written unless an unmasked invalid operation, denormal or zero divide stops the
+// instruction, an unmasked overflow, underflow or precision exception still leaves it written.
+func (fpu *Intel80387) deliver(exceptions uint16, write func()) {
+	if exceptions&(STATUS_IE|STATUS_DE|STATUS_ZE)&^fpu.control == 0 {
+		write()
+	}
+	if exceptions != 0 {
+		fpu.raise(exceptions)
+	}
+}
+
+// updateErrorSummary recomputes ES after the control or status word is loaded, reporting an
+// error if the load unmasked a pending exception
+func (fpu *Intel80387) updateErrorSummary() {
+	if fpu.status&STATUS_EXCEPTIONS&^fpu.control == 0 {
+		fpu.status &^= STATUS_ES | STATUS_B
+		return
+	}
+	if fpu.status&STATUS_ES == 0 {
+		fpu.status |= STATUS_ES | STATUS_B
+		fpu.reportError()
+	}
+}
+
+func (fpu *Intel80387) reportError() {
+	if fpu.nativeErrors || fpu.errorLatch {
+		return
+	}
+	fpu.errorLatch = true
+	if fpu.bus != nil {
+		fpu.bus.Signals().IRQ[13].Drive(true)
+	}
+}
+
+func (fpu *Intel80387) clearErrorLatch() {
+	if !fpu.errorLatch {
+		return
+	}
+	fpu.errorLatch = false
+	if fpu.bus != nil {
+		fpu.bus.Signals().IRQ[13].Drive(false)
+	}
+}
+
+// roundingMode is the rounding the control word selects
+func (fpu *Intel80387) roundingMode() big.RoundingMode {
+	switch fpu.control & CONTROL_ROUNDING >> 10 {
+	case 1:
+		return big.ToNegativeInf
+	case 2:
+		return big.ToPositiveInf
+	case 3:
+		return big.ToZero
+	}
+	return big.ToNearestEven
+}
+
+// precision is the format results are rounded to. Precision control only narrows the
+// significand, the exponent keeps its extended range.
+func (fpu *Intel80387) precision() realFormat {
+	format := extendedReal
+	switch fpu.control & CONTROL_PRECISION >> 8 {
+	case 0:
+		format.precision = singleReal.precision
+	case 2:
+		format.precision = doubleReal.precision
+	}
+	return format
+}
+
+// result rounds the exact result of an arithmetic instruction as the control word says
+func (fpu *Intel80387) result(value *big.Float) (Float80, uint16) {
+	rounded, exceptions := fpu.precision().round(value, fpu.roundingMode())
+	return fromBig(rounded), exceptions
+}
+
+func (fpu *Intel80387) setCondition(condition uint16) {
+	fpu.status = fpu.status&^STATUS_CONDITION | condition
+}
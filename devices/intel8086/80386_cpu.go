@@ -1,27 +1,37 @@
 package intel8086
 
 import (
+	"errors"
 	"fmt"
 	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/intel80387"
 	"github.com/andrewjc/threeatesix/devices/intel8259a"
 	"github.com/andrewjc/threeatesix/devices/io"
 	"github.com/andrewjc/threeatesix/devices/memmap"
+	"github.com/andrewjc/threeatesix/devices/monitor"
 	"log"
 	"os"
 )
 
+// New80386CPU builds a 386DX
 func New80386CPU() *CpuCore {
+	return NewCPU(CPU_MODEL_80386DX)
+}
+
+// NewCPU builds a core that behaves as the given processor model
+func NewCPU(model CpuModel) *CpuCore {
 
-	cpuCore := &CpuCore{}
+	cpuCore := &CpuCore{model: model}
 	cpuCore.partId = common.MODULE_PRIMARY_PROCESSOR
+	cpuCore.symbols = monitor.NewSymbolTable()
 
 	initializeRegisters(cpuCore)
 
 	initializeSegmentRegisters(cpuCore)
 
-	cpuCore.registers.IP = 0x0000 // Instruction pointer set to the start
-	cpuCore.registers.SP = 0xFFFE // Stack pointer set to the top of the stack
+	*cpuCore.registers.EIP() = 0x0000 // Instruction pointer set to the start
+	*cpuCore.registers.SP() = 0xFFFE  // Stack pointer set to the top of the stack
 
 	cpuCore.opCodeMap = make([]OpCodeImpl, 256)
 	cpuCore.opCodeMap2Byte = make([]OpCodeImpl, 256)
@@ -32,12 +42,16 @@ func New80386CPU() *CpuCore {
 }
 
 func initializeSegmentRegisters(cpuCore *CpuCore) {
-	cpuCore.registers.ES = SegmentRegister{Base: 0, Limit: 0xFFFF}
-	cpuCore.registers.CS = SegmentRegister{Base: 0xFFFF0, Limit: 0xFFFF}
-	cpuCore.registers.SS = SegmentRegister{Base: 0, Limit: 0xFFFF}
-	cpuCore.registers.DS = SegmentRegister{Base: 0, Limit: 0xFFFF}
-	cpuCore.registers.FS = SegmentRegister{Base: 0, Limit: 0xFFFF}
-	cpuCore.registers.GS = SegmentRegister{Base: 0, Limit: 0xFFFF}
+	cpuCore.registers.ES = RealModeSegment(0)
+	cpuCore.registers.CS = RealModeSegment(0xF000)
+	cpuCore.registers.SS = RealModeSegment(0)
+	cpuCore.registers.DS = RealModeSegment(0)
+	cpuCore.registers.FS = RealModeSegment(0)
+	cpuCore.registers.GS = RealModeSegment(0)
+	cpuCore.registers.IDTR = DescriptorTableRegister{Base: 0, Limit: 0x3FF}
+	cpuCore.registers.GDTR = DescriptorTableRegister{}
+	cpuCore.registers.LDTR = SegmentRegister{}
+	cpuCore.registers.TR = SegmentRegister{}
 }
 
 func initializeRegisters(cpuCore *CpuCore) {
@@ -45,37 +59,22 @@ func initializeRegisters(cpuCore *CpuCore) {
 
 	// index of 8 bit registers
 	cpuCore.registers.registers8Bit = []*uint8{
-		&cpuCore.registers.AL,
-		&cpuCore.registers.CL,
-		&cpuCore.registers.DL,
-		&cpuCore.registers.BL,
-		&cpuCore.registers.AH,
-		&cpuCore.registers.CH,
-		&cpuCore.registers.DH,
-		&cpuCore.registers.BH,
+		cpuCore.registers.AL(),
+		cpuCore.registers.CL(),
+		cpuCore.registers.DL(),
+		cpuCore.registers.BL(),
+		cpuCore.registers.AH(),
+		cpuCore.registers.CH(),
+		cpuCore.registers.DH(),
+		cpuCore.registers.BH(),
 	}
 
 	// index of 16 bit registers
-	cpuCore.registers.registers16Bit = []*uint16{
-		&cpuCore.registers.AX,
-		&cpuCore.registers.CX,
-		&cpuCore.registers.DX,
-		&cpuCore.registers.BX,
-		&cpuCore.registers.SP,
-		&cpuCore.registers.BP,
-		&cpuCore.registers.SI,
-		&cpuCore.registers.DI,
-	}
-
-	cpuCore.registers.registers32Bit = []*uint32{
-		&cpuCore.registers.EAX,
-		&cpuCore.registers.ECX,
-		&cpuCore.registers.EDX,
-		&cpuCore.registers.EBX,
-		&cpuCore.registers.ESP,
-		&cpuCore.registers.EBP,
-		&cpuCore.registers.ESI,
-		&cpuCore.registers.EDI,
+	cpuCore.registers.registers16Bit = make([]*uint16, len(cpuCore.registers.gpr))
+	cpuCore.registers.registers32Bit = make([]*uint32, len(cpuCore.registers.gpr))
+	for i := range cpuCore.registers.gpr {
+		cpuCore.registers.registers16Bit[i] = lowWord(&cpuCore.registers.gpr[i])
+		cpuCore.registers.registers32Bit[i] = &cpuCore.registers.gpr[i]
 	}
 
 	cpuCore.registers.registersSegmentRegisters = []*SegmentRegister{
@@ -94,6 +93,7 @@ type CpuCore struct {
 	memoryAccessController *memmap.MemoryAccessController
 	ioPortAccessController *io.IOPortAccessController
 
+	model          CpuModel
 	registers      *CpuRegisters
 	opCodeMap      []OpCodeImpl
 	opCodeMap2Byte []OpCodeImpl
@@ -102,9 +102,10 @@ type CpuCore struct {
 	flags CpuExecutionFlags
 
 	busId                     uint32
-	interruptChannel          chan bus.BusMessage
 	interruptControllerMaster *intel8259a.Intel8259a
 	interruptControllerSlave  *intel8259a.Intel8259a
+	mathCoProcessor           *intel80387.Intel80387
+	intrAsserted              bool // level of the INTR line from the interrupt controller
 
 	currentByteDecodeStart         uint32  //the start addr of the instruction being decoded (including prefixes etc)
 	currentPrefixBytes             []uint8 //current prefix bytes read for the byte being decoded in the instruction
@@ -112,10 +113,24 @@ type CpuCore struct {
 	currentOpCodeBeingExecuted     uint8   //the opcode of the instruction currently being exected
 	lastExecutedInstructionPointer uint32
 	is2ByteOperand                 bool
-	halt                           bool
+	halt                           uint8         //one of the HALT_* states
+	pendingException               *cpuException //the fault raised by the instruction being executed, delivered after it
+	currentPrivilegeLevel          uint8         //CPL in protected mode, see cpl()
+	debugTrap                      uint32        //DR6 bits of the debug traps the current instruction has set off, delivered after it
 	interruptEnableDelay           int
+	instructionCount               uint64 //number of instructions retired since power on
+	callStack                      []callFrame
+	symbols                        *monitor.SymbolTable
+	profiler                       *Profiler
 }
 
+// halt states, why the processor isn't executing instructions
+const (
+	HALT_NONE     = iota
+	HALT_HLT      // stopped by HLT until an interrupt arrives
+	HALT_SHUTDOWN // shut down by a triple fault, only a reset restarts it
+)
+
 type CpuExecutionFlags struct {
 	OperandSizeOverrideEnabled bool //treat operand size as 32bit
 	AddressSizeOverrideEnabled bool //treat address size as 32bit
@@ -123,7 +138,8 @@ type CpuExecutionFlags struct {
 	MemorySegmentOverride uint32
 	LockPrefixEnabled     bool
 	RepPrefixEnabled      bool
-	IsFarJump             bool //used to determine if the current instruction is a far jump
+	RepNePrefixEnabled    bool //the repeat prefix was F2, repne, rather than F3
+	IsFarJump             bool //set when the current instruction loaded (E)IP itself, so it must not be advanced past the instruction
 }
 
 func (device *CpuCore) GetDeviceBusId() uint32 {
@@ -136,16 +152,52 @@ func (device *CpuCore) SetDeviceBusId(id uint32) {
 
 func (device *CpuCore) SetBus(bus *bus.Bus) {
 	device.bus = bus
+
+	if device.partId == common.MODULE_PRIMARY_PROCESSOR {
+		bus.Signals().INTR.Subscribe(func(level bool) {
+			device.intrAsserted = level
+		})
+		bus.Signals().Reset.Subscribe(func(level bool) {
+			if level {
+				device.Reset()
+				// the reset vector is already loaded, so the instruction that caused the reset must not advance IP
+				device.flags.IsFarJump = true
+			}
+		})
+	}
+}
+
+type cpuCoreState struct {
+	core      CpuCore
+	registers CpuRegisters
+}
+
+func (device *CpuCore) SaveState() interface{} {
+	state := &cpuCoreState{core: *device, registers: *device.registers}
+	state.core.currentPrefixBytes = append([]uint8(nil), device.currentPrefixBytes...)
+	state.core.callStack = append([]callFrame(nil), device.callStack...)
+	return state
+}
+
+func (device *CpuCore) RestoreState(state interface{}) {
+	saved := state.(*cpuCoreState)
+
+	// the register index slices point into the live register file, so it is
+	// restored in place rather than replaced
+	registers := device.registers
+	symbols, profiler := device.symbols, device.profiler
+	*device = saved.core
+	*registers = saved.registers
+	device.registers = registers
+	device.symbols, device.profiler = symbols, profiler
+	device.currentPrefixBytes = append([]uint8(nil), saved.core.currentPrefixBytes...)
+	device.callStack = append([]callFrame(nil), saved.core.callStack...)
 }
 
 func (device *CpuCore) OnReceiveMessage(message bus.BusMessage) {
 	switch {
 	case message.Subject == common.MESSAGE_REQUEST_CPU_MODESWITCH:
 		device.EnterMode(message.Data[0])
-	case message.Subject == common.MESSAGE_INTERRUPT_RAISE:
-		device.AcknowledgeInterrupt(message)
-	case message.Subject == common.MESSAGE_INTERRUPT_EXECUTE:
-		device.HandleInterruptBusMessage(message)
 	}
 }
 
@@ -154,72 +206,107 @@ func (core *CpuCore) GetPortMap() *bus.DevicePortMap {
 }
 
 func (core *CpuCore) ReadAddr8(addr uint16) uint8 {
-	//TODO implement me
-	panic("implement me")
+	log.Printf("%s: Unsupported read from port %#04x", core.FriendlyPartName(), addr)
+	return 0xFF
 }
 
 func (core *CpuCore) WriteAddr8(addr uint16, data uint8) {
-	//TODO implement me
-	panic("implement me")
+	log.Printf("%s: Unsupported write to port %#04x with value %#02x", core.FriendlyPartName(), addr, data)
 }
 
+// SetCS loads CS as a real mode segment
 func (core *CpuCore) SetCS(addr uint32) {
-	core.registers.CS.Base = addr
+	core.registers.CS = RealModeSegment(uint16(addr))
 }
 
-func (core *CpuCore) SetIP(addr uint16) {
-	core.registers.IP = addr
+// SetIP loads EIP
+func (core *CpuCore) SetIP(addr uint32) {
+	*core.registers.EIP() = addr
 }
 
-func (core *CpuCore) GetIP() uint16 {
-	return core.registers.IP
+// GetIP returns EIP, the offset of the next instruction within CS
+func (core *CpuCore) GetIP() uint32 {
+	return *core.registers.EIP()
 }
 
+// GetCS returns the CS selector
 func (core *CpuCore) GetCS() uint32 {
-	return core.registers.CS.Base
+	return uint32(core.registers.CS.Selector)
 }
 
 func (core *CpuCore) IncrementIP() {
-	core.registers.IP++
+	*core.registers.EIP()++
 }
 
-func (core *CpuCore) Init(bus *bus.Bus) {
-	core.bus = bus
+func (core *CpuCore) Init(b *bus.Bus) error {
+	core.bus = b
 
 	// obtain a pointer to the memory controller on the bus
 	// this is a bit of a hack but avoids a linear lookup for every
 	// instruction access
-	dev1 := core.bus.FindSingleDevice(common.MODULE_MEMORY_ACCESS_CONTROLLER).(*memmap.MemoryAccessController)
-	core.memoryAccessController = dev1
+	var err error
+	if core.memoryAccessController, err = bus.FindSingleDeviceAs[*memmap.MemoryAccessController](b, common.MODULE_MEMORY_ACCESS_CONTROLLER); err != nil {
+		return err
+	}
 
-	dev2 := core.bus.FindSingleDevice(common.MODULE_IO_PORT_ACCESS_CONTROLLER).(*io.IOPortAccessController)
-	core.ioPortAccessController = dev2
+	core.memoryAccessController.SetAddressBusWidth(core.model.AddressBits())
 
-	pic1 := core.bus.FindSingleDevice(common.MODULE_INTERRUPT_CONTROLLER_1).(*intel8259a.Intel8259a)
-	core.interruptControllerMaster = pic1
+	if core.ioPortAccessController, err = bus.FindSingleDeviceAs[*io.IOPortAccessController](b, common.MODULE_IO_PORT_ACCESS_CONTROLLER); err != nil {
+		return err
+	}
+	if core.partId == common.MODULE_PRIMARY_PROCESSOR {
+		core.ioPortAccessController.SetInstructionSource(core)
+	}
 
-	pic2 := core.bus.FindSingleDevice(common.MODULE_INTERRUPT_CONTROLLER_2).(*intel8259a.Intel8259a)
-	core.interruptControllerSlave = pic2
+	if core.interruptControllerMaster, err = bus.FindSingleDeviceAs[*intel8259a.Intel8259a](b, common.MODULE_INTERRUPT_CONTROLLER_1); err != nil {
+		return err
+	}
+
+	if core.interruptControllerSlave, err = bus.FindSingleDeviceAs[*intel8259a.Intel8259a](b, common.MODULE_INTERRUPT_CONTROLLER_2); err != nil {
+		return err
+	}
+
+	// only a 386 machine has a coprocessor, without one the ESC instructions do nothing
+	core.mathCoProcessor, err = bus.FindSingleDeviceAs[*intel80387.Intel80387](b, common.MODULE_MATH_CO_PROCESSOR)
+	if err != nil && !errors.Is(err, bus.DeviceNotFoundError{DeviceType: common.MODULE_MATH_CO_PROCESSOR}) {
+		return err
+	}
+
+	hardwareMonitor, err := bus.FindSingleDeviceAs[*monitor.HardwareMonitor](b, common.MODULE_DEBUG_MONITOR)
+	if err != nil {
+		return err
+	}
+	core.symbols = hardwareMonitor.GetSymbols()
 
 	core.EnterMode(common.REAL_MODE)
 
 	core.Reset()
+	return nil
 }
 
 func (core *CpuCore) Reset() {
-	core.registers.CS.Base = 0xF000 // This sets the base of the code segment to 0xF0000 when multiplied by 16.
-	core.registers.IP = 0xFFF0      // Instruction pointer set to 0xFFF0.
-	core.registers.CR0 = 0          // Set to real mode
-	core.registers.FLAGS = 0x0002   // Set default flags
+	// A 386 starts with a CS base of FFFF0000, but the BIOS is only mapped below 1MB, so CS gets
+	// the real mode base for its selector instead
+	initializeSegmentRegisters(core)
+	*core.registers.EIP() = 0xFFF0 // Instruction pointer set to 0xFFF0.
+	core.registers.CR0 = 0         // Set to real mode
+	core.registers.EFLAGS = core.fixedFlags()
+	*core.registers.DX() = core.model.resetSignature()
+	core.registers.DR6 = DR6_RESET
+	core.registers.DR7 = DR7_RESET
+	if core.mathCoProcessor != nil {
+		core.mathCoProcessor.SetNativeErrorReporting(false)
+	}
+	core.pendingException = nil
+	core.currentPrivilegeLevel = 0
+	core.halt = HALT_NONE
 	core.bus.SendMessage(bus.BusMessage{Subject: common.MESSAGE_GLOBAL_LOCK_BIOS_MEM_REGION, Data: []byte{}})
-
-	core.shadowBios()
 }
 
 func (core *CpuCore) EnterMode(mode uint8) {
 	core.mode = mode
 
-	core.bus.SendMessage(bus.BusMessage{Subject: common.MESSAGE_GLOBAL_CPU_MODESWITCH, Data: []byte{mode}})
+	core.bus.Signals().ModeSwitch.Drive(mode)
 
 	processorString := core.FriendlyPartName()
 	modeString := ""
@@ -227,94 +314,30 @@ func (core *CpuCore) EnterMode(mode uint8) {
 		modeString = "REAL MODE"
 	} else if core.mode == common.PROTECTED_MODE {
 		modeString = "PROTECTED MODE"
+	} else if core.mode == common.VIRTUAL_8086_MODE {
+		modeString = "VIRTUAL 8086 MODE"
 	}
 	core.logDebug(fmt.Sprintf("%s entered %s", processorString, modeString))
 }
 
-// Gets the current code segment + IP addr in memory
+// Gets the current code segment + IP addr in memory. Instructions are always fetched from CS,
+// whatever segment override the last instruction had.
 func (core *CpuCore) GetCurrentCodePointer() uint32 {
-	addr := core.SegmentAddressToLinearAddress(core.registers.CS, core.registers.IP)
-	return addr
+	return core.linearAddress(&core.registers.CS, *core.registers.EIP())
 }
 
 func (core *CpuCore) GetCurrentDataPointer() uint32 {
-	addr := core.SegmentAddressToLinearAddress(core.registers.DS, core.registers.IP)
+	addr := core.SegmentAddressToLinearAddress(core.registers.DS, *core.registers.IP())
 	return addr
 }
 
-func (core *CpuCore) GetCurrentSegmentWidth() uint8 {
-	segment := core.registers.registersSegmentRegisters[common.SEGMENT_CS]
-
-	if core.flags.MemorySegmentOverride > 0 {
-		segment = core.registers.registersSegmentRegisters[core.flags.MemorySegmentOverride]
-	}
-
-	if segment.Limit == 0xFFFF {
-		return 16
-	} else {
-		return 32
-	}
-}
-
+// SegmentAddressToLinearAddress does not wrap at 1MB, FFFF:0010 and above reach the HMA. The
+// memory controller's A20 gate folds those addresses back to the bottom of memory when it is disabled.
 func (core *CpuCore) SegmentAddressToLinearAddress(segment SegmentRegister, offset uint16) uint32 {
-	addr := core.SegmentAddressToLinearAddress_NoMask(segment, offset)
-	linearAddr := addr & 0xFFFFF // Mask to 20 bits to simulate real-mode address wrapping.
-
-	return linearAddr
-}
-
-func (core *CpuCore) SegmentAddressToLinearAddress_NoMask(segment SegmentRegister, offset uint16) uint32 {
-
 	if core.flags.MemorySegmentOverride > 0 {
-		// default segment override
-		switch core.flags.MemorySegmentOverride {
-		case common.SEGMENT_CS:
-			return uint32(core.registers.CS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_SS:
-			return uint32(core.registers.SS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_DS:
-			return uint32(core.registers.DS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_ES:
-			return uint32(core.registers.ES.Base)<<4 + uint32(offset)
-		case common.SEGMENT_FS:
-			return uint32(core.registers.FS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_GS:
-			return uint32(core.registers.GS.Base)<<4 + uint32(offset)
-		default:
-			panic("Unhandled segment register override")
-		}
+		return core.linearAddress(core.segmentRegister(core.flags.MemorySegmentOverride), uint32(offset))
 	}
-
-	addr := uint32(segment.Base)<<4 + uint32(offset)
-
-	return addr
-}
-
-func (core *CpuCore) SegmentAddressToLinearAddress32(segment SegmentRegister, offset uint32) uint32 {
-
-	// Determine the base address of the segment
-	if core.flags.MemorySegmentOverride > 0 {
-		switch core.flags.MemorySegmentOverride {
-		case common.SEGMENT_CS:
-			return uint32(core.registers.CS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_SS:
-			return uint32(core.registers.SS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_DS:
-			return uint32(core.registers.DS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_ES:
-			return uint32(core.registers.ES.Base)<<4 + uint32(offset)
-		case common.SEGMENT_FS:
-			return uint32(core.registers.FS.Base)<<4 + uint32(offset)
-		case common.SEGMENT_GS:
-			return uint32(core.registers.GS.Base)<<4 + uint32(offset)
-		default:
-			panic("Unhandled segment register override")
-		}
-	}
-
-	addr := uint32(segment.Base)<<4 + uint32(offset)
-
-	return addr
+	return core.linearAddress(&segment, uint32(offset))
 }
 
 // Returns the address in memory of the instruction currently executing.
@@ -326,6 +349,14 @@ func (core *CpuCore) GetCurrentlyExecutingInstructionAddress() uint32 {
 
 func (core *CpuCore) Step() {
 
+	if core.halt != HALT_NONE {
+		// a halted processor only wakes for an interrupt, and a shut down one not even for that
+		if core.halt == HALT_HLT && core.serviceInterrupt() {
+			core.halt = HALT_NONE
+		}
+		return
+	}
+
 	core.currentByteAddr = core.GetCurrentCodePointer()
 	tmp := core.currentByteAddr
 	if core.currentByteAddr == core.lastExecutedInstructionPointer {
@@ -336,185 +367,93 @@ func (core *CpuCore) Step() {
 
 	core.currentByteDecodeStart = core.currentByteAddr
 
+	if core.instructionBreakpoint() {
+		return
+	}
+	core.debugTrap = 0
+	if core.registers.EFLAGS&TrapFlag != 0 {
+		// TF as the instruction starts decides whether it single steps, POPF can't take it back
+		core.debugTrap = DR6_BS
+	}
+
+	if core.profiler != nil {
+		core.profiler.beginStep(core)
+	}
+
 	status := core.decodeInstruction()
 
+	if core.profiler != nil {
+		core.profiler.endStep(core)
+	}
+
 	if status != 0 {
 		panic(0)
 	}
 	core.lastExecutedInstructionPointer = tmp
+	core.instructionCount++
+	core.deliverDebugTraps()
 
 	if core.interruptEnableDelay > 0 {
+		// STI takes effect after the instruction that follows it
 		core.interruptEnableDelay--
-		if core.interruptEnableDelay == 0 {
-			// Now actually check for pending interrupts
-			core.checkInterrupts()
-		}
+	} else {
+		core.serviceInterrupt()
 	}
 
 }
 
+// Stopped reports whether the processor has stopped for good, and why: shut down by a triple
+// fault, or halted with interrupts disabled so that nothing can wake it
+func (core *CpuCore) Stopped() (bool, string) {
+	switch {
+	case core.halt == HALT_SHUTDOWN:
+		return true, "shut down after a triple fault"
+	case core.halt == HALT_HLT && !core.registers.GetFlag(InterruptFlag):
+		return true, "halted with interrupts disabled"
+	}
+	return false, ""
+}
+
+// GetInstructionCount returns the number of instructions executed since power on
+func (core *CpuCore) GetInstructionCount() uint64 {
+	return core.instructionCount
+}
+
 func (core *CpuCore) FriendlyPartName() string {
 	if core.partId == common.MODULE_PRIMARY_PROCESSOR {
 		return "PRIMARY PROCESSOR"
 	}
 
-	if core.partId == common.MODULE_MATH_CO_PROCESSOR {
-		return "MATH CO PROCESSOR"
-	}
-
 	return "Unknown"
 }
-func (core *CpuCore) getEffectiveAddress8(modrm *ModRm) (uint32, string) {
-	var addr uint32
-	var addrDesc string
-
-	// Compute the effective address based on the mod and rm fields
-	switch modrm.mod {
-	case 0:
-		if modrm.rm == 6 { // Special case for 16-bit displacement when rm = 6
-			addr = uint32(modrm.disp16)
-			addrDesc = fmt.Sprintf("Disp16 [0x%X]", modrm.disp16)
-		} else {
-			addr = *core.registers.registers32Bit[modrm.rm] // Using 32-bit register for simplification in handling
-			addrDesc = fmt.Sprintf("[%s]", core.registers.index8ToString(modrm.rm))
-		}
-	case 1: // 8-bit displacement added to the register
-		addr = *core.registers.registers32Bit[modrm.rm] + uint32(int32(int8(modrm.disp8)))
-		addrDesc = fmt.Sprintf("[%s + 0x%X]", core.registers.index8ToString(modrm.rm), int8(modrm.disp8))
-	case 2: // 16-bit displacement added to the register
-		addr = *core.registers.registers32Bit[modrm.rm] + uint32(modrm.disp16)
-		addrDesc = fmt.Sprintf("[%s + 0x%X]", core.registers.index8ToString(modrm.rm), modrm.disp16)
-	case 3: // Register direct mode, no memory addressing involved
-		addr = 0 // No effective memory address
-		addrDesc = fmt.Sprintf("Register %s directly", core.registers.index8ToString(modrm.rm))
-	}
-
-	return addr, addrDesc
-}
-
-// define addressing mode constants
-const (
-	ADR_TYPE_DIRECT = iota
-	ADR_TYPE_INDIRECT
-	ADR_TYPE_BASE_INDEX
-	ADR_TYPE_BASE_INDEX_DISP8
-	ADR_TYPE_BASE_INDEX_DISP16
-	ADR_TYPE_BASE_INDEX_DISP32
-)
 
-func (core *CpuCore) getEffectiveAddress16(modrm *ModRm) (uint16, string, uint8) {
-	var addr uint16
-	var addrDesc string
-	addrMode := ADR_TYPE_DIRECT
-
-	if modrm.mod == 3 {
-		// Direct register operand
-		addr = *core.registers.registers16Bit[modrm.rm]
-		addrDesc = core.registers.index16ToString(modrm.rm)
-		addrMode = ADR_TYPE_DIRECT
-	} else if modrm.mod != 3 && modrm.rm == 4 { // SIB byte is present
-		baseAddr := *core.registers.registers16Bit[modrm.base]
-		indexValue := *core.registers.registers16Bit[modrm.index] * (1 << modrm.scale)
-
-		// Compute the effective address based on mod value
-		switch modrm.mod {
-		case 0:
-			if modrm.base == 5 { // Special case, base is absent, only displacement
-				addr = modrm.disp16
-				addrDesc = fmt.Sprintf("Disp16 [0x%X]", modrm.disp16) // Corrected to Disp16
-				addrMode = ADR_TYPE_INDIRECT
-			} else {
-				addr = baseAddr + indexValue
-				addrDesc = fmt.Sprintf("[%s + %s*%d]", core.registers.index16ToString(modrm.base), core.registers.index16ToString(modrm.index), 1<<modrm.scale)
-				addrMode = ADR_TYPE_BASE_INDEX
-			}
-		case 1:
-			addr = baseAddr + indexValue + uint16(int16(int8(modrm.disp8)))
-			addrDesc = fmt.Sprintf("[%s + %s*%d + 0x%X]", core.registers.index16ToString(modrm.base), core.registers.index16ToString(modrm.index), 1<<modrm.scale, int8(modrm.disp8))
-			addrMode = ADR_TYPE_BASE_INDEX_DISP8
-		case 2:
-			addr = baseAddr + indexValue + modrm.disp16
-			addrDesc = fmt.Sprintf("[%s + %s*%d + 0x%X]", core.registers.index16ToString(modrm.base), core.registers.index16ToString(modrm.index), 1<<modrm.scale, modrm.disp16) // Corrected to modrm.disp16
-			addrMode = ADR_TYPE_BASE_INDEX_DISP16
-		}
-	} else {
-		// No SIB byte, direct register addressing or displacement
-		switch modrm.mod {
-		case 0:
-			if modrm.rm == 6 { // Displacement-only addressing
-				addr = modrm.disp16
-				addrDesc = fmt.Sprintf("Disp16 [0x%X]", modrm.disp16)
-				addrMode = ADR_TYPE_INDIRECT
-			} else {
-				addr = *core.registers.registers16Bit[modrm.rm]
-				addrDesc = fmt.Sprintf("[%s]", core.registers.index16ToString(modrm.rm))
-				addrMode = ADR_TYPE_DIRECT
-			}
-		case 1:
-			addr = *core.registers.registers16Bit[modrm.rm] + uint16(int16(int8(modrm.disp8)))
-			addrDesc = fmt.Sprintf("[%s + 0x%X]", core.registers.index16ToString(modrm.rm), int8(modrm.disp8))
-			addrMode = ADR_TYPE_BASE_INDEX_DISP8
-		case 2:
-			addr = *core.registers.registers16Bit[modrm.rm] + modrm.disp16
-			addrDesc = fmt.Sprintf("[%s + 0x%X]", core.registers.index16ToString(modrm.rm), modrm.disp16)
-			addrMode = ADR_TYPE_BASE_INDEX_DISP16
-		}
+// fetchCode reads size bits of the instruction stream at linear address addr. The bytes must lie
+// within the code segment's limit, fetching past it is a #GP.
+func (core *CpuCore) fetchCode(addr uint32, size uint8) (uint32, error) {
+	offset := addr - core.registers.CS.Base
+	last := offset + uint32(size/8) - 1
+	if last > core.registers.CS.Limit || last < offset {
+		return 0, core.fault(EXCEPTION_GP, 0)
 	}
-
-	return addr, addrDesc, uint8(addrMode)
+	return core.readMemory(addr, size)
 }
 
-func (core *CpuCore) getEffectiveAddress32(modrm *ModRm) (uint32, string) {
-	var addr uint32
-	var addrDesc string
-
-	// Check for SIB byte usage
-	if modrm.mod != 3 && modrm.rm == 4 { // SIB byte is present
-		baseAddr := *core.registers.registers32Bit[modrm.base]
-		indexValue := *core.registers.registers32Bit[modrm.index] * (1 << modrm.scale)
+func (core *CpuCore) fetchCode8(addr uint32) (uint8, error) {
+	value, err := core.fetchCode(addr, 8)
+	return uint8(value), err
+}
 
-		// Compute the effective address based on mod value
-		switch modrm.mod {
-		case 0:
-			if modrm.base == 5 { // Special case, base is absent, only displacement
-				addr = modrm.disp32
-				addrDesc = fmt.Sprintf("Disp32 [0x%X]", modrm.disp32)
-			} else {
-				addr = baseAddr + indexValue
-				addrDesc = fmt.Sprintf("[%s + %s*%d]", core.registers.index32ToString(modrm.base), core.registers.index32ToString(modrm.index), 1<<modrm.scale)
-			}
-		case 1:
-			addr = baseAddr + indexValue + uint32(int32(int8(modrm.disp8)))
-			addrDesc = fmt.Sprintf("[%s + %s*%d + 0x%X]", core.registers.index32ToString(modrm.base), core.registers.index32ToString(modrm.index), 1<<modrm.scale, int8(modrm.disp8))
-		case 2:
-			addr = baseAddr + indexValue + modrm.disp32
-			addrDesc = fmt.Sprintf("[%s + %s*%d + 0x%X]", core.registers.index32ToString(modrm.base), core.registers.index32ToString(modrm.index), 1<<modrm.scale, modrm.disp32)
-		}
-	} else {
-		// No SIB byte, direct register addressing or displacement
-		switch modrm.mod {
-		case 0:
-			if modrm.rm == 5 { // Displacement-only addressing
-				addr = modrm.disp32
-				addrDesc = fmt.Sprintf("Disp32 [0x%X]", modrm.disp32)
-			} else {
-				addr = *core.registers.registers32Bit[modrm.rm]
-				addrDesc = fmt.Sprintf("[%s]", core.registers.index32ToString(modrm.rm))
-			}
-		case 1:
-			addr = *core.registers.registers32Bit[modrm.rm] + uint32(int32(int8(modrm.disp8)))
-			addrDesc = fmt.Sprintf("[%s + 0x%X]", core.registers.index32ToString(modrm.rm), int8(modrm.disp8))
-		case 2:
-			addr = *core.registers.registers32Bit[modrm.rm] + modrm.disp32
-			addrDesc = fmt.Sprintf("[%s + 0x%X]", core.registers.index32ToString(modrm.rm), modrm.disp32)
-		}
-	}
+func (core *CpuCore) fetchCode16(addr uint32) (uint16, error) {
+	value, err := core.fetchCode(addr, 16)
+	return uint16(value), err
+}
 
-	return addr, addrDesc
+func (core *CpuCore) fetchCode32(addr uint32) (uint32, error) {
+	return core.fetchCode(addr, 32)
 }
 
 func (core *CpuCore) readImm8() (uint8, error) {
-	retVal, err := core.memoryAccessController.ReadMemoryValue8(uint32(core.currentByteAddr))
+	retVal, err := core.fetchCode8(core.currentByteAddr)
 	if err != nil {
 		return 0, err
 	}
@@ -523,7 +462,7 @@ func (core *CpuCore) readImm8() (uint8, error) {
 }
 
 func (core *CpuCore) readImm16() (uint16, error) {
-	retVal, err := core.memoryAccessController.ReadMemoryValue16(uint32(core.currentByteAddr))
+	retVal, err := core.fetchCode16(core.currentByteAddr)
 	if err != nil {
 		return 0, err
 	}
@@ -532,7 +471,7 @@ func (core *CpuCore) readImm16() (uint16, error) {
 }
 
 func (core *CpuCore) readImm32() (uint32, error) {
-	retVal, err := core.memoryAccessController.ReadMemoryValue32(uint32(core.currentByteAddr))
+	retVal, err := core.fetchCode32(core.currentByteAddr)
 	if err != nil {
 		return 0, err
 	}
@@ -540,160 +479,15 @@ func (core *CpuCore) readImm32() (uint32, error) {
 	return retVal, nil
 }
 
-func (core *CpuCore) readRm8(modrm *ModRm) (*uint8, string, error) {
-	if modrm.mod == 3 {
-		// Directly accessing the register when Mod = 3
-		dest := core.registers.registers8Bit[modrm.rm]
-		destName := core.registers.index8ToString(modrm.rm)
-		return dest, destName, nil
-	} else {
-		// Calculating the effective address when accessing memory
-		addr, addrDesc := core.getEffectiveAddress8(modrm)
-
-		// Reading the value from memory using the calculated address
-		destValue, err := core.memoryAccessController.ReadMemoryValue8(addr)
-		if err != nil {
-			return nil, "", err // Properly return nil and error if the read fails
-		}
-
-		// Updating the address description to be more informative
-		destName := fmt.Sprintf("Memory at %s", addrDesc)
-		return &destValue, destName, nil
-	}
-}
-
-func (core *CpuCore) readRm16(modrm *ModRm) (*uint16, string, error) {
-	if modrm.mod == 3 {
-		// Direct register access when Mod is 3
-		dest := core.registers.registers16Bit[modrm.rm] // Direct pointer to the register
-		destName := core.registers.index16ToString(modrm.rm)
-		return dest, destName, nil
-	} else {
-		// Calculate the effective address when accessing memory
-		addr, addrDesc := core.getEffectiveAddress32(modrm)
-
-		// Read the 16-bit value from memory
-		destValue, err := core.memoryAccessController.ReadMemoryValue16(addr)
-		if err != nil {
-			return nil, "", err // Handle error by returning nil and the error
-		}
-
-		// Update the destination name to be more descriptive
-		return &destValue, addrDesc, nil
-	}
-}
-
-func (core *CpuCore) readRm32(modrm *ModRm) (*uint32, string, error) {
-	if modrm.mod == 3 {
-		// Direct register access when Mod is 3
-		dest := core.registers.registers32Bit[modrm.rm] // Direct pointer to the register
-		destName := core.registers.index32ToString(modrm.rm)
-		return dest, destName, nil
-	} else {
-		// Calculate the effective address when accessing memory
-		addr, addrDesc := core.getEffectiveAddress32(modrm)
-
-		// Read the 16-bit value from memory
-		destValue, err := core.memoryAccessController.ReadMemoryValue32(addr)
-		if err != nil {
-			return nil, "", err // Handle error by returning nil and the error
-		}
-
-		// Update the destination name to be more descriptive
-		destName := fmt.Sprintf("Memory at %s", addrDesc)
-		return &destValue, destName, nil
-	}
-}
-
-func (core *CpuCore) readR8(modrm *ModRm) (*uint8, string) {
-	dest := core.registers.registers8Bit[modrm.reg]
-	dstName := core.registers.index8ToString(modrm.reg)
-	return dest, dstName
-}
-
-func (core *CpuCore) readR16(modrm *ModRm) (*uint16, string) {
-	dest := core.registers.registers16Bit[modrm.reg]
-	dstName := core.registers.index16ToString(modrm.reg)
-	return dest, dstName
-
-}
-
-func (core *CpuCore) writeRm8(modrm *ModRm, value *uint8) (string, error) {
-	var destName string
-	var addr uint32
-	if modrm.mod == 3 {
-		// Direct register access when Mod is 3
-		*core.registers.registers8Bit[modrm.rm] = *value
-	} else {
-		// Calculate the effective address when accessing memory
-		addr, destName = core.getEffectiveAddress32(modrm) // Discard the address description here as it's not used
-
-		// Write the 8-bit value to memory
-		err := core.memoryAccessController.WriteMemoryAddr8(uint32(addr), *value)
-		if err != nil {
-			return destName, err // Properly return the error
-		}
-	}
-
-	return destName, nil // Return nil explicitly when no error occurs
-}
-
-func (core *CpuCore) writeRm16(modrm *ModRm, value *uint16) (string, error) {
-	var destName string
-	var addr uint32
-	if modrm.mod == 3 {
-		// Direct register access when Mod is 3
-		*core.registers.registers16Bit[modrm.rm] = *value
-		destName = core.registers.index16ToString(modrm.rm)
-	} else {
-		// Calculate the effective address when accessing memory
-		addr, destName = core.getEffectiveAddress32(modrm) // Discard the address description here as it's not used
-
-		// Write the 16-bit value to memory
-		err := core.memoryAccessController.WriteMemoryAddr16(uint32(addr), *value)
-		if err != nil {
-			return destName, err // Properly return the error
-		}
-	}
-
-	return destName, nil // Return nil explicitly when no error occurs
-}
-
-func (core *CpuCore) writeRm32(modrm *ModRm, value *uint32) error {
-	if modrm.mod == 3 {
-		// Direct register access when Mod is 3
-		*core.registers.registers32Bit[modrm.rm] = *value
-	} else {
-		// Calculate the effective address when accessing memory
-		addr, _ := core.getEffectiveAddress32(modrm) // Discard the address description here as it's not used
-
-		// Write the 16-bit value to memory
-		err := core.memoryAccessController.WriteMemoryAddr32(uint32(addr), *value)
-		if err != nil {
-			return err // Properly return the error
-		}
-	}
-
-	return nil // Return nil explicitly when no error occurs
-}
-
-func (core *CpuCore) writeR8(modrm *ModRm, value *uint8) {
-	*core.registers.registers8Bit[modrm.reg] = *value
-}
-
-func (core *CpuCore) writeR16(modrm *ModRm, value *uint16) {
-	*core.registers.registers16Bit[modrm.reg] = *value
-}
-
-func (core *CpuCore) SetFlag(mask uint16, status bool) {
+func (core *CpuCore) SetFlag(mask uint32, status bool) {
 	core.registers.SetFlag(mask, status)
 }
 
-func (core *CpuCore) GetFlag(mask uint16) bool {
+func (core *CpuCore) GetFlag(mask uint32) bool {
 	return core.registers.GetFlag(mask)
 }
 
-func (core *CpuCore) GetFlagInt(mask uint16) uint16 {
+func (core *CpuCore) GetFlagInt(mask uint32) uint32 {
 	return core.registers.GetFlagInt(mask)
 }
 
@@ -701,61 +495,31 @@ func (core *CpuCore) GetRegisters() *CpuRegisters {
 	return core.registers
 }
 
-func (core *CpuCore) writeSegmentRegister(register *SegmentRegister, value uint32) {
-	if core.flags.MemorySegmentOverride > 0 {
-		// default segment override
-		switch core.flags.MemorySegmentOverride {
-		case common.SEGMENT_CS:
-			core.registers.CS.Base = value
-		case common.SEGMENT_SS:
-			core.registers.SS.Base = value
-		case common.SEGMENT_DS:
-			core.registers.DS.Base = value
-		case common.SEGMENT_ES:
-			core.registers.ES.Base = value
-		case common.SEGMENT_FS:
-			core.registers.FS.Base = value
-		case common.SEGMENT_GS:
-			core.registers.GS.Base = value
-		default:
-			panic("Unhandled segment register override")
-		}
-	}
-
-	register.Base = value
-
-}
-
 func (cpuCore *CpuCore) logInstruction(logMessage string, a ...any) {
-	// encode logMessage to utf-8 bytes
+	// this runs for every instruction, so skip formatting when nothing is listening
+	line := &cpuCore.bus.Signals().InstructionLog
+	if !line.Connected() {
+		return
+	}
 
 	if len(a) > 0 {
-		logMessage = fmt.Sprintf(logMessage, a)
+		logMessage = fmt.Sprintf(logMessage, a...)
 	}
-	logMessageString := fmt.Sprintf("[op=%#04x]"+logMessage, cpuCore.currentOpCodeBeingExecuted)
-
-	// encode logMessage to utf-8 bytes
-	logMessageBytes := []byte(logMessageString)
-
-	cpuCore.bus.SendMessageToAll(common.MODULE_DEBUG_MONITOR, bus.BusMessage{Subject: common.MESSAGE_GLOBAL_CPU_INSTRUCTION_LOG, Data: logMessageBytes})
+	logMessageString := fmt.Sprintf("[op=%#04x]", cpuCore.currentOpCodeBeingExecuted)
+	if cpuCore.symbols.Len() > 0 {
+		logMessageString = fmt.Sprintf("[op=%#04x %s]", cpuCore.currentOpCodeBeingExecuted, cpuCore.symbolize(cpuCore.currentByteDecodeStart))
+	}
+	line.Drive(logMessageString + logMessage)
 }
 
 func (cpuCore *CpuCore) logDebug(logMessage string) {
-	// encode logMessage to utf-8 bytes
-	logMessageBytes := []byte(logMessage)
-
-	cpuCore.bus.SendMessageToAll(common.MODULE_DEBUG_MONITOR, bus.BusMessage{Subject: common.MESSAGE_GLOBAL_DEBUG_MESSAGE_LOG, Data: logMessageBytes})
+	cpuCore.bus.Signals().DebugLog.Drive(logMessage)
 }
 
 func (core *CpuCore) SetMemoryAccessController(controller *memmap.MemoryAccessController) {
 	core.memoryAccessController = controller
 }
 
-func (core *CpuCore) shadowBios() {
-
-	core.memoryAccessController.InitShadowBios()
-}
-
 func (core *CpuCore) GetRegister16(register *uint16) (uint32, string, uint8) {
 
 	var registerIndex uint8
@@ -766,18 +530,13 @@ func (core *CpuCore) GetRegister16(register *uint16) (uint32, string, uint8) {
 		}
 	}
 
-	if core.flags.OperandSizeOverrideEnabled {
-		// find the index of the pointer address in registers16Bit
-		return *core.registers.registers32Bit[registerIndex], core.registers.index32ToString(uint8(registerIndex)), 32
-
-	} else {
-		return uint32(*core.registers.registers16Bit[registerIndex]), core.registers.index16ToString(uint8(registerIndex)), 16
-	}
+	value, name := core.readReg(registerIndex, core.operandSize())
+	return value, name, core.operandSize()
 }
 
 func (core *CpuCore) SetRegister16(registerIndex uint8, value uint16) (string, error) {
 
-	core.registers.registers16Bit[registerIndex] = &value
+	*core.registers.registers16Bit[registerIndex] = value
 	return core.registers.index16ToString(registerIndex), nil
 }
 
@@ -791,27 +550,17 @@ func (core *CpuCore) GetRegister32(register *uint32) (uint32, string, uint8) {
 		}
 	}
 
-	if !core.flags.OperandSizeOverrideEnabled {
-		// find the index of the pointer address in registers16Bit
-		return *core.registers.registers32Bit[registerIndex], core.registers.index32ToString(uint8(registerIndex)), 32
-	} else {
-		return uint32(*core.registers.registers16Bit[registerIndex]), core.registers.index16ToString(uint8(registerIndex)), 16
-	}
+	return *core.registers.registers32Bit[registerIndex], core.registers.index32ToString(uint8(registerIndex)), 32
 }
 
 func (core *CpuCore) SetRegister32(registerIndex uint8, value uint32) (string, error) {
-	core.registers.registers32Bit[registerIndex] = &value
+	*core.registers.registers32Bit[registerIndex] = value
 	return core.registers.index32ToString(registerIndex), nil
 }
 
 func (core *CpuCore) GetImmediate16() (uint32, uint8, error) {
-	if core.flags.OperandSizeOverrideEnabled {
-		imm32, err := core.readImm32()
-		return imm32, 32, err
-	} else {
-		imm16, err := core.readImm16()
-		return uint32(imm16), 16, err
-	}
+	immediate, err := core.readImm(core.operandSize())
+	return immediate, core.operandSize(), err
 }
 
 func (core *CpuCore) updateSystemFlags(cr0 uint32) {
@@ -879,31 +628,16 @@ func (core *CpuCore) DisableWriteProtection() {
 
 func (core *CpuCore) EnableNumericError() {
 	log.Printf("Numeric error enabled")
+	if core.mathCoProcessor != nil {
+		core.mathCoProcessor.SetNativeErrorReporting(true)
+	}
 }
 
 func (core *CpuCore) DisableNumericError() {
 	log.Printf("Numeric error disabled")
-}
-
-func (device *CpuCore) getSegmentOverride() SegmentRegister {
-	if device.flags.MemorySegmentOverride > 0 {
-		switch device.flags.MemorySegmentOverride {
-		case common.SEGMENT_CS:
-			return device.registers.CS
-		case common.SEGMENT_SS:
-			return device.registers.SS
-		case common.SEGMENT_DS:
-			return device.registers.DS
-		case common.SEGMENT_ES:
-			return device.registers.ES
-		case common.SEGMENT_FS:
-			return device.registers.FS
-		case common.SEGMENT_GS:
-			return device.registers.GS
-		}
+	if core.mathCoProcessor != nil {
+		core.mathCoProcessor.SetNativeErrorReporting(false)
 	}
-
-	return device.registers.CS
 }
 
 func (device *CpuCore) dumpAndExit() {
@@ -911,7 +645,13 @@ func (device *CpuCore) dumpAndExit() {
 	os.Exit(1)
 }
 
+// INSTR_HLT stops the processor until an interrupt arrives. (E)IP moves past the hlt first, so
+// the interrupt returns to the instruction after it.
 func INSTR_HLT(core *CpuCore) {
-	core.halt = true
+	core.currentByteAddr++
+	if core.checkPrivilege() != nil {
+		return
+	}
+	core.halt = HALT_HLT
 	core.logInstruction(fmt.Sprintf("[%#04x] HLT", core.GetCurrentlyExecutingInstructionAddress()))
 }
@@ -2,537 +2,388 @@ package intel8086
 
 import (
 	"fmt"
-	"github.com/andrewjc/threeatesix/common"
+	"log"
 )
 
-func INSTR_CALL_M16(core *CpuCore) {
-	modrm, _, err := core.consumeModRm()
-	if err != nil {
-		core.logInstruction(fmt.Sprintf("Error reading ModR/M byte: %s", err))
-		return
+/*
+	Branches
+	Relative branches read their displacement straight after the opcode rather than through
+	currentByteAddr, so a handler can also be run on its own. Every branch places (E)IP itself, and
+	sets IsFarJump so the decoder doesn't then advance it past the instruction. The operand size
+	picks between rel16 and rel32 displacements and, for near branches, truncates the target to
+	16 bits when it is 16.
+*/
+
+// readBranchOperand reads the operand following a branch opcode and returns it with the
+// offset of the next instruction
+func (core *CpuCore) readBranchOperand(size uint8) (uint32, uint32, error) {
+	length := uint32(len(core.currentPrefixBytes)) + 1
+	value, err := core.fetchCode(core.GetCurrentCodePointer()+length, size)
+	return value, *core.registers.EIP() + length + uint32(size/8), err
+}
+
+// nextInstructionPointer is the offset of the instruction after the one being executed, for
+// handlers that have consumed their operands through currentByteAddr
+func (core *CpuCore) nextInstructionPointer() uint32 {
+	return *core.registers.EIP() + core.currentByteAddr - core.currentByteDecodeStart
+}
+
+// jumpNear loads (E)IP with target, truncated to 16 bits with a 16 bit operand size
+func (core *CpuCore) jumpNear(target uint32) {
+	if !core.Is32BitOperand() {
+		target &= 0xFFFF
 	}
+	core.setInstructionPointer(target)
+	core.flags.IsFarJump = true
+}
 
-	addr, addrName, err := core.readRm16(&modrm)
+// jumpFar loads CS and (E)IP. CS is loaded first so that a fault leaves both unchanged. A TSS or
+// task gate selector switches tasks instead, and the outgoing task will resume at next. A call
+// gate selector jumps to the gate's target.
+func (core *CpuCore) jumpFar(segment uint16, target uint32, next uint32) error {
+	if switched, err := core.taskTransfer(segment, TASK_SWITCH_JMP, next); switched || err != nil {
+		core.flags.IsFarJump = true
+		return err
+	}
+	if gated, err := core.callGateTransfer(segment, false, next); gated || err != nil {
+		core.flags.IsFarJump = true
+		return err
+	}
+	cs, err := core.farTarget(segment)
 	if err != nil {
-		core.logInstruction(fmt.Sprintf("Error reading address: %s", err))
-		return
+		return err
 	}
+	core.enterCodeSegment(cs, core.cpl())
+	core.setInstructionPointer(target)
+	core.flags.IsFarJump = true
+	return nil
+}
 
-	stackPush16(core, uint16(core.GetIP()+2))
-	core.registers.IP = uint16(*addr)
-	core.logInstruction(fmt.Sprintf("[%#04x] CALL %s (%#04x)", core.GetCurrentlyExecutingInstructionAddress(), addrName, uint16(*addr)))
+// condition evaluates the condition encoded in the low nibble of a Jcc opcode. Odd
+// conditions are the negation of the even condition before them.
+func (core *CpuCore) condition(cc uint8) (bool, string) {
+	var taken bool
+	cc &= 0xF
+	switch cc >> 1 {
+	case 0:
+		taken = core.registers.GetFlag(OverFlowFlag)
+	case 1:
+		taken = core.registers.GetFlag(CarryFlag)
+	case 2:
+		taken = core.registers.GetFlag(ZeroFlag)
+	case 3:
+		taken = core.registers.GetFlag(CarryFlag) || core.registers.GetFlag(ZeroFlag)
+	case 4:
+		taken = core.registers.GetFlag(SignFlag)
+	case 5:
+		taken = core.registers.GetFlag(ParityFlag)
+	case 6:
+		taken = core.registers.GetFlag(SignFlag) != core.registers.GetFlag(OverFlowFlag)
+	case 7:
+		taken = core.registers.GetFlag(ZeroFlag) || core.registers.GetFlag(SignFlag) != core.registers.GetFlag(OverFlowFlag)
+	}
+	names := [16]string{"JO", "JNO", "JB", "JNB", "JZ", "JNZ", "JBE", "JA", "JS", "JNS", "JPE", "JPO", "JL", "JGE", "JLE", "JG"}
+	return taken != (cc&1 == 1), names[cc]
 }
 
-func INSTR_CALL_RM16(core *CpuCore) {
-	core.currentByteAddr++
-	modrm, _, err := core.consumeModRm()
-	core.currentByteAddr--
+// INSTR_JCC_SHORT_REL8 runs the conditional jumps 70-7F
+func INSTR_JCC_SHORT_REL8(core *CpuCore) {
+	offset, next, err := core.readBranchOperand(8)
 	if err != nil {
-		core.logInstruction("Error reading modrm: %s", err.Error())
-		doCoreDump(core)
-		panic(0)
+		return
 	}
+	core.conditionalJump(next, next+signExtend(offset, 8), "SHORT REL8")
+}
 
-	addr, addrName, err := core.readRm16(&modrm)
+// INSTR_JCC_NEAR_REL runs the conditional jumps 0F 80-8F, with a rel16 or rel32 displacement
+func INSTR_JCC_NEAR_REL(core *CpuCore) {
+	size := core.operandSize()
+	offset, next, err := core.readBranchOperand(size)
 	if err != nil {
-		core.logInstruction("Error reading address: %s", err.Error())
-		doCoreDump(core)
-		panic(0)
+		return
 	}
-
-	stackPush16(core, uint16(core.GetIP()+2))
-	core.registers.IP = uint16(*addr)
-	core.logInstruction(fmt.Sprintf("[%#04x] CALL %s (%#04x)", core.GetCurrentlyExecutingInstructionAddress(), addrName, uint16(*addr)))
+	core.conditionalJump(next, next+signExtend(offset, size), "NEAR REL")
 }
 
-func INSTR_DEC_COUNT_JMP_SHORT(core *CpuCore) {
+func (core *CpuCore) conditionalJump(next uint32, destAddr uint32, form string) {
+	taken, mnemonic := core.condition(core.currentOpCodeBeingExecuted)
+	if taken {
+		core.jumpNear(destAddr)
+		core.logInstruction(fmt.Sprintf("[%#04x] %s %#04x (%s) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, destAddr, form))
+	} else {
+		core.jumpNear(next)
+		core.logInstruction(fmt.Sprintf("[%#04x] %s %#04x (%s) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, destAddr, form))
+	}
+}
 
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// INSTR_LOOP decrements CX, or ECX with a 32 bit address size, and jumps while it is non zero.
+// LOOPNE (E0) also needs ZF clear and LOOPE (E1) ZF set. The flags are left alone.
+func INSTR_LOOP(core *CpuCore) {
+	offset, next, err := core.readBranchOperand(8)
 	if err != nil {
 		return
 	}
+	destAddr := next + signExtend(offset, 8)
 
-	var destAddr = uint16(core.registers.IP + 2)
-	destAddr += uint16(offset) // Correctly calculate destination address
-
-	term1 := uint16(core.registers.CX)
-	result := term1 - 1 // Decrement CX
-	core.registers.CX = result
+	size := core.addressSize()
+	count, _ := core.readReg(REG_ECX, size)
+	count = (count - 1) & sizeMask(size)
+	core.writeReg(REG_ECX, size, count)
 
-	// Update flags
-	dataSize := uint16(16) // Assuming CX is a 16-bit register
-	sign1 := int16(term1 >> (dataSize - 1))
-	signr := int16((result >> (dataSize - 1)) & 0x01)
-
-	core.registers.SetFlag(CarryFlag, result > term1) // Set if borrow occurs
-
-	core.registers.SetFlag(ZeroFlag, result == 0)
-
-	core.registers.SetFlag(SignFlag, signr == 1)
-
-	core.registers.SetFlag(OverFlowFlag, (sign1 == 0) && (signr == 1)) // Set if result exceeds maximum negative value
-
-	silenceLogging := false
-	if core.lastExecutedInstructionPointer == core.GetCurrentlyExecutingInstructionAddress() {
-		silenceLogging = true
+	taken := count != 0
+	mnemonic := "LOOP"
+	switch core.currentOpCodeBeingExecuted {
+	case 0xE0:
+		taken, mnemonic = taken && !core.registers.GetFlag(ZeroFlag), "LOOPNE"
+	case 0xE1:
+		taken, mnemonic = taken && core.registers.GetFlag(ZeroFlag), "LOOPE"
 	}
 
+	// a tight loop would otherwise log every iteration
+	silenceLogging := core.lastExecutedInstructionPointer == core.GetCurrentlyExecutingInstructionAddress()
 	if !silenceLogging {
-		core.logInstruction(fmt.Sprintf("[%#04x] LOOP %#04x (SHORT REL8)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+		core.logInstruction(fmt.Sprintf("[%#04x] %s %#04x (SHORT REL8)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, destAddr))
 	}
-	if result != 0 {
-		core.registers.IP = uint16(destAddr)
+	if taken {
+		core.jumpNear(destAddr)
 		if !silenceLogging {
-			core.logInstruction(fmt.Sprintf("[%#04x]   |-> jumped (CX %#04x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.CX))
+			core.logInstruction(fmt.Sprintf("[%#04x]   |-> jumped (CX %#04x)", core.GetCurrentlyExecutingInstructionAddress(), count))
 		}
 	} else {
-		core.registers.IP += 2
+		core.jumpNear(next)
 		if !silenceLogging {
-			core.logInstruction(fmt.Sprintf("[%#04x]   |-> not jumped (CX %#04x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.CX))
+			core.logInstruction(fmt.Sprintf("[%#04x]   |-> not jumped (CX %#04x)", core.GetCurrentlyExecutingInstructionAddress(), count))
 		}
 	}
-
 }
 
-func INSTR_DEC_COUNT_JMP_SHORT_Z(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// INSTR_JCXZ_SHORT_REL8 jumps when CX, or ECX with a 32 bit address size, is zero
+func INSTR_JCXZ_SHORT_REL8(core *CpuCore) {
+	offset, next, err := core.readBranchOperand(8)
 	if err != nil {
 		return
 	}
+	destAddr := next + signExtend(offset, 8)
 
-	var destAddr = uint16(core.registers.IP + 2)
-	destAddr += uint16(offset) // Correctly calculate destination address
-
-	term1 := uint16(core.registers.CX)
-	result := term1 - 1 // Decrement CX
-	core.registers.CX = result
-
-	// Update flags
-	dataSize := uint16(16) // Assuming CX is a 16-bit register
-	sign1 := int16(term1 >> (dataSize - 1))
-	signr := int16((result >> (dataSize - 1)) & 0x01)
-
-	core.registers.SetFlag(CarryFlag, result > term1) // Set if borrow occurs
-
-	core.registers.SetFlag(ZeroFlag, result == 0)
-
-	core.registers.SetFlag(SignFlag, signr == 1)
-
-	core.registers.SetFlag(OverFlowFlag, (sign1 == 0) && (signr == 1)) // Set if result exceeds maximum negative value
-
-	additional := true
-	extraStr := ""
-
-	if core.currentOpCodeBeingExecuted == 0xE0 {
-		extraStr = "ZF=0"
-		additional = !core.registers.GetFlag(ZeroFlag) // Check for not zero flag
-	}
-	if core.currentOpCodeBeingExecuted == 0xE1 {
-		extraStr = "ZF=1"
-		additional = core.registers.GetFlag(ZeroFlag) // Check for zero flag
-	}
-
-	core.logInstruction(fmt.Sprintf("[%#04x] LOOP %#04x (SHORT REL8) %s", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr), extraStr))
-	if result != 0 && additional {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x]   |-> jumped (CX %#04x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.CX))
+	if count, name := core.readReg(REG_ECX, core.addressSize()); count == 0 {
+		core.jumpNear(destAddr)
+		core.logInstruction(fmt.Sprintf("[%#04x] J%sZ %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), name, destAddr))
 	} else {
-		core.registers.IP += 2
-		core.logInstruction(fmt.Sprintf("[%#04x]   |-> not jumped (CX %#04x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.CX))
-	}
-
-}
-
-func INSTR_JMP_FAR_PTR16(core *CpuCore) {
-
-	destAddr, err := core.memoryAccessController.ReadMemoryValue16(uint32(core.GetCurrentCodePointer()) + 1)
-	if err != nil {
-		core.logInstruction(fmt.Sprintf("Error reading memory address: %s", err))
-		return
-	}
-	segment, err := core.memoryAccessController.ReadMemoryValue16(uint32(core.GetCurrentCodePointer()) + 3)
-	if err != nil {
-		core.logInstruction(fmt.Sprintf("Error reading memory address: %s", err))
-		return
-	}
-
-	core.logInstruction(fmt.Sprintf("[%#04x] JMP %#04x:%#04x (FAR_PTR16)", core.GetCurrentlyExecutingInstructionAddress(), segment, destAddr))
-	if err == nil && segment < 0xFFFF {
-		segmentBase := uint32(segment)
-		core.writeSegmentRegister(&core.registers.CS, segmentBase)
+		core.jumpNear(next)
+		core.logInstruction(fmt.Sprintf("[%#04x] J%sZ %#04x (SHORT REL8) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), name, destAddr))
 	}
-
-	core.registers.IP = uint16(destAddr)
 }
 
-func INSTR_JMP_FAR_M16(core *CpuCore) {
-
-	core.currentByteAddr++
-	modrm, bytesConsumed, err := core.consumeModRm()
+func INSTR_JMP_SHORT_REL8(core *CpuCore) {
+	offset, next, err := core.readBranchOperand(8)
 	if err != nil {
-		core.logInstruction("Error in INSTR_JMP_FAR_M16: %s\n", err)
-		return
-	}
-	core.currentByteAddr += bytesConsumed
-
-	addr, addrName, addrMode := core.getEffectiveAddress16(&modrm)
-
-	if addrMode == ADR_TYPE_DIRECT {
-		// Update both CS and IP with register
-		core.registers.IP = addr
-		// core.registers.CS.Base = uint32(segment) << 4
-		core.flags.IsFarJump = true
-
-		core.logInstruction(fmt.Sprintf("[%#04x] JMP %s (dst=%#04x:%#04x)",
-			core.GetCurrentlyExecutingInstructionAddress(), addrName, addrName))
 		return
-	} else if addrMode == ADR_TYPE_INDIRECT {
-		// Read the offset (IP) and segment (CS) from memory
-		offset, err := core.memoryAccessController.ReadMemoryValue16(uint32(addr))
-		if err != nil {
-			core.logInstruction("Error reading offset: %s", err)
-			return
-		}
-		segment, err := core.memoryAccessController.ReadMemoryValue16(uint32(addr + 2))
-		if err != nil {
-			core.logInstruction("Error reading segment: %s", err)
-			return
-		}
-		// Update both CS and IP
-		core.registers.IP = offset
-		core.registers.CS.Base = uint32(segment) << 4
-		core.flags.IsFarJump = true
-
-		core.logInstruction(fmt.Sprintf("[%#04x] JMP %s (JMP_FAR_M16) (dst=%#04x:%#04x)",
-			core.GetCurrentlyExecutingInstructionAddress(), addrName, segment, offset))
-
-	} else {
-		core.logInstruction(fmt.Sprintf("Unhandled addressing mode: %d", addrMode))
-		doCoreDump(core)
-		panic(0)
 	}
+	destAddr := next + signExtend(offset, 8)
 
+	core.logInstruction(fmt.Sprintf("[%#04x] JMP %#04x (SHORT REL8)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
+	core.jumpNear(destAddr)
 }
 
+// INSTR_JMP_NEAR_REL16 jumps by a rel16 displacement, or rel32 with a 32 bit operand size
 func INSTR_JMP_NEAR_REL16(core *CpuCore) {
-
-	offset, err := core.memoryAccessController.ReadMemoryValue16(uint32(core.GetCurrentCodePointer()) + 1)
+	size := core.operandSize()
+	offset, next, err := core.readBranchOperand(size)
 	if err != nil {
 		return
 	}
+	destAddr := next + signExtend(offset, size)
 
-	var destAddr = core.registers.IP + 3
-	destAddr2 := int32(destAddr) + int32(int16(offset))
-
-	core.logInstruction(fmt.Sprintf("[%#04x] JMP %#04x (NEAR_REL16)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr2)))
-	core.registers.IP = uint16(destAddr2)
+	core.logInstruction(fmt.Sprintf("[%#04x] JMP %#04x (NEAR_REL)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
+	core.jumpNear(destAddr)
 }
 
+// INSTR_CALL_NEAR_REL16 calls by a rel16 displacement, or rel32 with a 32 bit operand size
 func INSTR_CALL_NEAR_REL16(core *CpuCore) {
-
-	// Get the current IP and read the offset
-	currentIP := core.GetIP()
-	offset, err := core.readImm16()
-
-	// Calculate the address after the instruction and the destination address
-	nextIP := currentIP + 3                           // Size of this CALL instruction
-	destAddr := uint16(int32(nextIP) + int32(offset)) // nextIP is the base from which the offset is applied
-
-	// Push the return address (next instruction address) onto the stack
-	err = stackPush16(core, nextIP)
+	size := core.operandSize()
+	offset, next, err := core.readBranchOperand(size)
 	if err != nil {
-		core.logInstruction("Error pushing to stack: %s", err.Error())
 		return
 	}
+	destAddr := next + signExtend(offset, size)
 
-	core.logInstruction(fmt.Sprintf("[%#04x] CALL %#04x (NEAR_REL16)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	core.registers.IP = destAddr
-}
-
-func INSTR_JS_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
-	if err != nil {
+	if err := stackPush(core, size, next); err != nil {
+		core.logInstruction("Error pushing to stack: %s", err.Error())
 		return
 	}
 
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if core.registers.GetFlag(SignFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JS %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP = uint16(core.GetIP() + 2)
-		core.logInstruction(fmt.Sprintf("[%#04x] JS %#04x (SHORT REL8) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	}
+	core.logInstruction(fmt.Sprintf("[%#04x] CALL %#04x (NEAR_REL)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
+	core.jumpNear(destAddr)
+	core.pushCallFrame(false)
 }
 
-func INSTR_JNS_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
+// readFarPointer reads the ptr16:16 or ptr16:32 operand of a direct far jump or call
+func (core *CpuCore) readFarPointer() (uint16, uint32, uint32, error) {
+	offset, segmentOffset, err := core.readBranchOperand(core.operandSize())
 	if err != nil {
-		return
-	}
-
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	// Jump if NOT Sign (SignFlag is not set)
-	if !core.registers.GetFlag(SignFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JNS %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP += 2
-		core.logInstruction(fmt.Sprintf("[%#04x] JNS %#04x (SHORT REL8) (Not Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+		return 0, 0, 0, err
 	}
+	// the selector follows the offset, and the next instruction follows the selector
+	segmentAddr := core.GetCurrentCodePointer() + segmentOffset - *core.registers.EIP()
+	segment, err := core.fetchCode16(segmentAddr)
+	return segment, offset, segmentOffset + 2, err
 }
 
-func INSTR_JZ_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
+// INSTR_JMP_FAR_PTR jumps to a ptr16:16, or ptr16:32 with a 32 bit operand size
+func INSTR_JMP_FAR_PTR(core *CpuCore) {
+	segment, offset, next, err := core.readFarPointer()
 	if err != nil {
+		core.logInstruction(fmt.Sprintf("Error reading memory address: %s", err))
 		return
 	}
 
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if core.registers.GetFlag(ZeroFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JZ %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP = uint16(core.GetIP() + 2)
-		core.logInstruction(fmt.Sprintf("[%#04x] JZ %#04x (SHORT REL8) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+	core.logInstruction(fmt.Sprintf("[%#04x] JMP %#04x:%#04x (FAR_PTR)", core.GetCurrentlyExecutingInstructionAddress(), segment, offset))
+	if err := core.jumpFar(segment, offset, next); err != nil {
+		core.logInstruction("Error jumping to %#04x:%#04x: %s", segment, offset, err)
 	}
 }
 
-func INSTR_JNZ_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
+// INSTR_CALL_FAR_PTR calls a ptr16:16, or ptr16:32 with a 32 bit operand size
+func INSTR_CALL_FAR_PTR(core *CpuCore) {
+	segment, offset, next, err := core.readFarPointer()
 	if err != nil {
+		core.logInstruction(fmt.Sprintf("Error reading memory address: %s", err))
 		return
 	}
 
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if !core.registers.GetFlag(ZeroFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JNZ %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP = uint16(core.GetIP() + 2)
-		core.logInstruction(fmt.Sprintf("[%#04x] JNZ %#04x (SHORT REL8) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	}
-}
-
-func INSTR_JBE_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
+	core.logInstruction(fmt.Sprintf("[%#04x] CALL %#04x:%#04x (FAR_PTR)", core.GetCurrentlyExecutingInstructionAddress(), segment, offset))
+	called, err := core.callFar(segment, offset, next)
 	if err != nil {
+		core.logInstruction("Error calling %#04x:%#04x: %s", segment, offset, err)
 		return
 	}
-
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if core.registers.GetFlag(CarryFlag) || core.registers.GetFlag(ZeroFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JBE %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP += 2
-		core.logInstruction(fmt.Sprintf("[%#04x] JBE %#04x (SHORT REL8) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+	if called {
+		core.pushCallFrame(true)
 	}
-
 }
 
-func INSTR_JCXZ_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
-	if err != nil {
-		return
+// callFar pushes CS and the return offset next, then loads CS:(E)IP. The new CS is checked
+// before anything is pushed, so a fault leaves the stack as it was. A TSS or task gate selector
+// nests the task it names instead, and nothing is pushed, and a call gate selector calls through
+// the gate, which pushes the return address itself. It reports whether a return address was
+// pushed for a far RET to pop. A nested task returns with IRET instead, so its call is recorded
+// on the call stack the way an interrupt is.
+func (core *CpuCore) callFar(segment uint16, target uint32, next uint32) (bool, error) {
+	returnAddr := core.linearAddress(&core.registers.CS, next)
+	if switched, err := core.taskTransfer(segment, TASK_SWITCH_CALL, next); switched || err != nil {
+		core.flags.IsFarJump = true
+		if err == nil {
+			core.pushInterruptFrame(returnAddr)
+		}
+		return false, err
 	}
-
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if core.registers.CX == 0 {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JCXZ %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP += 2
-		core.logInstruction(fmt.Sprintf("[%#04x] JCXZ %#04x (SHORT REL8) (Skipped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+	if gated, err := core.callGateTransfer(segment, true, next); gated || err != nil {
+		core.flags.IsFarJump = true
+		return err == nil, err
 	}
-
-}
-
-func INSTR_JMP_SHORT_REL8(core *CpuCore) {
-
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-
+	cs, err := core.farTarget(segment)
 	if err != nil {
-		return
+		return false, err
 	}
-
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	core.logInstruction(fmt.Sprintf("[%#04x] JMP %#04x (SHORT REL8)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	core.registers.IP = uint16(destAddr)
-
-}
-
-func INSTR_JO_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-	if err != nil {
-		return
+	size := core.operandSize()
+	if err := stackPush(core, size, uint32(core.registers.CS.Selector)); err != nil {
+		return false, err
 	}
-
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if core.registers.GetFlag(OverFlowFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JO %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP += 2
-		core.logInstruction(fmt.Sprintf("[%#04x] JO %#04x (SHORT REL8) (Not Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+	if err := stackPush(core, size, next); err != nil {
+		return false, err
 	}
+	core.enterCodeSegment(cs, core.cpl())
+	core.setInstructionPointer(target)
+	core.flags.IsFarJump = true
+	return true, nil
 }
 
-func INSTR_JNO_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// readIndirectTarget reads the r/m operand of an FF group 5 jump or call, the target offset for
+// the near forms or, for the far forms, the m16:16 or m16:32 pointer in memory
+func (core *CpuCore) readIndirectTarget(far bool) (uint16, uint32, string, error) {
+	size := core.operandSize()
+	core.currentByteAddr++
+	modrm, bytesConsumed, err := core.consumeModRm()
 	if err != nil {
-		return
-	}
-
-	tmp := int16(core.registers.IP + 2)
-	destAddr := uint16(tmp + int16(offset))
-
-	if !core.registers.GetFlag(OverFlowFlag) {
-		core.registers.IP = uint16(destAddr)
-		core.logInstruction(fmt.Sprintf("[%#04x] JNO %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
-	} else {
-		core.registers.IP += 2
-		core.logInstruction(fmt.Sprintf("[%#04x] JNO %#04x (SHORT REL8) (Not Jumped)", core.GetCurrentlyExecutingInstructionAddress(), uint16(destAddr)))
+		return 0, 0, "", err
 	}
-}
+	core.currentByteAddr += bytesConsumed
 
-func INSTR_JLE_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-	if err != nil {
-		return
+	if !far {
+		offset, name, err := core.readRm(&modrm, size)
+		return 0, offset, name, err
 	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if core.registers.GetFlag(ZeroFlag) || core.registers.GetFlag(SignFlag) != core.registers.GetFlag(OverFlowFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JLE %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
+	if modrm.mod == 3 {
+		return 0, 0, "", core.fault(EXCEPTION_UD, 0)
 	}
-}
 
-func INSTR_JG_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+	segment, pointer, name := core.memoryOperand(&modrm)
+	offset, err := core.readSegment(segment, pointer, size)
 	if err != nil {
-		return
-	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if !core.registers.GetFlag(ZeroFlag) && core.registers.GetFlag(SignFlag) == core.registers.GetFlag(OverFlowFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JG %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
+		return 0, 0, name, err
 	}
+	selector, err := core.readSegment(segment, pointer+uint32(size/8), 16)
+	return uint16(selector), offset, name, err
 }
 
-func INSTR_JB_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// INSTR_JMP_NEAR_RM jumps to the offset in a register or memory, FF /4
+func INSTR_JMP_NEAR_RM(core *CpuCore) {
+	_, offset, name, err := core.readIndirectTarget(false)
 	if err != nil {
+		log.Println("Error reading JMP target:", err)
 		return
 	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if core.registers.GetFlag(CarryFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JB %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
-	}
-}
 
-func INSTR_JNB_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
-	if err != nil {
-		return
-	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if !core.registers.GetFlag(CarryFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JNB %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
-	}
+	core.logInstruction(fmt.Sprintf("[%#04x] JMP %s (dst=%#04x)", core.GetCurrentlyExecutingInstructionAddress(), name, offset))
+	core.jumpNear(offset)
 }
 
-func INSTR_JL_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// INSTR_JMP_FAR_M jumps to the far pointer in memory, FF /5
+func INSTR_JMP_FAR_M(core *CpuCore) {
+	segment, offset, name, err := core.readIndirectTarget(true)
 	if err != nil {
+		log.Println("Error reading JMP target:", err)
 		return
 	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if core.registers.GetFlag(SignFlag) != core.registers.GetFlag(OverFlowFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JL %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
+
+	core.logInstruction(fmt.Sprintf("[%#04x] JMP %s (JMP_FAR_M) (dst=%#04x:%#04x)", core.GetCurrentlyExecutingInstructionAddress(), name, segment, offset))
+	if err := core.jumpFar(segment, offset, core.nextInstructionPointer()); err != nil {
+		core.logInstruction("Error jumping to %#04x:%#04x: %s", segment, offset, err)
 	}
 }
 
-func INSTR_JGE_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// INSTR_CALL_NEAR_RM calls the offset in a register or memory, FF /2
+func INSTR_CALL_NEAR_RM(core *CpuCore) {
+	_, offset, name, err := core.readIndirectTarget(false)
 	if err != nil {
+		log.Println("Error reading CALL target:", err)
 		return
 	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if core.registers.GetFlag(SignFlag) == core.registers.GetFlag(OverFlowFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JGE %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
+	if err := stackPush(core, core.operandSize(), core.nextInstructionPointer()); err != nil {
+		core.logInstruction("Error pushing to stack: %s", err.Error())
+		return
 	}
+
+	core.logInstruction(fmt.Sprintf("[%#04x] CALL %s (%#04x)", core.GetCurrentlyExecutingInstructionAddress(), name, offset))
+	core.jumpNear(offset)
+	core.pushCallFrame(false)
 }
 
-func INSTR_JPE_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+// INSTR_CALL_FAR_M calls the far pointer in memory, FF /3
+func INSTR_CALL_FAR_M(core *CpuCore) {
+	segment, offset, name, err := core.readIndirectTarget(true)
 	if err != nil {
+		log.Println("Error reading CALL target:", err)
 		return
 	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if core.registers.GetFlag(ParityFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JPE %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
-	}
-}
 
-func INSTR_JPO_SHORT_REL8(core *CpuCore) {
-	offset, err := common.Int8Err(core.memoryAccessController.ReadMemoryValue8(uint32(core.GetCurrentCodePointer()) + 1))
+	core.logInstruction(fmt.Sprintf("[%#04x] CALL %s (CALL_FAR_M) (dst=%#04x:%#04x)", core.GetCurrentlyExecutingInstructionAddress(), name, segment, offset))
+	called, err := core.callFar(segment, offset, core.nextInstructionPointer())
 	if err != nil {
+		core.logInstruction("Error calling %#04x:%#04x: %s", segment, offset, err)
 		return
 	}
-	destAddr := uint16(int16(core.registers.IP) + 2 + int16(offset))
-	if !core.registers.GetFlag(ParityFlag) {
-		core.registers.IP = destAddr
-		core.logInstruction(fmt.Sprintf("[%#04x] JPO %#04x (SHORT REL8) (Jumped)", core.GetCurrentlyExecutingInstructionAddress(), destAddr))
-	} else {
-		core.registers.IP += 2
+	if called {
+		core.pushCallFrame(true)
 	}
 }
@@ -0,0 +1,82 @@
+package intel8086
+
+import "fmt"
+
+// callFrame is a diagnostic record of a CALL, or an interrupt, that has not yet returned
+type callFrame struct {
+	callSite  uint32 // linear address of the CALL instruction, or where the interrupt returns to
+	target    uint32 // linear address that was called
+	interrupt bool   // entered through an interrupt, an exception or a CALL to a task, and left with IRET
+}
+
+// MAX_CALL_STACK_DEPTH bounds the diagnostic call stack for code that never returns
+const MAX_CALL_STACK_DEPTH = 256
+
+// pushCallFrame records a call once the handler has moved CS:IP to the target, far for CALL FAR
+// whether or not it changed CS
+func (core *CpuCore) pushCallFrame(far bool) {
+	frame := callFrame{
+		callSite: core.GetCurrentlyExecutingInstructionAddress(),
+		target:   core.GetCurrentCodePointer(),
+	}
+	core.appendCallFrame(frame)
+
+	if far && core.profiler != nil {
+		core.profiler.recordFarCall(frame.target)
+	}
+}
+
+// pushInterruptFrame records an interrupt or exception once CS:IP is at its handler, returnAddr
+// being the linear address the handler returns to
+func (core *CpuCore) pushInterruptFrame(returnAddr uint32) {
+	core.appendCallFrame(callFrame{
+		callSite:  returnAddr,
+		target:    core.GetCurrentCodePointer(),
+		interrupt: true,
+	})
+}
+
+func (core *CpuCore) appendCallFrame(frame callFrame) {
+	if len(core.callStack) >= MAX_CALL_STACK_DEPTH {
+		core.callStack = core.callStack[1:]
+	}
+	core.callStack = append(core.callStack, frame)
+}
+
+func (core *CpuCore) popCallFrame() {
+	if len(core.callStack) > 0 {
+		core.callStack = core.callStack[:len(core.callStack)-1]
+	}
+}
+
+// popInterruptFrame unwinds the call stack through the newest interrupt frame for IRET, dropping
+// any calls the handler left without returning. An IRET with no interrupt to return from, from a
+// handler called with PUSHF and CALL FAR say, pops the one frame.
+func (core *CpuCore) popInterruptFrame() {
+	for i := len(core.callStack) - 1; i >= 0; i-- {
+		if core.callStack[i].interrupt {
+			core.callStack = core.callStack[:i]
+			return
+		}
+	}
+	core.popCallFrame()
+}
+
+// Backtrace renders the call stack, innermost frame first
+func (core *CpuCore) Backtrace() []string {
+	frames := make([]string, 0, len(core.callStack))
+	for i := len(core.callStack) - 1; i >= 0; i-- {
+		frame := core.callStack[i]
+		if frame.interrupt {
+			frames = append(frames, fmt.Sprintf("%s (interrupt, returns to %s)", core.symbolize(frame.target), core.symbolize(frame.callSite)))
+		} else {
+			frames = append(frames, fmt.Sprintf("%s (called from %s)", core.symbolize(frame.target), core.symbolize(frame.callSite)))
+		}
+	}
+	return frames
+}
+
+// symbolize renders a linear address as function+offset when symbols are loaded
+func (core *CpuCore) symbolize(addr uint32) string {
+	return core.symbols.Format(addr)
+}
@@ -0,0 +1,102 @@
+package intel8086
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/devices/intel80387"
+)
+
+// coprocessorOperand is the memory operand of an ESC instruction, the coprocessor's accesses go
+// through the same segment checks as the processor's own
+type coprocessorOperand struct {
+	core    *CpuCore
+	segment *SegmentRegister
+	offset  uint32
+}
+
+func (operand *coprocessorOperand) Read(offset uint32, size uint8) (uint32, error) {
+	return operand.core.readSegment(operand.segment, operand.offset+offset, size)
+}
+
+func (operand *coprocessorOperand) Write(offset uint32, size uint8, value uint32) error {
+	return operand.core.writeSegment(operand.segment, operand.offset+offset, size, value)
+}
+
+// checkNumericError raises #MF for an unmasked coprocessor exception left pending by an earlier
+// instruction. With CR0.NE clear the coprocessor has reported it on IRQ 13 instead.
+func (core *CpuCore) checkNumericError() error {
+	if core.mathCoProcessor != nil && core.registers.CR0&CR0_NE != 0 && core.mathCoProcessor.ErrorPending() {
+		return core.fault(EXCEPTION_MF, 0)
+	}
+	return nil
+}
+
+// INSTR_ESC passes a coprocessor instruction, D8-DF, to the math coprocessor once the processor
+// has decoded its modrm byte and resolved its memory operand. CR0.EM and CR0.TS make it #NM
+// instead, for software emulation and for saving coprocessor state lazily on a task switch. With
+// no coprocessor fitted the instruction does nothing, so FNSTSW leaves its operand as it was,
+// which is how software detects that.
+func INSTR_ESC(core *CpuCore) {
+	escape := core.currentOpCodeBeingExecuted & 0x7
+	core.currentByteAddr++
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+
+	if core.registers.CR0&(CR0_EM|CR0_TS) != 0 {
+		core.fault(EXCEPTION_NM, 0)
+		return
+	}
+	if core.mathCoProcessor == nil {
+		core.logInstruction(fmt.Sprintf("[%#04x] ESC %d (no coprocessor)", core.GetCurrentlyExecutingInstructionAddress(), escape))
+		return
+	}
+
+	instruction := intel80387.Instruction{
+		Opcode:        uint16(escape)<<8 | uint16(modrm.mod<<6|modrm.reg<<3|modrm.rm),
+		CS:            core.registers.CS.Selector,
+		IP:            *core.registers.EIP(),
+		Operand32:     core.Is32BitOperand(),
+		ProtectedMode: core.isProtectedMode(),
+	}
+	if !intel80387.IsControlInstruction(instruction.Opcode) {
+		if err := core.checkNumericError(); err != nil {
+			return
+		}
+	}
+
+	mnemonic := intel80387.Mnemonic(instruction.Opcode)
+	if instruction.Opcode == intel80387.FNSTSW_AX {
+		*core.registers.AX() = core.mathCoProcessor.StatusWord()
+		core.logInstruction(fmt.Sprintf("[%#04x] %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic))
+		return
+	}
+
+	name := ""
+	if modrm.mod != 3 {
+		var segment *SegmentRegister
+		segment, instruction.DataOffset, name = core.memoryOperand(&modrm)
+		instruction.DataSelector = segment.Selector
+		instruction.Operand = &coprocessorOperand{core: core, segment: segment, offset: instruction.DataOffset}
+	}
+	if err := core.mathCoProcessor.Execute(instruction); err != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] %s %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, name))
+}
+
+// INSTR_WAIT waits for the coprocessor, which has always finished by the time the processor gets
+// to the next instruction, so all that is left is raising a pending error
+func INSTR_WAIT(core *CpuCore) {
+	core.currentByteAddr++
+	if core.registers.CR0&(CR0_MP|CR0_TS) == CR0_MP|CR0_TS {
+		core.fault(EXCEPTION_NM, 0)
+		return
+	}
+	if err := core.checkNumericError(); err != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] WAIT", core.GetCurrentlyExecutingInstructionAddress()))
+}
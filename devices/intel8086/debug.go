@@ -0,0 +1,172 @@
+package intel8086
+
+import "fmt"
+
+/*
+	Debug registers
+	DR0-DR3 hold breakpoint linear addresses and DR7 enables them, saying what each one watches:
+	instruction fetches, data writes, or data reads and writes, of 1, 2 or 4 bytes. An execute
+	breakpoint is a fault, taken before the instruction runs, and RF in EFLAGS lets the instruction
+	through once so that the debugger can IRET back to it. Data breakpoints, TF single steps and
+	the T bit of a TSS being switched to are traps, taken once the instruction has finished. Either
+	way DR6 records what hit, and interrupt 1 is raised. The processor never clears DR6, the
+	debugger does.
+*/
+
+// DR6 bits, B0-B3 are 1<<n for breakpoint n
+const (
+	DR6_BD = 0x2000 // a MOV DRn was caught by DR7_GD
+	DR6_BS = 0x4000 // single step
+	DR6_BT = 0x8000 // task switch to a TSS with its T bit set
+
+	// DR6_RESET is DR6 after reset, its reserved bits read as ones
+	DR6_RESET = 0xFFFF0FF0
+)
+
+// DR7 bits. Each breakpoint n has a local and global enable at bits 2n and 2n+1, which are
+// treated alike, and its RW and LEN fields at bits 16+4n and 18+4n.
+const (
+	DR7_GD = 0x2000 // general detect, MOV DRn raises #DB
+
+	// DR7_RESET is DR7 after reset, bit 10 is reserved and reads as one
+	DR7_RESET = 0x0400
+
+	DR7_RW_EXECUTE    = 0
+	DR7_RW_WRITE      = 1
+	DR7_RW_READ_WRITE = 3
+)
+
+// TSS_DEBUG_TRAP is the offset in a 386 TSS of the word whose low bit, T, raises #DB on a switch to it
+const TSS_DEBUG_TRAP = 0x64
+
+// breakpointLengths are the bytes a breakpoint covers for each LEN encoding. 10 is undefined on
+// the 386 and covers one byte.
+var breakpointLengths = [4]uint32{1, 2, 1, 4}
+
+// debugRegister is DRn for MOV DRn, DR4 and DR5 being aliases of DR6 and DR7
+func (r *CpuRegisters) debugRegister(index uint8) (*uint32, string) {
+	switch index {
+	case 0:
+		return &r.DR0, "DR0"
+	case 1:
+		return &r.DR1, "DR1"
+	case 2:
+		return &r.DR2, "DR2"
+	case 3:
+		return &r.DR3, "DR3"
+	case 4, 6:
+		return &r.DR6, "DR6"
+	}
+	return &r.DR7, "DR7"
+}
+
+// breakpointHits is the DR6 B0-B3 bits of the enabled breakpoints of the given RW type that an
+// access of size bits at linear address addr touches
+func (core *CpuCore) breakpointHits(addr uint32, size uint8, rw ...uint32) uint32 {
+	dr7 := core.registers.DR7
+	if dr7&0xFF == 0 {
+		return 0
+	}
+	var hits uint32
+	for n := uint8(0); n < 4; n++ {
+		if dr7>>(2*n)&3 == 0 {
+			continue
+		}
+		control := dr7 >> (16 + 4*n)
+		for _, kind := range rw {
+			if control&3 != kind {
+				continue
+			}
+			length := breakpointLengths[control>>2&3]
+			breakpoint, _ := core.registers.debugRegister(n)
+			start := *breakpoint &^ (length - 1)
+			if addr < start+length && start < addr+uint32(size/8) {
+				hits |= 1 << n
+			}
+		}
+	}
+	return hits
+}
+
+// watchData records the data breakpoints an access hits, to be reported once the instruction
+// has finished
+func (core *CpuCore) watchData(addr uint32, size uint8, write bool) {
+	if write {
+		core.debugTrap |= core.breakpointHits(addr, size, DR7_RW_WRITE, DR7_RW_READ_WRITE)
+	} else {
+		core.debugTrap |= core.breakpointHits(addr, size, DR7_RW_READ_WRITE)
+	}
+}
+
+// instructionBreakpoint raises the #DB fault for an execute breakpoint on the instruction about to
+// run, before it does, and reports whether it did. With RF set the instruction runs regardless,
+// and RF is cleared.
+func (core *CpuCore) instructionBreakpoint() bool {
+	if core.registers.EFLAGS&ResumeFlag != 0 {
+		core.registers.EFLAGS &^= ResumeFlag
+		return false
+	}
+	hits := core.breakpointHits(core.GetCurrentCodePointer(), 8, DR7_RW_EXECUTE)
+	if hits == 0 {
+		return false
+	}
+	core.registers.DR6 |= hits
+	core.logDebug(fmt.Sprintf("CPU: breakpoint at %#08x, DR6=%#08x", core.GetCurrentCodePointer(), core.registers.DR6))
+	core.fault(EXCEPTION_DB, 0)
+	core.deliverPendingException()
+	return true
+}
+
+// deliverDebugTraps raises #DB for the traps the instruction just executed set off, with EIP at
+// the instruction after it
+func (core *CpuCore) deliverDebugTraps() {
+	if core.debugTrap == 0 {
+		return
+	}
+	core.registers.DR6 |= core.debugTrap
+	core.debugTrap = 0
+	core.logDebug(fmt.Sprintf("CPU: debug trap, DR6=%#08x", core.registers.DR6))
+	core.deliverInterrupt(EXCEPTION_DB, false)
+}
+
+// INSTR_MOV_DR moves a debug register to r32, 0F 21, or r32 to a debug register, 0F 23. Both are
+// 386 only and privileged, and with DR7_GD set they raise #DB instead, clearing GD for the
+// debugger's handler.
+func INSTR_MOV_DR(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if core.checkPrivilege() != nil {
+		return
+	}
+	if core.registers.DR7&DR7_GD != 0 {
+		core.registers.DR6 |= DR6_BD
+		core.registers.DR7 &^= DR7_GD
+		core.fault(EXCEPTION_DB, 0)
+		return
+	}
+
+	debugRegister, debugName := core.registers.debugRegister(modrm.reg)
+	register := core.registers.registers32Bit[modrm.rm]
+	registerName := core.registers.index32ToString(modrm.rm)
+	if core.currentOpCodeBeingExecuted == 0x21 {
+		*register = *debugRegister
+		core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), registerName, debugName))
+		return
+	}
+	*debugRegister = *register
+	core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), debugName, registerName))
+}
+
+// INSTR_INT1 raises interrupt 1 as a debug trap, F1. It is the ICE breakpoint, and unlike INT n
+// doesn't check the gate's DPL.
+func INSTR_INT1(core *CpuCore) {
+	core.currentByteAddr++
+	core.logInstruction(fmt.Sprintf("[%#04x] INT1", core.GetCurrentlyExecutingInstructionAddress()))
+	core.setInstructionPointer(core.nextInstructionPointer())
+	core.deliverInterrupt(EXCEPTION_DB, false)
+	core.flags.IsFarJump = true
+}
@@ -3,7 +3,6 @@ package intel8086
 import (
 	"fmt"
 	"github.com/andrewjc/threeatesix/common"
-	"log"
 )
 
 func (core *CpuCore) resetFlags() {
@@ -14,8 +13,8 @@ func (core *CpuCore) resetFlags() {
 
 func (core *CpuCore) handlePrefixes() {
 	for {
-		prefixByte, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr)
-		if err != nil || !isPrefixByte(&prefixByte) {
+		prefixByte, err := core.fetchCode8(core.currentByteAddr)
+		if err != nil || !core.model.isPrefix(prefixByte) {
 			break
 		}
 		core.handlePrefix(prefixByte)
@@ -40,7 +39,10 @@ func (core *CpuCore) handlePrefix(prefixByte byte) {
 		core.flags.MemorySegmentOverride = common.SEGMENT_GS
 	case 0xf0:
 		core.flags.LockPrefixEnabled = true
-	case 0xf2, 0xf3:
+	case 0xf2:
+		core.flags.RepPrefixEnabled = true
+		core.flags.RepNePrefixEnabled = true
+	case 0xf3:
 		core.flags.RepPrefixEnabled = true
 	case 0x66:
 		core.flags.OperandSizeOverrideEnabled = true
@@ -58,10 +60,14 @@ func (core *CpuCore) applyFlagsToMemoryController() {
 }
 
 func (core *CpuCore) readInstructionByte() (byte, error) {
-	return core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr)
+	return core.fetchCode8(core.currentByteAddr)
 }
 
 func (core *CpuCore) handleInstructionReadError(err error) {
+	if core.pendingException != nil {
+		// fetching past the end of the code segment faults rather than stopping the emulator
+		return
+	}
 	core.logInstruction("Error reading instruction byte: %s\n", err)
 	doCoreDump(core)
 	panic(fmt.Sprintf("Instruction read error: %v", err))
@@ -75,18 +81,22 @@ func (core *CpuCore) handleNullInstruction() {
 
 func (core *CpuCore) handle2ByteOpcode() OpCodeImpl {
 	core.currentByteAddr++
-	secondByte, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr)
+	secondByte, err := core.fetchCode8(core.currentByteAddr)
 	if err != nil {
 		core.handleInstructionReadError(err)
 		return nil
 	}
 	core.currentByteAddr++
+	if !core.model.hasTwoByteOpcode(secondByte) {
+		core.fault(EXCEPTION_UD, 0)
+		return nil
+	}
 
 	core.currentOpCodeBeingExecuted = secondByte
 	instructionImpl := core.opCodeMap2Byte[core.currentOpCodeBeingExecuted]
 
 	if instructionImpl == nil {
-		core.logInstruction("[%#04x] Unrecognised 2-byte opcode: 0x0F %#02x\n", core.registers.IP, secondByte)
+		core.logInstruction("[%#04x] Unrecognised 2-byte opcode: 0x0F %#02x\n", *core.registers.EIP(), secondByte)
 		doCoreDump(core)
 		panic(fmt.Sprintf("Unrecognized 2-byte opcode: 0x0F %#02x", secondByte))
 	}
@@ -98,21 +108,29 @@ func (core *CpuCore) handle2ByteOpcode() OpCodeImpl {
 }
 
 func (core *CpuCore) handleUnrecognizedOpcode(instrByte byte) {
-	core.logDebug(fmt.Sprintf("[%#04x] Unrecognised opcode: %#02x %v\n", core.registers.IP, instrByte, core.currentPrefixBytes))
+	core.logDebug(fmt.Sprintf("[%#04x] Unrecognised opcode: %#02x %v\n", *core.registers.EIP(), instrByte, core.currentPrefixBytes))
 	core.logDebug("CPU CORE ERROR!!!")
 	doCoreDump(core)
 	panic(fmt.Sprintf("Unrecognized opcode: %#02x", instrByte))
 }
 
 func (core *CpuCore) updateInstructionPointer() {
-	core.registers.IP += uint16(core.currentByteAddr - core.currentByteDecodeStart)
+	core.setInstructionPointer(core.nextInstructionPointer())
+}
+
+// setInstructionPointer loads EIP, wrapping at 64K in a 16 bit code segment
+func (core *CpuCore) setInstructionPointer(eip uint32) {
+	if !core.registers.CS.Is32Bit() {
+		eip &= 0xFFFF
+	}
+	*core.registers.EIP() = eip
 }
 
 func (core *CpuCore) decodeInstruction() uint8 {
 
 	var instrByte uint8
 	var err error
-	nextInstructionAddr := core.SegmentAddressToLinearAddress32(core.registers.CS, uint32(core.registers.IP))
+	nextInstructionAddr := core.GetCurrentCodePointer()
 	core.currentByteAddr = nextInstructionAddr
 	core.currentByteDecodeStart = nextInstructionAddr
 
@@ -123,29 +141,38 @@ func (core *CpuCore) decodeInstruction() uint8 {
 	instrByte, err = core.readInstructionByte()
 	if err != nil {
 		core.handleInstructionReadError(err)
+		if core.pendingException != nil {
+			core.deliverPendingException()
+		}
 		return 0
 	}
 
+	core.currentOpCodeBeingExecuted = instrByte
+
 	var instructionImpl OpCodeImpl
 	switch instrByte {
 	case 0x00:
 		core.handleNullInstruction()
 		return 0
 	case 0x0F:
+		if core.model == CPU_MODEL_8086 {
+			// before the 286 made 0F the two byte opcode escape it was POP CS
+			INSTR_POP(core)
+			break
+		}
 		instructionImpl = core.handle2ByteOpcode()
 		if instructionImpl != nil {
 			instructionImpl(core)
-		} else {
+		} else if core.pendingException == nil {
 			core.handleUnrecognizedOpcode(instrByte)
 		}
-	case 0xFF:
-		handleGroup5Opcode(core)
-	case 0x80:
-		handleGroup80opcode(core)
-	case 0x81:
-		handleGroup81opcode(core)
 	default:
-		core.currentOpCodeBeingExecuted = instrByte
+		opcode, ok := core.model.decodeOpcode(instrByte)
+		if !ok {
+			core.fault(EXCEPTION_UD, 0)
+			break
+		}
+		core.currentOpCodeBeingExecuted = opcode
 		instructionImpl = core.opCodeMap[core.currentOpCodeBeingExecuted]
 
 		if instructionImpl != nil {
@@ -155,7 +182,11 @@ func (core *CpuCore) decodeInstruction() uint8 {
 		}
 	}
 
-	if core.flags.IsFarJump {
+	if core.pendingException != nil {
+		// a fault leaves (E)IP at the faulting instruction
+		core.flags.IsFarJump = false
+		core.deliverPendingException()
+	} else if core.flags.IsFarJump {
 		core.flags.IsFarJump = false
 	} else {
 		core.updateInstructionPointer()
@@ -202,15 +233,8 @@ func isPrefixByte(b *uint8) bool {
 	return false
 }
 
-func (core *CpuCore) Is32BitOperand() bool {
-	if core.mode == common.PROTECTED_MODE {
-		return core.GetCurrentSegmentWidth() == 32 && !core.flags.OperandSizeOverrideEnabled
-	} else {
-		return false
-	}
-}
-
-func handleGroup3OpCode_byte(core *CpuCore) {
+// handleGroup3Opcode dispatches F6 and F7, the byte and word forms of test, not, neg, mul, imul, div and idiv
+func handleGroup3Opcode(core *CpuCore) {
 	core.currentByteAddr++
 	modrm, _, err := core.consumeModRm()
 	if err != nil {
@@ -229,7 +253,7 @@ func handleGroup3OpCode_byte(core *CpuCore) {
 		reg = 6: DIV (Unsigned divide)
 		reg = 7: IDIV (Signed divide)
 	*/
-	case 0:
+	case 0, 1:
 		INSTR_TEST(core)
 	case 2:
 		INSTR_NOT(core)
@@ -243,195 +267,99 @@ func handleGroup3OpCode_byte(core *CpuCore) {
 		INSTR_DIV(core)
 	case 7:
 		INSTR_IDIV(core)
-
-	default:
-		core.logInstruction("INSTR_80_OPCODE UNHANDLED OPER: (modrm: base:%d, reg:%d, mod:%d, rm: %d)\n\n", modrm.base, modrm.reg, modrm.mod, modrm.rm)
-		doCoreDump(core)
-		panic(0)
 	}
 }
 
-func handleGroup5Opcode_word(core *CpuCore) {
-	handleGroup5Opcode(core)
-}
-
-func handleGroup5Opcode(core *CpuCore) {
-	if core.Is32BitOperand() {
-		handleGroup5Opcode_32(core)
-		return
-	}
-
+// handleGroup1Opcode dispatches the 80-83 immediate ALU group on the reg field of the modrm byte
+func handleGroup1Opcode(core *CpuCore) {
 	core.currentByteAddr++
 	modrm, _, err := core.consumeModRm()
-	if err != nil {
-		core.logInstruction(fmt.Sprintf("Error consuming ModR/M byte: %v\n", err))
-		return // Exit early on error
-	}
 	core.currentByteAddr--
-
-	switch modrm.reg {
-	case 0:
-		// INC rm16
-		INSTR_INC_RM16(core)
-	case 1:
-		// DEC rm16
-		INSTR_DEC_RM16(core)
-	case 2:
-		// CALL rm16
-		INSTR_CALL_RM16(core)
-	case 3:
-		// CALL m16:16
-		INSTR_CALL_M16(core)
-	case 4:
-		// JMP rm16
-		INSTR_JMP_FAR_M16(core)
-	case 5:
-		// JMP m16:16
-		INSTR_JMP_FAR_M16(core)
-	case 6:
-		// PUSH rm16
-		INSTR_PUSH_RM16(core)
-	case 7:
-		doCoreDump(core)
-		panic("Invalid Group 5 opcode: reg = 7 is undefined")
-	default:
-		core.logInstruction(fmt.Sprintf("INSTR_FF_OPCODE UNHANDLED OPER: (modrm: base:%d, reg:%d, mod:%d, rm: %d)\n\n", modrm.base, modrm.reg, modrm.mod, modrm.rm))
-	}
-}
-
-func handleGroup5Opcode_32(core *CpuCore) {
-
-	core.currentByteAddr++
-	modrm, bytesConsumed, err := core.consumeModRm()
 	if err != nil {
-		core.logInstruction(fmt.Sprintf("Error consuming ModR/M byte: %v\n", err))
-		return // Exit early on error
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
 	}
-	core.currentByteAddr += bytesConsumed
 
 	switch modrm.reg {
 	case 0:
-		if modrm.rm == 0 {
-			// inc rm32
-			INSTR_INC_RM32(core)
-		} else {
-			log.Println("Unexpected ModRM setup for INC instruction")
-		}
+		INSTR_ADD(core)
 	case 1:
-		if modrm.rm == 1 {
-			// dec rm32
-			INSTR_DEC_RM32(core)
-		} else {
-			log.Println("Unexpected ModRM setup for DEC instruction")
-		}
+		INSTR_OR(core)
 	case 2:
-		if modrm.rm == 2 {
-			// call rm32
-			INSTR_CALL_RM32(core)
-		} else {
-			log.Println("Unexpected ModRM setup for CALL RM32 instruction")
-		}
+		INSTR_ADC(core)
 	case 3:
-		if modrm.rm == 3 {
-			// call m16:16
-			INSTR_CALL_M16(core)
-		} else {
-			log.Println("Unexpected ModRM setup for CALL M16 instruction")
-		}
+		INSTR_SBB(core)
 	case 4:
-		// jmp rm32
-		INSTR_JMP_FAR_M32(core)
+		INSTR_AND(core)
 	case 5:
-		// jmp m16:16
-		INSTR_JMP_FAR_M16(core)
+		INSTR_SUB(core)
 	case 6:
-		// push rm32
-		INSTR_PUSH_32(core)
-	default:
-		core.logInstruction("INSTR_FF_OPCODE UNHANDLED OPER: (modrm: base:%d, reg:%d, mod:%d, rm: %d)\n\n", modrm.base, modrm.reg, modrm.mod, modrm.rm)
-		doCoreDump(core)
-		panic("Unhandled operation")
+		INSTR_XOR(core)
+	case 7:
+		INSTR_CMP(core)
 	}
 }
 
-func handleGroup80opcode(core *CpuCore) {
-
+// handleGroup4Opcode dispatches FE, inc and dec of a byte operand
+func handleGroup4Opcode(core *CpuCore) {
 	core.currentByteAddr++
 	modrm, _, err := core.consumeModRm()
 	core.currentByteAddr--
 	if err != nil {
-		goto eof
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
 	}
 
 	switch modrm.reg {
+	case 0:
+		INSTR_INC(core)
 	case 1:
-		INSTR_OR(core)
-	case 4:
-		INSTR_AND(core)
-	case 5:
-		INSTR_SUB(core)
-	case 6:
-		INSTR_XOR(core)
-	case 7:
-		INSTR_CMP(core)
+		INSTR_DEC(core)
 	default:
-		log.Println(fmt.Sprintf("INSTR_80_OPCODE UNHANDLED OPER: (modrm: base:%d, reg:%d, mod:%d, rm: %d)\n\n", modrm.base, modrm.reg, modrm.mod, modrm.rm))
+		core.logInstruction("INSTR_FE_OPCODE UNHANDLED OPER: (modrm: base:%d, reg:%d, mod:%d, rm: %d)\n\n", modrm.base, modrm.reg, modrm.mod, modrm.rm)
 		doCoreDump(core)
-		panic(0)
+		panic("Invalid Group 4 opcode")
 	}
-
-eof:
 }
 
-func handleGroup81opcode(core *CpuCore) {
+// handleGroup5Opcode dispatches FF, inc, dec, the indirect calls and jumps and push of a word operand
+func handleGroup5Opcode(core *CpuCore) {
 	core.currentByteAddr++
-	modrm, bytesConsumed, err := core.consumeModRm()
-	core.currentByteAddr += bytesConsumed
+	modrm, _, err := core.consumeModRm()
 	if err != nil {
-		core.dumpAndExit()
-	}
-
-	var immediate uint32
-
-	if !core.Is32BitOperand() {
-		imm16, err := core.readImm16()
-		if err != nil {
-			core.dumpAndExit()
-		}
-		immediate = uint32(imm16)
-	} else {
-		immediate, err = core.readImm32()
-		if err != nil {
-			core.dumpAndExit()
-		}
+		core.logInstruction(fmt.Sprintf("Error consuming ModR/M byte: %v\n", err))
+		return // Exit early on error
 	}
+	core.currentByteAddr--
 
 	switch modrm.reg {
 	case 0:
-		INSTR_ADD_RM32(core, modrm, immediate)
+		// INC r/m16 or r/m32
+		INSTR_INC(core)
 	case 1:
-		INSTR_OR_RM32(core, modrm, immediate)
+		// DEC r/m16 or r/m32
+		INSTR_DEC(core)
+	case 2:
+		// CALL r/m16 or r/m32
+		INSTR_CALL_NEAR_RM(core)
+	case 3:
+		// CALL m16:16 or m16:32
+		INSTR_CALL_FAR_M(core)
 	case 4:
-		INSTR_AND_RM32(core, modrm, immediate)
+		// JMP r/m16 or r/m32
+		INSTR_JMP_NEAR_RM(core)
+	case 5:
+		// JMP m16:16 or m16:32
+		INSTR_JMP_FAR_M(core)
 	case 6:
-		INSTR_XOR_RM32(core, modrm, immediate)
+		// PUSH r/m16 or r/m32
+		INSTR_PUSH(core)
 	case 7:
-		INSTR_CMP_RM32(core, modrm, immediate)
-	default:
-		log.Println(fmt.Sprintf("INSTR_81_OPCODE UNHANDLED OPER: (modrm: base:%d, reg:%d, mod:%d, rm: %d)\n\n", modrm.base, modrm.reg, modrm.mod, modrm.rm))
 		doCoreDump(core)
-		panic(0)
+		panic("Invalid Group 5 opcode: reg = 7 is undefined")
 	}
 }
 
 func (core *CpuCore) GetAddressSize() int {
-	if core.mode == common.REAL_MODE {
-		return 2
-	} else {
-		if core.flags.OperandSizeOverrideEnabled {
-			return 2
-		} else {
-			return 4
-		}
-	}
+	return int(core.addressSize() / 8)
 }
@@ -2,33 +2,48 @@ package intel8086
 
 import "fmt"
 
+// INSTR_ROUTER_2BYTE_00 dispatches the 0F 00 group on the reg field of the modrm byte
+func INSTR_ROUTER_2BYTE_00(core *CpuCore) {
+	modrm, _, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error in INSTR_ROUTER_2BYTE_00: %s\n", err)
+		return
+	}
+
+	switch modrm.reg {
+	case 0, 1:
+		INSTR_SLDT_STR(core)
+	case 2:
+		INSTR_LLDT(core)
+	case 3:
+		INSTR_LTR(core)
+	case 4, 5:
+		INSTR_VERR_VERW(core)
+	default:
+		core.fault(EXCEPTION_UD, 0)
+	}
+}
+
 func INSTR_ROUTER_2BYTE_01(core *CpuCore) {
 
-	core.currentByteAddr++
+	// currentByteAddr is already at the modrm byte, which the handler reads again
 	modrm, _, err := core.consumeModRm()
 	if err != nil {
 		core.logInstruction("Error in INSTR_ROUTER_2BYTE_01: %s\n", err)
 		return
 	}
-	core.currentByteAddr-- // We need to re-read the modrm byte
 
 	switch modrm.reg {
-	/*case 0x00:
-		return core.handleSGDT
-	case 0x01:
-		return core.handleSIDT
-	case 0x02:
-		return core.handleLGDT
-	case 0x03:
-		return core.handleLIDT*/
+	case 0x00, 0x01:
+		INSTR_SGDT_SIDT(core)
+	case 0x02, 0x03:
+		INSTR_LGDT_LIDT(core)
 	case 0x04:
 		INSTR_SMSW(core) //SMSW r/m16
-	case 0x05:
-		INSTR_SMSW(core) //SMSW r32/m16
-	/*case 0x06:
-		return core.handleLMSW
-	case 0x07:
-		return core.handleINVLPG*/
+	case 0x06:
+		INSTR_LMSW(core)
+	/*case 0x07:
+	return core.handleINVLPG*/
 	default:
 		core.logInstruction("[%#04x] Unrecognized 2-byte opcode: 0x0F 0x%02X", core.GetCurrentCodePointer(), modrm.reg)
 		doCoreDump(core)
@@ -3,6 +3,7 @@ package intel8086
 import (
 	"fmt"
 	"github.com/andrewjc/threeatesix/common"
+	"github.com/andrewjc/threeatesix/devices/bus"
 	"github.com/andrewjc/threeatesix/devices/monitor"
 	"log"
 	"strings"
@@ -10,9 +11,11 @@ import (
 
 func doCoreDump(core *CpuCore) {
 
-	core.logInstruction("Instruction log:")
-	for _, instruction := range core.bus.FindSingleDevice(common.MODULE_DEBUG_MONITOR).(*monitor.HardwareMonitor).GetInstructionLog() {
-		core.logInstruction("%s", instruction)
+	if hardwareMonitor, err := bus.FindSingleDeviceAs[*monitor.HardwareMonitor](core.bus, common.MODULE_DEBUG_MONITOR); err == nil {
+		core.logInstruction("Instruction log:")
+		for _, instruction := range hardwareMonitor.GetInstructionLog() {
+			core.logInstruction("%s", instruction)
+		}
 	}
 
 	log.Println("Dumping core: " + core.FriendlyPartName())
@@ -36,7 +39,13 @@ func doCoreDump(core *CpuCore) {
 	}
 	core.logInstruction("Previous 10 bytes at instruction pointer: " + stb.String())
 
-	core.logInstruction("CS: %#2x, IP: %#2x", core.registers.CS, core.registers.IP)
+	core.logInstruction("CS: %#2x, EIP: %#2x", core.registers.CS, *core.registers.EIP())
+	core.logInstruction("Executing: %s", core.symbolize(core.currentByteDecodeStart))
+
+	core.logInstruction("Call stack:")
+	for i, frame := range core.Backtrace() {
+		core.logInstruction("#%d %s", i, frame)
+	}
 
 	core.logInstruction("8 Bit registers:")
 	for x, y := range core.registers.registers8Bit {
@@ -46,6 +55,10 @@ func doCoreDump(core *CpuCore) {
 	for x, y := range core.registers.registers16Bit {
 		core.logInstruction("%v %#2x (pntr: %#2x)", core.registers.index16ToString(uint8(x)), *y, y)
 	}
+	core.logInstruction("32 Bit registers:")
+	for x, y := range core.registers.registers32Bit {
+		core.logInstruction("%v %#2x (pntr: %#2x)", core.registers.index32ToString(uint8(x)), *y, y)
+	}
 	core.logInstruction("Segment registers:")
 	for x, y := range core.registers.registersSegmentRegisters {
 		core.logInstruction("%v %#2x (pntr: %#2x)", core.registers.indexSegmentToString(uint8(x)), *y, y)
@@ -65,8 +78,13 @@ func doCoreDump(core *CpuCore) {
 	core.logInstruction("CR0[et] = %b", core.registers.CR0>>4&1)
 	core.logInstruction("CR0[ne] = %b", core.registers.CR0>>5&1)
 
+	core.logInstruction("Debug registers:")
+	core.logInstruction("DR0 %#08x DR1 %#08x DR2 %#08x DR3 %#08x", core.registers.DR0, core.registers.DR1, core.registers.DR2, core.registers.DR3)
+	core.logInstruction("DR6 %#08x DR7 %#08x", core.registers.DR6, core.registers.DR7)
+
 	log.Print("Other details:")
 	core.logInstruction("Is in protected mode: %t", core.mode == common.PROTECTED_MODE)
 	core.logInstruction("Is in real mode: %t", core.mode == common.REAL_MODE)
+	core.logInstruction("Is in virtual 8086 mode: %t", core.mode == common.VIRTUAL_8086_MODE)
 	core.logInstruction("Is decoding 2 byte instruction: %t", core.is2ByteOperand)
 }
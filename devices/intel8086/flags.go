@@ -16,13 +16,22 @@ const (
 	OverFlowFlag         = 0x0800
 	IoPrivilegeLevelFlag = 0x3000
 	NestedTaskFlag       = 0x4000
+	ResumeFlag           = 0x10000
+	VirtualModeFlag      = 0x20000 // virtual 8086 mode
 )
 
-func (core *CpuRegisters) GetFlag(mask uint16) bool {
-	return core.GetFlagInt(mask) == uint16(mask)
+// loadFlags loads EFLAGS from a value popped by IRET or read from a TSS, entering or leaving
+// virtual 8086 mode as VM says
+func (core *CpuCore) loadFlags(value uint32) {
+	core.registers.EFLAGS = value&core.writableFlags() | core.fixedFlags()
+	core.updateMode()
 }
 
-func (core *CpuRegisters) GetFlagInt(mask uint16) uint16 {
+func (core *CpuRegisters) GetFlag(mask uint32) bool {
+	return core.GetFlagInt(mask) == mask
+}
+
+func (core *CpuRegisters) GetFlagInt(mask uint32) uint32 {
 	if mask == 0x0002 {
 		return 1
 	} //Reserved, always 1 in EFLAGS
@@ -30,20 +39,22 @@ func (core *CpuRegisters) GetFlagInt(mask uint16) uint16 {
 		return 0
 	} // Reserved, always 1 on 8086 and 186, always 0 on later models
 
-	return core.FLAGS & mask
+	return core.EFLAGS & mask
 }
 
-func (core *CpuRegisters) SetFlag(mask uint16, status bool) {
+func (core *CpuRegisters) SetFlag(mask uint32, status bool) {
 	if status {
-		core.FLAGS = core.FLAGS | mask
+		core.EFLAGS = core.EFLAGS | mask
 	} else {
-		core.FLAGS &= ^mask
+		core.EFLAGS &= ^mask
 	}
 }
 
 func INSTR_CLI(core *CpuCore) {
 	// Clear interrupts
-
+	if core.checkIOPL() != nil {
+		return
+	}
 	core.logInstruction(fmt.Sprintf("[%#04x] CLI", core.GetCurrentCodePointer()))
 	core.registers.SetFlag(InterruptFlag, false)
 	core.currentByteAddr++
@@ -58,6 +69,9 @@ func INSTR_CLD(core *CpuCore) {
 
 func INSTR_STI(core *CpuCore) {
 	// Set interrupts
+	if core.checkIOPL() != nil {
+		return
+	}
 	core.currentByteAddr++
 	core.logInstruction(fmt.Sprintf("[%#04x] STI", core.GetCurrentCodePointer()))
 	core.registers.SetFlag(InterruptFlag, true)
@@ -67,6 +81,44 @@ func INSTR_STI(core *CpuCore) {
 
 }
 
+// INSTR_PUSHF pushes FLAGS, or EFLAGS with a 32 bit operand size. VM and RF read as clear.
+func INSTR_PUSHF(core *CpuCore) {
+	core.currentByteAddr++
+	if core.checkVirtual8086IOPL() != nil {
+		return
+	}
+	size := core.operandSize()
+	flags := core.registers.EFLAGS &^ (VirtualModeFlag | ResumeFlag) & sizeMask(size)
+	if err := stackPush(core, size, flags); err != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] PUSHF (%#04x)", core.GetCurrentlyExecutingInstructionAddress(), flags))
+}
+
+// INSTR_POPF pops FLAGS, or EFLAGS with a 32 bit operand size. VM and RF are left alone, IOPL is
+// only loaded at CPL 0 and IF only when CPL is at or below IOPL.
+func INSTR_POPF(core *CpuCore) {
+	core.currentByteAddr++
+	if core.checkVirtual8086IOPL() != nil {
+		return
+	}
+	size := core.operandSize()
+	flags, err := stackPop(core, size)
+	if err != nil {
+		return
+	}
+
+	mask := core.writableFlags() &^ (VirtualModeFlag | ResumeFlag) & sizeMask(size)
+	if core.cpl() > 0 {
+		mask &^= IoPrivilegeLevelFlag
+	}
+	if core.cpl() > core.iopl() {
+		mask &^= InterruptFlag
+	}
+	core.registers.EFLAGS = core.registers.EFLAGS&^mask | flags&mask
+	core.logInstruction(fmt.Sprintf("[%#04x] POPF (%#04x)", core.GetCurrentlyExecutingInstructionAddress(), flags))
+}
+
 func INSTR_CMC(core *CpuCore) {
 	// Complement carry flag
 	carryFlag := core.registers.GetFlag(CarryFlag)
@@ -85,8 +137,12 @@ func INSTR_CLC(core *CpuCore) {
 func INSTR_SMSW(core *CpuCore) {
 	var destName string
 
-	// Get the Machine Status Word (MSW), which is the lower 16 bits of CR0
-	msw := uint16(core.registers.CR0 & 0xFFFF)
+	// Get the Machine Status Word (MSW), which is the lower 16 bits of CR0. The 286 only has the
+	// low four bits, the rest read as ones.
+	msw := core.registers.CR0 & 0xFFFF
+	if core.model == CPU_MODEL_80286 {
+		msw |= 0xFFF0
+	}
 
 	modrm, bytesConsumed, err := core.consumeModRm()
 	if err != nil {
@@ -94,41 +150,11 @@ func INSTR_SMSW(core *CpuCore) {
 	}
 	core.currentByteAddr += bytesConsumed
 
-	switch modrm.reg {
-	case 4, 5, 7: // All variants of SMSW
-		if modrm.mod == 3 { // Register operand
-			if modrm.reg == 5 { // 32-bit register for SMSW r32/m16
-				tmp := uint32(modrm.rm)
-				var regValue uint32
-				regValue, destName, _ = core.GetRegister32(&tmp)
-				_, err := core.SetRegister32(modrm.rm, (regValue&0xFFFF0000)|uint32(msw))
-				if err != nil {
-					return
-				}
-			} else { // 16-bit register for SMSW r/m16
-				tmp := uint16(modrm.rm)
-				_, destName, _ = core.GetRegister16(&tmp)
-				_, err := core.SetRegister16(modrm.rm, msw)
-				if err != nil {
-					return
-				}
-			}
-		} else { // Memory operand
-			var addr uint32
-
-			// Calculate the effective address when accessing memory
-			addr, destName = core.getEffectiveAddress32(&modrm) // Discard the address description here as it's not used
-
-			// Write the 16-bit value to memory
-			err := core.memoryAccessController.WriteMemoryAddr16(uint32(addr), msw)
-			if err != nil {
-				return
-			}
-		}
-	default:
-		core.logInstruction(fmt.Sprintf("Unrecognized SMSW opcode: 0x0F 0x01 0x%02X", modrm.reg))
-		doCoreDump(core)
-		panic(fmt.Sprintf("Unrecognized SMSW opcode: 0x0F 0x01 0x%02X", modrm.reg))
+	if modrm.mod == 3 {
+		// a register destination takes the operand size, memory is always written as a word
+		destName = core.writeReg(modrm.rm, core.operandSize(), msw)
+	} else if destName, err = core.writeRm(&modrm, 16, msw); err != nil {
+		return
 	}
 
 eof:
@@ -7,39 +7,31 @@ type OpCodeImpl func(*CpuCore)
 func mapOpCodes(c *CpuCore) {
 	// Mapping individual opcodes to instruction handlers
 	opcodeHandlers := map[byte]OpCodeImpl{
-		0xEA: INSTR_JMP_FAR_PTR16,
+		0xEA: INSTR_JMP_FAR_PTR,
+		0x9A: INSTR_CALL_FAR_PTR,
 		0xE9: INSTR_JMP_NEAR_REL16,
 		0xE8: INSTR_CALL_NEAR_REL16,
 		0xEB: INSTR_JMP_SHORT_REL8,
-		0xE0: INSTR_DEC_COUNT_JMP_SHORT_Z,
-		0xE1: INSTR_DEC_COUNT_JMP_SHORT_Z,
-		0xE2: INSTR_DEC_COUNT_JMP_SHORT,
+		0xE0: INSTR_LOOP,
+		0xE1: INSTR_LOOP,
+		0xE2: INSTR_LOOP,
 		0xE3: INSTR_JCXZ_SHORT_REL8,
 		0xFA: INSTR_CLI,
 		0xFB: INSTR_STI,
+		0x9C: INSTR_PUSHF,
+		0x9D: INSTR_POPF,
 		0xFC: INSTR_CLD,
-		0xFE: INSTR_INC_SHORT_REL8,
+		0xFE: handleGroup4Opcode,
+		0xFF: handleGroup5Opcode,
 		0xF4: INSTR_HLT,
 		0xF5: INSTR_CMC,
 		0xF8: INSTR_CLC,
 		0xF9: INSTR_STC,
-		0x70: INSTR_JO_SHORT_REL8,
-		0x71: INSTR_JNO_SHORT_REL8,
-		0x74: INSTR_JZ_SHORT_REL8,
-		0x75: INSTR_JNZ_SHORT_REL8,
-		0x76: INSTR_JBE_SHORT_REL8,
-		0x78: INSTR_JS_SHORT_REL8,
-		0x79: INSTR_JNS_SHORT_REL8,
-		0x7e: INSTR_JLE_SHORT_REL8,
-		0x7f: INSTR_JG_SHORT_REL8,
-		0x72: INSTR_JB_SHORT_REL8,
-		0x73: INSTR_JNB_SHORT_REL8,
-		0x7c: INSTR_JL_SHORT_REL8,
-		0x7d: INSTR_JGE_SHORT_REL8,
-		0x7a: INSTR_JPE_SHORT_REL8,
-		0x7b: INSTR_JPO_SHORT_REL8,
-		0xC2: INSTR_RET_FAR,
+		0xC2: INSTR_RET_NEAR,
 		0xC3: INSTR_RET_NEAR,
+		0xCA: INSTR_RET_FAR,
+		0xCB: INSTR_RET_FAR,
+		0x63: INSTR_ARPL,
 		// Input/Output Instructions
 		0xE4: INSTR_IN,
 		0xE5: INSTR_IN,
@@ -54,15 +46,15 @@ func mapOpCodes(c *CpuCore) {
 		0xA1: INSTR_MOV,
 		0xA2: INSTR_MOV,
 		0xA3: INSTR_MOV,
-		0xA4: INSTR_MOV,
-		0xA5: INSTR_MOV,
 		0x8A: INSTR_MOV,
 		0x8B: INSTR_MOV,
 		0x8C: INSTR_MOV,
-		0x8D: INSTR_MOV,
+		0x8D: INSTR_LEA,
 		0x8E: INSTR_MOV,
 		0x88: INSTR_MOV,
 		0x89: INSTR_MOV,
+		0xC6: INSTR_MOV,
+		0xC7: INSTR_MOV,
 		// Comparison Instructions
 		0x3A: INSTR_CMP,
 		0x3B: INSTR_CMP,
@@ -70,8 +62,6 @@ func mapOpCodes(c *CpuCore) {
 		0x3D: INSTR_CMP,
 		0x38: INSTR_CMP,
 		0x39: INSTR_CMP,
-		0xA6: INSTR_CMP,
-		0xA7: INSTR_CMP,
 		0x86: INSTR_XCHG,
 		0x87: INSTR_XCHG,
 		// Arithmetic Instructions
@@ -136,43 +126,62 @@ func mapOpCodes(c *CpuCore) {
 
 		0x68: INSTR_PUSH,
 		0x69: INSTR_IMUL,
+		0x6B: INSTR_IMUL,
 		0x0E: INSTR_PUSH,
 		0x16: INSTR_PUSH,
 		0x1E: INSTR_PUSH,
 		0x06: INSTR_PUSH,
 		0x61: INSTR_POP,
+		0x07: INSTR_POP,
 		0x8F: INSTR_POP,
 		0x17: INSTR_POP,
-		// Special Instructions
-		0xAA: INSTR_STOSB, //Store string byte
-		0xAB: INSTR_STOSD,
+		// String Instructions
+		0xA4: INSTR_MOVS,
+		0xA5: INSTR_MOVS,
+		0xA6: INSTR_CMPS,
+		0xA7: INSTR_CMPS,
+		0xAA: INSTR_STOS,
+		0xAB: INSTR_STOS,
 		0xAC: INSTR_LODS,
 		0xAD: INSTR_LODS,
+		0xAE: INSTR_SCAS,
+		0xAF: INSTR_SCAS,
 
-		0xA8: INSTR_TEST_IMM8_AL,  // Test immediate 8-bit with AL
-		0xA9: INSTR_TEST_IMM16_AX, // Test immediate 16-bit with AX
+		0xA8: INSTR_TEST, // Test immediate 8-bit with AL
+		0xA9: INSTR_TEST, // Test immediate 16 or 32-bit with eAX
 
 		0x1D: INSTR_SBB, // Subtract with Borrow from AX with immediate 16-bit
 		0x1C: INSTR_SBB, // Subtract with Borrow from AL with immediate 8-bit
-		0x1F: INSTR_POP, // Subtract with Borrow from AX with register16
+		0x1F: INSTR_POP, // POP DS
 
 		// Group 1 opcodes, dynamically handled based on ModR/M byte
-		0x80: handleGroup80opcode,
-		0x81: handleGroup80opcode,
-		0x82: handleGroup80opcode,
-		0x83: handleGroup80opcode,
+		0x80: handleGroup1Opcode,
+		0x81: handleGroup1Opcode,
+		0x82: handleGroup1Opcode,
+		0x83: handleGroup1Opcode,
 		// Test opcodes, handled based on ModR/M byte
-		0x84: INSTR_TEST,              // Test 8-bit register/memory with 8-bit register
-		0x85: INSTR_TEST,              // Test 16-bit register/memory with 16-bit register
-		0xF6: handleGroup3OpCode_byte, // Group 3 byte operations (TEST, NOT, NEG, MUL, IMUL, DIV, IDIV)
-		0xF7: handleGroup5Opcode_word, // Group 3 word operations (TEST, NOT, NEG, MUL, IMUL, DIV, IDIV)
+		0x84: INSTR_TEST,         // Test 8-bit register/memory with 8-bit register
+		0x85: INSTR_TEST,         // Test 16 or 32-bit register/memory with register
+		0xF6: handleGroup3Opcode, // Group 3 byte operations (TEST, NOT, NEG, MUL, IMUL, DIV, IDIV)
+		0xF7: handleGroup3Opcode, // Group 3 word operations (TEST, NOT, NEG, MUL, IMUL, DIV, IDIV)
+
+		// Coprocessor
+		0x9B: INSTR_WAIT,
+		0xD8: INSTR_ESC,
+		0xD9: INSTR_ESC,
+		0xDA: INSTR_ESC,
+		0xDB: INSTR_ESC,
+		0xDC: INSTR_ESC,
+		0xDD: INSTR_ESC,
+		0xDE: INSTR_ESC,
+		0xDF: INSTR_ESC,
 
 		// Software interrupts
-		//0xCD: INSTR_INT,
 		0xCC: INSTR_INT3,
-		//0xCE: INSTR_INT,
-		//0xCF: INSTR_IRET,
-
+		0xF1: INSTR_INT1,
+		0xCD: INSTR_INT,
+		0xCE: INSTR_INT,
+		0xCF: INSTR_IRET,
 	}
 
 	// Register-based opcodes dynamically generated from register lists
@@ -189,6 +198,10 @@ func mapOpCodes(c *CpuCore) {
 		opcodeHandlers[0x90+byte(i)] = INSTR_XCHG
 	}
 
+	for cc := byte(0); cc < 16; cc++ {
+		opcodeHandlers[0x70+cc] = INSTR_JCC_SHORT_REL8
+	}
+
 	// Transfer opcodes into the CPU core map
 	for k, v := range opcodeHandlers {
 		c.opCodeMap[k] = v
@@ -196,15 +209,19 @@ func mapOpCodes(c *CpuCore) {
 
 	// Two-byte opcode map
 	opCodeMap2ByteHandlers := map[byte]OpCodeImpl{
+		0x00: INSTR_ROUTER_2BYTE_00,
 		0x01: INSTR_ROUTER_2BYTE_01,
-		/*        0x00: INSTR_ROUTER_2BYTE_GROUP6,
-		    0x02: INSTR_LAR,
-		    0x03: INSTR_LSL,
-		    0x06: INSTR_CLTS,
-		    0x08: INSTR_INVD,
+		0x02: INSTR_LAR_LSL,
+		0x03: INSTR_LAR_LSL,
+		0x05: INSTR_LOADALL,
+		0x06: INSTR_CLTS,
+		0x20: INSTR_MOV,
+		0x21: INSTR_MOV_DR,
+		0x22: INSTR_MOV,
+		0x23: INSTR_MOV_DR,
+		0xAF: INSTR_IMUL,
+		/*  0x08: INSTR_INVD,
 		    0x09: INSTR_WBINVD,
-		    0x20: INSTR_MOVCR,
-		    0x22: INSTR_MOVDR,
 		    0x30: INSTR_WRMSR,
 		    0x31: INSTR_RDTSC,
 		    0x32: INSTR_RDMSR,
@@ -220,7 +237,6 @@ func mapOpCodes(c *CpuCore) {
 			0xAB: INSTR_BTS,
 			0xAC: INSTR_SHRD,
 			0xAD: INSTR_SHRD_CL,
-			0xAF: INSTR_IMUL,
 			0xB0: INSTR_CMPXCHG,
 			0xB1: INSTR_CMPXCHG,
 			0xB6: INSTR_MOVZX,
@@ -233,11 +249,11 @@ func mapOpCodes(c *CpuCore) {
 			0xBF: INSTR_MOVSX,*/
 	}
 
-	/*for i := 0x80; i <= 0x8F; i++ {
-		c.opCodeMap2Byte[byte(i)] = INSTR_JCC
+	for i := 0x80; i <= 0x8F; i++ {
+		opCodeMap2ByteHandlers[byte(i)] = INSTR_JCC_NEAR_REL
 	}
 
-	for i := 0x90; i <= 0x9F; i++ {
+	/*for i := 0x90; i <= 0x9F; i++ {
 		c.opCodeMap2Byte[byte(i)] = INSTR_SETCC
 	}*/
 
@@ -3,163 +3,337 @@ package intel8086
 import (
 	"fmt"
 	"github.com/andrewjc/threeatesix/common"
-	"github.com/andrewjc/threeatesix/devices/bus"
-	"log"
-	"math/bits"
 )
 
-func INSTR_INT3(core *CpuCore) {
-	core.logInstruction("INT 3")
-	core.registers.IP++
-	interruptMessage := bus.BusMessage{
-		Subject: common.MESSAGE_INTERRUPT_RAISE,
-		Sender:  core.busId,
-		Data:    []byte{byte(3)},
+// exception vectors the processor raises itself
+const (
+	EXCEPTION_DE = 0  // divide error
+	EXCEPTION_DB = 1  // debug, breakpoints and single steps
+	EXCEPTION_UD = 6  // invalid opcode
+	EXCEPTION_NM = 7  // coprocessor not available
+	EXCEPTION_DF = 8  // double fault
+	EXCEPTION_TS = 10 // invalid TSS
+	EXCEPTION_NP = 11 // segment not present
+	EXCEPTION_SS = 12 // stack segment fault
+	EXCEPTION_GP = 13 // general protection
+	EXCEPTION_MF = 16 // coprocessor error
+)
+
+// cpuException is a fault raised while executing an instruction. The handler returns it as an
+// error and stops, and the decoder delivers it once the handler has returned. (E)IP is still at the
+// faulting instruction then, so the exception handler can restart it.
+type cpuException struct {
+	vector       uint8
+	errorCode    uint16
+	hasErrorCode bool
+}
+
+func (e *cpuException) Error() string {
+	return fmt.Sprintf("exception %d, error code %#04x", e.vector, e.errorCode)
+}
+
+// fault raises an exception for the current instruction. Only the first exception an instruction
+// raises is delivered. The error code is dropped for vectors that don't push one.
+func (core *CpuCore) fault(vector uint8, errorCode uint16) error {
+	exception := &cpuException{vector: vector, errorCode: errorCode}
+	switch vector {
+	case EXCEPTION_DF, EXCEPTION_TS, EXCEPTION_NP, EXCEPTION_SS, EXCEPTION_GP, 14, 17:
+		exception.hasErrorCode = true
+	default:
+		exception.errorCode = 0
 	}
-	err := core.bus.SendMessageSingle(common.MODULE_INTERRUPT_CONTROLLER_1, interruptMessage)
-	if err != nil {
-		core.logInstruction("8259A: Error sending interrupt request message: %v", err)
+	if core.pendingException == nil {
+		core.pendingException = exception
 	}
+	return exception
 }
 
-func (core *CpuCore) checkInterrupts() {
-	if core.registers.GetFlag(InterruptFlag) && core.hasPendingInterrupt() {
-		core.handleInterrupt()
+// deliverPendingException vectors to the handler for the exception the current instruction
+// raised. An exception raised while delivering it becomes a double fault, and one raised while
+// delivering a double fault shuts the processor down.
+func (core *CpuCore) deliverPendingException() {
+	exception := core.pendingException
+	core.pendingException = nil
+	core.logDebug(fmt.Sprintf("CPU: %s", exception))
+
+	if core.enterInterrupt(exception.vector, false, exception.hasErrorCode, exception.errorCode) == nil {
+		return
+	}
+	core.pendingException = nil
+	if exception.vector != EXCEPTION_DF && core.enterInterrupt(EXCEPTION_DF, false, true, 0) == nil {
+		return
 	}
+	core.pendingException = nil
+	core.logDebug("CPU: triple fault, shutting down")
+	core.halt = HALT_SHUTDOWN
+}
+
+func INSTR_INT3(core *CpuCore) {
+	core.logInstruction("INT 3")
+	core.currentByteAddr++
+	// the return address is the instruction after the int3
+	core.setInstructionPointer(core.nextInstructionPointer())
+	core.deliverInterrupt(3, true)
+	core.flags.IsFarJump = true
 }
 
-func (core *CpuCore) handleInterrupt() {
-	if !core.registers.GetFlag(InterruptFlag) {
-		return // Interrupts are disabled
+// INSTR_INT raises a software interrupt, CD ib, or interrupt 4 for INTO, CE, when OF is set
+func INSTR_INT(core *CpuCore) {
+	core.currentByteAddr++
+	vector := uint8(4)
+	if core.currentOpCodeBeingExecuted == 0xCD {
+		if core.checkVirtual8086IOPL() != nil {
+			return
+		}
+		var err error
+		if vector, err = core.readImm8(); err != nil {
+			return
+		}
+	} else if !core.registers.GetFlag(OverFlowFlag) {
+		core.logInstruction(fmt.Sprintf("[%#04x] INTO (not taken)", core.GetCurrentlyExecutingInstructionAddress()))
+		return
 	}
 
-	intNum, hasInterrupt := core.getHighestPriorityInterrupt()
-	if !hasInterrupt {
+	core.logInstruction(fmt.Sprintf("[%#04x] INT %#02x", core.GetCurrentlyExecutingInstructionAddress(), vector))
+	core.setInstructionPointer(core.nextInstructionPointer())
+	core.deliverInterrupt(vector, true)
+	core.flags.IsFarJump = true
+}
+
+// INSTR_IRET returns from an interrupt handler, popping (E)IP, CS and FLAGS, and SS:(E)SP too when
+// it returns to a less privileged level. In protected mode with NT set the handler is a nested
+// task, and IRET switches back to the task in its back-link. An IRETD at ring 0 popping flags with
+// VM set returns to virtual 8086 mode, and in virtual 8086 mode IRET is only allowed at IOPL 3,
+// where it can't change IOPL.
+func INSTR_IRET(core *CpuCore) {
+	core.currentByteAddr++
+	if core.checkVirtual8086IOPL() != nil {
+		return
+	}
+	if core.isProtectedMode() && !core.isVirtual8086Mode() && core.registers.GetFlag(NestedTaskFlag) {
+		backLink, err := core.memoryAccessController.ReadMemoryValue16(core.registers.TR.Base)
+		if err != nil {
+			return
+		}
+		core.logInstruction(fmt.Sprintf("[%#04x] IRET (task %#04x)", core.GetCurrentlyExecutingInstructionAddress(), backLink))
+		if core.taskSwitch(backLink, TASK_SWITCH_IRET, core.nextInstructionPointer()) == nil {
+			core.flags.IsFarJump = true
+			core.popInterruptFrame()
+		}
 		return
 	}
 
-	// Send an interrupt message to the interrupt controller
-	interruptMessage := bus.BusMessage{
-		Subject: common.MESSAGE_INTERRUPT_RAISE,
-		Sender:  core.busId,
-		Data:    []byte{intNum},
+	size := core.operandSize()
+	sp := *core.registers.ESP()
+	var returnState [3]uint32
+	for i := range returnState {
+		value, err := stackPop(core, size)
+		if err != nil {
+			*core.registers.ESP() = sp
+			return
+		}
+		returnState[i] = value
 	}
 
-	err := core.bus.SendMessageSingle(common.MODULE_INTERRUPT_CONTROLLER_1, interruptMessage)
-	if err != nil {
-		core.logDebug(fmt.Sprintf("CPU: Error sending interrupt request message: %v", err))
+	flags := returnState[2]
+	if size == 16 {
+		flags = core.registers.EFLAGS&^0xFFFF | flags&0xFFFF
+	}
+	switch {
+	case core.isVirtual8086Mode():
+		kept := uint32(IoPrivilegeLevelFlag | VirtualModeFlag | ResumeFlag)
+		flags = flags&^kept | core.registers.EFLAGS&kept
+	case core.isProtectedMode() && flags&VirtualModeFlag != 0 && size == 32 && core.cpl() == 0:
+		if core.returnToVirtual8086(returnState[0], returnState[1], flags) != nil {
+			*core.registers.ESP() = sp
+			return
+		}
+		core.flags.IsFarJump = true
+		core.popInterruptFrame()
+		return
+	default:
+		flags &^= VirtualModeFlag
+		if core.cpl() > 0 {
+			flags = flags&^IoPrivilegeLevelFlag | core.registers.EFLAGS&IoPrivilegeLevelFlag
+		}
+		if core.cpl() > core.iopl() {
+			flags = flags&^InterruptFlag | core.registers.EFLAGS&InterruptFlag
+		}
 	}
 
-	// Send a debug message
-	core.logDebug(fmt.Sprintf("CPU: Interrupt %d raised", intNum))
+	if err := core.returnFar(uint16(returnState[1]), size, 0); err != nil {
+		*core.registers.ESP() = sp
+		return
+	}
 
+	core.logInstruction(fmt.Sprintf("[%#04x] IRET", core.GetCurrentlyExecutingInstructionAddress()))
+	core.loadFlags(flags)
+	core.setInstructionPointer(returnState[0])
+	core.flags.IsFarJump = true
+	core.popInterruptFrame()
 }
 
-func (core *CpuCore) getHighestPriorityInterrupt() (uint8, bool) {
-	// Check master PIC
-	masterIRQ := core.interruptControllerMaster.IrqRequest & ^core.interruptControllerMaster.IrqMask
-	if masterIRQ != 0 {
-		irqNum := uint8(bits.TrailingZeros8(masterIRQ))
-		return core.interruptControllerMaster.InterruptVectorBase + irqNum, true
+// serviceInterrupt runs an interrupt acknowledge cycle when the interrupt controller
+// asserts INTR and interrupts are enabled, then vectors to the handler. It reports whether
+// an interrupt was taken.
+func (core *CpuCore) serviceInterrupt() bool {
+	if !core.intrAsserted || !core.registers.GetFlag(InterruptFlag) {
+		return false
 	}
 
-	// Check slave PIC
-	if core.interruptControllerMaster.IrqMask&(1<<2) == 0 {
-		slaveIRQ := core.interruptControllerSlave.IrqRequest & ^core.interruptControllerSlave.IrqMask
-		if slaveIRQ != 0 {
-			irqNum := uint8(bits.TrailingZeros8(slaveIRQ))
-			return core.interruptControllerSlave.InterruptVectorBase + irqNum, true
+	irq, vector, ok := core.interruptControllerMaster.AcknowledgeInterrupt()
+	if !ok {
+		return false
+	}
+	if irq == 2 {
+		// cascaded from the secondary controller, which supplies the vector
+		if _, vector, ok = core.interruptControllerSlave.AcknowledgeInterrupt(); !ok {
+			return false
 		}
 	}
 
-	return 0, false
+	core.logDebug(fmt.Sprintf("CPU: Interrupt %d raised", vector))
+	core.deliverInterrupt(vector, false)
+	return true
 }
 
-func (core *CpuCore) hasPendingInterrupt() bool {
-
-	masterIRQ := core.interruptControllerMaster.IrqRequest & ^core.interruptControllerMaster.IrqMask
-	if masterIRQ != 0 {
-		return true
+// deliverInterrupt vectors to the handler for an interrupt, software for INT3, INT n and INTO. A
+// fault while doing so is delivered in turn, as a fault raised by an instruction would be.
+func (core *CpuCore) deliverInterrupt(vector uint8, software bool) {
+	if core.enterInterrupt(vector, software, false, 0) != nil && core.pendingException != nil {
+		core.deliverPendingException()
 	}
+}
 
-	// Check slave PIC only if its interrupt line on master is unmasked
-	if core.interruptControllerMaster.IrqMask&(1<<2) == 0 {
-		slaveIRQ := core.interruptControllerSlave.IrqRequest & ^core.interruptControllerSlave.IrqMask
-		if slaveIRQ != 0 {
-			return true
-		}
+// enterInterrupt pushes the return state and loads CS:(E)IP from the interrupt vector table in
+// real mode, or from an interrupt or trap gate in the IDT in protected mode
+func (core *CpuCore) enterInterrupt(vector uint8, software bool, pushErrorCode bool, errorCode uint16) error {
+	// an instruction that enters a handler, by faulting or with INT n, doesn't trap afterwards
+	core.debugTrap = 0
+	returnAddr := core.GetCurrentCodePointer()
+
+	var err error
+	if core.isProtectedMode() {
+		err = core.enterProtectedModeInterrupt(vector, software, pushErrorCode, errorCode)
+	} else {
+		err = core.enterRealModeInterrupt(vector)
 	}
-
-	return false
+	if err == nil {
+		core.pushInterruptFrame(returnAddr)
+	}
+	return err
 }
 
-func (core *CpuCore) HandleInterruptBusMessage(message bus.BusMessage) {
-
-	vector := message.Data[0]
+// enterRealModeInterrupt pushes FLAGS, CS and IP and vectors through the interrupt vector table
+func (core *CpuCore) enterRealModeInterrupt(vector uint8) error {
+	// the real mode vector table is wherever the IDTR points, address 0 after reset
+	vectorAddr := core.registers.IDTR.Base + uint32(vector)*4
+	ip, err := core.memoryAccessController.ReadMemoryValue16(vectorAddr)
+	if err != nil {
+		return err
+	}
+	cs, err := core.memoryAccessController.ReadMemoryValue16(vectorAddr + 2)
+	if err != nil {
+		return err
+	}
 
-	// if vector comes from the second interrupt controller, subtract 8
-	if message.Sender == common.MODULE_INTERRUPT_CONTROLLER_2 {
-		vector -= 8
+	if err := stackPush16(core, uint16(core.registers.EFLAGS)); err != nil {
+		return err
+	}
+	if err := stackPush16(core, core.registers.CS.Selector); err != nil {
+		return err
+	}
+	if err := stackPush16(core, *core.registers.IP()); err != nil {
+		return err
 	}
 
-	// Disable interrupts
 	core.registers.SetFlag(InterruptFlag, false)
+	core.registers.SetFlag(TrapFlag, false)
 
-	// Push the current flags and CS:IP onto the stack
-	err := stackPush16(core, core.registers.FLAGS)
-	if err != nil {
-		return
+	*core.registers.EIP() = uint32(ip)
+	return core.loadSegment(common.SEGMENT_CS, cs)
+}
+
+// enterProtectedModeInterrupt vectors through an interrupt or trap gate, which differ only in
+// that an interrupt gate also clears IF. 386 gates push 32 bit values and 286 gates 16 bit ones.
+// A task gate switches to the handler task instead. A software interrupt may only use a gate whose
+// DPL is at least CPL, and a handler in a more privileged non-conforming segment runs on that
+// level's stack from the TSS, with the interrupted SS:ESP pushed first.
+func (core *CpuCore) enterProtectedModeInterrupt(vector uint8, software bool, pushErrorCode bool, errorCode uint16) error {
+	// error codes for faults on the gate itself point at the IDT entry
+	gateError := uint16(vector)<<3 | 0x2
+	gateAddr := uint32(vector) << 3
+	if gateAddr+7 > uint32(core.registers.IDTR.Limit) {
+		return core.fault(EXCEPTION_GP, gateError)
 	}
-	err = stackPush32(core, core.registers.CS.Base)
+	low, err := core.memoryAccessController.ReadMemoryValue32(core.registers.IDTR.Base + gateAddr)
 	if err != nil {
-		return
+		return err
 	}
-	err = stackPush16(core, core.registers.IP)
+	high, err := core.memoryAccessController.ReadMemoryValue32(core.registers.IDTR.Base + gateAddr + 4)
 	if err != nil {
-		return
+		return err
 	}
 
-	// Set the necessary flags
-	core.registers.SetFlag(TrapFlag, false)
-
-	// Set the CS:IP to the interrupt vector
-
-	vectorAddr := uint16(vector) << 2
-
-	// Read IP and CS from the interrupt vector table
-
-	vectorAddr2 := uint32(0x000020)<<4 + uint32(vectorAddr)
-
-	core.registers.IP, _ = core.memoryAccessController.ReadMemoryValue16(uint32(vectorAddr2))
-	newBase, _ := core.memoryAccessController.ReadMemoryValue16(uint32(vectorAddr2 + 3))
-
-	core.registers.CS.Base = uint32(newBase)
+	gateType := high >> 8 & 0x1F
+	size := uint8(32)
+	switch gateType {
+	case DESCRIPTOR_INTERRUPT_GATE_32, DESCRIPTOR_TRAP_GATE_32, DESCRIPTOR_TASK_GATE:
+	case DESCRIPTOR_INTERRUPT_GATE_16, DESCRIPTOR_TRAP_GATE_16:
+		size = 16
+	default:
+		return core.fault(EXCEPTION_GP, gateError)
+	}
+	if software && uint8(high>>13&3) < core.cpl() {
+		return core.fault(EXCEPTION_GP, gateError)
+	}
+	if high&(SEGMENT_PRESENT<<8) == 0 {
+		return core.fault(EXCEPTION_NP, gateError)
+	}
+	if gateType == DESCRIPTOR_TASK_GATE {
+		return core.interruptTask(uint16(low>>16), pushErrorCode, errorCode)
+	}
 
-	// Re-enable interrupts
-	core.registers.SetFlag(InterruptFlag, true)
+	target := high&0xFFFF0000 | low&0xFFFF
+	if size == 16 {
+		target &= 0xFFFF
+	}
+	cs, err := core.checkSegmentDescriptor(common.SEGMENT_CS, uint16(low>>16))
+	if err != nil {
+		return err
+	}
+	cpl := core.cpl()
+	if cs.DPL() > cpl {
+		return core.fault(EXCEPTION_GP, cs.Selector&0xFFFC)
+	}
 
-	// Send a message to the debug monitor
-	core.logDebug(fmt.Sprintf("Interrupt %d handled", vector))
+	if core.isVirtual8086Mode() {
+		return core.interruptFromVirtual8086(cs, target, size, gateType&1 == 0, pushErrorCode, errorCode)
+	}
 
-	// Send EOI message to the 8259A
-	//core.sendEOI(vector)
-	// Send EOI command to the 8259A
-	eoiMessage := bus.BusMessage{
-		Subject: common.MESSAGE_INTERRUPT_COMPLETE,
-		Sender:  message.Sender,
-		Data:    []byte{vector},
+	stack, esp := core.registers.SS, *core.registers.ESP()
+	var returnState []uint32
+	if !cs.Conforming() && cs.DPL() < cpl {
+		cpl = cs.DPL()
+		if stack, esp, err = core.innerStack(cpl); err != nil {
+			return err
+		}
+		returnState = append(returnState, uint32(core.registers.SS.Selector), *core.registers.ESP())
 	}
-	err = core.bus.SendMessageToDeviceById(message.Sender, eoiMessage)
-	if err != nil {
-		core.logDebug(fmt.Sprintf("CPU: Error sending EOI message: %v", err))
+	returnState = append(returnState, core.registers.EFLAGS, uint32(core.registers.CS.Selector), *core.registers.EIP())
+	if pushErrorCode {
+		returnState = append(returnState, uint32(errorCode))
+	}
+	if err := core.pushOnStack(stack, esp, size, returnState); err != nil {
+		return err
 	}
-}
 
-func (core *CpuCore) AcknowledgeInterrupt(message bus.BusMessage) {
-	// send message to the interrupt controller that raised the interrupt
-	err := core.bus.SendMessageToDeviceById(message.Sender, bus.BusMessage{Subject: common.MESSAGE_INTERRUPT_ACKNOWLEDGE, Data: message.Data})
-	if err != nil {
-		log.Fatalf("Failed to acknowledge interrupt: %s", err)
-		return
+	if gateType&1 == 0 {
+		core.registers.SetFlag(InterruptFlag, false)
 	}
+	core.registers.EFLAGS &^= TrapFlag | NestedTaskFlag | ResumeFlag
+
+	core.enterCodeSegment(cs, cpl)
+	core.setInstructionPointer(target)
+	return nil
 }
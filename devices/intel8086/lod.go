@@ -2,138 +2,172 @@ package intel8086
 
 import (
 	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+	"log"
 )
 
-func INSTR_LODS(core *CpuCore) {
-	core.currentByteAddr++
-
-	var prefixStr = ""
-	var operStr = ""
-	var extras = ""
-	if core.flags.RepPrefixEnabled {
-		prefixStr = "REP"
-	}
+/*
+	String instructions
+	The source operand is DS:SI, or another segment given by an override prefix, and the destination
+	is always ES:DI. The address size picks SI, DI and CX or ESI, EDI and ECX. A rep prefix repeats the
+	instruction CX times, and for cmps and scas also stops on the first mismatch with repe or the
+	first match with repne.
+*/
+
+// stringIndex reads SI, DI or CX at the current address size
+func (core *CpuCore) stringIndex(index uint8) uint32 {
+	value, _ := core.readReg(index, core.addressSize())
+	return value
+}
 
-	if core.registers.CX > 0 && core.flags.RepPrefixEnabled {
-		extras = fmt.Sprintf("(%d repetitions)", core.registers.CX)
+// advanceStringIndex steps SI or DI past an element, backwards when the direction flag is set
+func (core *CpuCore) advanceStringIndex(index uint8, size uint8) {
+	step := uint32(size / 8)
+	if core.registers.GetFlag(DirectionFlag) {
+		step = -step
 	}
+	core.writeReg(index, core.addressSize(), core.stringIndex(index)+step)
+}
 
-	segment := core.getSegmentOverride() // Get overridden segment register
-
-	for (core.registers.CX > 0 && core.flags.RepPrefixEnabled) || !core.flags.RepPrefixEnabled {
-		switch core.currentOpCodeBeingExecuted {
-		case 0xAC:
-			m8, err := core.memoryAccessController.ReadMemoryValue8(core.SegmentAddressToLinearAddress(segment, uint16(core.registers.SI)))
-			if err != nil {
-				core.logInstruction(fmt.Sprintf("Error reading memory: %s", err))
-				return
-			}
-			core.registers.AL = m8
-			if core.registers.GetFlag(DirectionFlag) {
-				core.registers.SI -= 1
-			} else {
-				core.registers.SI += 1
-			}
-		case 0xAD:
-			m16, err := core.memoryAccessController.ReadMemoryValue16(core.SegmentAddressToLinearAddress(segment, uint16(core.registers.SI)))
-			if err != nil {
-				core.logInstruction(fmt.Sprintf("Error reading memory: %s", err))
-				return
-			}
-			core.registers.AX = m16
-			if core.registers.GetFlag(DirectionFlag) {
-				core.registers.SI -= 2
-			} else {
-				core.registers.SI += 2
-			}
-		}
-		if !core.flags.RepPrefixEnabled {
-			break
-		} else {
-			core.registers.CX--
-		}
-	}
+// readStringSource reads the element at DS:SI, or the override segment:SI
+func (core *CpuCore) readStringSource(size uint8) (uint32, error) {
+	return core.readSegment(core.segmentFor(common.SEGMENT_DS), core.stringIndex(REG_ESI), size)
+}
 
-	core.logInstruction(fmt.Sprintf("[%#04x] %s %s %s", core.GetCurrentlyExecutingInstructionAddress(), prefixStr, operStr, extras))
+// readStringDestination reads the element at ES:DI
+func (core *CpuCore) readStringDestination(size uint8) (uint32, error) {
+	return core.readSegment(&core.registers.ES, core.stringIndex(REG_EDI), size)
+}
 
+// writeStringDestination writes the element at ES:DI
+func (core *CpuCore) writeStringDestination(size uint8, value uint32) error {
+	return core.writeSegment(&core.registers.ES, core.stringIndex(REG_EDI), size, value)
 }
 
-func INSTR_STOSB(core *CpuCore) {
+// repeatString runs step once, or with a rep prefix until the count register reaches zero. When
+// compares is set a repeat also ends once the zero flag left by step stops matching the prefix.
+func (core *CpuCore) repeatString(mnemonic string, compares bool, step func() error) {
 	core.currentByteAddr++
 
-	// Check if there is a repetition prefix
-	if core.flags.RepPrefixEnabled {
-		// Execute the operation for the number of times specified in the CX register
-		for core.registers.CX > 0 {
-			// Perform the STOSB operation
-			core.memoryAccessController.WriteMemoryAddr8(core.SegmentAddressToLinearAddress(core.registers.ES, core.registers.DI), core.registers.AL)
-
-			// Update the DI register depending on the direction flag
-			if core.registers.GetFlag(DirectionFlag) {
-				core.registers.DI--
-			} else {
-				core.registers.DI++
-			}
-
-			core.registers.CX--
+	if !core.flags.RepPrefixEnabled {
+		if err := step(); err != nil {
+			log.Printf("Error executing %s: %v", mnemonic, err)
 		}
+		return
+	}
 
-		// Reset the repetition prefix
-		core.flags.RepPrefixEnabled = false
-
-	} else {
-		// No repetition prefix, just perform the STOSB operation once
-		core.memoryAccessController.WriteMemoryAddr8(core.SegmentAddressToLinearAddress(core.registers.ES, core.registers.DI), core.registers.AL)
-
-		// Update the DI register depending on the direction flag
-		if core.registers.GetFlag(DirectionFlag) {
-			core.registers.DI--
-		} else {
-			core.registers.DI++
+	for {
+		count := core.stringIndex(REG_ECX)
+		if count == 0 {
+			return
+		}
+		if err := step(); err != nil {
+			log.Printf("Error executing %s: %v", mnemonic, err)
+			return
+		}
+		core.writeReg(REG_ECX, core.addressSize(), count-1)
+		if compares && core.registers.GetFlag(ZeroFlag) == core.flags.RepNePrefixEnabled {
+			return
 		}
 	}
+}
 
-	// Log the instruction
-	core.logInstruction(fmt.Sprintf("[%#04x] STOSB", core.GetCurrentlyExecutingInstructionAddress()))
-
+// stringMnemonic names a string instruction with its element size and any repeat prefix, e.g. REP MOVSW
+func (core *CpuCore) stringMnemonic(name string, size uint8) string {
+	suffix := map[uint8]string{8: "B", 16: "W", 32: "D"}[size]
+	switch {
+	case core.flags.RepNePrefixEnabled:
+		return "REPNE " + name + suffix
+	case core.flags.RepPrefixEnabled:
+		return "REP " + name + suffix
+	}
+	return name + suffix
 }
 
-func INSTR_STOSD(core *CpuCore) {
-	core.currentByteAddr++
+func INSTR_MOVS(core *CpuCore) {
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("MOVS", size)
+	core.logInstruction(fmt.Sprintf("[%#04x] %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic))
 
-	// Check if there is a repetition prefix
-	if core.flags.RepPrefixEnabled {
-		// Execute the operation for the number of times specified in the CX register
-		for core.registers.CX > 0 {
-			// Perform the STOSD operation
-			core.memoryAccessController.WriteMemoryAddr32(core.SegmentAddressToLinearAddress32(core.registers.ES, core.registers.EDI), core.registers.EAX)
-
-			// Update the DI register depending on the direction flag
-			if core.registers.GetFlag(DirectionFlag) {
-				core.registers.EDI -= 4
-			} else {
-				core.registers.EDI += 4
-			}
-
-			core.registers.CX--
+	core.repeatString(mnemonic, false, func() error {
+		value, err := core.readStringSource(size)
+		if err != nil {
+			return err
+		}
+		if err := core.writeStringDestination(size, value); err != nil {
+			return err
 		}
+		core.advanceStringIndex(REG_ESI, size)
+		core.advanceStringIndex(REG_EDI, size)
+		return nil
+	})
+}
+
+func INSTR_CMPS(core *CpuCore) {
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("CMPS", size)
+	core.logInstruction(fmt.Sprintf("[%#04x] %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic))
 
-		// Reset the repetition prefix
-		core.flags.RepPrefixEnabled = false
+	core.repeatString(mnemonic, true, func() error {
+		term1, err := core.readStringSource(size)
+		if err != nil {
+			return err
+		}
+		term2, err := core.readStringDestination(size)
+		if err != nil {
+			return err
+		}
+		core.subWithFlags(size, term1, term2, 0)
+		core.advanceStringIndex(REG_ESI, size)
+		core.advanceStringIndex(REG_EDI, size)
+		return nil
+	})
+}
 
-	} else {
-		// No repetition prefix, just perform the STOSD operation once
-		core.memoryAccessController.WriteMemoryAddr32(core.SegmentAddressToLinearAddress32(core.registers.ES, core.registers.EDI), core.registers.EAX)
+func INSTR_SCAS(core *CpuCore) {
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("SCAS", size)
+	core.logInstruction(fmt.Sprintf("[%#04x] %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic))
 
-		// Update the DI register depending on the direction flag
-		if core.registers.GetFlag(DirectionFlag) {
-			core.registers.EDI -= 4
-		} else {
-			core.registers.EDI += 4
+	core.repeatString(mnemonic, true, func() error {
+		value, err := core.readStringDestination(size)
+		if err != nil {
+			return err
 		}
-	}
+		accumulator, _ := core.readReg(REG_EAX, size)
+		core.subWithFlags(size, accumulator, value, 0)
+		core.advanceStringIndex(REG_EDI, size)
+		return nil
+	})
+}
+
+func INSTR_STOS(core *CpuCore) {
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("STOS", size)
+	core.logInstruction(fmt.Sprintf("[%#04x] %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic))
 
-	// Log the instruction
-	core.logInstruction(fmt.Sprintf("[%#04x] STOSD", core.GetCurrentlyExecutingInstructionAddress()))
+	core.repeatString(mnemonic, false, func() error {
+		accumulator, _ := core.readReg(REG_EAX, size)
+		if err := core.writeStringDestination(size, accumulator); err != nil {
+			return err
+		}
+		core.advanceStringIndex(REG_EDI, size)
+		return nil
+	})
+}
 
+func INSTR_LODS(core *CpuCore) {
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("LODS", size)
+	core.logInstruction(fmt.Sprintf("[%#04x] %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic))
+
+	core.repeatString(mnemonic, false, func() error {
+		value, err := core.readStringSource(size)
+		if err != nil {
+			return err
+		}
+		core.writeReg(REG_EAX, size, value)
+		core.advanceStringIndex(REG_ESI, size)
+		return nil
+	})
 }
@@ -0,0 +1,179 @@
+package intel8086
+
+import "fmt"
+
+/*
+	CPU models
+	The core can stand in for the processors PC software tells apart when it probes what it is
+	running on. The 8086 pushes SP after decrementing it, always has FLAGS bits 12-15 set, runs 0F
+	as POP CS, has none of the 186's instructions and drives 20 address lines. The 80286 always
+	has FLAGS bits 12-15 clear in real mode, drives 24 address lines, reads the unused machine
+	status word bits as ones, only reaches its machine status word through LMSW and SMSW rather
+	than MOV CRn, has LOADALL, and raises #UD for the 386's prefixes and two byte opcodes. The
+	386SX is a 386 on a 24 bit bus. After reset a 386 leaves its component and stepping ids in DX.
+*/
+
+// CpuModel is the processor a CpuCore behaves as
+type CpuModel uint8
+
+const (
+	CPU_MODEL_8086 CpuModel = iota
+	CPU_MODEL_80286
+	CPU_MODEL_80386SX
+	CPU_MODEL_80386DX
+)
+
+// LOADALL_TABLE is the physical address the 286 LOADALL reads the whole processor state from
+const LOADALL_TABLE = 0x800
+
+func (model CpuModel) String() string {
+	switch model {
+	case CPU_MODEL_8086:
+		return "8086"
+	case CPU_MODEL_80286:
+		return "80286"
+	case CPU_MODEL_80386SX:
+		return "80386SX"
+	}
+	return "80386DX"
+}
+
+// AddressBits is the width of the model's address bus
+func (model CpuModel) AddressBits() uint8 {
+	switch model {
+	case CPU_MODEL_8086:
+		return 20
+	case CPU_MODEL_80286, CPU_MODEL_80386SX:
+		return 24
+	}
+	return 32
+}
+
+// resetSignature is DX after reset, the component id in DH and the stepping in DL. Only the 386
+// has one, the 8086 and 286 leave DX clear.
+func (model CpuModel) resetSignature() uint16 {
+	switch model {
+	case CPU_MODEL_80386SX:
+		return 0x2308
+	case CPU_MODEL_80386DX:
+		return 0x0308
+	}
+	return 0
+}
+
+// isPrefix is isPrefixByte for the model. FS, GS and the operand and address size overrides are
+// the 386's, 64-67 being conditional jumps on the 8086 and invalid on the 286.
+func (model CpuModel) isPrefix(b uint8) bool {
+	if (model == CPU_MODEL_8086 || model == CPU_MODEL_80286) && b >= 0x64 && b <= 0x67 {
+		return false
+	}
+	return isPrefixByte(&b)
+}
+
+// decodeOpcode is the one byte opcode the model runs opcode as, and false if it has no such
+// instruction. The 8086 only partly decodes the opcodes the 186 went on to use, running 60-6F as
+// the conditional jumps 70-7F, C0 and C1 as the near returns C2 and C3, and C8 and C9 as the far
+// returns CA and CB.
+func (model CpuModel) decodeOpcode(opcode uint8) (uint8, bool) {
+	switch {
+	case model == CPU_MODEL_8086 && opcode >= 0x60 && opcode <= 0x6F:
+		return opcode + 0x10, true
+	case model == CPU_MODEL_8086 && (opcode == 0xC0 || opcode == 0xC1 || opcode == 0xC8 || opcode == 0xC9):
+		return opcode + 2, true
+	case model == CPU_MODEL_80286 && opcode >= 0x64 && opcode <= 0x67:
+		return opcode, false
+	}
+	return opcode, true
+}
+
+// hasTwoByteOpcode reports whether the model has the 0F opcode. The 286 only has the protection
+// instructions 0F 00-03, LOADALL and CLTS, the rest arrived with the 386.
+func (model CpuModel) hasTwoByteOpcode(opcode uint8) bool {
+	return model != CPU_MODEL_80286 || opcode <= 0x06 && opcode != 0x04
+}
+
+// Model is the processor the core behaves as
+func (core *CpuCore) Model() CpuModel {
+	return core.model
+}
+
+// writableFlags are the bits of EFLAGS that POPF, IRET and task switches can load. The 8086 has
+// no IOPL or NT, and neither does the 286 in real mode, and only the 386 has EFLAGS above bit 15.
+func (core *CpuCore) writableFlags() uint32 {
+	switch {
+	case core.model == CPU_MODEL_8086:
+		return 0x0FD5
+	case core.model == CPU_MODEL_80286 && !core.isProtectedMode():
+		return 0x0FD5
+	case core.model == CPU_MODEL_80286:
+		return 0x7FD5
+	}
+	return 0x37FD5
+}
+
+// fixedFlags are the bits of EFLAGS that always read as set, bit 1 and on the 8086 bits 12-15
+func (core *CpuCore) fixedFlags() uint32 {
+	if core.model == CPU_MODEL_8086 {
+		return 0xF002
+	}
+	return 0x0002
+}
+
+// INSTR_LOADALL loads every register, including the hidden descriptor caches, from the table at
+// LOADALL_TABLE, 0F 05. It is the 286's, and only runs at CPL 0. A 286 descriptor cache entry is
+// a 24 bit base, the access byte and a 16 bit limit.
+func INSTR_LOADALL(core *CpuCore) {
+	if core.model != CPU_MODEL_80286 {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+	if core.checkPrivilege() != nil {
+		return
+	}
+
+	var table [0x66]uint8
+	for i := range table {
+		value, err := core.memoryAccessController.ReadMemoryValue8(LOADALL_TABLE + uint32(i))
+		if err != nil {
+			return
+		}
+		table[i] = value
+	}
+	word := func(offset int) uint16 {
+		return uint16(table[offset]) | uint16(table[offset+1])<<8
+	}
+	cache := func(offset int, selector uint16) SegmentRegister {
+		return SegmentRegister{
+			Selector:           selector,
+			Base:               uint32(table[offset]) | uint32(table[offset+1])<<8 | uint32(table[offset+2])<<16,
+			Limit:              uint32(word(offset + 4)),
+			access_information: uint16(table[offset+3]),
+		}
+	}
+	descriptorTable := func(offset int) DescriptorTableRegister {
+		entry := cache(offset, 0)
+		return DescriptorTableRegister{Base: entry.Base, Limit: uint16(entry.Limit)}
+	}
+
+	registers := core.registers
+	for i, index := range []uint8{REG_EDI, REG_ESI, REG_EBP, REG_ESP, REG_EBX, REG_EDX, REG_ECX, REG_EAX} {
+		core.writeReg(index, 16, uint32(word(0x26+2*i)))
+	}
+	registers.ES = cache(0x36, word(0x24))
+	registers.CS = cache(0x3C, word(0x22))
+	registers.SS = cache(0x42, word(0x20))
+	registers.DS = cache(0x48, word(0x1E))
+	registers.GDTR = descriptorTable(0x4E)
+	registers.LDTR = cache(0x54, word(0x1C))
+	registers.IDTR = descriptorTable(0x5A)
+	registers.TR = cache(0x60, word(0x16))
+
+	// like LMSW, LOADALL can't leave protected mode
+	core.updateSystemFlags(registers.CR0&^0xF | uint32(word(0x06))&0xF | registers.CR0&CR0_PE)
+	core.loadFlags(uint32(word(0x18)))
+	core.currentPrivilegeLevel = registers.CS.DPL()
+	core.logInstruction(fmt.Sprintf("[%#04x] LOADALL", core.GetCurrentlyExecutingInstructionAddress()))
+
+	*registers.EIP() = uint32(word(0x1A))
+	core.flags.IsFarJump = true
+}
@@ -7,7 +7,7 @@ type ModRm struct {
 	reg uint8 // Reg field typically used for register opcode extension.
 	rm  uint8 // R/M field specifies register/memory operand addressing.
 
-	sib   uint8 // SIB byte used in protected mode for more complex addressing.
+	sib   uint8 // SIB byte used by 32 bit addressing for more complex addressing.
 	base  uint8 // Base register index (part of SIB byte decoding).
 	index uint8 // Index register index (part of SIB byte decoding).
 	scale uint8 // Scale factor (part of SIB byte decoding).
@@ -26,7 +26,7 @@ func (core *CpuCore) consumeModRm() (ModRm, uint32, error) {
 	var modrmByte uint8
 	m := ModRm{}
 
-	modrmByte, err := core.memoryAccessController.ReadMemoryValue8(uint32(core.currentByteAddr))
+	modrmByte, err := core.fetchCode8(core.currentByteAddr)
 	if err != nil {
 		return m, bytesConsumed, err
 	}
@@ -36,11 +36,11 @@ func (core *CpuCore) consumeModRm() (ModRm, uint32, error) {
 	m.reg = (modrmByte >> 3) & 0x07
 	m.rm = modrmByte & 0x07
 
-	// Handle real mode and protected mode addressing
-	if core.registers.CR0&1 == 0 { // Real mode
-		bytesConsumed, err = handleRealModeAddressing(core, &m, bytesConsumed)
-	} else { // Protected mode
-		bytesConsumed, err = handleProtectedModeAddressing(core, &m, bytesConsumed)
+	// the address size, not the cpu mode, decides between the 16 and 32 bit addressing forms
+	if core.Is32BitAddress() {
+		bytesConsumed, err = decodeModRm32(core, &m, bytesConsumed)
+	} else {
+		bytesConsumed, err = decodeModRm16(core, &m, bytesConsumed)
 	}
 	if err != nil {
 		return m, bytesConsumed, err
@@ -49,13 +49,13 @@ func (core *CpuCore) consumeModRm() (ModRm, uint32, error) {
 	return m, bytesConsumed, nil
 }
 
-func handleRealModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32) (uint32, error) {
+func decodeModRm16(core *CpuCore, m *ModRm, bytesConsumed uint32) (uint32, error) {
 	var err error
 
 	switch m.mod {
 	case 0:
 		if m.rm == 6 { // Special case: direct addressing with a 16-bit displacement
-			m.disp16, err = core.memoryAccessController.ReadMemoryValue16(uint32(core.currentByteAddr + bytesConsumed))
+			m.disp16, err = core.fetchCode16(core.currentByteAddr + bytesConsumed)
 			if err != nil {
 				return bytesConsumed, err
 			}
@@ -65,7 +65,7 @@ func handleRealModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32) (ui
 
 	case 1: // 8-bit displacement
 		var disp8 uint8
-		disp8, err = core.memoryAccessController.ReadMemoryValue8(uint32(core.currentByteAddr + bytesConsumed))
+		disp8, err = core.fetchCode8(core.currentByteAddr + bytesConsumed)
 		if err != nil {
 			return bytesConsumed, err
 		}
@@ -73,7 +73,7 @@ func handleRealModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32) (ui
 		bytesConsumed++
 
 	case 2: // 16-bit displacement
-		m.disp16, err = core.memoryAccessController.ReadMemoryValue16(uint32(core.currentByteAddr + bytesConsumed))
+		m.disp16, err = core.fetchCode16(core.currentByteAddr + bytesConsumed)
 		if err != nil {
 			return bytesConsumed, err
 		}
@@ -90,12 +90,12 @@ func handleRealModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32) (ui
 	return bytesConsumed, nil
 }
 
-func handleProtectedModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32) (uint32, error) {
+func decodeModRm32(core *CpuCore, m *ModRm, bytesConsumed uint32) (uint32, error) {
 	var err error
 
 	// Check if there's an SIB byte to decode
 	if m.mod != 3 && m.rm == 4 { // SIB byte is present when mod != 3 and rm = 4
-		m.sib, err = core.memoryAccessController.ReadMemoryValue8(uint32(core.currentByteAddr + bytesConsumed))
+		m.sib, err = core.fetchCode8(core.currentByteAddr + bytesConsumed)
 		if err != nil {
 			return bytesConsumed, err
 		}
@@ -109,8 +109,8 @@ func handleProtectedModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32
 	// Handle displacements based on the mod value
 	switch m.mod {
 	case 0:
-		if m.rm == 5 { // Only when rm is 5, it means disp32 with no base register in mod 0
-			m.disp32, err = core.memoryAccessController.ReadMemoryValue32(uint32(core.currentByteAddr + bytesConsumed))
+		if m.rm == 5 || (m.rm == 4 && m.base == 5) { // disp32 with no base register, with or without an SIB byte
+			m.disp32, err = core.fetchCode32(core.currentByteAddr + bytesConsumed)
 			if err != nil {
 				return bytesConsumed, err
 			}
@@ -119,7 +119,7 @@ func handleProtectedModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32
 
 	case 1: // 8-bit displacement, applies to all rm values including when an SIB byte is present
 		var disp8 uint8
-		disp8, err = core.memoryAccessController.ReadMemoryValue8(uint32(core.currentByteAddr + bytesConsumed))
+		disp8, err = core.fetchCode8(core.currentByteAddr + bytesConsumed)
 		if err != nil {
 			return bytesConsumed, err
 		}
@@ -127,7 +127,7 @@ func handleProtectedModeAddressing(core *CpuCore, m *ModRm, bytesConsumed uint32
 		bytesConsumed++
 
 	case 2: // 32-bit displacement, applies to all rm values including when an SIB byte is present
-		m.disp32, err = core.memoryAccessController.ReadMemoryValue32(uint32(core.currentByteAddr + bytesConsumed))
+		m.disp32, err = core.fetchCode32(core.currentByteAddr + bytesConsumed)
 		if err != nil {
 			return bytesConsumed, err
 		}
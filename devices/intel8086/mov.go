@@ -2,264 +2,129 @@ package intel8086
 
 import (
 	"fmt"
+	"github.com/andrewjc/threeatesix/common"
 	"log"
 )
 
 func INSTR_MOV(core *CpuCore) {
+	opcode := core.currentOpCodeBeingExecuted
 
-	switch core.currentOpCodeBeingExecuted {
-	case 0xA0:
+	switch opcode {
+	case 0xA0, 0xA1:
 		{
-			// mov al, moffs8*
+			// mov AL/eAX, moffs
 			core.currentByteAddr++
-			offset, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr)
+			size := core.operandSizeFor(opcode)
+			offset, err := core.readOffset()
 			if err != nil {
 				core.logInstruction(fmt.Sprintf("Error reading memory: %s", err))
 				return
 			}
-			core.currentByteAddr++
-
-			segment := core.getSegmentOverride() // Get overridden segment register
 
-			byteValue, err := core.memoryAccessController.ReadMemoryValue8(core.SegmentAddressToLinearAddress(segment, uint16(offset)))
+			value, err := core.readSegment(core.segmentFor(common.SEGMENT_DS), offset, size)
 			if err != nil {
 				core.logInstruction(fmt.Sprintf("Error reading memory: %s", err))
 				return
 			}
+			destName := core.writeReg(REG_EAX, size, value)
 
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV al, byte ptr %s:[%#02x]", core.GetCurrentlyExecutingInstructionAddress(), core.registers.indexSegmentToString(uint8(segment.Base)), offset))
-			core.registers.AL = byteValue
-		}
-	case 0xA1:
-		{
-
-			// mov ax, moffs16*
-			core.currentByteAddr++
-			offset, err := core.memoryAccessController.ReadMemoryValue16(core.currentByteAddr)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr += 2
-
-			segment := core.getSegmentOverride()
-			byteValue, err := core.memoryAccessController.ReadMemoryValue16(core.SegmentAddressToLinearAddress(segment, offset))
-			if err != nil {
-				goto eof
-			}
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV ax, word ptr %s:[%#04x]", core.GetCurrentlyExecutingInstructionAddress(), core.registers.indexSegmentToString(uint8(segment.Base)), offset))
-
-			core.registers.AX = byteValue
-		}
-	case 0xA2:
-		{
-			// mov moffs8*, al
-			core.currentByteAddr++
-			offset, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr++
-
-			segment := core.getSegmentOverride()
-			err = core.memoryAccessController.WriteMemoryAddr8(core.SegmentAddressToLinearAddress(segment, uint16(offset)), core.registers.AL)
-			if err != nil {
-				goto eof
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV byte ptr %s:[%#02x], al", core.GetCurrentlyExecutingInstructionAddress(), core.registers.indexSegmentToString(uint8(segment.Base)), offset))
-		}
-	case 0xA3:
-		{
-			// mov moffs16*, ax
-			core.currentByteAddr++
-			offset, err := core.memoryAccessController.ReadMemoryValue16(core.currentByteAddr)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr += 2
-
-			segment := core.getSegmentOverride()
-			err = core.memoryAccessController.WriteMemoryAddr16(core.SegmentAddressToLinearAddress(segment, offset), core.registers.AX)
-			if err != nil {
-				goto eof
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV word ptr %s:[%#04x], ax", core.GetCurrentlyExecutingInstructionAddress(), core.registers.indexSegmentToString(uint8(segment.Base)), offset))
-		}
-	case 0xA4:
-		{
-			// movsb
-			core.currentByteAddr++
-			src := core.getSegmentOverride()
-			dest := core.registers.ES
-			srcAddr := core.SegmentAddressToLinearAddress(src, core.registers.SI)
-			destAddr := core.SegmentAddressToLinearAddress(dest, core.registers.DI)
-
-			srcData, err := core.memoryAccessController.ReadMemoryValue8(srcAddr)
-			if err != nil {
-				goto eof
-			}
-
-			err = core.memoryAccessController.WriteMemoryAddr8(destAddr, srcData)
-			if err != nil {
-				goto eof
-			}
-
-			if !core.registers.GetFlag(DirectionFlag) {
-				core.registers.SI++
-				core.registers.DI++
-			} else {
-				core.registers.SI--
-				core.registers.DI--
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOVSB", core.GetCurrentlyExecutingInstructionAddress()))
+			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, [%#04x]", core.GetCurrentlyExecutingInstructionAddress(), destName, offset))
 		}
-	case 0xA5:
+	case 0xA2, 0xA3:
 		{
-			// movsw
+			// mov moffs, AL/eAX
 			core.currentByteAddr++
-			src := core.getSegmentOverride()
-			dest := core.registers.ES
-			srcAddr := core.SegmentAddressToLinearAddress(src, core.registers.SI)
-			destAddr := core.SegmentAddressToLinearAddress(dest, core.registers.DI)
-
-			srcData, err := core.memoryAccessController.ReadMemoryValue16(srcAddr)
+			size := core.operandSizeFor(opcode)
+			offset, err := core.readOffset()
 			if err != nil {
 				goto eof
 			}
 
-			err = core.memoryAccessController.WriteMemoryAddr16(destAddr, srcData)
+			value, srcName := core.readReg(REG_EAX, size)
+			err = core.writeSegment(core.segmentFor(common.SEGMENT_DS), offset, size, value)
 			if err != nil {
 				goto eof
 			}
 
-			if !core.registers.GetFlag(DirectionFlag) {
-				core.registers.SI += 2
-				core.registers.DI += 2
-			} else {
-				core.registers.SI -= 2
-				core.registers.DI -= 2
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOVSW", core.GetCurrentlyExecutingInstructionAddress()))
-
-		}
-	case 0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7:
-		{
-			// mov r8, imm8
-			core.currentByteAddr++
-			regIndex := core.currentOpCodeBeingExecuted - 0xB0
-			r8 := core.registers.registers8Bit[regIndex]
-			r8Str := core.registers.index8ToString(regIndex)
-			val, err := core.readImm8()
-			if err != nil {
-				goto eof
-			}
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %#02x", core.GetCurrentlyExecutingInstructionAddress(), r8Str, val))
-			*r8 = val
+			core.logInstruction(fmt.Sprintf("[%#04x] MOV [%#04x], %s", core.GetCurrentlyExecutingInstructionAddress(), offset, srcName))
 		}
-	case 0xB8, 0xB9, 0xBA, 0xBB, 0xBC, 0xBD, 0xBE, 0xBF:
+	case 0xB0, 0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6, 0xB7,
+		0xB8, 0xB9, 0xBA, 0xBB, 0xBC, 0xBD, 0xBE, 0xBF:
 		{
-			// mov r16, imm16
+			// mov reg, imm - B0-B7 are byte registers, B8-BF word or doubleword
 			core.currentByteAddr++
-			regIndex := uint8(core.currentOpCodeBeingExecuted - 0xB8)
-			immVal, _, err := core.GetImmediate16()
-			if err != nil {
-				goto eof
+			size := uint8(8)
+			if opcode >= 0xB8 {
+				size = core.operandSize()
 			}
-
-			regName, err := core.SetRegister16(regIndex, uint16(immVal))
-			if err != nil {
-				goto eof
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %#04x", core.GetCurrentlyExecutingInstructionAddress(), regName, immVal))
-		}
-	case 0x88:
-		{
-			/* MOV r/m8, r8 */
-			core.currentByteAddr++
-			modrm, bytesConsumed, err := core.consumeModRm()
+			val, err := core.readImm(size)
 			if err != nil {
 				goto eof
 			}
-			core.currentByteAddr += bytesConsumed
-
-			var src *uint8
-			var srcName string
-			var dstName string
-
-			src = core.registers.registers8Bit[modrm.rm]
-			srcName = core.registers.index8ToString(modrm.rm)
+			regName := core.writeReg(opcode&7, size, val)
 
-			dstName, err = core.writeRm8(&modrm, src)
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), dstName, srcName))
+			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %#x", core.GetCurrentlyExecutingInstructionAddress(), regName, val))
 		}
-	case 0x89:
+	case 0x88, 0x89:
 		{
-			/* MOV r/m16, r16 */
+			/* MOV r/m, reg */
 			core.currentByteAddr++
+			size := core.operandSizeFor(opcode)
 			modrm, bytesConsumed, err := core.consumeModRm()
 			if err != nil {
 				goto eof
 			}
 			core.currentByteAddr += bytesConsumed
 
-			src := core.registers.registers16Bit[modrm.reg]
-			srcName := core.registers.index16ToString(modrm.reg)
-
-			destName, err := core.writeRm16(&modrm, src)
+			src, srcName := core.readR(&modrm, size)
+			destName, err := core.writeRm(&modrm, size, src)
 			if err != nil {
 				goto eof
 			}
 
 			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), destName, srcName))
 		}
-	case 0x8A:
+	case 0x8A, 0x8B:
 		{
-			/* MOV r8,r/m8 */
+			/* MOV reg, r/m */
 			core.currentByteAddr++
+			size := core.operandSizeFor(opcode)
 			modrm, bytesConsumed, err := core.consumeModRm()
 			if err != nil {
 				goto eof
 			}
 			core.currentByteAddr += bytesConsumed
 
-			rm8, srcName, err := core.readRm8(&modrm)
+			src, srcName, err := core.readRm(&modrm, size)
 			if err != nil {
 				goto eof
 			}
-
-			dest := core.registers.registers8Bit[modrm.reg]
-			destName := core.registers.index8ToString(modrm.reg)
-
-			*dest = *rm8
+			destName := core.writeR(&modrm, size, src)
 
 			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), destName, srcName))
 		}
-	case 0x8B:
+	case 0xC6, 0xC7:
 		{
-			/* mov r16, r/m16 */
+			/* MOV r/m, imm */
 			core.currentByteAddr++
+			size := core.operandSizeFor(opcode)
 			modrm, bytesConsumed, err := core.consumeModRm()
 			if err != nil {
 				goto eof
 			}
 			core.currentByteAddr += bytesConsumed
 
-			rm16, srcName, err := core.readRm16(&modrm)
+			// the immediate follows the displacement, so the address is worked out after it is read
+			val, err := core.readImm(size)
+			if err != nil {
+				goto eof
+			}
+			destName, err := core.writeRm(&modrm, size, val)
 			if err != nil {
 				goto eof
 			}
 
-			dest := core.registers.registers16Bit[modrm.reg]
-			destName := core.registers.index16ToString(modrm.reg)
-
-			*dest = *rm16
-
-			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), destName, srcName))
+			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %#x", core.GetCurrentlyExecutingInstructionAddress(), destName, val))
 		}
 	case 0x8C:
 		{
@@ -270,12 +135,20 @@ func INSTR_MOV(core *CpuCore) {
 				goto eof
 			}
 			core.currentByteAddr += bytesConsumed
+			if modrm.reg > 5 {
+				core.fault(EXCEPTION_UD, 0)
+				goto eof
+			}
 
 			src := core.registers.registersSegmentRegisters[modrm.reg]
 			srcName := core.registers.indexSegmentToString(modrm.reg)
 
-			regBase := uint16(src.Base >> 4)
-			destName, err := core.writeRm16(&modrm, &regBase)
+			// a register destination takes the operand size, memory is always written as a word
+			size := uint8(16)
+			if modrm.mod == 3 {
+				size = core.operandSize()
+			}
+			destName, err := core.writeRm(&modrm, size, uint32(src.Selector))
 			if err != nil {
 				goto eof
 			}
@@ -292,28 +165,37 @@ func INSTR_MOV(core *CpuCore) {
 			}
 			core.currentByteAddr += bytesConsumed
 
-			src, srcName, err := core.readRm16(&modrm)
+			if modrm.reg == 1 || modrm.reg > 5 {
+				// CS can only be loaded by a far transfer
+				core.fault(EXCEPTION_UD, 0)
+				goto eof
+			}
+
+			src, srcName, err := core.readRm(&modrm, 16)
 			if err != nil {
 				goto eof
 			}
 
-			dest := core.registers.registersSegmentRegisters[modrm.reg]
 			dstName := core.registers.indexSegmentToString(modrm.reg)
-
-			dest.Base = uint32(*src) << 4
+			if err := core.loadSegment(uint32(modrm.reg)+1, uint16(src)); err != nil {
+				goto eof
+			}
 
 			core.logInstruction(fmt.Sprintf("[%#04x] MOV %s, %s", core.GetCurrentlyExecutingInstructionAddress(), dstName, srcName))
 		}
 	case 0x20:
 		{
-			/* MOV r32, cr0 */
-			core.currentByteAddr++
+			/* MOV r32, cr0 - 0F 20, so currentByteAddr is already at the modrm byte */
 			modrm, bytesConsumed, err := core.consumeModRm()
 			if err != nil {
 				goto eof
 			}
 			core.currentByteAddr += bytesConsumed
 
+			if core.checkPrivilege() != nil {
+				goto eof
+			}
+
 			dst := core.registers.registers32Bit[modrm.rm]
 			dstName := core.registers.index32ToString(modrm.rm)
 
@@ -344,13 +226,17 @@ func INSTR_MOV(core *CpuCore) {
 		}
 	case 0x22:
 		{
-			core.currentByteAddr++
+			/* MOV cr0, r32 - 0F 22 */
 			modrm, bytesConsumed, err := core.consumeModRm()
 			if err != nil {
 				goto eof
 			}
 			core.currentByteAddr += bytesConsumed
 
+			if core.checkPrivilege() != nil {
+				goto eof
+			}
+
 			src := core.registers.registers32Bit[modrm.rm]
 			srcName := core.registers.index32ToString(modrm.rm)
 
@@ -386,3 +272,24 @@ func INSTR_MOV(core *CpuCore) {
 
 eof:
 }
+
+// INSTR_LEA loads the offset a memory operand refers to, without reading memory or applying a segment
+func INSTR_LEA(core *CpuCore) {
+	core.currentByteAddr++
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		log.Println("Error consuming ModR/M byte: ", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+
+	if modrm.mod == 3 {
+		log.Println("LEA with a register operand is undefined")
+		return
+	}
+
+	offset, srcName, _ := core.effectiveOffset(&modrm)
+	destName := core.writeR(&modrm, core.operandSize(), offset)
+
+	core.logInstruction(fmt.Sprintf("[%#04x] LEA %s, %s", core.GetCurrentlyExecutingInstructionAddress(), destName, srcName))
+}
@@ -0,0 +1,282 @@
+package intel8086
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+)
+
+/*
+	Operand and address size
+	The D bit of the code segment picks the default operand and address size, 16 or 32 bits, and the
+	0x66 and 0x67 prefixes flip it for a single instruction. Handlers fetch their operands through the
+	sized helpers here, passing the width in bits, instead of choosing between the 16 and 32 bit
+	registers themselves.
+*/
+
+// Is32BitOperand reports whether the instruction being executed has 32 bit operands
+func (core *CpuCore) Is32BitOperand() bool {
+	return core.registers.CS.Is32Bit() != core.flags.OperandSizeOverrideEnabled
+}
+
+// Is32BitAddress reports whether the instruction being executed forms 32 bit addresses
+func (core *CpuCore) Is32BitAddress() bool {
+	return core.registers.CS.Is32Bit() != core.flags.AddressSizeOverrideEnabled
+}
+
+// operandSize is the width in bits of a word sized operand, 16 or 32
+func (core *CpuCore) operandSize() uint8 {
+	if core.Is32BitOperand() {
+		return 32
+	}
+	return 16
+}
+
+// operandSizeFor is the operand width of an opcode that uses its low bit to pick between
+// a byte and a word sized operand, as the ALU, test, xchg, mov and string opcodes do
+func (core *CpuCore) operandSizeFor(opcode uint8) uint8 {
+	if opcode&1 == 0 {
+		return 8
+	}
+	return core.operandSize()
+}
+
+// addressSize is the width in bits of offsets and of the index and count registers, 16 or 32
+func (core *CpuCore) addressSize() uint8 {
+	if core.Is32BitAddress() {
+		return 32
+	}
+	return 16
+}
+
+func sizeMask(size uint8) uint32 {
+	return uint32(1<<size - 1)
+}
+
+func signBit(size uint8) uint32 {
+	return 1 << (size - 1)
+}
+
+// signExtend widens the low size bits of value to 32 bits
+func signExtend(value uint32, size uint8) uint32 {
+	shift := 32 - size
+	return uint32(int32(value<<shift) >> shift)
+}
+
+func (core *CpuCore) segmentRegister(segment uint32) *SegmentRegister {
+	switch segment {
+	case common.SEGMENT_ES:
+		return &core.registers.ES
+	case common.SEGMENT_CS:
+		return &core.registers.CS
+	case common.SEGMENT_SS:
+		return &core.registers.SS
+	case common.SEGMENT_FS:
+		return &core.registers.FS
+	case common.SEGMENT_GS:
+		return &core.registers.GS
+	default:
+		return &core.registers.DS
+	}
+}
+
+// segmentFor is the segment a memory operand is in, the one named by a segment override
+// prefix if the instruction has one and otherwise the instruction's default segment
+func (core *CpuCore) segmentFor(defaultSegment uint32) *SegmentRegister {
+	if core.flags.MemorySegmentOverride > 0 {
+		return core.segmentRegister(core.flags.MemorySegmentOverride)
+	}
+	return core.segmentRegister(defaultSegment)
+}
+
+// linearAddress translates an offset within a segment to the address the memory controller sees,
+// without checking it against the segment's limit
+func (core *CpuCore) linearAddress(segment *SegmentRegister, offset uint32) uint32 {
+	return segment.Base + offset
+}
+
+// effectiveOffset works out the offset a memory modrm operand refers to with the current address
+// size, and the segment it defaults to. Addresses based on BP, EBP or ESP default to the stack segment.
+func (core *CpuCore) effectiveOffset(modrm *ModRm) (uint32, string, uint32) {
+	if core.Is32BitAddress() {
+		return core.effectiveOffset32(modrm)
+	}
+	return core.effectiveOffset16(modrm)
+}
+
+func (core *CpuCore) effectiveOffset16(modrm *ModRm) (uint32, string, uint32) {
+	var base uint16
+	var desc string
+	segment := uint32(common.SEGMENT_DS)
+
+	switch modrm.rm {
+	case 0:
+		base, desc = *core.registers.BX()+*core.registers.SI(), "BX+SI"
+	case 1:
+		base, desc = *core.registers.BX()+*core.registers.DI(), "BX+DI"
+	case 2:
+		base, desc, segment = *core.registers.BP()+*core.registers.SI(), "BP+SI", common.SEGMENT_SS
+	case 3:
+		base, desc, segment = *core.registers.BP()+*core.registers.DI(), "BP+DI", common.SEGMENT_SS
+	case 4:
+		base, desc = *core.registers.SI(), "SI"
+	case 5:
+		base, desc = *core.registers.DI(), "DI"
+	case 6:
+		if modrm.mod == 0 {
+			return uint32(modrm.disp16), fmt.Sprintf("[%#04x]", modrm.disp16), segment
+		}
+		base, desc, segment = *core.registers.BP(), "BP", common.SEGMENT_SS
+	case 7:
+		base, desc = *core.registers.BX(), "BX"
+	}
+
+	switch modrm.mod {
+	case 1:
+		base += uint16(int8(modrm.disp8))
+		desc = fmt.Sprintf("%s%+#x", desc, int8(modrm.disp8))
+	case 2:
+		base += modrm.disp16
+		desc = fmt.Sprintf("%s+%#04x", desc, modrm.disp16)
+	}
+	return uint32(base), "[" + desc + "]", segment
+}
+
+func (core *CpuCore) effectiveOffset32(modrm *ModRm) (uint32, string, uint32) {
+	var offset uint32
+	var desc string
+	segment := uint32(common.SEGMENT_DS)
+
+	base := modrm.rm
+	if modrm.rm == 4 {
+		base = modrm.base
+	}
+	if modrm.mod == 0 && base == REG_EBP {
+		// no base register, just a 32 bit displacement
+		offset, desc = modrm.disp32, fmt.Sprintf("%#08x", modrm.disp32)
+	} else {
+		offset, desc = *core.registers.registers32Bit[base], core.registers.index32ToString(base)
+		if base == REG_ESP || base == REG_EBP {
+			segment = common.SEGMENT_SS
+		}
+	}
+
+	if modrm.rm == 4 && modrm.index != REG_ESP {
+		// an index of ESP means no index
+		offset += *core.registers.registers32Bit[modrm.index] << modrm.scale
+		desc = fmt.Sprintf("%s+%s*%d", desc, core.registers.index32ToString(modrm.index), 1<<modrm.scale)
+	}
+
+	switch {
+	case modrm.mod == 1:
+		offset += signExtend(uint32(modrm.disp8), 8)
+		desc = fmt.Sprintf("%s%+#x", desc, int8(modrm.disp8))
+	case modrm.mod == 2:
+		offset += modrm.disp32
+		desc = fmt.Sprintf("%s+%#08x", desc, modrm.disp32)
+	}
+	return offset, "[" + desc + "]", segment
+}
+
+// memoryOperand is the segment and offset of a memory modrm operand
+func (core *CpuCore) memoryOperand(modrm *ModRm) (*SegmentRegister, uint32, string) {
+	offset, desc, segment := core.effectiveOffset(modrm)
+	return core.segmentFor(segment), offset, desc
+}
+
+func (core *CpuCore) readMemory(addr uint32, size uint8) (uint32, error) {
+	switch size {
+	case 8:
+		return common.UInt32From8(core.memoryAccessController.ReadMemoryValue8(addr))
+	case 16:
+		return common.UInt32From16(core.memoryAccessController.ReadMemoryValue16(addr))
+	default:
+		return core.memoryAccessController.ReadMemoryValue32(addr)
+	}
+}
+
+func (core *CpuCore) writeMemory(addr uint32, size uint8, value uint32) error {
+	switch size {
+	case 8:
+		return core.memoryAccessController.WriteMemoryAddr8(addr, uint8(value))
+	case 16:
+		return core.memoryAccessController.WriteMemoryAddr16(addr, uint16(value))
+	default:
+		return core.memoryAccessController.WriteMemoryAddr32(addr, value)
+	}
+}
+
+// readReg reads general purpose register index as an 8, 16 or 32 bit register
+func (core *CpuCore) readReg(index uint8, size uint8) (uint32, string) {
+	switch size {
+	case 8:
+		return uint32(*core.registers.registers8Bit[index]), core.registers.index8ToString(index)
+	case 16:
+		return uint32(*core.registers.registers16Bit[index]), core.registers.index16ToString(index)
+	default:
+		return *core.registers.registers32Bit[index], core.registers.index32ToString(index)
+	}
+}
+
+// writeReg writes general purpose register index as an 8, 16 or 32 bit register, leaving the
+// rest of the 32 bit register alone
+func (core *CpuCore) writeReg(index uint8, size uint8, value uint32) string {
+	switch size {
+	case 8:
+		*core.registers.registers8Bit[index] = uint8(value)
+		return core.registers.index8ToString(index)
+	case 16:
+		*core.registers.registers16Bit[index] = uint16(value)
+		return core.registers.index16ToString(index)
+	default:
+		*core.registers.registers32Bit[index] = value
+		return core.registers.index32ToString(index)
+	}
+}
+
+// readRm reads the register or memory operand of a modrm byte
+func (core *CpuCore) readRm(modrm *ModRm, size uint8) (uint32, string, error) {
+	if modrm.mod == 3 {
+		value, name := core.readReg(modrm.rm, size)
+		return value, name, nil
+	}
+	segment, offset, desc := core.memoryOperand(modrm)
+	value, err := core.readSegment(segment, offset, size)
+	return value, desc, err
+}
+
+// writeRm writes the register or memory operand of a modrm byte
+func (core *CpuCore) writeRm(modrm *ModRm, size uint8, value uint32) (string, error) {
+	if modrm.mod == 3 {
+		return core.writeReg(modrm.rm, size, value), nil
+	}
+	segment, offset, desc := core.memoryOperand(modrm)
+	return desc, core.writeSegment(segment, offset, size, value)
+}
+
+// readR reads the register named by the reg field of a modrm byte
+func (core *CpuCore) readR(modrm *ModRm, size uint8) (uint32, string) {
+	return core.readReg(modrm.reg, size)
+}
+
+// writeR writes the register named by the reg field of a modrm byte
+func (core *CpuCore) writeR(modrm *ModRm, size uint8, value uint32) string {
+	return core.writeReg(modrm.reg, size, value)
+}
+
+// readImm reads an immediate of the given width from the instruction stream
+func (core *CpuCore) readImm(size uint8) (uint32, error) {
+	switch size {
+	case 8:
+		return common.UInt32From8(core.readImm8())
+	case 16:
+		return common.UInt32From16(core.readImm16())
+	default:
+		return core.readImm32()
+	}
+}
+
+// readOffset reads a memory offset of the current address size from the instruction stream, as
+// the moffs forms of mov and far pointers use
+func (core *CpuCore) readOffset() (uint32, error) {
+	return core.readImm(core.addressSize())
+}
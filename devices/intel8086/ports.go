@@ -6,210 +6,136 @@ import (
 )
 
 func INSTR_IN(core *CpuCore) {
-	// Read from port
+	// Read from port. E4/E5 take the port from an imm8, EC/ED from DX.
+	// E5/ED read a word, or a dword with a 32 bit operand size.
 
+	var port uint16
 	switch core.currentOpCodeBeingExecuted {
-	case 0xE4:
-		{
-			// Read from port (imm) to AL
-			imm, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr + 1)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr += 2
-
-			data := core.ioPortAccessController.ReadAddr8(uint16(imm))
-
-			if imm == 0x80 {
-				// do nothing
-			} else {
-				core.registers.AL = data
-			}
-			core.logInstruction(fmt.Sprintf("[%#04x] IN AL, IMM8 (Port: %#04x, data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), imm, data))
-		}
-	case 0xE5:
-		{
-			// Read from port (DX) to AL
-
-			dx := core.registers.DX
-
-			data := core.ioPortAccessController.ReadAddr8(uint16(dx))
-
-			core.registers.AL = data
-			core.logInstruction(fmt.Sprintf("[%#04x] IN AL, DX (Port: %#04x, data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), dx, data))
-		}
-	case 0xEC:
-		{
-			// Read from port (imm) to AX
-
-			imm, err := core.memoryAccessController.ReadMemoryValue16(core.currentByteAddr + 1)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr += 2
-
-			data := core.ioPortAccessController.ReadAddr16(imm)
-
-			core.registers.AX = data
-			core.logInstruction(fmt.Sprintf("[%#04x] IN AX, IMM16 (Port: %#04x, data = %#16x)", core.GetCurrentlyExecutingInstructionAddress(), imm, data))
-		}
-	case 0xED:
-		{
-			// Read from port (DX) to AX
-
-			dx := core.registers.DX
-
-			data := core.ioPortAccessController.ReadAddr16(uint16(dx))
-
-			core.registers.AX = data
-			core.logInstruction(fmt.Sprintf("[%#04x] IN AX, DX (Port: %#04x, data = %#16x)", core.GetCurrentlyExecutingInstructionAddress(), dx, data))
+	case 0xE4, 0xE5:
+		imm, err := core.fetchCode8(core.currentByteAddr + 1)
+		if err != nil {
+			return
 		}
+		port = uint16(imm)
+		core.currentByteAddr += 2
+	case 0xEC, 0xED:
+		port = *core.registers.DX()
+		core.currentByteAddr++
 	default:
 		log.Fatal("Unrecognised IN (port read) instruction!")
 	}
+	if core.checkIOPermission(port, core.operandSizeFor(core.currentOpCodeBeingExecuted)) != nil {
+		return
+	}
 
-eof:
+	switch {
+	case core.currentOpCodeBeingExecuted == 0xE4 || core.currentOpCodeBeingExecuted == 0xEC:
+		data := core.ioPortAccessController.ReadAddr8(port)
+		*core.registers.AL() = data
+		core.logInstruction(fmt.Sprintf("[%#04x] IN AL, %#04x (data = %#02x)", core.GetCurrentlyExecutingInstructionAddress(), port, data))
+	case core.Is32BitOperand():
+		data := core.ioPortAccessController.ReadAddr32(port)
+		*core.registers.EAX() = data
+		core.logInstruction(fmt.Sprintf("[%#04x] IN EAX, %#04x (data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), port, data))
+	default:
+		data := core.ioPortAccessController.ReadAddr16(port)
+		*core.registers.AX() = data
+		core.logInstruction(fmt.Sprintf("[%#04x] IN AX, %#04x (data = %#04x)", core.GetCurrentlyExecutingInstructionAddress(), port, data))
+	}
 }
 
+// INSTR_INS reads port DX into ES:DI, a byte for 6C and a word or doubleword for 6D
 func INSTR_INS(core *CpuCore) {
-	// Read from port
-
-	switch core.currentOpCodeBeingExecuted {
-	case 0x6C:
-		{
-			// Read from port (imm) to AL
-
-			imm, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr + 1)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr++
-
-			data := core.ioPortAccessController.ReadAddr8(uint16(imm))
-
-			core.memoryAccessController.WriteMemoryAddr8(core.SegmentAddressToLinearAddress(core.registers.ES, core.registers.DI), data)
-			core.registers.DI += 1
-			core.logInstruction(fmt.Sprintf("[%#04x] INS AL, IMM8 (Port: %#04x, data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), imm, data))
-		}
-	case 0x6D:
-		{
-			// Read from port (DX) to AL
-
-			dx := core.registers.DX
-
-			data := core.ioPortAccessController.ReadAddr8(uint16(dx))
-
-			core.memoryAccessController.WriteMemoryAddr8(core.SegmentAddressToLinearAddress(core.registers.ES, core.registers.DI), data)
-			core.registers.DI += 1
-			core.logInstruction(fmt.Sprintf("[%#04x] INS AL, DX (Port: %#04x, data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), dx, data))
-		}
-	case 0x6E:
-		{
-			// Read from port (imm) to AX
-
-			imm, err := core.memoryAccessController.ReadMemoryValue16(core.currentByteAddr + 1)
-			if err != nil {
-				goto eof
-			}
-			core.currentByteAddr += 2
-
-			data := core.ioPortAccessController.ReadAddr16(imm)
-
-			core.memoryAccessController.WriteMemoryAddr16(core.SegmentAddressToLinearAddress(core.registers.ES, core.registers.DI), data)
-			core.registers.DI += 2
-			core.logInstruction(fmt.Sprintf("[%#04x] INS AX, IMM16 (Port: %#04x, data = %#16x)", core.GetCurrentlyExecutingInstructionAddress(), imm, data))
-		}
-	case 0x6F:
-		{
-			// Read from port (DX) to AX
-
-			dx := core.registers.DX
-
-			data := core.ioPortAccessController.ReadAddr16(uint16(dx))
-
-			core.memoryAccessController.WriteMemoryAddr16(core.SegmentAddressToLinearAddress(core.registers.ES, core.registers.DI), data)
-			core.registers.DI += 2
-			core.logInstruction(fmt.Sprintf("[%#04x] INS AX, DX (Port: %#04x, data = %#16x)", core.GetCurrentlyExecutingInstructionAddress(), dx, data))
-		}
-	default:
-		log.Fatal("Unrecognised IN (port read) instruction!")
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("INS", size)
+	if core.checkIOPermission(*core.registers.DX(), size) != nil {
+		return
 	}
+	core.logInstruction(fmt.Sprintf("[%#04x] %s (Port: %#04x)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, *core.registers.DX()))
 
-eof:
+	core.repeatString(mnemonic, false, func() error {
+		if err := core.writeStringDestination(size, core.readPort(*core.registers.DX(), size)); err != nil {
+			return err
+		}
+		core.advanceStringIndex(REG_EDI, size)
+		return nil
+	})
 }
 
 func INSTR_OUT(core *CpuCore) {
-	// Read from port
+	// Write to port. E6/E7 take the port from an imm8, EE/EF from DX.
+	// E7/EF write a word, or a dword with a 32 bit operand size.
 
+	var port uint16
 	switch core.currentOpCodeBeingExecuted {
-	case 0xE6:
-		{
-			// Write value in AL to port addr imm8
-			imm, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr + 1)
-			if err != nil {
-				goto eof
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] OUT %#08x, AL (data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), imm, core.registers.AL))
-			core.ioPortAccessController.WriteAddr8(uint16(imm), core.registers.AL)
-
-			core.currentByteAddr += 2
+	case 0xE6, 0xE7:
+		imm, err := core.fetchCode8(core.currentByteAddr + 1)
+		if err != nil {
+			return
 		}
-	case 0xE7:
-		{
-			// Write value in AX to port addr imm8
-			imm, err := core.memoryAccessController.ReadMemoryValue8(core.currentByteAddr + 1)
-			if err != nil {
-				goto eof
-			}
-
-			core.logInstruction(fmt.Sprintf("[%#04x] OUT %#04x, AX (data = %#16x)", core.GetCurrentlyExecutingInstructionAddress(), imm, core.registers.AX))
-			core.ioPortAccessController.WriteAddr16(uint16(imm), core.registers.AX)
-			core.currentByteAddr++
+		port = uint16(imm)
+		core.currentByteAddr += 2
+	case 0xEE, 0xEF:
+		port = *core.registers.DX()
+		core.currentByteAddr++
+	default:
+		log.Fatal("Unrecognised OUT (port write) instruction!")
+	}
+	if core.checkIOPermission(port, core.operandSizeFor(core.currentOpCodeBeingExecuted)) != nil {
+		return
+	}
 
-		}
-	case 0xEE:
-		{
-			// Use value of DX as io port addr, and write value in AL
+	switch {
+	case core.currentOpCodeBeingExecuted == 0xE6 || core.currentOpCodeBeingExecuted == 0xEE:
+		core.logInstruction(fmt.Sprintf("[%#04x] OUT %#04x, AL (data = %#02x)", core.GetCurrentlyExecutingInstructionAddress(), port, *core.registers.AL()))
+		core.ioPortAccessController.WriteAddr8(port, *core.registers.AL())
+	case core.Is32BitOperand():
+		core.logInstruction(fmt.Sprintf("[%#04x] OUT %#04x, EAX (data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), port, *core.registers.EAX()))
+		core.ioPortAccessController.WriteAddr32(port, *core.registers.EAX())
+	default:
+		core.logInstruction(fmt.Sprintf("[%#04x] OUT %#04x, AX (data = %#04x)", core.GetCurrentlyExecutingInstructionAddress(), port, *core.registers.AX()))
+		core.ioPortAccessController.WriteAddr16(port, *core.registers.AX())
+	}
+}
 
-			core.logInstruction(fmt.Sprintf("[%#04x] OUT DX, AL (Port: %#16x, data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.DX, core.registers.AL))
-			core.ioPortAccessController.WriteAddr8(uint16(core.registers.DX), core.registers.AL)
+// INSTR_OUTS writes DS:SI to port DX, a byte for 6E and a word or doubleword for 6F
+func INSTR_OUTS(core *CpuCore) {
+	size := core.operandSizeFor(core.currentOpCodeBeingExecuted)
+	mnemonic := core.stringMnemonic("OUTS", size)
+	if core.checkIOPermission(*core.registers.DX(), size) != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] %s (Port: %#04x)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, *core.registers.DX()))
 
+	core.repeatString(mnemonic, false, func() error {
+		value, err := core.readStringSource(size)
+		if err != nil {
+			return err
 		}
-	case 0xEF:
-		{
-			// Use value of DX as io port addr, and write value in AX
-
-			core.logInstruction(fmt.Sprintf("[%#04x] OUT DX, AX (Port: %#16x, data = %#04x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.DX, core.registers.AX))
-			core.ioPortAccessController.WriteAddr16(uint16(core.registers.DX), core.registers.AX)
+		core.writePort(*core.registers.DX(), size, value)
+		core.advanceStringIndex(REG_ESI, size)
+		return nil
+	})
+}
 
-		}
+func (core *CpuCore) readPort(port uint16, size uint8) uint32 {
+	switch size {
+	case 8:
+		return uint32(core.ioPortAccessController.ReadAddr8(port))
+	case 16:
+		return uint32(core.ioPortAccessController.ReadAddr16(port))
 	default:
-		log.Fatal("Unrecognised OUT (port read) instruction!")
+		return core.ioPortAccessController.ReadAddr32(port)
 	}
-
-eof:
 }
 
-func INSTR_OUTS(core *CpuCore) {
-	// Read from port
-
-	switch core.currentOpCodeBeingExecuted {
-	case 0x6E:
-		{
-			// Write value in AL to port addr imm8
-			core.logInstruction(fmt.Sprintf("[%#04x] OUTS DX, AL (Port: %#16x, data = %#08x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.DX, core.registers.AL))
-			core.ioPortAccessController.WriteAddr8(uint16(core.registers.DX), core.registers.AL)
-			core.registers.DI += 1
-		}
-	case 0x6F:
-		{
-			// Write value in AX to port addr imm8
-			core.logInstruction(fmt.Sprintf("[%#04x] OUTS DX, AX (Port: %#16x, data = %#16x)", core.GetCurrentlyExecutingInstructionAddress(), core.registers.DX, core.registers.AX))
-			core.ioPortAccessController.WriteAddr16(uint16(core.registers.DX), core.registers.AX)
-			core.registers.DI += 2
-		}
+func (core *CpuCore) writePort(port uint16, size uint8, value uint32) {
+	switch size {
+	case 8:
+		core.ioPortAccessController.WriteAddr8(port, uint8(value))
+	case 16:
+		core.ioPortAccessController.WriteAddr16(port, uint16(value))
 	default:
-		log.Fatal("Unrecognised OUTS (port read) instruction!")
+		core.ioPortAccessController.WriteAddr32(port, value)
 	}
 }
@@ -0,0 +1,196 @@
+package intel8086
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+)
+
+/*
+	Minimal writer for the pprof profile.proto format, covering the subset of
+	fields the profiler needs: sample types, samples, locations and functions.
+*/
+
+// profile.proto field numbers
+const (
+	pprofProfileSampleType  = 1
+	pprofProfileSample      = 2
+	pprofProfileLocation    = 4
+	pprofProfileFunction    = 5
+	pprofProfileStringTable = 6
+	pprofProfilePeriodType  = 11
+	pprofProfilePeriod      = 12
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationId = 1
+	pprofSampleValue      = 2
+
+	pprofLocationId      = 1
+	pprofLocationAddress = 3
+	pprofLocationLine    = 4
+
+	pprofLineFunctionId = 1
+
+	pprofFunctionId   = 1
+	pprofFunctionName = 2
+)
+
+type pprofSample struct {
+	locations []uint64
+	values    []int64
+}
+
+type pprofLocation struct {
+	id         uint64
+	address    uint32
+	functionId uint64
+}
+
+type pprofBuilder struct {
+	sampleTypes [][2]string
+	periodType  [2]string
+
+	strings     []string
+	stringIndex map[string]int64
+
+	functions map[string]uint64
+	locations []pprofLocation
+	locIndex  map[[2]uint64]uint64 // (address, function id) -> location id
+
+	samples []pprofSample
+}
+
+func newPprofBuilder(sampleTypes [][2]string, periodType string, periodUnit string) *pprofBuilder {
+	return &pprofBuilder{
+		sampleTypes: sampleTypes,
+		periodType:  [2]string{periodType, periodUnit},
+		strings:     []string{""},
+		stringIndex: map[string]int64{"": 0},
+		functions:   make(map[string]uint64),
+		locIndex:    make(map[[2]uint64]uint64),
+	}
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+	if i, ok := b.stringIndex[s]; ok {
+		return i
+	}
+	b.strings = append(b.strings, s)
+	b.stringIndex[s] = int64(len(b.strings) - 1)
+	return int64(len(b.strings) - 1)
+}
+
+// location returns the id of the location for address within the named function
+func (b *pprofBuilder) location(address uint32, function string) uint64 {
+	functionId, ok := b.functions[function]
+	if !ok {
+		functionId = uint64(len(b.functions) + 1)
+		b.functions[function] = functionId
+	}
+
+	key := [2]uint64{uint64(address), functionId}
+	if id, ok := b.locIndex[key]; ok {
+		return id
+	}
+	id := uint64(len(b.locations) + 1)
+	b.locations = append(b.locations, pprofLocation{id: id, address: address, functionId: functionId})
+	b.locIndex[key] = id
+	return id
+}
+
+func (b *pprofBuilder) addSample(locations []uint64, values ...int64) {
+	b.samples = append(b.samples, pprofSample{locations: locations, values: values})
+}
+
+func (b *pprofBuilder) write(w io.Writer) error {
+	var profile protoBuffer
+
+	for _, sampleType := range b.sampleTypes {
+		profile.message(pprofProfileSampleType, b.valueType(sampleType))
+	}
+
+	for _, sample := range b.samples {
+		var msg protoBuffer
+		msg.packedUints(pprofSampleLocationId, sample.locations)
+		values := make([]uint64, len(sample.values))
+		for i, v := range sample.values {
+			values[i] = uint64(v)
+		}
+		msg.packedUints(pprofSampleValue, values)
+		profile.message(pprofProfileSample, msg)
+	}
+
+	for _, location := range b.locations {
+		var line protoBuffer
+		line.uint(pprofLineFunctionId, location.functionId)
+
+		var msg protoBuffer
+		msg.uint(pprofLocationId, location.id)
+		msg.uint(pprofLocationAddress, uint64(location.address))
+		msg.message(pprofLocationLine, line)
+		profile.message(pprofProfileLocation, msg)
+	}
+
+	for name, id := range b.functions {
+		var msg protoBuffer
+		msg.uint(pprofFunctionId, id)
+		msg.uint(pprofFunctionName, uint64(b.str(name)))
+		profile.message(pprofProfileFunction, msg)
+	}
+
+	profile.message(pprofProfilePeriodType, b.valueType(b.periodType))
+	profile.uint(pprofProfilePeriod, 1)
+
+	// the string table goes last so that every string above has been interned
+	for _, s := range b.strings {
+		profile.bytes(pprofProfileStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(profile); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (b *pprofBuilder) valueType(valueType [2]string) protoBuffer {
+	var msg protoBuffer
+	msg.uint(pprofValueTypeType, uint64(b.str(valueType[0])))
+	msg.uint(pprofValueTypeUnit, uint64(b.str(valueType[1])))
+	return msg
+}
+
+// protoBuffer appends protobuf wire format fields
+type protoBuffer []byte
+
+func (p *protoBuffer) key(field int, wireType uint64) {
+	*p = binary.AppendUvarint(*p, uint64(field)<<3|wireType)
+}
+
+func (p *protoBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.key(field, 0)
+	*p = binary.AppendUvarint(*p, v)
+}
+
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.key(field, 2)
+	*p = binary.AppendUvarint(*p, uint64(len(b)))
+	*p = append(*p, b...)
+}
+
+func (p *protoBuffer) message(field int, msg protoBuffer) {
+	p.bytes(field, msg)
+}
+
+func (p *protoBuffer) packedUints(field int, values []uint64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed = binary.AppendUvarint(packed, v)
+	}
+	p.bytes(field, packed)
+}
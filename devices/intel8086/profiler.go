@@ -0,0 +1,275 @@
+package intel8086
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Execution profiler
+	When enabled, every step is counted against the opcode handler that ran it,
+	the linear address it was fetched from, and the guest call stack it ran under.
+	Far call targets are counted separately. Guest profiles can be written as
+	folded stacks for flamegraph tools or as pprof profiles, and the handler
+	profile shows which INSTR_* implementations the emulator spends host time in.
+*/
+
+type Profiler struct {
+	opcodeCounts     [2][256]uint64 // indexed by [is 2 byte opcode][opcode]
+	opcodeNanos      [2][256]int64
+	addressCounts    map[uint32]uint64
+	farCallCounts    map[uint32]uint64
+	stackCounts      map[string]uint64 // guest stacks encoded by encodeStack
+	instructionCount uint64
+
+	stepStart time.Time
+	keyBuf    []byte
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		addressCounts: make(map[uint32]uint64),
+		farCallCounts: make(map[uint32]uint64),
+		stackCounts:   make(map[string]uint64),
+	}
+}
+
+func (core *CpuCore) EnableProfiler() *Profiler {
+	core.profiler = NewProfiler()
+	return core.profiler
+}
+
+func (core *CpuCore) DisableProfiler() {
+	core.profiler = nil
+}
+
+func (core *CpuCore) GetProfiler() *Profiler {
+	return core.profiler
+}
+
+// errProfilerDisabled is returned by the profile writers when there is no profile to write
+var errProfilerDisabled = errors.New("the profiler is not enabled")
+
+func (profiler *Profiler) beginStep(core *CpuCore) {
+	profiler.stepStart = time.Now()
+}
+
+func (profiler *Profiler) endStep(core *CpuCore) {
+	elapsed := time.Since(profiler.stepStart).Nanoseconds()
+
+	table := 0
+	if core.is2ByteOperand {
+		table = 1
+	}
+	profiler.opcodeCounts[table][core.currentOpCodeBeingExecuted]++
+	profiler.opcodeNanos[table][core.currentOpCodeBeingExecuted] += elapsed
+
+	addr := core.currentByteDecodeStart
+	profiler.addressCounts[addr]++
+	profiler.instructionCount++
+
+	profiler.keyBuf = encodeStack(profiler.keyBuf[:0], core.callStack, addr)
+	profiler.stackCounts[string(profiler.keyBuf)]++
+}
+
+// recordFarCall counts a CALL FAR to target, including one into the segment it was made from
+func (profiler *Profiler) recordFarCall(target uint32) {
+	profiler.farCallCounts[target]++
+}
+
+// encodeStack packs the call targets, outermost first, followed by the current address
+func encodeStack(buf []byte, frames []callFrame, addr uint32) []byte {
+	for _, frame := range frames {
+		buf = binary.LittleEndian.AppendUint32(buf, frame.target)
+	}
+	return binary.LittleEndian.AppendUint32(buf, addr)
+}
+
+func decodeStack(key string) []uint32 {
+	addrs := make([]uint32, 0, len(key)/4)
+	for i := 0; i+4 <= len(key); i += 4 {
+		addrs = append(addrs, binary.LittleEndian.Uint32([]byte(key[i:i+4])))
+	}
+	return addrs
+}
+
+func (profiler *Profiler) GetInstructionCount() uint64 {
+	return profiler.instructionCount
+}
+
+func (profiler *Profiler) GetAddressCounts() map[uint32]uint64 {
+	return profiler.addressCounts
+}
+
+func (profiler *Profiler) GetFarCallCounts() map[uint32]uint64 {
+	return profiler.farCallCounts
+}
+
+// GetOpcodeCount returns how many times an opcode executed. 2 byte opcodes are looked up by their second byte.
+func (profiler *Profiler) GetOpcodeCount(opcode uint8, twoByte bool) uint64 {
+	if twoByte {
+		return profiler.opcodeCounts[1][opcode]
+	}
+	return profiler.opcodeCounts[0][opcode]
+}
+
+// functionName is the name a guest address is attributed to in stack profiles
+func (core *CpuCore) functionName(addr uint32) string {
+	if symbol, _, ok := core.symbols.Lookup(addr); ok {
+		return symbol.Name
+	}
+	return fmt.Sprintf("%#05x", addr)
+}
+
+// WriteFoldedStacks writes the guest profile in the folded format read by flamegraph.pl and similar tools
+func (core *CpuCore) WriteFoldedStacks(w io.Writer) error {
+	if core.profiler == nil {
+		return errProfilerDisabled
+	}
+
+	folded := make(map[string]uint64)
+	for key, count := range core.profiler.stackCounts {
+		addrs := decodeStack(key)
+		frames := make([]string, len(addrs))
+		for i, addr := range addrs {
+			frames[i] = core.functionName(addr)
+		}
+		folded[strings.Join(frames, ";")] += count
+	}
+
+	stacks := make([]string, 0, len(folded))
+	for stack := range folded {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	for _, stack := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, folded[stack]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteGuestPprof writes the guest profile as a gzipped pprof protobuf
+func (core *CpuCore) WriteGuestPprof(w io.Writer) error {
+	if core.profiler == nil {
+		return errProfilerDisabled
+	}
+
+	profile := newPprofBuilder([][2]string{{"instructions", "count"}}, "instructions", "count")
+
+	for key, count := range core.profiler.stackCounts {
+		addrs := decodeStack(key)
+
+		// pprof lists the leaf location first
+		locations := make([]uint64, 0, len(addrs))
+		for i := len(addrs) - 1; i >= 0; i-- {
+			locations = append(locations, profile.location(addrs[i], core.functionName(addrs[i])))
+		}
+		profile.addSample(locations, int64(count))
+	}
+
+	return profile.write(w)
+}
+
+// WriteHandlerPprof writes a gzipped pprof profile of executions and host time spent per opcode handler
+func (core *CpuCore) WriteHandlerPprof(w io.Writer) error {
+	if core.profiler == nil {
+		return errProfilerDisabled
+	}
+
+	profile := newPprofBuilder([][2]string{{"executions", "count"}, {"time", "nanoseconds"}}, "executions", "count")
+
+	for table := 0; table < 2; table++ {
+		for opcode := 0; opcode < 256; opcode++ {
+			count := core.profiler.opcodeCounts[table][opcode]
+			if count == 0 {
+				continue
+			}
+			handler := core.handlerName(uint8(opcode), table == 1)
+			locations := []uint64{
+				profile.location(0, opcodeName(uint8(opcode), table == 1)),
+				profile.location(0, handler),
+			}
+			profile.addSample(locations, int64(count), core.profiler.opcodeNanos[table][opcode])
+		}
+	}
+
+	return profile.write(w)
+}
+
+// WriteHandlerReport writes a plain text table of opcode handlers ordered by host time spent in them
+func (core *CpuCore) WriteHandlerReport(w io.Writer) error {
+	if core.profiler == nil {
+		return errProfilerDisabled
+	}
+
+	type row struct {
+		opcode  string
+		handler string
+		count   uint64
+		nanos   int64
+	}
+
+	rows := make([]row, 0)
+	for table := 0; table < 2; table++ {
+		for opcode := 0; opcode < 256; opcode++ {
+			count := core.profiler.opcodeCounts[table][opcode]
+			if count == 0 {
+				continue
+			}
+			rows = append(rows, row{
+				opcode:  opcodeName(uint8(opcode), table == 1),
+				handler: core.handlerName(uint8(opcode), table == 1),
+				count:   count,
+				nanos:   core.profiler.opcodeNanos[table][opcode],
+			})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].nanos > rows[j].nanos })
+
+	if _, err := fmt.Fprintf(w, "%-8s %-32s %12s %14s %8s\n", "OPCODE", "HANDLER", "COUNT", "TOTAL NS", "NS/OP"); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if _, err := fmt.Fprintf(w, "%-8s %-32s %12d %14d %8d\n", r.opcode, r.handler, r.count, r.nanos, r.nanos/int64(r.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func opcodeName(opcode uint8, twoByte bool) string {
+	if twoByte {
+		return fmt.Sprintf("0x0F %#02x", opcode)
+	}
+	return fmt.Sprintf("%#02x", opcode)
+}
+
+// handlerName returns the name of the function that implements an opcode
+func (core *CpuCore) handlerName(opcode uint8, twoByte bool) string {
+	var impl OpCodeImpl
+	if twoByte {
+		impl = core.opCodeMap2Byte[opcode]
+	} else {
+		if opcode == 0x00 {
+			return "handleNullInstruction"
+		}
+		impl = core.opCodeMap[opcode]
+	}
+
+	if impl == nil {
+		return "unrecognised"
+	}
+
+	name := runtime.FuncForPC(reflect.ValueOf(impl).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
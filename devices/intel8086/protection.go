@@ -0,0 +1,374 @@
+package intel8086
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+)
+
+/*
+	Privilege levels
+	Protected mode code runs at the current privilege level, CPL, 0 being the most privileged and 3
+	the least. CPL is the RPL of CS. A direct far JMP or CALL stays at CPL, only a call gate or an
+	interrupt can enter a more privileged, non-conforming code segment, and when it does it
+	switches to that level's stack from the TSS and pushes the caller's SS:ESP. A far RET or IRET
+	to a less privileged level pops them again, and nulls any data segment register the outer
+	level couldn't have loaded. Data segments can only be loaded from their own level or a more
+	privileged one, and SS only at exactly CPL.
+*/
+
+// cpl is the current privilege level, 0 in real mode and 3 in virtual 8086 mode
+func (core *CpuCore) cpl() uint8 {
+	switch {
+	case !core.isProtectedMode():
+		return 0
+	case core.isVirtual8086Mode():
+		return 3
+	}
+	return core.currentPrivilegeLevel
+}
+
+// checkPrivilege raises #GP for a privileged instruction run outside ring 0. In real mode CPL is
+// always 0, in virtual 8086 mode always 3.
+func (core *CpuCore) checkPrivilege() error {
+	if core.cpl() != 0 {
+		return core.fault(EXCEPTION_GP, 0)
+	}
+	return nil
+}
+
+// enterCodeSegment loads CS and, in protected mode, makes cpl the current privilege level, which
+// becomes the RPL of CS
+func (core *CpuCore) enterCodeSegment(cs SegmentRegister, cpl uint8) {
+	if core.isProtectedMode() && !core.isVirtual8086Mode() {
+		cs.Selector = cs.Selector&^3 | uint16(cpl)
+		core.currentPrivilegeLevel = cpl
+	}
+	core.registers.CS = cs
+}
+
+// farTarget fetches the code segment a direct far JMP or CALL goes to, which runs at CPL. A
+// non-conforming segment must be at CPL, with an RPL no higher, and a conforming one at CPL or
+// more privileged.
+func (core *CpuCore) farTarget(selector uint16) (SegmentRegister, error) {
+	cs, err := core.segmentLoad(common.SEGMENT_CS, selector)
+	if err != nil || !core.isProtectedMode() || core.isVirtual8086Mode() {
+		return cs, err
+	}
+	cpl := core.cpl()
+	if cs.Conforming() && cs.DPL() > cpl || !cs.Conforming() && (uint8(selector&3) > cpl || cs.DPL() != cpl) {
+		return SegmentRegister{}, core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+	return cs, nil
+}
+
+// checkReturnTarget checks the code segment a far RET or IRET returns to, or a task switch
+// starts in. Its RPL is the level returned to, which can't be more privileged than CPL, and a
+// non-conforming segment must be at that level.
+func (core *CpuCore) checkReturnTarget(cs *SegmentRegister) error {
+	rpl := uint8(cs.Selector & 3)
+	if rpl < core.cpl() || cs.Conforming() && cs.DPL() > rpl || !cs.Conforming() && cs.DPL() != rpl {
+		return core.fault(EXCEPTION_GP, cs.Selector&0xFFFC)
+	}
+	return nil
+}
+
+// innerStack fetches the stack for privilege level dpl from the TSS, which must be a writable data
+// segment at that level. A bad one is #TS.
+func (core *CpuCore) innerStack(dpl uint8) (SegmentRegister, uint32, error) {
+	ss, esp, err := core.tssStack(dpl)
+	if err != nil {
+		return SegmentRegister{}, 0, err
+	}
+	stack, err := core.checkSegmentDescriptorAt(common.SEGMENT_SS, ss, dpl)
+	if err != nil {
+		return SegmentRegister{}, 0, core.taskFault(err)
+	}
+	return stack, esp, nil
+}
+
+// pushOnStack moves to the stack at stack:esp and pushes frame there. A fault moves back to the
+// stack it was on, so that the instruction can be restarted.
+func (core *CpuCore) pushOnStack(stack SegmentRegister, esp uint32, size uint8, frame []uint32) error {
+	outerStack, outerESP := core.registers.SS, *core.registers.ESP()
+	core.registers.SS = stack
+	*core.registers.ESP() = esp
+	for _, value := range frame {
+		if err := stackPush(core, size, value); err != nil {
+			core.registers.SS = outerStack
+			*core.registers.ESP() = outerESP
+			return err
+		}
+	}
+	return nil
+}
+
+// callGateTransfer handles a far JMP or CALL whose selector names a call gate. A CALL through a
+// gate to a more privileged non-conforming segment switches to that level's stack, pushes the
+// caller's SS:ESP and copies the gate's count of parameters across. A JMP can't change level. It
+// reports whether the selector was a call gate.
+func (core *CpuCore) callGateTransfer(selector uint16, call bool, next uint32) (bool, error) {
+	if !core.isProtectedMode() || core.isVirtual8086Mode() || selector&0xFFFC == 0 {
+		return false, nil
+	}
+	low, high, _, err := core.readDescriptorWords(selector)
+	if err != nil {
+		return true, err
+	}
+	gateType := high >> 8 & 0x1F
+	size := uint8(32)
+	switch gateType {
+	case DESCRIPTOR_CALL_GATE_32:
+	case DESCRIPTOR_CALL_GATE_16:
+		size = 16
+	default:
+		return false, nil
+	}
+
+	cpl := core.cpl()
+	if gateDPL := uint8(high >> 13 & 3); gateDPL < max(cpl, uint8(selector&3)) {
+		return true, core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+	if high&(SEGMENT_PRESENT<<8) == 0 {
+		return true, core.fault(EXCEPTION_NP, selector&0xFFFC)
+	}
+	target := high&0xFFFF0000 | low&0xFFFF
+	if size == 16 {
+		target &= 0xFFFF
+	}
+	cs, err := core.checkSegmentDescriptor(common.SEGMENT_CS, uint16(low>>16))
+	if err != nil {
+		return true, err
+	}
+	inner := !cs.Conforming() && cs.DPL() < cpl
+	if cs.DPL() > cpl || !call && !cs.Conforming() && cs.DPL() != cpl {
+		return true, core.fault(EXCEPTION_GP, cs.Selector&0xFFFC)
+	}
+
+	stack, esp := core.registers.SS, *core.registers.ESP()
+	var frame []uint32
+	if inner {
+		if stack, esp, err = core.innerStack(cs.DPL()); err != nil {
+			return true, err
+		}
+		frame = append(frame, uint32(core.registers.SS.Selector), *core.registers.ESP())
+
+		// the parameters go across in the order they are on the caller's stack
+		params := make([]uint32, high&0x1F)
+		sp, _ := core.readReg(REG_ESP, core.stackAddressSize())
+		for i := range params {
+			if params[i], err = core.readSegment(&core.registers.SS, sp+uint32(i)*uint32(size/8), size); err != nil {
+				return true, err
+			}
+		}
+		for i := len(params) - 1; i >= 0; i-- {
+			frame = append(frame, params[i])
+		}
+		cpl = cs.DPL()
+	}
+	if call {
+		frame = append(frame, uint32(core.registers.CS.Selector), next)
+	}
+	if err := core.pushOnStack(stack, esp, size, frame); err != nil {
+		return true, err
+	}
+
+	core.enterCodeSegment(cs, cpl)
+	core.setInstructionPointer(target)
+	return true, nil
+}
+
+// returnFar loads the CS a far RET or IRET returns to, once (E)IP, CS and for IRET the flags have
+// been popped, and releases release bytes of parameters. A return to a less privileged level also
+// pops that level's SS:ESP from below the parameters, releases the parameters from the outer
+// stack too, and nulls the data segment registers the outer level can't use.
+func (core *CpuCore) returnFar(selector uint16, size uint8, release uint16) error {
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		if err := core.loadSegment(common.SEGMENT_CS, selector); err != nil {
+			return err
+		}
+		core.releaseStack(release)
+		return nil
+	}
+
+	cs, err := core.checkSegmentDescriptor(common.SEGMENT_CS, selector)
+	if err != nil {
+		return err
+	}
+	if err := core.checkReturnTarget(&cs); err != nil {
+		return err
+	}
+	rpl := uint8(selector & 3)
+	core.releaseStack(release)
+	if rpl == core.cpl() {
+		core.enterCodeSegment(cs, rpl)
+		return nil
+	}
+
+	esp, err := stackPop(core, size)
+	if err != nil {
+		return err
+	}
+	ss, err := stackPop(core, size)
+	if err != nil {
+		return err
+	}
+	stack, err := core.checkSegmentDescriptorAt(common.SEGMENT_SS, uint16(ss), rpl)
+	if err != nil {
+		return err
+	}
+
+	core.enterCodeSegment(cs, rpl)
+	core.registers.SS = stack
+	core.writeReg(REG_ESP, size, esp)
+	core.releaseStack(release)
+	core.nullInaccessibleSegments()
+	return nil
+}
+
+// nullInaccessibleSegments clears the data segment registers holding a segment more privileged
+// than CPL, after a return to an outer level, so it can't reach the inner level's data
+func (core *CpuCore) nullInaccessibleSegments() {
+	for _, segment := range []*SegmentRegister{&core.registers.ES, &core.registers.DS, &core.registers.FS, &core.registers.GS} {
+		if segment.Usable() && !segment.Conforming() && segment.DPL() < core.cpl() {
+			*segment = SegmentRegister{}
+		}
+	}
+}
+
+// visibleDescriptor reads the descriptor LAR, LSL, VERR and VERW ask about, along with its high
+// dword. It is only visible when the selector is within its table and, unless it is a conforming
+// code segment, the descriptor's DPL is no more privileged than CPL or the selector's RPL.
+func (core *CpuCore) visibleDescriptor(selector uint16) (SegmentRegister, uint32, bool) {
+	addr, ok := core.descriptorInTable(selector)
+	if selector&0xFFFC == 0 || !ok {
+		return SegmentRegister{}, 0, false
+	}
+	low, err := core.memoryAccessController.ReadMemoryValue32(addr)
+	if err != nil {
+		return SegmentRegister{}, 0, false
+	}
+	high, err := core.memoryAccessController.ReadMemoryValue32(addr + 4)
+	if err != nil {
+		return SegmentRegister{}, 0, false
+	}
+	descriptor := decodeDescriptor(selector, low, high)
+	if !descriptor.Conforming() && descriptor.DPL() < max(core.cpl(), uint8(selector&3)) {
+		return SegmentRegister{}, 0, false
+	}
+	return descriptor, high, true
+}
+
+// INSTR_ARPL raises the RPL of the selector in r/m16 to that of the one in r16, setting ZF when it
+// had to, 63 /r
+func INSTR_ARPL(core *CpuCore) {
+	core.currentByteAddr++
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+
+	dest, destName, err := core.readRm(&modrm, 16)
+	if err != nil {
+		return
+	}
+	src, srcName := core.readReg(modrm.reg, 16)
+	adjust := dest&3 < src&3
+	if adjust {
+		if _, err := core.writeRm(&modrm, 16, dest&^3|src&3); err != nil {
+			return
+		}
+	}
+	core.registers.SetFlag(ZeroFlag, adjust)
+	core.logInstruction(fmt.Sprintf("[%#04x] ARPL %s, %s", core.GetCurrentlyExecutingInstructionAddress(), destName, srcName))
+}
+
+// INSTR_VERR_VERW sets ZF when the segment a selector names could be read, 0F 00 /4, or
+// written, 0F 00 /5, at CPL. Neither faults on a selector that can't be used.
+func INSTR_VERR_VERW(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+
+	value, name, err := core.readRm(&modrm, 16)
+	if err != nil {
+		return
+	}
+	write, mnemonic := modrm.reg == 5, "VERR"
+	if write {
+		mnemonic = "VERW"
+	}
+	accessible := false
+	if descriptor, _, ok := core.visibleDescriptor(uint16(value)); ok && descriptor.access_information&SEGMENT_CODE_DATA != 0 {
+		isCode := descriptor.access_information&SEGMENT_CODE != 0
+		writable := descriptor.access_information&SEGMENT_WRITABLE != 0
+		if write {
+			accessible = !isCode && writable
+		} else {
+			accessible = !isCode || writable
+		}
+	}
+	core.registers.SetFlag(ZeroFlag, accessible)
+	core.logInstruction(fmt.Sprintf("[%#04x] %s %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, name))
+}
+
+// INSTR_LAR_LSL loads the access rights, 0F 02, or the limit in bytes, 0F 03, of the descriptor a
+// selector names, setting ZF when it is visible. Besides code and data segments LAR reads TSSs,
+// LDTs, call gates and task gates and LSL only those with a limit, TSSs and LDTs.
+func INSTR_LAR_LSL(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+
+	value, name, err := core.readRm(&modrm, 16)
+	if err != nil {
+		return
+	}
+	lsl, mnemonic := core.currentOpCodeBeingExecuted == 0x03, "LAR"
+	if lsl {
+		mnemonic = "LSL"
+	}
+
+	descriptor, high, ok := core.visibleDescriptor(uint16(value))
+	if ok && descriptor.access_information&SEGMENT_CODE_DATA == 0 {
+		switch descriptor.access_information & 0xF {
+		case DESCRIPTOR_TSS_16, DESCRIPTOR_TSS_16 | DESCRIPTOR_TSS_BUSY, DESCRIPTOR_LDT, DESCRIPTOR_TSS_32, DESCRIPTOR_TSS_32 | DESCRIPTOR_TSS_BUSY:
+		case DESCRIPTOR_CALL_GATE_16, DESCRIPTOR_TASK_GATE, DESCRIPTOR_CALL_GATE_32:
+			ok = !lsl
+		default:
+			ok = false
+		}
+	}
+	core.registers.SetFlag(ZeroFlag, ok)
+	if !ok {
+		core.logInstruction(fmt.Sprintf("[%#04x] %s %s (not visible)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, name))
+		return
+	}
+
+	// LAR reads the access byte and the flags nibble in place, as they are in the descriptor
+	result := high & 0x00F0FF00
+	if lsl {
+		result = descriptor.Limit
+	}
+	destName := core.writeReg(modrm.reg, core.operandSize(), result&sizeMask(core.operandSize()))
+	core.logInstruction(fmt.Sprintf("[%#04x] %s %s, %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, destName, name))
+}
@@ -1,16 +1,98 @@
 package intel8086
 
-import "fmt"
+import (
+	"fmt"
+	"unsafe"
+)
 
+// SegmentRegister is the selector last loaded into a segment register together with the hidden
+// cache of the descriptor it selected. Addresses are formed from the cached base and checked
+// against the cached limit, never from the selector itself.
 type SegmentRegister struct {
-	Base  uint32
-	Limit uint32
-	//selector uint16
-	access_information uint16
+	Selector           uint16
+	Base               uint32 // linear base address
+	Limit              uint32 // highest valid offset, in bytes
+	access_information uint16 // the descriptor's access byte, with its G and D flags in the high byte
+}
+
+// segment access information, the access byte of a descriptor and the flags nibble above the limit
+const (
+	SEGMENT_ACCESSED    = 0x0001
+	SEGMENT_WRITABLE    = 0x0002 // writable for data segments, readable for code segments
+	SEGMENT_EXPAND_DOWN = 0x0004 // expand down for data segments, conforming for code segments
+	SEGMENT_CODE        = 0x0008
+	SEGMENT_CODE_DATA   = 0x0010 // clear for system descriptors such as the LDT, TSSs and gates
+	SEGMENT_PRESENT     = 0x0080
+	SEGMENT_GRANULARITY = 0x8000
+
+	// SEGMENT_DEFAULT_32BIT is the D bit of a segment's access information. A code segment with it set
+	// defaults to 32 bit operands and addresses, and a stack segment with it set uses ESP rather than SP.
+	SEGMENT_DEFAULT_32BIT = 0x4000
+)
+
+// system descriptor types, the low nibble of the access byte when SEGMENT_CODE_DATA is clear
+const (
+	DESCRIPTOR_TSS_16            = 0x1
+	DESCRIPTOR_LDT               = 0x2
+	DESCRIPTOR_CALL_GATE_16      = 0x4
+	DESCRIPTOR_TASK_GATE         = 0x5
+	DESCRIPTOR_INTERRUPT_GATE_16 = 0x6
+	DESCRIPTOR_TRAP_GATE_16      = 0x7
+	DESCRIPTOR_INTERRUPT_GATE_32 = 0xE
+	DESCRIPTOR_TSS_32            = 0x9
+	DESCRIPTOR_CALL_GATE_32      = 0xC
+	DESCRIPTOR_TRAP_GATE_32      = 0xF
+
+	// DESCRIPTOR_TSS_BUSY marks the TSS of a task that is running or has been nested into, types 3 and B
+	DESCRIPTOR_TSS_BUSY = 0x2
+)
+
+// RealModeSegment is a segment register as a real mode load of selector leaves it, based at
+// selector*16 with a 64K limit and read/write access
+func RealModeSegment(selector uint16) SegmentRegister {
+	return SegmentRegister{
+		Selector:           selector,
+		Base:               uint32(selector) << 4,
+		Limit:              0xFFFF,
+		access_information: SEGMENT_PRESENT | SEGMENT_CODE_DATA | SEGMENT_WRITABLE | SEGMENT_ACCESSED,
+	}
+}
+
+func (s *SegmentRegister) Is32Bit() bool {
+	return s.access_information&SEGMENT_DEFAULT_32BIT != 0
+}
+
+func (s *SegmentRegister) SetDefault32Bit(enabled bool) {
+	if enabled {
+		s.access_information |= SEGMENT_DEFAULT_32BIT
+	} else {
+		s.access_information &^= SEGMENT_DEFAULT_32BIT
+	}
+}
+
+// DPL is the descriptor privilege level of the cached descriptor
+func (s *SegmentRegister) DPL() uint8 {
+	return uint8(s.access_information >> 5 & 3)
+}
+
+// Conforming is true for a conforming code segment, which runs at the privilege level of its caller
+func (s *SegmentRegister) Conforming() bool {
+	return s.access_information&(SEGMENT_CODE_DATA|SEGMENT_CODE|SEGMENT_EXPAND_DOWN) == SEGMENT_CODE_DATA|SEGMENT_CODE|SEGMENT_EXPAND_DOWN
+}
+
+// Usable is false for a segment register loaded with the null selector in protected mode
+func (s *SegmentRegister) Usable() bool {
+	return s.access_information&SEGMENT_PRESENT != 0
 }
 
 func (s *SegmentRegister) String() string {
-	return fmt.Sprintf("SegmentRegister{base=%#04x, limit=%#08x, access_information=%#04x}", s.Base, s.Limit, s.access_information)
+	return fmt.Sprintf("SegmentRegister{selector=%#04x, base=%#08x, limit=%#08x, access_information=%#04x}", s.Selector, s.Base, s.Limit, s.access_information)
+}
+
+// DescriptorTableRegister locates the GDT or IDT, as LGDT and LIDT load it
+type DescriptorTableRegister struct {
+	Base  uint32
+	Limit uint16
 }
 
 type CpuRegisters struct {
@@ -28,47 +110,21 @@ type CpuRegisters struct {
 	FS SegmentRegister // ?? segment
 	GS SegmentRegister // ?? segment
 
-	IP  uint16 // 16 bit instruction pointer
-	SP  uint16
-	BP  uint16
-	SI  uint16
-	DI  uint16
-	EIP uint32 // 32 bit instruction pointer
-	ESP uint32
-	EBP uint32
-	ESI uint32
-	EDI uint32
-
-	// accumulator registers
-	// used for I/O port access, arithmetic, interrupt calls
-	AH  uint8
-	AL  uint8
-	AX  uint16
-	EAX uint32
-
-	// base registers
-	// used as a base pointer for memory access
-	BX  uint16
-	EBX uint32
-	BH  uint8
-	BL  uint8
-
-	// counter registers
-	// used as loop counter and for shifts
-	CX  uint16
-	ECX uint32
-	CH  uint8
-	CL  uint8
-
-	// data registers
-	// used for I/O port access, arithmetic, interrupt calls
-	DX  uint16
-	EDX uint32
-	DH  uint8
-	DL  uint8
-
-	// Flags
-	FLAGS uint16
+	// descriptor tables. The LDT is selected from the GDT and cached like a segment.
+	GDTR DescriptorTableRegister
+	IDTR DescriptorTableRegister
+	LDTR SegmentRegister
+
+	// TR selects the TSS of the running task from the GDT, and caches its descriptor like a segment
+	TR SegmentRegister
+
+	// general purpose registers in encoding order, EAX, ECX, EDX, EBX, ESP, EBP, ESI, EDI.
+	// The 8 and 16 bit registers are views of the same storage, see AL, AX and friends.
+	gpr [8]uint32
+	eip uint32 // IP is the low half
+
+	// Flags, FLAGS is the low word
+	EFLAGS uint32
 
 	// Control Flag
 	CR0 uint32
@@ -76,8 +132,93 @@ type CpuRegisters struct {
 	CR2 uint32
 	CR3 uint32
 	CR4 uint32
+
+	// Debug registers, the breakpoint linear addresses in DR0-DR3, the status in DR6 and the
+	// control in DR7
+	DR0 uint32
+	DR1 uint32
+	DR2 uint32
+	DR3 uint32
+	DR6 uint32
+	DR7 uint32
+}
+
+// CR0 bits
+const (
+	CR0_PE = 0x01 // protection enable
+	CR0_MP = 0x02 // monitor coprocessor, WAIT raises #NM too when TS is set
+	CR0_EM = 0x04 // emulate coprocessor, ESC instructions raise #NM
+	CR0_TS = 0x08 // task switched, the next ESC instruction raises #NM
+	CR0_NE = 0x20 // numeric errors raise #MF rather than IRQ 13
+)
+
+// general purpose register numbers, as the modrm byte and the register forms of opcodes encode them
+const (
+	REG_EAX = iota
+	REG_ECX
+	REG_EDX
+	REG_EBX
+	REG_ESP
+	REG_EBP
+	REG_ESI
+	REG_EDI
+)
+
+// offsets of the low word, low byte and high byte within a 32 bit register on this host
+var lowWordOffset, lowByteOffset, highByteOffset = registerViewOffsets()
+
+func registerViewOffsets() (uintptr, uintptr, uintptr) {
+	probe := uint16(1)
+	if *(*uint8)(unsafe.Pointer(&probe)) == 1 {
+		return 0, 0, 1 // little endian
+	}
+	return 2, 3, 2
 }
 
+func lowWord(r *uint32) *uint16 {
+	return (*uint16)(unsafe.Add(unsafe.Pointer(r), lowWordOffset))
+}
+
+func lowByte(r *uint32) *uint8 {
+	return (*uint8)(unsafe.Add(unsafe.Pointer(r), lowByteOffset))
+}
+
+func highByte(r *uint32) *uint8 {
+	return (*uint8)(unsafe.Add(unsafe.Pointer(r), highByteOffset))
+}
+
+// Register views. Each returns a pointer into the register file, so writes through
+// AL are visible in AX and EAX and the other way around.
+
+func (c *CpuRegisters) EAX() *uint32 { return &c.gpr[REG_EAX] }
+func (c *CpuRegisters) ECX() *uint32 { return &c.gpr[REG_ECX] }
+func (c *CpuRegisters) EDX() *uint32 { return &c.gpr[REG_EDX] }
+func (c *CpuRegisters) EBX() *uint32 { return &c.gpr[REG_EBX] }
+func (c *CpuRegisters) ESP() *uint32 { return &c.gpr[REG_ESP] }
+func (c *CpuRegisters) EBP() *uint32 { return &c.gpr[REG_EBP] }
+func (c *CpuRegisters) ESI() *uint32 { return &c.gpr[REG_ESI] }
+func (c *CpuRegisters) EDI() *uint32 { return &c.gpr[REG_EDI] }
+func (c *CpuRegisters) EIP() *uint32 { return &c.eip }
+
+func (c *CpuRegisters) AX() *uint16 { return lowWord(&c.gpr[REG_EAX]) }
+func (c *CpuRegisters) CX() *uint16 { return lowWord(&c.gpr[REG_ECX]) }
+func (c *CpuRegisters) DX() *uint16 { return lowWord(&c.gpr[REG_EDX]) }
+func (c *CpuRegisters) BX() *uint16 { return lowWord(&c.gpr[REG_EBX]) }
+func (c *CpuRegisters) SP() *uint16 { return lowWord(&c.gpr[REG_ESP]) }
+func (c *CpuRegisters) BP() *uint16 { return lowWord(&c.gpr[REG_EBP]) }
+func (c *CpuRegisters) SI() *uint16 { return lowWord(&c.gpr[REG_ESI]) }
+func (c *CpuRegisters) DI() *uint16 { return lowWord(&c.gpr[REG_EDI]) }
+func (c *CpuRegisters) IP() *uint16 { return lowWord(&c.eip) }
+
+func (c *CpuRegisters) AL() *uint8 { return lowByte(&c.gpr[REG_EAX]) }
+func (c *CpuRegisters) CL() *uint8 { return lowByte(&c.gpr[REG_ECX]) }
+func (c *CpuRegisters) DL() *uint8 { return lowByte(&c.gpr[REG_EDX]) }
+func (c *CpuRegisters) BL() *uint8 { return lowByte(&c.gpr[REG_EBX]) }
+func (c *CpuRegisters) AH() *uint8 { return highByte(&c.gpr[REG_EAX]) }
+func (c *CpuRegisters) CH() *uint8 { return highByte(&c.gpr[REG_ECX]) }
+func (c *CpuRegisters) DH() *uint8 { return highByte(&c.gpr[REG_EDX]) }
+func (c *CpuRegisters) BH() *uint8 { return highByte(&c.gpr[REG_EBX]) }
+
 func (c *CpuRegisters) index8ToString(i uint8) string {
 
 	switch {
@@ -0,0 +1,406 @@
+package intel8086
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+)
+
+/*
+	Segmentation
+	Each segment register holds the selector last loaded into it and a hidden cache of the descriptor
+	it selected: the linear base, the limit and the access rights. In real mode a load just sets the
+	base to selector*16 and leaves the limit and rights as they were. In protected mode the selector
+	indexes the GDT or LDT, and the descriptor is checked and copied into the cache. Memory accesses
+	only ever use the cache, so a segment given a 4GB limit in protected mode keeps it after the
+	switch back to real mode, which is all unreal mode is.
+*/
+
+// isProtectedMode reports whether CR0.PE is set
+func (core *CpuCore) isProtectedMode() bool {
+	return core.registers.CR0&CR0_PE != 0
+}
+
+// decodeDescriptor unpacks the two dwords of a code, data or system segment descriptor into a
+// segment register cache, expanding a page granular limit to bytes
+func decodeDescriptor(selector uint16, low uint32, high uint32) SegmentRegister {
+	limit := low&0xFFFF | high&0x000F0000
+	access := uint16(high >> 8 & 0xF0FF)
+	if access&SEGMENT_GRANULARITY != 0 {
+		limit = limit<<12 | 0xFFF
+	}
+	return SegmentRegister{
+		Selector:           selector,
+		Base:               low>>16 | (high&0xFF)<<16 | high&0xFF000000,
+		Limit:              limit,
+		access_information: access,
+	}
+}
+
+// descriptorAddress is the linear address of the descriptor a selector picks from the GDT, or
+// from the LDT when its table indicator bit is set. A selector past the end of the table is a #GP.
+func (core *CpuCore) descriptorAddress(selector uint16) (uint32, error) {
+	addr, ok := core.descriptorInTable(selector)
+	if !ok {
+		return 0, core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+	return addr, nil
+}
+
+// descriptorInTable is descriptorAddress without the fault, reporting whether the selector lies
+// within its table
+func (core *CpuCore) descriptorInTable(selector uint16) (uint32, bool) {
+	index := uint32(selector & 0xFFF8)
+	base, limit := core.registers.GDTR.Base, uint32(core.registers.GDTR.Limit)
+	if selector&0x4 != 0 {
+		if !core.registers.LDTR.Usable() {
+			return 0, false
+		}
+		base, limit = core.registers.LDTR.Base, core.registers.LDTR.Limit
+	}
+	return base + index, index+7 <= limit
+}
+
+// readDescriptor fetches the descriptor a selector refers to
+func (core *CpuCore) readDescriptor(selector uint16) (SegmentRegister, uint32, error) {
+	low, high, addr, err := core.readDescriptorWords(selector)
+	if err != nil {
+		return SegmentRegister{}, 0, err
+	}
+	return decodeDescriptor(selector, low, high), addr, nil
+}
+
+// readDescriptorWords fetches the two dwords of the descriptor a selector refers to, for gates
+// whose fields don't fit a segment register
+func (core *CpuCore) readDescriptorWords(selector uint16) (uint32, uint32, uint32, error) {
+	addr, err := core.descriptorAddress(selector)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	low, err := core.memoryAccessController.ReadMemoryValue32(addr)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	high, err := core.memoryAccessController.ReadMemoryValue32(addr + 4)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return low, high, addr, nil
+}
+
+// checkSegmentDescriptor fetches the descriptor for a protected mode load of selector into
+// segment and checks that it suits the register: CS needs a code segment, SS a writable data
+// segment and the data segment registers data or readable code. The null selector may only be
+// loaded into the data segment registers, and leaves them unusable.
+func (core *CpuCore) checkSegmentDescriptor(segment uint32, selector uint16) (SegmentRegister, error) {
+	return core.checkSegmentDescriptorAt(segment, selector, core.cpl())
+}
+
+// checkSegmentDescriptorAt is checkSegmentDescriptor for code running at privilege level cpl. SS
+// must be at exactly that level, a data segment at the level or one less privileged. Whether CS
+// may be loaded depends on how it is being entered, which the caller checks.
+func (core *CpuCore) checkSegmentDescriptorAt(segment uint32, selector uint16, cpl uint8) (SegmentRegister, error) {
+	if selector&0xFFFC == 0 {
+		if segment == common.SEGMENT_CS || segment == common.SEGMENT_SS {
+			return SegmentRegister{}, core.fault(EXCEPTION_GP, 0)
+		}
+		return SegmentRegister{Selector: selector}, nil
+	}
+
+	descriptor, addr, err := core.readDescriptor(selector)
+	if err != nil {
+		return SegmentRegister{}, err
+	}
+
+	access := descriptor.access_information
+	isCode := access&SEGMENT_CODE != 0
+	rpl, dpl := uint8(selector&3), descriptor.DPL()
+	var suitable bool
+	switch segment {
+	case common.SEGMENT_CS:
+		suitable = isCode
+	case common.SEGMENT_SS:
+		suitable = !isCode && access&SEGMENT_WRITABLE != 0 && rpl == cpl && dpl == cpl
+	default:
+		suitable = (!isCode || access&SEGMENT_WRITABLE != 0) && (descriptor.Conforming() || dpl >= max(cpl, rpl))
+	}
+	if access&SEGMENT_CODE_DATA == 0 || !suitable {
+		return SegmentRegister{}, core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+
+	if access&SEGMENT_PRESENT == 0 {
+		if segment == common.SEGMENT_SS {
+			return SegmentRegister{}, core.fault(EXCEPTION_SS, selector&0xFFFC)
+		}
+		return SegmentRegister{}, core.fault(EXCEPTION_NP, selector&0xFFFC)
+	}
+
+	if access&SEGMENT_ACCESSED == 0 {
+		descriptor.access_information |= SEGMENT_ACCESSED
+		if err := core.memoryAccessController.WriteMemoryAddr8(addr+5, uint8(descriptor.access_information)); err != nil {
+			return SegmentRegister{}, err
+		}
+	}
+	return descriptor, nil
+}
+
+// segmentLoad works out what loading selector into one of the common.SEGMENT_* registers would
+// leave in it, without loading it. In real mode only the selector and base change, in protected
+// mode the whole descriptor cache is replaced.
+func (core *CpuCore) segmentLoad(segment uint32, selector uint16) (SegmentRegister, error) {
+	if core.isVirtual8086Mode() {
+		// virtual 8086 mode has no descriptor cache to keep, every load resets the limit and rights
+		return RealModeSegment(selector), nil
+	}
+	if !core.isProtectedMode() {
+		register := *core.segmentRegister(segment)
+		register.Selector = selector
+		register.Base = uint32(selector) << 4
+		return register, nil
+	}
+	return core.checkSegmentDescriptor(segment, selector)
+}
+
+// loadSegment loads selector into one of the common.SEGMENT_* registers
+func (core *CpuCore) loadSegment(segment uint32, selector uint16) error {
+	register, err := core.segmentLoad(segment, selector)
+	if err != nil {
+		return err
+	}
+	*core.segmentRegister(segment) = register
+	return nil
+}
+
+// segmentAddress checks an access of size bits at offset against a segment's cached limit and, in
+// protected mode, its rights, and returns the linear address. Faults on the stack segment are #SS,
+// everything else #GP.
+func (core *CpuCore) segmentAddress(segment *SegmentRegister, offset uint32, size uint8, write bool) (uint32, error) {
+	vector := uint8(EXCEPTION_GP)
+	if segment == &core.registers.SS {
+		vector = EXCEPTION_SS
+	}
+	if !segment.Usable() {
+		return 0, core.fault(vector, 0)
+	}
+
+	access := segment.access_information
+	if core.isProtectedMode() {
+		isCode := access&SEGMENT_CODE != 0
+		if write && (isCode || access&SEGMENT_WRITABLE == 0) || !write && isCode && access&SEGMENT_WRITABLE == 0 {
+			return 0, core.fault(EXCEPTION_GP, 0)
+		}
+	}
+
+	last := offset + uint32(size/8) - 1
+	if access&(SEGMENT_CODE|SEGMENT_EXPAND_DOWN) == SEGMENT_EXPAND_DOWN {
+		// valid offsets of an expand down segment lie above the limit
+		upper := uint32(0xFFFF)
+		if segment.Is32Bit() {
+			upper = 0xFFFFFFFF
+		}
+		if offset <= segment.Limit || last > upper || last < offset {
+			return 0, core.fault(vector, 0)
+		}
+	} else if last > segment.Limit || last < offset {
+		return 0, core.fault(vector, 0)
+	}
+	return core.linearAddress(segment, offset), nil
+}
+
+// readSegment reads size bits at offset within a segment
+func (core *CpuCore) readSegment(segment *SegmentRegister, offset uint32, size uint8) (uint32, error) {
+	addr, err := core.segmentAddress(segment, offset, size, false)
+	if err != nil {
+		return 0, err
+	}
+	core.watchData(addr, size, false)
+	return core.readMemory(addr, size)
+}
+
+// writeSegment writes size bits at offset within a segment
+func (core *CpuCore) writeSegment(segment *SegmentRegister, offset uint32, size uint8, value uint32) error {
+	addr, err := core.segmentAddress(segment, offset, size, true)
+	if err != nil {
+		return err
+	}
+	core.watchData(addr, size, true)
+	return core.writeMemory(addr, size, value)
+}
+
+// INSTR_LGDT_LIDT loads the GDTR or IDTR from a 6 byte pseudo descriptor, 0F 01 /2 and /3. With a
+// 16 bit operand size only 24 bits of the base are used.
+func INSTR_LGDT_LIDT(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if modrm.mod == 3 {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+	if core.checkPrivilege() != nil {
+		return
+	}
+
+	segment, offset, name := core.memoryOperand(&modrm)
+	limit, err := core.readSegment(segment, offset, 16)
+	if err != nil {
+		return
+	}
+	base, err := core.readSegment(segment, offset+2, 32)
+	if err != nil {
+		return
+	}
+	if !core.Is32BitOperand() {
+		base &= 0x00FFFFFF
+	}
+
+	table, mnemonic := &core.registers.GDTR, "LGDT"
+	if modrm.reg == 3 {
+		table, mnemonic = &core.registers.IDTR, "LIDT"
+	}
+	*table = DescriptorTableRegister{Base: base, Limit: uint16(limit)}
+	core.logInstruction(fmt.Sprintf("[%#04x] %s %s (base=%#08x, limit=%#04x)", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, name, base, limit))
+}
+
+// INSTR_SGDT_SIDT stores the GDTR or IDTR as a 6 byte pseudo descriptor, 0F 01 /0 and /1. The top
+// byte of the base reads as zero with a 16 bit operand size.
+func INSTR_SGDT_SIDT(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if modrm.mod == 3 {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+
+	table, mnemonic := core.registers.GDTR, "SGDT"
+	if modrm.reg == 1 {
+		table, mnemonic = core.registers.IDTR, "SIDT"
+	}
+	base := table.Base
+	if !core.Is32BitOperand() {
+		base &= 0x00FFFFFF
+	}
+
+	segment, offset, name := core.memoryOperand(&modrm)
+	if err := core.writeSegment(segment, offset, 16, uint32(table.Limit)); err != nil {
+		return
+	}
+	if err := core.writeSegment(segment, offset+2, 32, base); err != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] %s %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, name))
+}
+
+// INSTR_LMSW loads the low four bits of CR0 from r/m16, 0F 01 /6. It can set PE but never clear it.
+func INSTR_LMSW(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if core.checkPrivilege() != nil {
+		return
+	}
+
+	msw, name, err := core.readRm(&modrm, 16)
+	if err != nil {
+		return
+	}
+	cr0 := core.registers.CR0&^0xE | msw&0xF | core.registers.CR0&CR0_PE
+	core.updateSystemFlags(cr0)
+	core.logInstruction(fmt.Sprintf("[%#04x] LMSW %s", core.GetCurrentlyExecutingInstructionAddress(), name))
+}
+
+// INSTR_CLTS clears CR0.TS, which a task switch sets, 0F 06
+func INSTR_CLTS(core *CpuCore) {
+	if core.checkPrivilege() != nil {
+		return
+	}
+	core.registers.CR0 &^= CR0_TS
+	core.logInstruction(fmt.Sprintf("[%#04x] CLTS", core.GetCurrentlyExecutingInstructionAddress()))
+}
+
+// INSTR_SLDT_STR stores the LDT selector, 0F 00 /0, or the task register's, 0F 00 /1
+func INSTR_SLDT_STR(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+
+	selector, mnemonic := core.registers.LDTR.Selector, "SLDT"
+	if modrm.reg == 1 {
+		selector, mnemonic = core.registers.TR.Selector, "STR"
+	}
+	size := uint8(16)
+	if modrm.mod == 3 {
+		size = core.operandSize()
+	}
+	name, err := core.writeRm(&modrm, size, uint32(selector))
+	if err != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] %s %s", core.GetCurrentlyExecutingInstructionAddress(), mnemonic, name))
+}
+
+// INSTR_LLDT loads the LDT register from a GDT selector, 0F 00 /2
+func INSTR_LLDT(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+	if core.checkPrivilege() != nil {
+		return
+	}
+
+	value, name, err := core.readRm(&modrm, 16)
+	if err != nil {
+		return
+	}
+	if err := core.loadLDT(uint16(value)); err != nil {
+		return
+	}
+	core.logInstruction(fmt.Sprintf("[%#04x] LLDT %s", core.GetCurrentlyExecutingInstructionAddress(), name))
+}
+
+// loadLDT loads the LDT register, as LLDT and task switches do. The descriptor must be a present
+// LDT descriptor in the GDT, the null selector leaves the LDT unusable.
+func (core *CpuCore) loadLDT(selector uint16) error {
+	if selector&0xFFFC == 0 {
+		core.registers.LDTR = SegmentRegister{Selector: selector}
+		return nil
+	}
+	if selector&0x4 != 0 {
+		return core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+	descriptor, _, err := core.readDescriptor(selector)
+	if err != nil {
+		return err
+	}
+	if descriptor.access_information&(SEGMENT_CODE_DATA|0xF) != DESCRIPTOR_LDT {
+		return core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+	if !descriptor.Usable() {
+		return core.fault(EXCEPTION_NP, selector&0xFFFC)
+	}
+	core.registers.LDTR = descriptor
+	return nil
+}
@@ -5,294 +5,243 @@ import (
 	"log"
 )
 
-func stackPush8(core *CpuCore, val uint8) error {
-	//log.Println("Pushing value:", val)
-	core.registers.SP -= 1
-	stackAddr := core.SegmentAddressToLinearAddress32(core.registers.SS, uint32(core.registers.SP))
-	ret := core.memoryAccessController.WriteMemoryAddr8(stackAddr, val)
-	return ret
+// stackAddressSize is the width of the stack pointer, ESP when the stack segment's B bit is set and SP otherwise
+func (core *CpuCore) stackAddressSize() uint8 {
+	if core.registers.SS.Is32Bit() {
+		return 32
+	}
+	return 16
 }
 
-func stackPush16(core *CpuCore, val uint16) error {
-	//log.Println("Pushing value:", val)
-	core.registers.SP -= 2
-	stackAddr := core.SegmentAddressToLinearAddress32(core.registers.SS, uint32(core.registers.SP))
-	ret := core.memoryAccessController.WriteMemoryAddr16(stackAddr, val)
-	return ret
-}
+// stackPush pushes a 16 or 32 bit value onto SS:SP or SS:ESP
+func stackPush(core *CpuCore, size uint8, val uint32) error {
+	spSize := core.stackAddressSize()
+	sp, _ := core.readReg(REG_ESP, spSize)
+	sp = (sp - uint32(size/8)) & sizeMask(spSize)
 
-func stackPop8(core *CpuCore) (uint8, error) {
-	stackAddr := core.SegmentAddressToLinearAddress32(core.registers.SS, uint32(core.registers.SP))
-	val, err := core.memoryAccessController.ReadMemoryValue8(stackAddr)
-	core.registers.SP += 1
-	if err != nil {
-		return 0, err
+	if err := core.writeSegment(&core.registers.SS, sp, size, val); err != nil {
+		return err
 	}
-	return val, nil
+	core.writeReg(REG_ESP, spSize, sp)
+	return nil
 }
 
-func stackPop16(core *CpuCore) (uint16, error) {
-	stackAddr := core.SegmentAddressToLinearAddress32(core.registers.SS, uint32(core.registers.SP))
-	val, err := core.memoryAccessController.ReadMemoryValue16(stackAddr)
-	core.registers.SP += 2
+// stackPop pops a 16 or 32 bit value from SS:SP or SS:ESP
+func stackPop(core *CpuCore, size uint8) (uint32, error) {
+	spSize := core.stackAddressSize()
+	sp, _ := core.readReg(REG_ESP, spSize)
+
+	val, err := core.readSegment(&core.registers.SS, sp, size)
 	if err != nil {
 		return 0, err
 	}
+	core.writeReg(REG_ESP, spSize, sp+uint32(size/8))
 	return val, nil
 }
 
+func stackPush16(core *CpuCore, val uint16) error {
+	return stackPush(core, 16, uint32(val))
+}
+
+// INSTR_RET_NEAR pops the return address, C2 then releases imm16 bytes of parameters
 func INSTR_RET_NEAR(core *CpuCore) {
-	stackPntrAddr, err := stackPop16(core)
+	core.currentByteAddr++
+	var release uint16
+	if core.currentOpCodeBeingExecuted == 0xC2 {
+		var err error
+		if release, err = core.readImm16(); err != nil {
+			log.Println("Error reading RET operand:", err)
+			return
+		}
+	}
+
+	returnAddr, err := stackPop(core, core.operandSize())
 	if err != nil {
 		log.Println("Error popping from stack:", err)
 		return
 	}
+	core.releaseStack(release)
 
-	core.registers.IP = stackPntrAddr
 	core.logInstruction(fmt.Sprintf("[%#04x] RET NEAR", core.GetCurrentlyExecutingInstructionAddress()))
+	core.setInstructionPointer(returnAddr)
+	core.flags.IsFarJump = true
+	core.popCallFrame()
 }
 
+// INSTR_RET_FAR pops the return address and CS, CA then releases imm16 bytes of parameters. A
+// return to a less privileged level pops that level's stack pointer as well.
 func INSTR_RET_FAR(core *CpuCore) {
-	stackPntrAddr, err := stackPop16(core)
+	core.currentByteAddr++
+	var release uint16
+	if core.currentOpCodeBeingExecuted == 0xCA {
+		var err error
+		if release, err = core.readImm16(); err != nil {
+			log.Println("Error reading RET operand:", err)
+			return
+		}
+	}
+
+	size := core.operandSize()
+	sp := *core.registers.ESP()
+	returnAddr, err := stackPop(core, size)
 	if err != nil {
 		log.Println("Error popping IP from stack:", err)
 		return
 	}
-
-	stackPntrSegment, err := stackPop16(core)
+	segment, err := stackPop(core, size)
 	if err != nil {
 		log.Println("Error popping CS from stack:", err)
+		*core.registers.ESP() = sp
+		return
+	}
+	if err := core.returnFar(uint16(segment), size, release); err != nil {
+		// a fault on the return CS or stack leaves the return address on the stack
+		*core.registers.ESP() = sp
 		return
 	}
 
-	core.registers.IP = stackPntrAddr
-	core.registers.CS.Base = uint32(stackPntrSegment) // << 4
 	core.logInstruction(fmt.Sprintf("[%#04x] RET FAR", core.GetCurrentlyExecutingInstructionAddress()))
+	core.setInstructionPointer(returnAddr)
+	core.flags.IsFarJump = true
+	core.popCallFrame()
+}
+
+// releaseStack drops bytes from the top of the stack, as ret imm16 does for the caller's parameters
+func (core *CpuCore) releaseStack(bytes uint16) {
+	spSize := core.stackAddressSize()
+	sp, _ := core.readReg(REG_ESP, spSize)
+	core.writeReg(REG_ESP, spSize, sp+uint32(bytes))
 }
 
 func INSTR_PUSH(core *CpuCore) {
 	opcode := core.currentOpCodeBeingExecuted
-	switch opcode {
-	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57: // PUSH r16
-		index := opcode - 0x50
-		val := core.registers.registers16Bit[index]
-		if err := stackPush16(core, *val); err != nil {
-			core.logInstruction("Error pushing register: %#04x\n", opcode)
-			return
-		}
-		core.logInstruction(fmt.Sprintf("[%#04x] PUSH %s", core.GetCurrentlyExecutingInstructionAddress(), core.registers.index16ToString(index)))
-		core.currentByteAddr += 2
-	case 0x06: // PUSH ES
-		segmentSelector := uint16(core.registers.ES.Base >> 4)
-		if err := stackPush16(core, segmentSelector); err != nil {
-			core.logInstruction("Error pushing ES: %s\n", err)
-			return
-		}
-		core.logInstruction(fmt.Sprintf("PUSH ES"))
-		core.currentByteAddr += 1
+	size := core.operandSize()
+	core.currentByteAddr++
 
-	case 0x60:
-		// Save the original SP to push later
-		originalSP := core.registers.SP
+	var val uint32
+	var valName string
+	var err error
 
-		// The order in which registers are pushed to the stack: DI, SI, BP, original SP, BX, DX, CX, AX
-		err := stackPush16(core, core.registers.DI)
-		if err != nil {
-			log.Println("Error pushing DI:", err)
-			return
-		}
-		err = stackPush16(core, core.registers.SI)
-		if err != nil {
-			log.Println("Error pushing SI:", err)
-			return
-		}
-		err = stackPush16(core, core.registers.BP)
-		if err != nil {
-			log.Println("Error pushing BP:", err)
-			return
-		}
-		err = stackPush16(core, originalSP) // Push the original SP value
-		if err != nil {
-			log.Println("Error pushing original SP:", err)
-			return
-		}
-		err = stackPush16(core, core.registers.BX)
-		if err != nil {
-			log.Println("Error pushing BX:", err)
-			return
-		}
-		err = stackPush16(core, core.registers.DX)
-		if err != nil {
-			log.Println("Error pushing DX:", err)
-			return
-		}
-		err = stackPush16(core, core.registers.CX)
-		if err != nil {
-			log.Println("Error pushing CX:", err)
-			return
-		}
-		err = stackPush16(core, core.registers.AX)
-		if err != nil {
-			log.Println("Error pushing AX:", err)
-			return
+	switch opcode {
+	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57: // PUSH r
+		val, valName = core.readReg(opcode&7, size)
+		if opcode == 0x54 && core.model == CPU_MODEL_8086 {
+			// the 8086 pushes SP as it is after the decrement
+			val = (val - uint32(size/8)) & sizeMask(size)
+		}
+	case 0x06, 0x0E, 0x16, 0x1E: // PUSH ES, CS, SS, DS
+		index := opcode >> 3
+		val, valName = uint32(core.registers.registersSegmentRegisters[index].Selector), core.registers.indexSegmentToString(index)
+	case 0x60: // PUSHA, PUSHAD
+		originalSP, _ := core.readReg(REG_ESP, size)
+		for index := uint8(REG_EAX); index <= REG_EDI; index++ {
+			val, _ = core.readReg(index, size)
+			if index == REG_ESP {
+				val = originalSP
+			}
+			if err := stackPush(core, size, val); err != nil {
+				log.Println("Error pushing registers:", err)
+				return
+			}
 		}
-
 		core.logInstruction(fmt.Sprintf("[%#04x] PUSHA", core.GetCurrentlyExecutingInstructionAddress()))
-		core.currentByteAddr += 1
-
-	case 0x6A: // PUSH imm8
-		imm8, err := core.readImm8() // Assumes implementation to read the next byte as signed 8-bit
-		if err != nil {
-			core.logInstruction("Error reading immediate value: %s\n", err)
-			return
-		}
-		signExtended := uint16(int8(imm8))
-		if err := stackPush16(core, signExtended); err != nil {
-			core.logInstruction("Error pushing sign-extended immediate value: %s\n", err)
-			return
-		}
-		core.logInstruction(fmt.Sprintf("PUSH %d (sign-extended)", signExtended))
-		core.currentByteAddr += 2
-	case 0x68: // PUSH imm16
-		imm16, err := core.readImm16() // Assumes implementation to read the next two bytes as 16-bit
-		if err != nil {
-			core.logInstruction("Error reading immediate 16-bit value: %s\n", err)
-			return
-		}
-		if err := stackPush16(core, imm16); err != nil {
-			core.logInstruction("Error pushing immediate value: %s\n", err)
-			return
-		}
-		core.logInstruction(fmt.Sprintf("PUSH %#04x", imm16))
-		core.currentByteAddr += 3
+		return
+	case 0x6A: // PUSH imm8, sign extended
+		val, err = core.readImm(8)
+		val = signExtend(val, 8) & sizeMask(size)
+		valName = fmt.Sprintf("%#x", val)
+	case 0x68: // PUSH imm
+		val, err = core.readImm(size)
+		valName = fmt.Sprintf("%#x", val)
+	case 0xFF: // PUSH r/m
+		modrm, bytesConsumed, modrmErr := core.consumeModRm()
+		if modrmErr != nil {
+			core.logInstruction("Error consuming ModR/M byte: %v\n", modrmErr)
+			return
+		}
+		core.currentByteAddr += bytesConsumed
+		val, valName, err = core.readRm(&modrm, size)
 	default:
 		core.logInstruction("Unhandled PUSH opcode: %#04x\n", opcode)
+		return
 	}
-}
-
-func INSTR_PUSH_RM16(core *CpuCore) {
-	core.currentByteAddr++
-	modrm, _, err := core.consumeModRm()
-	if err != nil {
-		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
-		return // Exit early on error
-	}
-	core.currentByteAddr--
-
-	addr, addrName, err := core.readRm16(&modrm)
 	if err != nil {
-		core.logInstruction("Error reading RM16: %s\n", err)
+		core.logInstruction("Error reading PUSH operand: %s\n", err)
 		return
 	}
 
-	if err := stackPush16(core, *addr); err != nil {
-		core.logInstruction("Error pushing RM16: %s\n", err)
+	if err := stackPush(core, size, val); err != nil {
+		core.logInstruction("Error pushing %s: %s\n", valName, err)
 		return
 	}
-
-	core.logInstruction(fmt.Sprintf("[%#04x] PUSH %s", core.GetCurrentlyExecutingInstructionAddress(), addrName))
-	core.currentByteAddr += 1
+	core.logInstruction(fmt.Sprintf("[%#04x] PUSH %s", core.GetCurrentlyExecutingInstructionAddress(), valName))
 }
 
 func INSTR_POP(core *CpuCore) {
-	var instructionSize uint32
+	opcode := core.currentOpCodeBeingExecuted
+	size := core.operandSize()
+	core.currentByteAddr++
 
-	switch core.currentOpCodeBeingExecuted {
-	case 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F:
-		regIndex := core.currentOpCodeBeingExecuted - 0x58
-		val, valName := core.registers.registers16Bit[regIndex], core.registers.index16ToString(regIndex)
-		pval, err := stackPop16(core)
+	switch opcode {
+	case 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F: // POP r
+		val, err := stackPop(core, size)
 		if err != nil {
 			log.Println("Error popping from stack:", err)
 			return
 		}
-		*val = pval
+		valName := core.writeReg(opcode&7, size, val)
 		core.logInstruction(fmt.Sprintf("[%#04x] POP %s", core.GetCurrentlyExecutingInstructionAddress(), valName))
-		instructionSize = 1 // POP r16 instructions are 1 byte long
 
-	case 0x07, 0x17, 0x1F, 0x0E: // POP ES, SS, DS, CS respectively
-		var reg *SegmentRegister
-		var regName string
-		switch core.currentOpCodeBeingExecuted {
-		case 0x07:
-			reg = &core.registers.ES
-			regName = "ES"
-		case 0x17:
-			reg = &core.registers.SS
-			regName = "SS"
-		case 0x1F:
-			reg = &core.registers.DS
-			regName = "DS"
-		case 0x0E:
-			reg = &core.registers.CS
-			regName = "CS"
-		}
-		val, err := stackPop16(core)
+	case 0x07, 0x0F, 0x17, 0x1F: // POP ES, CS (8086 only), SS, DS
+		index := opcode >> 3
+		regName := core.registers.indexSegmentToString(index)
+		sp := *core.registers.ESP()
+		val, err := stackPop(core, size)
 		if err != nil {
 			core.logInstruction("Error popping %s from stack: %s\n", regName, err)
 			return
 		}
-		reg.Base = uint32(val) << 4
-		core.logInstruction(fmt.Sprintf("[%#04x] POP %s", core.GetCurrentlyExecutingInstructionAddress(), regName))
-		instructionSize = 1 // POP segment register instructions are also 1 byte long
-	case 0x61:
-		// The order in which registers are popped from the stack: AX, CX, DX, BX, original SP, BP, SI, DI
-		AX, err := stackPop16(core)
-		if err != nil {
-			log.Println("Error popping AX:", err)
+		if err := core.loadSegment(uint32(index)+1, uint16(val)); err != nil {
+			*core.registers.ESP() = sp
 			return
 		}
-		CX, err := stackPop16(core)
-		if err != nil {
-			log.Println("Error popping CX:", err)
-			return
-		}
-		DX, err := stackPop16(core)
-		if err != nil {
-			log.Println("Error popping DX:", err)
-			return
+		core.logInstruction(fmt.Sprintf("[%#04x] POP %s", core.GetCurrentlyExecutingInstructionAddress(), regName))
 
-		}
-		BX, err := stackPop16(core)
+	case 0x8F: // POP r/m
+		modrm, bytesConsumed, err := core.consumeModRm()
 		if err != nil {
-			log.Println("Error popping BX:", err)
+			core.logInstruction("Error consuming ModR/M byte: %v\n", err)
 			return
 		}
-		originalSP, err := stackPop16(core)
-		if err != nil {
-			log.Println("Error popping original SP:", err)
-			return
-		}
-		BP, err := stackPop16(core)
-		if err != nil {
-			log.Println("Error popping BP:", err)
-			return
-		}
-		SI, err := stackPop16(core)
+		core.currentByteAddr += bytesConsumed
+
+		val, err := stackPop(core, size)
 		if err != nil {
-			log.Println("Error popping SI:", err)
+			log.Println("Error popping from stack:", err)
 			return
 		}
-		DI, err := stackPop16(core)
+		// an ESP based destination is addressed with ESP after the pop
+		valName, err := core.writeRm(&modrm, size, val)
 		if err != nil {
-			log.Println("Error popping DI:", err)
+			log.Println("Error writing POP destination:", err)
 			return
 		}
+		core.logInstruction(fmt.Sprintf("[%#04x] POP %s", core.GetCurrentlyExecutingInstructionAddress(), valName))
 
-		core.registers.AX = AX
-		core.registers.CX = CX
-		core.registers.DX = DX
-		core.registers.BX = BX
-		core.registers.SP = originalSP
-		core.registers.BP = BP
-		core.registers.SI = SI
-		core.registers.DI = DI
+	case 0x61: // POPA, POPAD - the saved SP is discarded
+		for index := int(REG_EDI); index >= REG_EAX; index-- {
+			val, err := stackPop(core, size)
+			if err != nil {
+				log.Println("Error popping registers:", err)
+				return
+			}
+			if index != REG_ESP {
+				core.writeReg(uint8(index), size, val)
+			}
+		}
+		core.logInstruction(fmt.Sprintf("[%#04x] POPA", core.GetCurrentlyExecutingInstructionAddress()))
 
 	default:
-		core.logInstruction("Unhandled POP instruction: %#04x\n", core.currentOpCodeBeingExecuted)
-		return
+		core.logInstruction("Unhandled POP instruction: %#04x\n", opcode)
 	}
-
-	// Increment the instruction pointer by the size of the instruction
-	core.currentByteAddr += instructionSize
 }
@@ -0,0 +1,366 @@
+package intel8086
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+)
+
+/*
+	Tasks
+	A task's registers live in its TSS, which TR selects from the GDT. A task switch saves the
+	registers into the outgoing TSS and loads them from the incoming one. A JMP just moves to the
+	new task. A CALL, or an interrupt through a task gate, nests it: the new TSS gets a back-link to
+	the old one and the new task runs with NT set, so that its IRET switches back through the
+	back-link. Every task on that chain has the busy bit set in its TSS descriptor, so none of them
+	can be entered again until it is returned to.
+	Each switch sets CR0.TS, and the coprocessor state is only saved once the new task uses it.
+*/
+
+// reasons for a task switch, which differ in what they do with the busy bits, NT and the back-link
+const (
+	TASK_SWITCH_JMP  = iota
+	TASK_SWITCH_CALL // CALL, and interrupts and exceptions through a task gate
+	TASK_SWITCH_IRET
+)
+
+// tssLayout is where a 286 or 386 TSS keeps the registers a task switch saves and loads
+type tssLayout struct {
+	size     uint8  // width of the register fields
+	minLimit uint32 // the smallest limit a TSS of this type can have
+	eip      uint32
+	flags    uint32
+	gprs     uint32 // EAX to EDI in encoding order
+	segments uint32 // ES, CS, SS and DS, then FS and GS in a 386 TSS
+	segCount int
+	ldt      uint32
+}
+
+var (
+	tss16 = tssLayout{size: 16, minLimit: 0x2B, eip: 0x0E, flags: 0x10, gprs: 0x12, segments: 0x22, segCount: 4, ldt: 0x2A}
+	tss32 = tssLayout{size: 32, minLimit: 0x67, eip: 0x20, flags: 0x24, gprs: 0x28, segments: 0x48, segCount: 6, ldt: 0x60}
+)
+
+// TSS_CR3 is the offset of the page directory base in a 386 TSS
+const TSS_CR3 = 0x1C
+
+// tssLayoutFor is the layout of the TSS a descriptor describes, 386 TSSs have bit 3 of their type set
+func tssLayoutFor(tss *SegmentRegister) *tssLayout {
+	if tss.access_information&0x8 != 0 {
+		return &tss32
+	}
+	return &tss16
+}
+
+// field is the offset of the index'th register field starting at offset
+func (layout *tssLayout) field(offset uint32, index int) uint32 {
+	return offset + uint32(index)*uint32(layout.size/8)
+}
+
+// taskTransfer handles a far JMP or CALL whose selector names a TSS or a task gate rather than a
+// code segment, by switching to that task. It reports whether the selector was one of those, the
+// caller goes on to load CS when it wasn't. The TSS or gate must be at least as privileged as CPL
+// and the selector's RPL, so that outer rings can only switch to the tasks they are given gates to.
+func (core *CpuCore) taskTransfer(selector uint16, reason uint8, next uint32) (bool, error) {
+	if !core.isProtectedMode() || selector&0xFFFC == 0 {
+		return false, nil
+	}
+	descriptor, _, err := core.readDescriptor(selector)
+	if err != nil {
+		return true, err
+	}
+
+	descriptorType := descriptor.access_information & (SEGMENT_CODE_DATA | 0xF)
+	switch descriptorType {
+	case DESCRIPTOR_TSS_16, DESCRIPTOR_TSS_16 | DESCRIPTOR_TSS_BUSY, DESCRIPTOR_TSS_32, DESCRIPTOR_TSS_32 | DESCRIPTOR_TSS_BUSY:
+	case DESCRIPTOR_TASK_GATE:
+	default:
+		return false, nil
+	}
+	if descriptor.DPL() < max(core.cpl(), uint8(selector&3)) {
+		return true, core.fault(EXCEPTION_GP, selector&0xFFFC)
+	}
+	if descriptorType == DESCRIPTOR_TASK_GATE {
+		if !descriptor.Usable() {
+			return true, core.fault(EXCEPTION_NP, selector&0xFFFC)
+		}
+		// a gate keeps its TSS selector where a segment descriptor keeps the low word of its base
+		selector = uint16(descriptor.Base)
+	}
+	return true, core.taskSwitch(selector, reason, next)
+}
+
+// taskSwitch saves the running task in the TSS TR selects and switches to the task whose TSS
+// selector names. The outgoing task resumes at next when it is switched back to. Faults up to
+// loading TR are raised in the outgoing task, those loading the new task's state in the new task.
+func (core *CpuCore) taskSwitch(selector uint16, reason uint8, next uint32) error {
+	// the incoming TSS must be in the GDT, and busy only when returning to a task that nested
+	invalid, busy := uint8(EXCEPTION_GP), uint16(0)
+	if reason == TASK_SWITCH_IRET {
+		invalid, busy = EXCEPTION_TS, DESCRIPTOR_TSS_BUSY
+	}
+	if selector&0x4 != 0 {
+		return core.fault(invalid, selector&0xFFFC)
+	}
+	incoming, incomingAddr, err := core.readDescriptor(selector)
+	if err != nil {
+		return err
+	}
+	switch incoming.access_information & (SEGMENT_CODE_DATA | 0xF) {
+	case DESCRIPTOR_TSS_16 | busy, DESCRIPTOR_TSS_32 | busy:
+	default:
+		return core.fault(invalid, selector&0xFFFC)
+	}
+	if !incoming.Usable() {
+		return core.fault(EXCEPTION_NP, selector&0xFFFC)
+	}
+	if incoming.Limit < tssLayoutFor(&incoming).minLimit {
+		return core.fault(EXCEPTION_TS, selector&0xFFFC)
+	}
+
+	outgoing := core.registers.TR
+	if !outgoing.Usable() || outgoing.Limit < tssLayoutFor(&outgoing).minLimit {
+		return core.fault(EXCEPTION_TS, outgoing.Selector&0xFFFC)
+	}
+	outgoingAddr, err := core.descriptorAddress(outgoing.Selector)
+	if err != nil {
+		return err
+	}
+
+	// a task returned from is no longer nested
+	flags := core.registers.EFLAGS
+	if reason == TASK_SWITCH_IRET {
+		flags &^= NestedTaskFlag
+	}
+	if err := core.saveTaskState(&outgoing, next, flags); err != nil {
+		return err
+	}
+
+	switch reason {
+	case TASK_SWITCH_CALL:
+		if err := core.memoryAccessController.WriteMemoryAddr16(incoming.Base, outgoing.Selector); err != nil {
+			return err
+		}
+	default:
+		if err := core.setTaskBusy(outgoingAddr, &outgoing, false); err != nil {
+			return err
+		}
+	}
+	if reason != TASK_SWITCH_IRET {
+		if err := core.setTaskBusy(incomingAddr, &incoming, true); err != nil {
+			return err
+		}
+	}
+
+	core.logDebug(fmt.Sprintf("CPU: task switch from TSS %#04x to %#04x", outgoing.Selector, selector))
+	core.registers.TR = incoming
+	core.registers.CR0 |= CR0_TS
+	return core.loadTaskState(reason == TASK_SWITCH_CALL)
+}
+
+// setTaskBusy sets or clears the busy bit of the TSS descriptor at addr in the GDT
+func (core *CpuCore) setTaskBusy(addr uint32, tss *SegmentRegister, busy bool) error {
+	if busy {
+		tss.access_information |= DESCRIPTOR_TSS_BUSY
+	} else {
+		tss.access_information &^= DESCRIPTOR_TSS_BUSY
+	}
+	return core.memoryAccessController.WriteMemoryAddr8(addr+5, uint8(tss.access_information))
+}
+
+// saveTaskState stores the running task's registers in its TSS, with the offset and flags it
+// resumes with. The LDT selector and CR3 are never saved, a task can't change them.
+func (core *CpuCore) saveTaskState(tss *SegmentRegister, eip uint32, flags uint32) error {
+	layout := tssLayoutFor(tss)
+	write := func(offset uint32, value uint32) error {
+		return core.writeMemory(tss.Base+offset, layout.size, value)
+	}
+
+	if err := write(layout.eip, eip); err != nil {
+		return err
+	}
+	if err := write(layout.flags, flags); err != nil {
+		return err
+	}
+	for i, value := range core.registers.gpr {
+		if err := write(layout.field(layout.gprs, i), value); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < layout.segCount; i++ {
+		if err := write(layout.field(layout.segments, i), uint32(core.registers.registersSegmentRegisters[i].Selector)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTaskState loads the registers of the task TR has just been switched to, setting NT when it
+// is nested. The LDT is loaded before the segment registers, whose selectors may be in it. A
+// selector that doesn't suit its register is #TS rather than #GP.
+func (core *CpuCore) loadTaskState(nested bool) error {
+	tss := core.registers.TR
+	layout := tssLayoutFor(&tss)
+	read := func(offset uint32, size uint8) (uint32, error) {
+		return core.readMemory(tss.Base+offset, size)
+	}
+
+	eip, err := read(layout.eip, layout.size)
+	if err != nil {
+		return err
+	}
+	flags, err := read(layout.flags, layout.size)
+	if err != nil {
+		return err
+	}
+	var gprs [8]uint32
+	for i := range gprs {
+		if gprs[i], err = read(layout.field(layout.gprs, i), layout.size); err != nil {
+			return err
+		}
+	}
+	selectors := make([]uint16, layout.segCount)
+	for i := range selectors {
+		value, err := read(layout.field(layout.segments, i), 16)
+		if err != nil {
+			return err
+		}
+		selectors[i] = uint16(value)
+	}
+	ldt, err := read(layout.ldt, 16)
+	if err != nil {
+		return err
+	}
+	if layout == &tss32 {
+		if core.registers.CR3, err = read(TSS_CR3, 32); err != nil {
+			return err
+		}
+		debugTrap, err := read(TSS_DEBUG_TRAP, 16)
+		if err != nil {
+			return err
+		}
+		if debugTrap&1 != 0 {
+			core.debugTrap |= DR6_BT
+		}
+	}
+
+	// a 286 TSS only holds the low words, the upper halves of the registers are left as they were
+	for i, value := range gprs {
+		core.writeReg(uint8(i), layout.size, value)
+	}
+	core.loadFlags(flags)
+	if nested {
+		core.registers.SetFlag(NestedTaskFlag, true)
+	}
+	*core.registers.EIP() = eip
+
+	if err := core.loadLDT(uint16(ldt)); err != nil {
+		return core.taskFault(err)
+	}
+	// a task whose flags have VM set runs in virtual 8086 mode, and loads its segments as such.
+	// CS first, so that the offset is set in the new task should another selector fault. The
+	// task runs at the RPL of its CS, and its other segments are checked at that level.
+	core.currentPrivilegeLevel = uint8(selectors[common.SEGMENT_CS-1] & 3)
+	for _, segment := range []uint32{common.SEGMENT_CS, common.SEGMENT_SS, common.SEGMENT_ES, common.SEGMENT_DS, common.SEGMENT_FS, common.SEGMENT_GS}[:layout.segCount] {
+		register, err := core.segmentLoad(segment, selectors[segment-1])
+		if err == nil && segment == common.SEGMENT_CS && !core.isVirtual8086Mode() {
+			err = core.checkReturnTarget(&register)
+		}
+		if err != nil {
+			return core.taskFault(err)
+		}
+		*core.segmentRegister(segment) = register
+		if segment == common.SEGMENT_CS {
+			core.setInstructionPointer(eip)
+		}
+	}
+	return nil
+}
+
+// taskFault turns a #GP raised loading the incoming task's state into the #TS a task switch raises
+func (core *CpuCore) taskFault(err error) error {
+	if exception, ok := err.(*cpuException); ok && exception == core.pendingException && exception.vector == EXCEPTION_GP {
+		exception.vector = EXCEPTION_TS
+	}
+	return err
+}
+
+// tssStack reads the stack pointer for privilege level dpl from the running task's TSS, the stack
+// an interrupt or call into a more privileged level switches to
+func (core *CpuCore) tssStack(dpl uint8) (uint16, uint32, error) {
+	tss := &core.registers.TR
+	layout := tssLayoutFor(tss)
+	// SS follows the stack pointer, and the pair for each level follows the back-link
+	offset := layout.field(layout.field(0, 1), int(dpl)*2)
+	if !tss.Usable() || layout.field(offset, 2)-1 > tss.Limit {
+		return 0, 0, core.fault(EXCEPTION_TS, tss.Selector&0xFFFC)
+	}
+	esp, err := core.readMemory(tss.Base+offset, layout.size)
+	if err != nil {
+		return 0, 0, err
+	}
+	ss, err := core.readMemory(tss.Base+layout.field(offset, 1), 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint16(ss), esp, nil
+}
+
+// interruptTask runs an interrupt handler that is a task of its own, reached through a task gate.
+// The interrupted task resumes where it was interrupted, and an error code goes on the handler
+// task's stack.
+func (core *CpuCore) interruptTask(selector uint16, pushErrorCode bool, errorCode uint16) error {
+	if err := core.taskSwitch(selector, TASK_SWITCH_CALL, *core.registers.EIP()); err != nil {
+		return err
+	}
+	if pushErrorCode {
+		return stackPush(core, tssLayoutFor(&core.registers.TR).size, uint32(errorCode))
+	}
+	return nil
+}
+
+// INSTR_LTR loads the task register from a GDT selector, 0F 00 /3. The descriptor must be an
+// available TSS, which becomes busy.
+func INSTR_LTR(core *CpuCore) {
+	modrm, bytesConsumed, err := core.consumeModRm()
+	if err != nil {
+		core.logInstruction("Error consuming ModR/M byte: %v\n", err)
+		return
+	}
+	core.currentByteAddr += bytesConsumed
+	if !core.isProtectedMode() || core.isVirtual8086Mode() {
+		core.fault(EXCEPTION_UD, 0)
+		return
+	}
+	if core.checkPrivilege() != nil {
+		return
+	}
+
+	value, name, err := core.readRm(&modrm, 16)
+	if err != nil {
+		return
+	}
+	selector := uint16(value)
+	if selector&0xFFFC == 0 || selector&0x4 != 0 {
+		core.fault(EXCEPTION_GP, selector&0xFFFC)
+		return
+	}
+	descriptor, addr, err := core.readDescriptor(selector)
+	if err != nil {
+		return
+	}
+	switch descriptor.access_information & (SEGMENT_CODE_DATA | 0xF) {
+	case DESCRIPTOR_TSS_16, DESCRIPTOR_TSS_32:
+	default:
+		core.fault(EXCEPTION_GP, selector&0xFFFC)
+		return
+	}
+	if !descriptor.Usable() {
+		core.fault(EXCEPTION_NP, selector&0xFFFC)
+		return
+	}
+	if err := core.setTaskBusy(addr, &descriptor, true); err != nil {
+		return
+	}
+	core.registers.TR = descriptor
+	core.logInstruction(fmt.Sprintf("[%#04x] LTR %s", core.GetCurrentlyExecutingInstructionAddress(), name))
+}
@@ -0,0 +1,159 @@
+package intel8086
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+)
+
+/*
+	Virtual 8086 mode
+	With EFLAGS.VM set in protected mode the processor runs real mode code as a task at privilege
+	level 3. Segments are loaded real mode style, base selector*16 with a 64K limit. Interrupts and
+	exceptions still go through the IDT, to a ring 0 handler, the V86 monitor, which gets the
+	virtual 8086 segment registers pushed on its stack and returns with an IRET that pops them.
+	CLI, STI, PUSHF, POPF, INT n and IRET fault with #GP unless IOPL is 3, so that the monitor can
+	emulate them. Port accesses don't depend on IOPL but on the TSS's I/O permission bitmap.
+*/
+
+// TSS_IO_MAP_BASE is the offset in a 386 TSS of the word holding the I/O permission bitmap's offset
+const TSS_IO_MAP_BASE = 0x66
+
+// isVirtual8086Mode reports whether protected mode code is running as a virtual 8086 task
+func (core *CpuCore) isVirtual8086Mode() bool {
+	return core.isProtectedMode() && core.registers.EFLAGS&VirtualModeFlag != 0
+}
+
+// updateMode follows the processor into or out of virtual 8086 mode after VM has changed
+func (core *CpuCore) updateMode() {
+	mode := uint8(common.REAL_MODE)
+	if core.isVirtual8086Mode() {
+		mode = common.VIRTUAL_8086_MODE
+	} else if core.isProtectedMode() {
+		mode = common.PROTECTED_MODE
+	}
+	if mode != core.mode {
+		core.EnterMode(mode)
+	}
+}
+
+// iopl is the privilege level port accesses and the interrupt flag need, from EFLAGS
+func (core *CpuCore) iopl() uint8 {
+	return uint8(core.registers.EFLAGS & IoPrivilegeLevelFlag >> 12)
+}
+
+// checkIOPL raises #GP for CLI and STI in protected mode when CPL is above IOPL, which in virtual
+// 8086 mode is whenever IOPL isn't 3
+func (core *CpuCore) checkIOPL() error {
+	if core.cpl() > core.iopl() {
+		return core.fault(EXCEPTION_GP, 0)
+	}
+	return nil
+}
+
+// checkVirtual8086IOPL raises #GP for PUSHF, POPF, INT n and IRET in virtual 8086 mode unless
+// IOPL is 3. In protected mode those instructions don't fault on IOPL.
+func (core *CpuCore) checkVirtual8086IOPL() error {
+	if core.isVirtual8086Mode() && core.iopl() < 3 {
+		return core.fault(EXCEPTION_GP, 0)
+	}
+	return nil
+}
+
+// checkIOPermission decides whether the running code may access size bits at port. Real mode code
+// and protected mode code with CPL at or below IOPL always can. Otherwise, and always in virtual
+// 8086 mode, the 386 TSS's I/O permission bitmap must have a clear bit for every byte accessed,
+// and a port whose bit lies past the end of the TSS is #GP.
+func (core *CpuCore) checkIOPermission(port uint16, size uint8) error {
+	if !core.isProtectedMode() || !core.isVirtual8086Mode() && core.cpl() <= core.iopl() {
+		return nil
+	}
+	tss := &core.registers.TR
+	if !tss.Usable() || tssLayoutFor(tss) != &tss32 || tss.Limit < TSS_IO_MAP_BASE+1 {
+		return core.fault(EXCEPTION_GP, 0)
+	}
+	mapBase, err := core.memoryAccessController.ReadMemoryValue16(tss.Base + TSS_IO_MAP_BASE)
+	if err != nil {
+		return err
+	}
+
+	// the bits for one access can straddle two bytes, which are always read together
+	offset := uint32(mapBase) + uint32(port)/8
+	if offset+1 > tss.Limit {
+		return core.fault(EXCEPTION_GP, 0)
+	}
+	bits, err := core.memoryAccessController.ReadMemoryValue16(tss.Base + offset)
+	if err != nil {
+		return err
+	}
+	if bits>>(port%8)&(1<<(size/8)-1) != 0 {
+		return core.fault(EXCEPTION_GP, 0)
+	}
+	return nil
+}
+
+// interruptFromVirtual8086 enters the protected mode handler for an interrupt or exception raised
+// in virtual 8086 mode. The handler must be in a ring 0 non-conforming code segment and runs on
+// the ring 0 stack from the TSS, with GS, FS, DS, ES and the virtual 8086 stack pushed above the
+// usual return state. The data segment registers are nulled, since their real mode style
+// contents mean nothing to the handler.
+func (core *CpuCore) interruptFromVirtual8086(cs SegmentRegister, target uint32, size uint8, clearIF bool, pushErrorCode bool, errorCode uint16) error {
+	if cs.DPL() != 0 || cs.access_information&SEGMENT_EXPAND_DOWN != 0 {
+		return core.fault(EXCEPTION_GP, cs.Selector&0xFFFC)
+	}
+	stack, esp, err := core.innerStack(0)
+	if err != nil {
+		return err
+	}
+
+	registers := core.registers
+	frame := []uint32{
+		uint32(registers.GS.Selector), uint32(registers.FS.Selector), uint32(registers.DS.Selector), uint32(registers.ES.Selector),
+		uint32(registers.SS.Selector), *registers.ESP(), registers.EFLAGS, uint32(registers.CS.Selector), *registers.EIP(),
+	}
+	if pushErrorCode {
+		frame = append(frame, uint32(errorCode))
+	}
+	if err := core.pushOnStack(stack, esp, size, frame); err != nil {
+		return err
+	}
+
+	for _, segment := range []*SegmentRegister{&registers.ES, &registers.DS, &registers.FS, &registers.GS} {
+		*segment = SegmentRegister{}
+	}
+	if clearIF {
+		registers.SetFlag(InterruptFlag, false)
+	}
+	registers.EFLAGS &^= VirtualModeFlag | ResumeFlag | NestedTaskFlag | TrapFlag
+	core.updateMode()
+
+	core.enterCodeSegment(cs, 0)
+	core.setInstructionPointer(target)
+	return nil
+}
+
+// returnToVirtual8086 finishes an IRETD at ring 0 whose popped EFLAGS has VM set. Below EIP, CS and
+// EFLAGS the stack holds the virtual 8086 task's ESP, SS, ES, DS, FS and GS, and all of the
+// segment registers are loaded real mode style.
+func (core *CpuCore) returnToVirtual8086(eip uint32, cs uint32, flags uint32) error {
+	var state [6]uint32
+	for i := range state {
+		value, err := stackPop(core, 32)
+		if err != nil {
+			return err
+		}
+		state[i] = value
+	}
+
+	core.logInstruction(fmt.Sprintf("[%#04x] IRETD (to virtual 8086 mode %#04x:%#04x)", core.GetCurrentlyExecutingInstructionAddress(), cs, eip&0xFFFF))
+	core.loadFlags(flags)
+	registers := core.registers
+	registers.CS = RealModeSegment(uint16(cs))
+	registers.SS = RealModeSegment(uint16(state[1]))
+	registers.ES = RealModeSegment(uint16(state[2]))
+	registers.DS = RealModeSegment(uint16(state[3]))
+	registers.FS = RealModeSegment(uint16(state[4]))
+	registers.GS = RealModeSegment(uint16(state[5]))
+	*registers.ESP() = state[0]
+	core.setInstructionPointer(eip & 0xFFFF)
+	return nil
+}
@@ -11,9 +11,13 @@ import (
 
 /*
 Simulated 82335 High Integration Interface Device for 386SX
+The 16 bit memory configuration register (MCR) at 0x22 decides whether the BIOS,
+video BIOS and adapter ROM areas read from ROM or from shadow RAM, whether the
+shadow RAM is write protected, and whether base memory ends at 512K or 640K.
 */
 const (
 	MCR_BIOS_ROM_ENABLE       = 0  // Bit position for BIOS ROM enable
+	MCR_BIOS_READ_ONLY        = 1  // Bit position for BIOS shadow write protect
 	MCR_S640_BASE_MEMORY_SIZE = 3  // Bit position for base memory size (512KB or 640KB)
 	MCR_DRAM_MEMORY_SIZE      = 4  // Bit position for DRAM memory size (1MBx1 or 256KBx1/256KBx4)
 	MCR_MEMORY_INTERLEAVE     = 6  // Bit position for memory interleave mode
@@ -22,6 +26,9 @@ const (
 	MCR_VIDEO_RAM_ENABLE      = 10 // Bit position for video RAM enable
 	MCR_VIDEO_READ_ONLY       = 11 // Bit position for video read-only mode
 
+	// MCR_RESET_VALUE - 640K base memory, everything read from ROM
+	MCR_RESET_VALUE = 1 << MCR_S640_BASE_MEMORY_SIZE
+
 	MCR_MEMORY_INTERLEAVE_1_BANK = 1 // Memory interleave mode: 1 bank
 	MCR_MEMORY_INTERLEAVE_2_BANK = 2 // Memory interleave mode: 2 banks
 	MCR_MEMORY_INTERLEAVE_3_BANK = 3 // Memory interleave mode: 3 banks
@@ -32,17 +39,17 @@ type Intel82335 struct {
 	busId uint32   // Device bus ID
 	bus   *bus.Bus // Reference to the bus
 
-	biosRomAccessEnabled bool  // 0 = enable BIOS ROM access, 1 = disable BIOS ROM access and enable BIOS shadow
+	biosShadowEnabled    bool  // 0 = enable BIOS ROM access, 1 = disable BIOS ROM access and enable BIOS shadow
+	biosReadOnly         bool  // 0 = BIOS shadow read-write, 1 = BIOS shadow read-only
 	s640BaseMemorySize   bool  // 0 = 512KB, 1 = 640KB
 	dRamSize             bool  // 0 = 1MBx1 DRAM, 1 = 256KBx1 or 256KBx4 DRAM
 	romSize              bool  // 0 = 256KB ROM, 1 = 512KB ROM
-	adapterRomEnabled    bool  // 0 = enable adapter ROM access, 1 = disable adapter ROM access and enable shadow
-	videoRamEnabled      bool  // 0 = enable video RAM access, 1 = disable video RAM access
-	videoReadOnly        bool  // 0 = video read-write, 1 = video read-only
+	adapterShadowEnabled bool  // 0 = enable adapter ROM access, 1 = disable adapter ROM access and enable shadow
+	videoShadowEnabled   bool  // 0 = enable video BIOS ROM access, 1 = disable video BIOS ROM access and enable shadow
+	videoReadOnly        bool  // 0 = video shadow read-write, 1 = video shadow read-only
 	memoryInterleaving   uint8 // Memory interleaving mode
 
-	controlRegister uint8   // Control register value
-	mcrRegisters    []uint8 // MCR registers
+	mcr uint16 // Memory configuration register
 
 	// RC1 module
 	rc1RollCompareRegister uint8 // RC1 roll compare register
@@ -53,9 +60,9 @@ type Intel82335 struct {
 
 func NewIntel82335() *Intel82335 {
 	chip := &Intel82335{
-		mcrRegisters:           make([]uint8, 0x100),
 		rc1RollCompareRegister: 0x00,
 	}
+	chip.decodeMcr(MCR_RESET_VALUE)
 	return chip
 }
 
@@ -67,6 +74,15 @@ func (controller *Intel82335) SetBus(bus *bus.Bus) {
 	controller.bus = bus
 }
 
+func (controller *Intel82335) SaveState() interface{} {
+	state := *controller
+	return &state
+}
+
+func (controller *Intel82335) RestoreState(state interface{}) {
+	*controller = *state.(*Intel82335)
+}
+
 func (device *Intel82335) GetDeviceBusId() uint32 {
 	return device.busId
 }
@@ -81,18 +97,26 @@ func (device *Intel82335) OnReceiveMessage(message bus.BusMessage) {
 
 func (controller *Intel82335) GetPortMap() *bus.DevicePortMap {
 	return &bus.DevicePortMap{
-		ReadPorts:  []uint16{0x0022, 0x0024},
-		WritePorts: []uint16{0x0022, 0x0024},
+		Mappings: []bus.PortMapping{
+			{
+				Ports:   bus.Ports(0x0022, 0x0023),
+				Read:    controller.ReadAddr8,
+				Write:   controller.WriteAddr8,
+				Read16:  controller.ReadMcr,
+				Write16: controller.WriteMcr,
+			},
+			bus.ReadWrite(bus.Port(0x0024), controller),
+		},
 	}
 }
 
 func (controller *Intel82335) ReadAddr8(addr uint16) uint8 {
 	switch addr {
 	case 0x0022:
-		// Example: Read a system configuration register or similar
-		return controller.ReadSelectedRegister()
+		return uint8(controller.mcr)
+	case 0x0023:
+		return uint8(controller.mcr >> 8)
 	case 0x0024:
-		// Example: Read another important register
 		return controller.Rc1RegisterRead()
 	default:
 		log.Printf("Intel82335: Invalid read address: %#04x", addr)
@@ -103,63 +127,78 @@ func (controller *Intel82335) ReadAddr8(addr uint16) uint8 {
 func (controller *Intel82335) WriteAddr8(addr uint16, data uint8) {
 	switch addr {
 	case 0x0022:
-		// Example: Write to a system configuration register
-		controller.McrRegisterInitialize(data)
+		controller.McrRegisterInitialize(controller.mcr&0xFF00 | uint16(data))
+	case 0x0023:
+		controller.McrRegisterInitialize(controller.mcr&0x00FF | uint16(data)<<8)
 	case 0x0024:
-		// Example: Write to another control register
 		controller.Rc1RegisterWrite(data)
 	default:
 		log.Printf("Intel82335: Invalid write address: %#04x", addr)
 	}
 }
 
-func (device *Intel82335) McrRegisterInitialize(registerValue uint8) {
-	device.controlRegister = registerValue
+func (controller *Intel82335) ReadMcr(addr uint16) uint16 {
+	return controller.mcr
+}
+
+func (controller *Intel82335) WriteMcr(addr uint16, value uint16) {
+	controller.McrRegisterInitialize(value)
+}
+
+func (device *Intel82335) McrRegisterInitialize(registerValue uint16) {
+	device.decodeMcr(registerValue)
+
+	// Log the updated configuration
+	log.Printf("MCR Set Config: %s", device.toString())
+
+	device.bus.Signals().MemoryConfig.Drive(device.GetMemoryConfig())
+}
+
+func (device *Intel82335) decodeMcr(registerValue uint16) {
+	device.mcr = registerValue
 
 	// Extract configuration bits from the MCR register value
-	device.biosRomAccessEnabled = getRegisterBit(registerValue, MCR_BIOS_ROM_ENABLE)
+	device.biosShadowEnabled = getRegisterBit(registerValue, MCR_BIOS_ROM_ENABLE)
+	device.biosReadOnly = getRegisterBit(registerValue, MCR_BIOS_READ_ONLY)
 	device.s640BaseMemorySize = getRegisterBit(registerValue, MCR_S640_BASE_MEMORY_SIZE)
 	device.dRamSize = getRegisterBit(registerValue, MCR_DRAM_MEMORY_SIZE)
 	device.memoryInterleaving = getMemoryInterleaveMode(registerValue)
 	device.romSize = getRegisterBit(registerValue, MCR_ROM_SIZE)
-	device.adapterRomEnabled = getRegisterBit(registerValue, MCR_ADAPTER_ROM_ENABLE)
-	device.videoRamEnabled = getRegisterBit(registerValue, MCR_VIDEO_RAM_ENABLE)
+	device.adapterShadowEnabled = getRegisterBit(registerValue, MCR_ADAPTER_ROM_ENABLE)
+	device.videoShadowEnabled = getRegisterBit(registerValue, MCR_VIDEO_RAM_ENABLE)
 	device.videoReadOnly = getRegisterBit(registerValue, MCR_VIDEO_READ_ONLY)
+}
 
-	// Log the updated configuration
-	log.Printf("MCR Set Config: %s", device.toString())
-
-	if device.biosRomAccessEnabled {
-		log.Printf("BIOS ROM Access Enabled")
-
-		// Send a message to the bus to notify other devices of the change
-		device.bus.SendMessage(bus.BusMessage{
-			Subject: common.MESSAGE_BIOS_ROM_ACCESS_ENABLED,
-			Sender:  device.busId,
-			Data:    []byte{0},
-		})
-	} else {
-		log.Printf("BIOS ROM Access Disabled, BIOS Shadow Enabled")
-
-		// Send a message to the bus to notify other devices of the change
-		device.bus.SendMessage(bus.BusMessage{
-			Subject: common.MESSAGE_BIOS_ROM_ACCESS_DISABLED,
-			Sender:  device.busId,
-			Data:    []byte{0},
-		})
+// GetMemoryConfig returns how the current MCR value maps memory
+func (device *Intel82335) GetMemoryConfig() bus.MemoryConfig {
+	config := bus.MemoryConfig{
+		BiosShadow:     device.biosShadowEnabled,
+		BiosReadOnly:   device.biosReadOnly,
+		VideoShadow:    device.videoShadowEnabled,
+		VideoReadOnly:  device.videoReadOnly,
+		AdapterShadow:  device.adapterShadowEnabled,
+		BaseMemorySize: 0x80000,
+	}
+	if device.s640BaseMemorySize {
+		config.BaseMemorySize = 0xA0000
 	}
+	return config
 }
 
 func (device *Intel82335) toString() string {
 	var strs []string
 
 	// Append configuration strings based on the current settings
-	if device.biosRomAccessEnabled {
+	if !device.biosShadowEnabled {
 		strs = append(strs, "BiosRomAccessEnabled")
 	} else {
 		strs = append(strs, "BiosRomAccessDisabled,BiosRomShadowEnabled")
 	}
 
+	if device.biosReadOnly {
+		strs = append(strs, "BiosShadowReadOnly")
+	}
+
 	if !device.s640BaseMemorySize {
 		strs = append(strs, "S640BaseMemorySize=512KB")
 	} else {
@@ -180,33 +219,28 @@ func (device *Intel82335) toString() string {
 		strs = append(strs, "ROMSIZE=512KB")
 	}
 
-	if !device.adapterRomEnabled {
+	if !device.adapterShadowEnabled {
 		strs = append(strs, "AdapterRomAccessEnabled")
 	} else {
 		strs = append(strs, "AdapterRomAccessDisabled,AdapterRomShadowEnabled")
 	}
 
-	if !device.videoRamEnabled {
-		strs = append(strs, "VideoRamAccessEnabled")
+	if !device.videoShadowEnabled {
+		strs = append(strs, "VideoRomAccessEnabled")
 	} else {
-		strs = append(strs, "VideoRamAccessDisabled")
+		strs = append(strs, "VideoRomAccessDisabled,VideoRomShadowEnabled")
 	}
 
 	if !device.videoReadOnly {
-		strs = append(strs, "VideoReadWrite")
+		strs = append(strs, "VideoShadowReadWrite")
 	} else {
-		strs = append(strs, "VideoReadOnly")
+		strs = append(strs, "VideoShadowReadOnly")
 	}
 
 	// Join the configuration strings and return the result
 	return strings.Join(strs, ",")
 }
 
-func (device *Intel82335) ReadSelectedRegister() uint8 {
-	// Read the value of the selected MCR register based on the control register value
-	return device.mcrRegisters[device.controlRegister]
-}
-
 func (controller *Intel82335) Rc1RegisterRead() uint8 {
 	// Read the value of the RC1 roll compare register
 	return controller.rc1RollCompareRegister
@@ -247,7 +281,7 @@ func (controller *Intel82335) DmaCommandRegisterWrite(value uint8) {
 	controller.dmaCommandRegister = value
 }
 
-func getMemoryInterleaveMode(registervalue uint8) uint8 {
+func getMemoryInterleaveMode(registervalue uint16) uint8 {
 	// Extract the memory interleave mode bits from the register value
 	o2 := getRegisterBit(registervalue, MCR_MEMORY_INTERLEAVE)
 	o1 := getRegisterBit(registervalue, MCR_MEMORY_INTERLEAVE+1)
@@ -268,7 +302,7 @@ func getMemoryInterleaveMode(registervalue uint8) uint8 {
 	}
 }
 
-func getRegisterBit(source uint8, position uint8) bool {
+func getRegisterBit(source uint16, position uint8) bool {
 	// Extract the bit value at the specified position from the source value
 	return (source>>position)&1 == 1
 }
@@ -1,6 +1,7 @@
 package intel8237
 
 import (
+	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
 	"github.com/andrewjc/threeatesix/devices/memmap"
 	"log"
@@ -51,156 +52,118 @@ func (d *Intel8237) OnReceiveMessage(message bus.BusMessage) {
 func (d *Intel8237) GetPortMap() *bus.DevicePortMap {
 	if d.isPrimaryDevice {
 		return &bus.DevicePortMap{
-			ReadPorts: []uint16{
-				0x0000, 0x0001, 0x0002, 0x0003, 0x0004, 0x0005, 0x0006, 0x0007, // Channel registers
-				0x0008,                         // Status register
-				0x000D,                         // Temporary register
-				0x0087, 0x0083, 0x0081, 0x0082, // Page registers
-			},
-			WritePorts: []uint16{
-				0x0000, 0x0001, 0x0002, 0x0003, 0x0004, 0x0005, 0x0006, 0x0007, // Channel registers
-				0x0008,                         // Command register
-				0x0009,                         // Request register
-				0x000A,                         // Single mask register bit
-				0x000B,                         // Mode register
-				0x000C,                         // Clear byte pointer flip-flop
-				0x000D,                         // Master clear / Temporary register
-				0x000E,                         // Clear mask register
-				0x000F,                         // Write all mask register bits
-				0x0087, 0x0083, 0x0081, 0x0082, // Page registers
+			Mappings: []bus.PortMapping{
+				bus.ReadWrite(bus.Ports(0x0000, 0x0008), d), // Channel registers, command / status register
+				bus.WriteOnly(bus.Ports(0x0009, 0x000C), d), // Request, single mask, mode, clear flip-flop
+				bus.ReadWrite(bus.Port(0x000D), d),          // Master clear / Temporary register
+				bus.WriteOnly(bus.Ports(0x000E, 0x000F), d), // Clear mask, write all mask register bits
+				bus.ReadWrite(bus.Ports(0x0081, 0x0083), d), // Page registers
+				bus.ReadWrite(bus.Port(0x0087), d),
 			},
 		}
 	} else if d.isSecondaryDevice {
+		// the secondary controller sits on A1-A4, so each register is decoded at an even port and its odd alias
 		return &bus.DevicePortMap{
-			ReadPorts: []uint16{
-				0x00C0, 0x00C2, 0x00C4, 0x00C6, 0x00C8, 0x00CA, 0x00CC, 0x00CE, // Channel registers
-				0x00D0,                         // Status register
-				0x00DA,                         // Temporary register
-				0x008F, 0x008B, 0x0089, 0x008A, // Page registers
-			},
-			WritePorts: []uint16{
-				0x00C0, 0x00C2, 0x00C4, 0x00C6, 0x00C8, 0x00CA, 0x00CC, 0x00CE, // Channel registers
-				0x00D0,                         // Command register
-				0x00D2,                         // Request register
-				0x00D4,                         // Single mask register bit
-				0x00D6,                         // Mode register
-				0x00D8,                         // Clear byte pointer flip-flop
-				0x00DA,                         // Master clear / Temporary register
-				0x00DC,                         // Clear mask register
-				0x00DE,                         // Write all mask register bits
-				0x008F, 0x008B, 0x0089, 0x008A, // Page registers
+			Mappings: []bus.PortMapping{
+				bus.ReadWrite(bus.Ports(0x00C0, 0x00D1), d), // Channel registers, command / status register
+				bus.WriteOnly(bus.Ports(0x00D2, 0x00D9), d), // Request, single mask, mode, clear flip-flop
+				bus.ReadWrite(bus.Ports(0x00DA, 0x00DB), d), // Master clear / Temporary register
+				bus.WriteOnly(bus.Ports(0x00DC, 0x00DF), d), // Clear mask, write all mask register bits
+				bus.ReadWrite(bus.Ports(0x0089, 0x008B), d), // Page registers
+				bus.ReadWrite(bus.Port(0x008F), d),
 			},
 		}
 	}
 	return nil
 }
 
-func (d *Intel8237) ReadAddr8(addr uint16) uint8 {
-	if d.isPrimaryDevice {
-		switch addr {
-		case 0x0008:
-			return d.ReadStatusRegister()
-		case 0x000D:
-			return d.ReadTemporaryRegister()
-		}
-	} else if d.isSecondaryDevice {
-		switch addr {
-		case 0x00D0:
-			return d.ReadStatusRegister()
-		case 0x00DA:
-			return d.ReadTemporaryRegister()
-		}
+// register returns the 8237 register (0x0-0xF) a port decodes to
+func (d *Intel8237) register(addr uint16) uint8 {
+	if d.isSecondaryDevice {
+		return uint8((addr-0x00C0)>>1) & 0x0F
 	}
+	return uint8(addr) & 0x0F
+}
 
-	log.Fatalf("Intel8237 Invalid read address: %#04x", addr)
-	panic(0)
+// pageRegister returns the channel of a page register port. Page register ports are not in channel order.
+func pageRegister(addr uint16) (int, bool) {
+	switch addr {
+	case 0x0087, 0x008F:
+		return 0, true
+	case 0x0083, 0x008B:
+		return 1, true
+	case 0x0081, 0x0089:
+		return 2, true
+	case 0x0082, 0x008A:
+		return 3, true
+	}
+	return 0, false
 }
 
-func (d *Intel8237) WriteAddr8(addr uint16, data uint8) {
+func (d *Intel8237) ReadAddr8(addr uint16) uint8 {
+	if channel, ok := pageRegister(addr); ok {
+		return d.pageRegisters[channel]
+	}
 
-	// For address and count registers
-	if addr >= 0x0000 && addr <= 0x0007 {
-		channel := (addr >> 1) & 0x03
+	switch register := d.register(addr); register {
+	case 0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7:
+		// Address and count registers are read a byte at a time, low byte first
+		channel := register >> 1
+		value := d.addressRegisters[channel]
+		if register&1 == 1 {
+			value = d.countRegisters[channel]
+		}
 		if d.flipFlop {
-			// High byte
-			if addr&1 == 0 {
-				d.addressRegisters[channel] = (d.addressRegisters[channel] & 0x00FF) | (uint16(data) << 8)
-			} else {
-				d.countRegisters[channel] = (d.countRegisters[channel] & 0x00FF) | (uint16(data) << 8)
-			}
-		} else {
-			// Low byte
-			if addr&1 == 0 {
-				d.addressRegisters[channel] = (d.addressRegisters[channel] & 0xFF00) | uint16(data)
-			} else {
-				d.countRegisters[channel] = (d.countRegisters[channel] & 0xFF00) | uint16(data)
-			}
+			value >>= 8
 		}
 		d.flipFlop = !d.flipFlop
+		return uint8(value)
+	case 0x8:
+		return d.ReadStatusRegister()
+	case 0xD:
+		return d.ReadTemporaryRegister()
 	}
 
-	// Page registers for primary DMA controller
-	if addr >= 0x0087 && addr <= 0x008F {
-		channel := (addr - 0x0087) >> 1
-		if channel < 4 {
-			d.pageRegisters[channel] = data
-		}
+	log.Printf("Intel8237: Invalid read address: %#04x", addr)
+	return 0xFF
+}
+
+func (d *Intel8237) WriteAddr8(addr uint16, data uint8) {
+	if channel, ok := pageRegister(addr); ok {
+		d.pageRegisters[channel] = data
+		return
 	}
 
-	if d.isPrimaryDevice {
-		switch addr {
-		case 0x0000, 0x0002, 0x0004, 0x0006:
-			// DMA channel memory address bytes 1 and 0 (low)
-			channel := uint8(addr / 2)
-			d.addressRegisters[channel] = (d.addressRegisters[channel] & 0xFF00) | uint16(data)
-		case 0x0001, 0x0003, 0x0005, 0x0007:
-			// DMA channel memory address bytes 1 and 0 (high)
-			channel := uint8((addr - 1) / 2)
-			d.addressRegisters[channel] = (uint16(data) << 8) | (d.addressRegisters[channel] & 0x00FF)
-		case 0x0008:
-			d.WriteCommandRegister(data)
-		case 0x0009:
-			d.WriteRequestRegister(data)
-		case 0x000A:
-			d.WriteSingleMaskRegister(data)
-		case 0x000B:
-			d.WriteModeRegister(data)
-		case 0x000C:
-			d.ClearBytePointerFlipFlop()
-		case 0x000D:
-			// ignored, write to temporary register
-		case 0x000E:
-			d.ClearMaskRegister()
-		case 0x000F:
-			d.WriteMaskRegister(data)
+	switch register := d.register(addr); register {
+	case 0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7:
+		// Address and count registers are written a byte at a time, low byte first
+		channel := register >> 1
+		target := &d.addressRegisters[channel]
+		if register&1 == 1 {
+			target = &d.countRegisters[channel]
 		}
-	} else if d.isSecondaryDevice {
-		switch addr {
-		case 0x00C0, 0x00C4, 0x00C8, 0x00CC:
-			// DMA channel memory address bytes 1 and 0 (low)
-			channel := uint8((addr - 0x00C0) / 4)
-			d.addressRegisters[channel] = (d.addressRegisters[channel] & 0xFF00) | uint16(data)
-		case 0x00C2, 0x00C6, 0x00CA, 0x00CE:
-			// DMA channel memory address bytes 1 and 0 (high)
-			channel := uint8((addr - 0x00C2) / 4)
-			d.addressRegisters[channel] = (uint16(data) << 8) | (d.addressRegisters[channel] & 0x00FF)
-		case 0x00D0:
-			d.WriteCommandRegister(data)
-		case 0x00D2:
-			d.WriteRequestRegister(data)
-		case 0x00D4:
-			d.WriteSingleMaskRegister(data)
-		case 0x00D6:
-			d.WriteModeRegister(data)
-		case 0x00D8:
-			d.ClearBytePointerFlipFlop()
-		case 0x00DA:
-			// ignored, write to temporary register
-		case 0x00DC:
-			d.ClearMaskRegister()
-		case 0x00DE:
-			d.WriteMaskRegister(data)
+		if d.flipFlop {
+			*target = (*target & 0x00FF) | (uint16(data) << 8)
+		} else {
+			*target = (*target & 0xFF00) | uint16(data)
 		}
+		d.flipFlop = !d.flipFlop
+	case 0x8:
+		d.WriteCommandRegister(data)
+	case 0x9:
+		d.WriteRequestRegister(data)
+	case 0xA:
+		d.WriteSingleMaskRegister(data)
+	case 0xB:
+		d.WriteModeRegister(data)
+	case 0xC:
+		d.ClearBytePointerFlipFlop()
+	case 0xD:
+		d.MasterClear()
+	case 0xE:
+		d.ClearMaskRegister()
+	case 0xF:
+		d.WriteMaskRegister(data)
 	}
 }
 
@@ -385,6 +348,15 @@ func (d *Intel8237) SetBus(bus *bus.Bus) {
 	d.bus = bus
 }
 
+func (d *Intel8237) SaveState() interface{} {
+	state := *d
+	return &state
+}
+
+func (d *Intel8237) RestoreState(state interface{}) {
+	*d = *state.(*Intel8237)
+}
+
 func (d *Intel8237) StopDMATransfer(channel uint8) {
 	// Implement the logic to stop the DMA transfer on the specified channel.
 
@@ -449,7 +421,11 @@ func (d *Intel8237) HandleDMATransfer(channel uint8) {
 	sourceAddr := uint32(d.addressRegisters[channel])
 	count := d.countRegisters[channel]
 
-	memoryController := d.bus.FindSingleDevice(0).(*memmap.MemoryAccessController)
+	memoryController, err := bus.FindSingleDeviceAs[*memmap.MemoryAccessController](d.bus, common.MODULE_MEMORY_ACCESS_CONTROLLER)
+	if err != nil {
+		log.Printf("DMA Transfer failed for channel %d: %v", channel, err)
+		return
+	}
 
 	for i := uint16(0); i < count; i++ {
 		switch transferType {
@@ -1,7 +1,6 @@
 package intel8259a
 
 import (
-	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
 	"log"
 )
@@ -26,6 +25,10 @@ type Intel8259a struct {
 	interruptOutput     bool
 	readISR             bool
 	readIRR             bool
+
+	initStep   uint8 // next ICW expected on the data port, 0 once initialised
+	singleMode bool
+	needICW4   bool
 }
 
 func NewIntel8259a() *Intel8259a {
@@ -44,28 +47,42 @@ func (d *Intel8259a) SetDeviceBusId(id uint32) {
 
 func (d *Intel8259a) SetBus(bus *bus.Bus) {
 	d.bus = bus
+
+	// the primary controller takes IRQ 0-7, the secondary IRQ 8-15 and cascades into IRQ 2
+	first := uint8(0)
+	if d.slaveMode {
+		first = 8
+	}
+	for i := uint8(0); i < 8; i++ {
+		irq := i
+		bus.Signals().IRQ[first+irq].Subscribe(func(level bool) {
+			if level {
+				d.assertInterrupt(irq)
+			}
+		})
+	}
+}
+
+func (d *Intel8259a) SaveState() interface{} {
+	state := *d
+	return &state
+}
+
+func (d *Intel8259a) RestoreState(state interface{}) {
+	*d = *state.(*Intel8259a)
 }
 
 func (d *Intel8259a) OnReceiveMessage(message bus.BusMessage) {
-	if message.Subject == common.MESSAGE_INTERRUPT_RAISE {
-		d.assertInterrupt(message.Data[0])
-	} else if message.Subject == common.MESSAGE_INTERRUPT_ACKNOWLEDGE {
-		d.acknowledgeInterrupt()
-	} else if message.Subject == common.MESSAGE_INTERRUPT_COMPLETE {
-		d.completeInterrupt(message.Data[0])
-	}
 }
 
 func (d *Intel8259a) GetPortMap() *bus.DevicePortMap {
 	if d.masterMode {
 		return &bus.DevicePortMap{
-			ReadPorts:  []uint16{0x20, 0x21},
-			WritePorts: []uint16{0x20, 0x21},
+			Mappings: []bus.PortMapping{bus.ReadWrite(bus.Ports(0x20, 0x21), d)},
 		}
 	} else if d.slaveMode {
 		return &bus.DevicePortMap{
-			ReadPorts:  []uint16{0xA0, 0xA1},
-			WritePorts: []uint16{0xA0, 0xA1},
+			Mappings: []bus.PortMapping{bus.ReadWrite(bus.Ports(0xA0, 0xA1), d)},
 		}
 	}
 	return nil
@@ -98,81 +115,107 @@ func (d *Intel8259a) WriteAddr8(addr uint16, data uint8) {
 			d.initialize(data)
 		} else if data&0x08 != 0 {
 			d.operationCommand3(data)
-		} else if data&0x04 != 0 {
-			d.operationCommand2(data)
 		} else {
-			d.InterruptVectorBase = data & 0xF8
+			d.operationCommand2(data)
 		}
 	case 0x21, 0xA1:
-		if d.slaveMode && data&0x04 != 0 {
-			d.slaveID = data & 0x07
-		} else {
-			d.IrqMask = data
-		}
+		d.writeDataPort(data)
 	default:
 		log.Printf("8259A: Unsupported write to address 0x%04X with data 0x%02X", addr, data)
 	}
 }
 
+// initialize handles ICW1, which starts the ICW2-ICW4 sequence on the data port
 func (d *Intel8259a) initialize(data uint8) {
-	d.IrqMask = 0xFF
+	d.IrqMask = 0x00
 	d.IrqRequest = 0
 	d.inService = 0
-	d.InterruptVectorBase = data & 0xF8
-	d.autoEOI = data&0x02 != 0
-	d.mode8086 = data&0x01 != 0
-	d.slaveMode = data&0x08 == 0
-	d.masterMode = !d.slaveMode
+	d.singleMode = data&0x02 != 0
+	d.needICW4 = data&0x01 != 0
+	d.autoEOI = false
+	d.mode8086 = false
 	d.readISR = false
 	d.readIRR = false
-	d.interruptOutput = false
+	d.initStep = 2
+	d.updateInterruptOutput()
+}
+
+func (d *Intel8259a) writeDataPort(data uint8) {
+	switch d.initStep {
+	case 2: // ICW2
+		d.InterruptVectorBase = data & 0xF8
+		d.initStep = 3
+		if d.singleMode {
+			d.initStep = d.lastInitStep()
+		}
+	case 3: // ICW3
+		if d.slaveMode {
+			d.slaveID = data & 0x07
+		}
+		d.initStep = d.lastInitStep()
+	case 4: // ICW4
+		d.mode8086 = data&0x01 != 0
+		d.autoEOI = data&0x02 != 0
+		d.initStep = 0
+	default: // OCW1
+		d.IrqMask = data
+		d.updateInterruptOutput()
+	}
+}
+
+func (d *Intel8259a) lastInitStep() uint8 {
+	if d.needICW4 {
+		return 4
+	}
+	return 0
 }
 
 func (d *Intel8259a) operationCommand2(data uint8) {
-	rotate := data&0x80 != 0
-	autoEOI := data&0x40 != 0
-	specificEOI := data&0x20 != 0
-	nonSpecificEOI := data&0x10 != 0
-	rotateIRQ := data & 0x07
+	specific := data&0x40 != 0
+	eoi := data&0x20 != 0
+	level := data & 0x07
 
-	if nonSpecificEOI {
-		d.completeInterrupt(d.findHighestPriorityIRQ())
-	} else if specificEOI {
-		d.completeInterrupt(rotateIRQ)
+	if !eoi {
+		// priority rotation is not supported
+		return
 	}
 
-	if autoEOI {
-		d.autoEOI = true
-	} else if rotate {
-		d.rotateInterrupt(rotateIRQ)
+	irq := level
+	if !specific {
+		irq = d.highestInService()
+	}
+	if irq != 0xFF {
+		d.completeInterrupt(irq)
 	}
 }
 
 func (d *Intel8259a) operationCommand3(data uint8) {
-	if data&0x01 != 0 {
-		d.readISR = true
-	} else if data&0x02 != 0 {
-		d.readIRR = true
+	if data&0x02 == 0 {
+		return
 	}
+	d.readISR = data&0x01 != 0
+	d.readIRR = !d.readISR
 }
 
 func (d *Intel8259a) assertInterrupt(irq uint8) {
 	d.IrqRequest |= 1 << irq
-	d.bus.SendMessageSingle(common.MODULE_PRIMARY_PROCESSOR, bus.BusMessage{
-		Subject: common.MESSAGE_INTERRUPT_RAISE,
-		Data:    []byte{d.IrqRequest},
-		Sender:  d.busId,
-	})
+	d.updateInterruptOutput()
 }
 
-func (d *Intel8259a) acknowledgeInterrupt() {
-	irq := d.findHighestPriorityIRQ()
-	if irq != 0xFF {
+// AcknowledgeInterrupt is the INTA cycle: it moves the highest priority request into
+// service and returns its IRQ and interrupt vector
+func (d *Intel8259a) AcknowledgeInterrupt() (irq uint8, vector uint8, ok bool) {
+	irq, ok = d.pendingIRQ()
+	if !ok {
+		return 0, 0, false
+	}
+
+	d.IrqRequest &^= 1 << irq
+	if !d.autoEOI {
 		d.inService |= 1 << irq
-		d.IrqRequest &^= 1 << irq
-		interruptVector := d.InterruptVectorBase + irq
-		d.sendInterrupt(interruptVector)
 	}
+	d.updateInterruptOutput()
+	return irq, d.InterruptVectorBase + irq, true
 }
 
 func (d *Intel8259a) completeInterrupt(irq uint8) {
@@ -180,39 +223,44 @@ func (d *Intel8259a) completeInterrupt(irq uint8) {
 	d.updateInterruptOutput()
 }
 
+// updateInterruptOutput drives INTR on the primary controller, or IRQ 2 on the secondary
 func (d *Intel8259a) updateInterruptOutput() {
-	if d.IrqRequest&^d.IrqMask != 0 {
-		d.interruptOutput = true
-		d.bus.SendMessageSingle(common.MODULE_PRIMARY_PROCESSOR, bus.BusMessage{
-			Subject: common.MESSAGE_INTERRUPT_RAISE,
-			Data:    []byte{0},
-			Sender:  d.busId,
-		})
+	_, pending := d.pendingIRQ()
+	if pending == d.interruptOutput && !pending {
+		return
+	}
+	d.interruptOutput = pending
+	if d.bus == nil {
+		return
+	}
+
+	if d.slaveMode {
+		d.bus.Signals().IRQ[2].Drive(pending)
 	} else {
-		d.interruptOutput = false
+		d.bus.Signals().INTR.Drive(pending)
 	}
 }
 
-func (d *Intel8259a) findHighestPriorityIRQ() uint8 {
+// pendingIRQ returns the highest priority unmasked request that is not blocked by an interrupt in service
+func (d *Intel8259a) pendingIRQ() (uint8, bool) {
 	for irq := uint8(0); irq < 8; irq++ {
-		if d.IrqRequest&(1<<irq) != 0 && d.inService&(1<<irq) == 0 {
-			return irq
+		if d.inService&(1<<irq) != 0 {
+			return 0, false
+		}
+		if d.IrqRequest&^d.IrqMask&(1<<irq) != 0 {
+			return irq, true
 		}
 	}
-	return 0xFF
-}
-
-func (d *Intel8259a) rotateInterrupt(irq uint8) {
-	d.IrqRequest = (d.IrqRequest << irq) | (d.IrqRequest >> (8 - irq))
-	d.inService = (d.inService << irq) | (d.inService >> (8 - irq))
+	return 0, false
 }
 
-func (d *Intel8259a) sendInterrupt(interruptVector uint8) {
-	d.bus.SendMessageSingle(common.MODULE_PRIMARY_PROCESSOR, bus.BusMessage{
-		Subject: common.MESSAGE_INTERRUPT_EXECUTE,
-		Data:    []byte{interruptVector},
-		Sender:  d.busId,
-	})
+func (d *Intel8259a) highestInService() uint8 {
+	for irq := uint8(0); irq < 8; irq++ {
+		if d.inService&(1<<irq) != 0 {
+			return irq
+		}
+	}
+	return 0xFF
 }
 
 func (d *Intel8259a) IsPrimaryDevice(b bool) {
@@ -1,8 +1,8 @@
 package intel82C54
 
 import (
-	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/replay"
 	"log"
 	"time"
 )
@@ -22,6 +22,7 @@ type Intel82C54 struct {
 	counterLatched     [3]bool
 	statusLatched      bool
 	previousUpdateTime int64
+	journal            *replay.Journal
 }
 
 func NewIntel82C54() *Intel82C54 {
@@ -42,8 +43,10 @@ func (p *Intel82C54) OnReceiveMessage(message bus.BusMessage) {
 
 func (p *Intel82C54) GetPortMap() *bus.DevicePortMap {
 	return &bus.DevicePortMap{
-		ReadPorts:  []uint16{0x0040, 0x0041, 0x0042, 0x0043},
-		WritePorts: []uint16{0x0040, 0x0041, 0x0042, 0x0043},
+		Mappings: []bus.PortMapping{
+			bus.ReadWrite(bus.Ports(0x0040, 0x0042), p),
+			bus.WriteOnly(bus.Port(0x0043), p), // control word register is write only
+		},
 	}
 }
 
@@ -225,14 +228,33 @@ func (p *Intel82C54) SetBus(bus *bus.Bus) {
 	p.bus = bus
 }
 
+func (p *Intel82C54) SaveState() interface{} {
+	state := *p
+	return &state
+}
+
+func (p *Intel82C54) RestoreState(state interface{}) {
+	*p = *state.(*Intel82C54)
+}
+
+func (p *Intel82C54) SetJournal(journal *replay.Journal) {
+	p.journal = journal
+}
+
 func (p *Intel82C54) Step() {
 	// Step the PIT counters at 1.19318 MHz
 	previousUpdateTime := p.previousUpdateTime
 	currentTime := time.Now().UnixNano() / 1000
+	if p.journal != nil {
+		currentTime = p.journal.HostTime(currentTime)
+	}
 	if currentTime-previousUpdateTime < 164800 {
 		return
 	}
 
+	if p.journal != nil {
+		p.journal.HostTimeConsumed(currentTime)
+	}
 	p.previousUpdateTime = currentTime
 
 	for i := 0; i < 3; i++ {
@@ -335,14 +357,9 @@ func (p *Intel82C54) Step() {
 					// Set the previous update time to the current time
 					p.previousUpdateTime = currentTime
 
-					interruptMessage := bus.BusMessage{
-						Subject: common.MESSAGE_INTERRUPT_RAISE,
-						Sender:  p.busId,
-						Data:    []byte{byte(i)},
-					}
-					err := p.bus.SendMessageSingle(common.MODULE_INTERRUPT_CONTROLLER_1, interruptMessage)
-					if err != nil {
-						log.Printf("8259A: Error sending interrupt request message: %v", err)
+					// only counter 0 is wired to an interrupt line, IRQ 0
+					if i == 0 {
+						p.bus.Signals().IRQ[0].Drive(true)
 					}
 				}
 			}
@@ -1,23 +1,27 @@
 package io
 
 import (
-	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
-	"github.com/andrewjc/threeatesix/devices/cga"
-	"github.com/andrewjc/threeatesix/devices/intel82335"
-	"github.com/andrewjc/threeatesix/devices/intel8237"
-	"github.com/andrewjc/threeatesix/devices/ps2"
 	"log"
 )
 
 /*
 	IO Port Access Controller
-	Provides read/write functions for port mapped IO
+	Provides read/write functions for port mapped IO. Accesses are routed to the
+	device that claimed the port on the bus; 16 and 32 bit accesses go to the
+	device's wide handler when it has one and are split into byte accesses otherwise.
 */
 
 type IOPortAccessController struct {
 	bus   *bus.Bus
 	busId uint32
+
+	policies           []portPolicy
+	defaultReadPolicy  UnhandledPortPolicy
+	defaultWritePolicy UnhandledPortPolicy
+
+	tracer            *portTracer
+	instructionSource InstructionSource
 }
 
 func (mem *IOPortAccessController) GetPortMap() *bus.DevicePortMap {
@@ -25,7 +29,10 @@ func (mem *IOPortAccessController) GetPortMap() *bus.DevicePortMap {
 }
 
 func NewIOPortController() *IOPortAccessController {
-	return &IOPortAccessController{}
+	return &IOPortAccessController{
+		defaultReadPolicy:  PORT_POLICY_FATAL,
+		defaultWritePolicy: PORT_POLICY_LOG,
+	}
 }
 
 func (mem *IOPortAccessController) GetDeviceBusId() uint32 {
@@ -41,254 +48,146 @@ func (mem *IOPortAccessController) OnReceiveMessage(message bus.BusMessage) {
 }
 
 func (r *IOPortAccessController) ReadAddr8(addr uint16) uint8 {
-	log.Printf("ReadAddr8: %#04x", addr)
-
-	devicePortRegistration := r.bus.GetDeviceOnPort(addr)
-	if devicePortRegistration != nil {
-		return devicePortRegistration.Device.ReadAddr8(addr)
-	} else {
-		//core.logInstruction("warn: PORT READ WITHOUT DEVICE ROUTE: %#04x", addr)
-
-		if addr == 0x24 {
-			// RC1 roll compare register???
-			//core.logInstruction("RC1 roll compare register read")
-			sr := r.GetBus().FindSingleDevice(common.MODULE_INTEL_82335).(*intel82335.Intel82335).Rc1RegisterRead()
-			return sr
-		}
-
-		if addr == 0x80 {
-			// Delay port - hack!
-			return 0x00
-		}
-
-		if addr == 0xc3 {
-			// 8237 DMA controller status register
-			return r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).ReadStatusRegister()
-		}
-
-		log.Fatalf("Unhandled IO port read: PORT=[%#04x]", addr)
+	route := r.bus.GetPortReadRoute(addr)
+	if route == nil {
+		value := r.unhandledRead(addr)
+		r.trace(PORT_READ, addr, 1, uint32(value), "unhandled")
+		return value
 	}
-	return 0
-}
 
-func (r *IOPortAccessController) WriteAddr8(port_addr uint16, value uint8) {
-	// log.Printf("WriteAddr8: %#04x, %#02x", port_addr, value)
-	devicePortRegistration := r.bus.GetDeviceOnPort(port_addr)
-	if devicePortRegistration != nil {
-		devicePortRegistration.Device.WriteAddr8(port_addr, value)
-	} else {
-		//core.logInstruction("warn: PORT WRITE WITHOUT DEVICE ROUTE: %#04x", port_addr)
-
-		if port_addr == 0x00F1 {
-			// 80287 math coprocessor
-			err := r.GetBus().SendMessageSingle(common.MODULE_MATH_CO_PROCESSOR, bus.BusMessage{Subject: common.MESSAGE_REQUEST_CPU_MODESWITCH, Data: []byte{common.REAL_MODE}})
-			if err != nil {
-				log.Fatalf("Failed to send message to math coprocessor: %s", err)
-				return
-			}
-			return
-		}
-
-		if port_addr == 0x64 {
-			// Command Register Write
-			r.GetBus().FindSingleDevice(common.MODULE_PS2_CONTROLLER).(*ps2.Ps2Controller).WriteCommandRegister(value)
-			return
-		}
-
-		if port_addr == 0x60 {
-			// Data Port Write
-			r.GetBus().FindSingleDevice(common.MODULE_PS2_CONTROLLER).(*ps2.Ps2Controller).WriteDataPort(value)
-			return
-		}
-
-		if port_addr == 0x61 {
-			// Command Port Write
-			r.GetBus().FindSingleDevice(common.MODULE_PS2_CONTROLLER).(*ps2.Ps2Controller).WriteControlPort(value)
-			return
-		}
-
-		if port_addr == 0x80 && value > 0x00 {
-			// bios post diag
-			log.Printf("BIOS POST: %#02x - %s", value, common.BiosPostCodeToString(value))
-
-			if value == 0x40 {
-				// disable a20 line
-				err := r.GetBus().SendMessageSingle(common.MODULE_MEMORY_ACCESS_CONTROLLER, bus.BusMessage{Subject: common.MESSAGE_DISABLE_A20_GATE, Data: []byte{value}})
-				if err != nil {
-					log.Fatalf("Failed to send message to memory access controller: %s", err)
-					return
-				}
-			}
-
-			return
-		}
-
-		if port_addr == 0x81 && value > 0x00 {
-			// bios post diag checkpoint
-			log.Printf("BIOS POST CHECKPOINT: %#02x - %s", value, common.BiosPostCodeToString(value))
-			return
-		}
-
-		if port_addr == 0x80 && value == 0x00 {
-			// port 80 delay
-			return
-		}
-		if port_addr == 0x81 && value == 0x00 {
-			// port 80 delay
-			return
-		}
-
-		if port_addr == 0x84 {
-			// unknown?
-			return
-		}
-
-		if port_addr == 0x92 {
-			// A20 Gate
-			// core.logInstruction("A20 GATE: %#02x", value)
-			if value == 0x00 {
-				err := r.GetBus().SendMessageSingle(common.MODULE_MEMORY_ACCESS_CONTROLLER, bus.BusMessage{Subject: common.MESSAGE_DISABLE_A20_GATE, Data: []byte{value}})
-				if err != nil {
-					log.Fatalf("Failed to send message to memory access controller: %s", err)
-					return
-				}
-			} else {
-				err := r.GetBus().SendMessageSingle(common.MODULE_MEMORY_ACCESS_CONTROLLER, bus.BusMessage{Subject: common.MESSAGE_ENABLE_A20_GATE, Data: []byte{value}})
-				if err != nil {
-					log.Fatalf("Failed to send message to memory access controller: %s", err)
-					return
-				}
-			}
-
-			return
-		}
-
-		if port_addr == 0x08 {
-			// Write command register to DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).WriteCommandRegister(value)
-			return
-		}
-
-		if port_addr == 0x09 {
-			// Write request register to DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).WriteRequestRegister(value)
-			return
-		}
-
-		if port_addr == 0x0A {
-			// Write single mask register to DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).WriteSingleMaskRegister(value)
-			return
-		}
+	value := route.Mapping.Read(addr)
+	r.trace(PORT_READ, addr, 1, uint32(value), route.Name)
+	return value
+}
 
-		if port_addr == 0x0B {
-			// Write mode register to DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).WriteModeRegister(value)
-			return
-		}
+func (r *IOPortAccessController) ReadAddr16(addr uint16) uint16 {
+	route := r.bus.GetPortReadRoute(addr)
+	if route != nil && route.Mapping.Read16 != nil && route.Mapping.Ports.Contains(addr+1) {
+		value := route.Mapping.Read16(addr)
+		r.trace(PORT_READ, addr, 2, uint32(value), route.Name)
+		return value
+	}
 
-		if port_addr == 0x0C {
-			// Clear byte pointer flip-flop in DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).ClearBytePointerFlipFlop()
-			return
-		}
+	// no word handler, so the access is split into byte accesses like an 8 bit device on the ISA bus sees it
+	b1 := uint16(r.ReadAddr8(addr))
+	b2 := uint16(r.ReadAddr8(addr + 1))
+	return b2<<8 | b1
+}
 
-		if port_addr == 0x0D {
-			// Read temporary register from DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).ReadTemporaryRegister()
-			return
-		}
+func (r *IOPortAccessController) ReadAddr32(addr uint16) uint32 {
+	route := r.bus.GetPortReadRoute(addr)
+	if route != nil && route.Mapping.Read32 != nil && route.Mapping.Ports.Contains(addr+3) {
+		value := route.Mapping.Read32(addr)
+		r.trace(PORT_READ, addr, 4, value, route.Name)
+		return value
+	}
 
-		if port_addr == 0x0D {
-			// Master clear DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).MasterClear()
-			return
-		}
+	w1 := uint32(r.ReadAddr16(addr))
+	w2 := uint32(r.ReadAddr16(addr + 2))
+	return w2<<16 | w1
+}
 
-		if port_addr == 0x0E {
-			// Clear mask register in DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).ClearMaskRegister()
-			return
-		}
+// SetUnhandledPortPolicy sets what happens on accesses to ports in a range that no device
+// handles. Ranges set later take precedence over earlier overlapping ones.
+func (r *IOPortAccessController) SetUnhandledPortPolicy(ports PortRange, policy UnhandledPortPolicy) {
+	r.policies = append(r.policies, portPolicy{ports: ports, policy: policy})
+}
 
-		if port_addr == 0x0F {
-			// Write mask register to DMA controller
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER).(*intel8237.Intel8237).WriteMaskRegister(value)
-			return
-		}
+// SetDefaultUnhandledPortPolicy sets the policy for ports not covered by any range
+func (r *IOPortAccessController) SetDefaultUnhandledPortPolicy(policy UnhandledPortPolicy) {
+	r.defaultReadPolicy = policy
+	r.defaultWritePolicy = policy
+}
 
-		if port_addr == 0x00D0 {
-			// Write command register to DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).WriteCommandRegister(value)
-			return
+func (r *IOPortAccessController) policyFor(port uint16, fallback UnhandledPortPolicy) UnhandledPortPolicy {
+	for i := len(r.policies) - 1; i >= 0; i-- {
+		if r.policies[i].ports.Contains(port) {
+			return r.policies[i].policy
 		}
+	}
+	return fallback
+}
 
-		if port_addr == 0x00D2 {
-			// Write request register to DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).WriteRequestRegister(value)
-			return
-		}
+func (r *IOPortAccessController) unhandledRead(addr uint16) uint8 {
+	switch r.policyFor(addr, r.defaultReadPolicy) {
+	case PORT_POLICY_FATAL:
+		log.Fatalf("Unhandled IO port read: PORT=[%#04x]", addr)
+	case PORT_POLICY_LOG:
+		log.Printf("Unhandled IO port read: PORT=[%#04x]", addr)
+	}
+	return OPEN_BUS_VALUE
+}
 
-		if port_addr == 0x00D4 {
-			// Write single mask register to DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).WriteSingleMaskRegister(value)
-			return
-		}
+func (r *IOPortAccessController) unhandledWrite(addr uint16, value uint8) {
+	switch r.policyFor(addr, r.defaultWritePolicy) {
+	case PORT_POLICY_FATAL:
+		log.Fatalf("Unhandled IO port write: PORT=[%#04x], value=%#02x", addr, value)
+	case PORT_POLICY_LOG:
+		log.Printf("Unhandled IO port write: PORT=[%#04x], value=%#02x", addr, value)
+	}
+}
 
-		if port_addr == 0x00D6 {
-			// Write mode register to DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).WriteModeRegister(value)
-			return
-		}
+// EnablePortTrace passes every IN/OUT on a port in ranges to sink. No ranges traces all ports.
+func (r *IOPortAccessController) EnablePortTrace(sink func(access PortAccess), ranges ...PortRange) {
+	r.tracer = &portTracer{ranges: ranges, sink: sink}
+}
 
-		if port_addr == 0x00D8 {
-			// Clear byte pointer flip-flop in DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).ClearBytePointerFlipFlop()
-			return
-		}
+func (r *IOPortAccessController) DisablePortTrace() {
+	r.tracer = nil
+}
 
-		if port_addr == 0x00DA {
-			// Read temporary register from DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).ReadTemporaryRegister()
-			return
-		}
+// SetInstructionSource sets where the CS:IP of traced accesses comes from
+func (r *IOPortAccessController) SetInstructionSource(source InstructionSource) {
+	r.instructionSource = source
+}
 
-		if port_addr == 0x00DA {
-			// Master clear DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).MasterClear()
-			return
-		}
+func (r *IOPortAccessController) trace(direction PortDirection, port uint16, width uint8, value uint32, device string) {
+	if r.tracer == nil || !r.tracer.wants(port) {
+		return
+	}
 
-		if port_addr == 0x00DC {
-			// Clear mask register in DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).ClearMaskRegister()
-			return
-		}
+	access := PortAccess{Direction: direction, Port: port, Width: width, Value: value, Device: device}
+	if r.instructionSource != nil {
+		access.CS = r.instructionSource.GetCS()
+		access.IP = r.instructionSource.GetIP()
+	}
+	r.tracer.sink(access)
+}
 
-		if port_addr == 0x00DE {
-			// Write mask register to DMA controller (channels 4-7)
-			r.GetBus().FindSingleDevice(common.MODULE_DMA_CONTROLLER_2).(*intel8237.Intel8237).WriteMaskRegister(value)
-			return
-		}
+func (r *IOPortAccessController) WriteAddr8(addr uint16, value uint8) {
+	route := r.bus.GetPortWriteRoute(addr)
+	if route == nil {
+		r.unhandledWrite(addr, value)
+		r.trace(PORT_WRITE, addr, 1, uint32(value), "unhandled")
+		return
+	}
 
-		if port_addr == 0x03d8 {
-			// CGA
-			r.GetBus().FindSingleDevice(common.MODULE_CGA).(*cga.Motorola6845).WriteAddr8(port_addr, value)
-			return
-		}
+	route.Mapping.Write(addr, value)
+	r.trace(PORT_WRITE, addr, 1, uint32(value), route.Name)
+}
 
-		log.Println("Unhandled IO port write: PORT=[%#04x], value=%#02x", port_addr, value)
+func (r *IOPortAccessController) WriteAddr16(addr uint16, value uint16) {
+	route := r.bus.GetPortWriteRoute(addr)
+	if route != nil && route.Mapping.Write16 != nil && route.Mapping.Ports.Contains(addr+1) {
+		route.Mapping.Write16(addr, value)
+		r.trace(PORT_WRITE, addr, 2, uint32(value), route.Name)
+		return
 	}
-}
 
-func (r *IOPortAccessController) ReadAddr16(addr uint16) uint16 {
-	b1 := uint16(r.ReadAddr8(addr))
-	b2 := uint16(r.ReadAddr8(addr + 1))
-	return b2<<8 | b1
+	r.WriteAddr8(addr, uint8(value))
+	r.WriteAddr8(addr+1, uint8(value>>8))
 }
 
-func (r *IOPortAccessController) WriteAddr16(addr uint16, value uint16) {
+func (r *IOPortAccessController) WriteAddr32(addr uint16, value uint32) {
+	route := r.bus.GetPortWriteRoute(addr)
+	if route != nil && route.Mapping.Write32 != nil && route.Mapping.Ports.Contains(addr+3) {
+		route.Mapping.Write32(addr, value)
+		r.trace(PORT_WRITE, addr, 4, value, route.Name)
+		return
+	}
 
+	r.WriteAddr16(addr, uint16(value))
+	r.WriteAddr16(addr+2, uint16(value>>16))
 }
 
 func (controller *IOPortAccessController) GetBus() *bus.Bus {
@@ -0,0 +1,195 @@
+package io
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewjc/threeatesix/devices/bus"
+	stdio "io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+/*
+	Port access policy and tracing
+	Unhandled ports fall back to a policy chosen per port range, and every IN/OUT
+	can be traced with the device that served it and the CS:IP that issued it.
+*/
+
+type UnhandledPortPolicy uint8
+
+const (
+	PORT_POLICY_FATAL    UnhandledPortPolicy = iota // stop the emulator
+	PORT_POLICY_LOG                                 // log the access, reads return 0xFF
+	PORT_POLICY_OPEN_BUS                            // behave like an empty ISA bus, reads return 0xFF
+)
+
+// OPEN_BUS_VALUE is what a read from a port with nothing attached returns
+const OPEN_BUS_VALUE = 0xFF
+
+func (policy UnhandledPortPolicy) String() string {
+	switch policy {
+	case PORT_POLICY_FATAL:
+		return "fatal"
+	case PORT_POLICY_LOG:
+		return "log"
+	case PORT_POLICY_OPEN_BUS:
+		return "openbus"
+	default:
+		return fmt.Sprintf("UnhandledPortPolicy(%d)", uint8(policy))
+	}
+}
+
+func ParseUnhandledPortPolicy(s string) (UnhandledPortPolicy, error) {
+	switch strings.ToLower(s) {
+	case "fatal":
+		return PORT_POLICY_FATAL, nil
+	case "log":
+		return PORT_POLICY_LOG, nil
+	case "openbus", "0xff":
+		return PORT_POLICY_OPEN_BUS, nil
+	default:
+		return 0, fmt.Errorf("unknown port policy %q", s)
+	}
+}
+
+type PortRange = bus.PortRange
+
+// ParsePortRanges parses a comma separated list of ports and port ranges, e.g. "0x60-0x64,0x80"
+func ParsePortRanges(s string) ([]PortRange, error) {
+	ranges := make([]PortRange, 0)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(field, "-")
+		if !isRange {
+			last = first
+		}
+		firstPort, err := strconv.ParseUint(strings.TrimSpace(first), 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad port range %q: %w", field, err)
+		}
+		lastPort, err := strconv.ParseUint(strings.TrimSpace(last), 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad port range %q: %w", field, err)
+		}
+		if lastPort < firstPort {
+			return nil, fmt.Errorf("bad port range %q: end is before start", field)
+		}
+		ranges = append(ranges, PortRange{First: uint16(firstPort), Last: uint16(lastPort)})
+	}
+	return ranges, nil
+}
+
+// ConfigureUnhandledPortPolicies applies a comma separated policy spec such as
+// "log,0x200-0x3ff=openbus,0x80=fatal". An entry without a port range sets the default.
+func (r *IOPortAccessController) ConfigureUnhandledPortPolicies(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		ports, policyName, hasPorts := strings.Cut(entry, "=")
+		if !hasPorts {
+			policy, err := ParseUnhandledPortPolicy(entry)
+			if err != nil {
+				return err
+			}
+			r.SetDefaultUnhandledPortPolicy(policy)
+			continue
+		}
+
+		policy, err := ParseUnhandledPortPolicy(policyName)
+		if err != nil {
+			return err
+		}
+		ranges, err := ParsePortRanges(ports)
+		if err != nil {
+			return err
+		}
+		for _, portRange := range ranges {
+			r.SetUnhandledPortPolicy(portRange, policy)
+		}
+	}
+	return nil
+}
+
+type portPolicy struct {
+	ports  PortRange
+	policy UnhandledPortPolicy
+}
+
+type PortDirection uint8
+
+const (
+	PORT_READ PortDirection = iota
+	PORT_WRITE
+)
+
+func (direction PortDirection) String() string {
+	if direction == PORT_WRITE {
+		return "OUT"
+	}
+	return "IN"
+}
+
+func (direction PortDirection) MarshalText() ([]byte, error) {
+	return []byte(direction.String()), nil
+}
+
+// PortAccess is a single traced IN or OUT
+type PortAccess struct {
+	Direction PortDirection `json:"dir"`
+	Port      uint16        `json:"port"`
+	Width     uint8         `json:"width"` // access size in bytes
+	Value     uint32        `json:"value"`
+	Device    string        `json:"device"`
+	CS        uint32        `json:"cs"`
+	IP        uint32        `json:"ip"`
+}
+
+func (access PortAccess) String() string {
+	return fmt.Sprintf("%-3s port=%#04x value=%#0*x device=%s at %04x:%04x", access.Direction, access.Port, int(access.Width)*2+2, access.Value, access.Device, access.CS, access.IP)
+}
+
+// InstructionSource reports the CS:IP of the instruction performing the current port access
+type InstructionSource interface {
+	GetCS() uint32
+	GetIP() uint32
+}
+
+type portTracer struct {
+	ranges []PortRange // empty traces every port
+	sink   func(access PortAccess)
+}
+
+func (tracer *portTracer) wants(port uint16) bool {
+	if len(tracer.ranges) == 0 {
+		return true
+	}
+	for _, r := range tracer.ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogPortTraceSink writes each access to the standard logger
+func LogPortTraceSink(access PortAccess) {
+	log.Print(access.String())
+}
+
+// NewJsonPortTraceSink writes each access to w as a line of JSON
+func NewJsonPortTraceSink(w stdio.Writer) func(access PortAccess) {
+	encoder := json.NewEncoder(w)
+	return func(access PortAccess) {
+		if err := encoder.Encode(access); err != nil {
+			log.Printf("Failed to write port trace: %s", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package memmap
+
+import (
+	"fmt"
+)
+
+/*
+	System BIOS ROM
+	The BIOS is decoded at the top of the first megabyte so that its last paragraph
+	lands on the FFFF0 reset vector. Images smaller than the 64K window repeat through
+	it, since the socket doesn't decode the upper address lines, and a 128K image
+	reaches down to E0000.
+*/
+
+const BIOS_ROM_START = 0xF0000
+const BIOS_ROM_SIZE = 0x10000
+
+const BIOS_ROM_MIN_SIZE = 0x2000
+const BIOS_ROM_MAX_SIZE = 0x20000
+
+// BIOS_RESET_VECTOR_OFFSET - the reset vector is the last paragraph of the image
+const BIOS_RESET_VECTOR_OFFSET = 16
+
+// ValidateBiosRom checks that an image decodes with its last paragraph at the reset vector and that a jump sits there
+func ValidateBiosRom(image []uint8) error {
+	size := len(image)
+	if size < BIOS_ROM_MIN_SIZE || size > BIOS_ROM_MAX_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bios image is %d bytes, not a power of two between %dK and %dK", size, BIOS_ROM_MIN_SIZE>>10, BIOS_ROM_MAX_SIZE>>10)
+	}
+
+	switch opcode := image[size-BIOS_RESET_VECTOR_OFFSET]; opcode {
+	case 0xEA, 0xE9, 0xEB: // jmp far, jmp near, jmp short
+	default:
+		return fmt.Errorf("bios image has %#02x at the reset vector, not a jump", opcode)
+	}
+	return nil
+}
+
+// MapBiosRom validates the bios image and maps it at the top of the first megabyte. An empty image
+// maps a blank rom that reads as open bus. Call it again after the image is replaced.
+func (mem *MemoryAccessController) MapBiosRom() error {
+	image := *mem.biosImage
+	if len(image) == 0 {
+		mem.setOpenBus(EXTENDED_BIOS_START, BIOS_ROM_START-EXTENDED_BIOS_START)
+		return mem.MapRom("bios rom", BIOS_ROM_START, BIOS_ROM_SIZE, nil)
+	}
+	if err := ValidateBiosRom(image); err != nil {
+		return err
+	}
+
+	for len(image) < BIOS_ROM_SIZE {
+		image = append(image[:len(image):len(image)], image...)
+	}
+
+	// a previous, larger image may have reached below F0000
+	mem.setOpenBus(EXTENDED_BIOS_START, BIOS_ROM_START-EXTENDED_BIOS_START)
+	size := uint32(len(image))
+	return mem.MapRom("bios rom", EXTENDED_MEMORY_START-size, size, image)
+}
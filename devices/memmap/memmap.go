@@ -1,23 +1,27 @@
 package memmap
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
-	"log"
 )
 
 /*
 	Memory interconnect - provides memory access between intel8086 and ram
+	Accesses are decoded through the page table in pagetable.go; byte, word and
+	dword accesses within a ram or rom page are served straight from its slice.
 */
 
 type MemoryAccessController struct {
-	backingRam     *[]uint8
-	biosImage      *[]uint8
-	videoBiosImage *[]uint8
+	backingRam *[]uint8
+	biosImage  *[]uint8
 
-	rcAddr uint32
+	pages        []page
+	baseMemory   *Region // the ram region mapped at 0
+	memoryConfig bus.MemoryConfig
 
-	memoryAccessProvider MemoryAccessProvider
+	rcAddr uint32
 
 	resetVectorBaseAddr uint32
 
@@ -29,19 +33,77 @@ type MemoryAccessController struct {
 	operandSizeOverride bool
 	setLockPrefix       bool
 	setRepPrefix        bool
+
+	keyboardA20        bool   // A20 gate output of the 8042
+	systemControlPortA uint8  // port 0x92, bit 1 is the fast A20 gate
+	a20Mask            uint32 // applied to every physical address, clears bit 20 while the gate is disabled
+	busMask            uint32 // the address lines the processor drives, a 286 or 386SX only has 24
 }
 
-type MemoryAccessProvider interface {
-	ReadMemoryAddr8(u uint32) (*uint8, error)
-	ReadMemoryAddr16(u uint32) (*uint16, error)
-	ReadMemoryAddr32(u uint32) (*uint32, error)
-	ReadSequential(addr uint32, numBytes uint32) []*uint8
-	WriteMemoryAddr8(address uint32, data uint8) error
+// the 82335 can leave 512K-640K to the ISA bus
+const BASE_MEMORY_HOLE_START = 0x80000
+const BASE_MEMORY_END = 0xA0000
+
+const VIDEO_RAM_START = 0xA0000
+const VIDEO_BIOS_START = OPTION_ROM_START
+
+// EXTENDED_BIOS_START - a 128K bios image reaches down to here
+const EXTENDED_BIOS_START = 0xE0000
+
+// EXTENDED_MEMORY_START - ram above the first megabyte. The ram behind 640K-1M is only reachable as shadow ram.
+const EXTENDED_MEMORY_START = 0x100000
+
+const A20_ENABLED_MASK = 0xFFFFFFFF
+const A20_DISABLED_MASK = 0xFFEFFFFF
+
+func NewMemoryController(ram *[]byte, bios *[]byte) (*MemoryAccessController, error) {
+	mem := &MemoryAccessController{
+		backingRam:   ram,
+		biosImage:    bios,
+		memoryConfig: bus.MemoryConfig{BaseMemorySize: BASE_MEMORY_END},
+		a20Mask:      A20_DISABLED_MASK,
+		busMask:      0xFFFFFFFF,
+	}
+
+	if len(*ram) < EXTENDED_MEMORY_START {
+		return nil, fmt.Errorf("%d bytes of ram is less than the first megabyte", len(*ram))
+	}
+	mem.pages = make([]page, len(*ram)>>PAGE_SHIFT)
+
+	// conventional ram, video ram, the upper memory area left to the ISA bus and extended ram
+	err := mem.MapRam("conventional ram", 0, (*ram)[:BASE_MEMORY_END])
+	if err == nil {
+		err = mem.MapRam("video ram", VIDEO_RAM_START, (*ram)[VIDEO_RAM_START:VIDEO_BIOS_START])
+	}
+	if err == nil {
+		mem.setOpenBus(VIDEO_BIOS_START, BIOS_ROM_START-VIDEO_BIOS_START)
+	}
+	if err == nil && len(*ram) > EXTENDED_MEMORY_START {
+		err = mem.MapRam("extended ram", EXTENDED_MEMORY_START, (*ram)[EXTENDED_MEMORY_START:len(*ram)&^PAGE_MASK])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mem.baseMemory = mem.pages[0].region
+	if err := mem.MapBiosRom(); err != nil {
+		return nil, err
+	}
+	return mem, nil
 }
 
-func NewMemoryController(ram *[]byte, bios *[]byte, vBiosImage *[]byte) *MemoryAccessController {
+// GetRamSize returns the amount of ram installed, including the ram behind 640K-1M
+func (mem *MemoryAccessController) GetRamSize() uint32 {
+	return uint32(len(*mem.backingRam))
+}
 
-	return &MemoryAccessController{ram, bios, vBiosImage, 0, nil, 0, nil, 0, 0, false, false, false, false}
+// applyMemoryConfig reroutes the shadowable rom areas and base memory as the chipset configured them
+func (mem *MemoryAccessController) applyMemoryConfig(config bus.MemoryConfig) {
+	mem.memoryConfig = config
+	mem.setShadow(BIOS_ROM_START, BIOS_ROM_SIZE, config.BiosShadow, config.BiosReadOnly)
+	mem.setShadow(VIDEO_BIOS_START, 0x8000, config.VideoShadow, config.VideoReadOnly)
+	mem.setShadow(0xC8000, 0x18000, config.AdapterShadow, false)
+	mem.setBaseMemorySize(config.BaseMemorySize)
 }
 
 func (mem *MemoryAccessController) GetDeviceBusId() uint32 {
@@ -58,108 +120,137 @@ func (mem *MemoryAccessController) OnReceiveMessage(message bus.BusMessage) {
 		mem.LockBootVector()
 	case message.Subject == common.MESSAGE_GLOBAL_UNLOCK_BIOS_MEM_REGION:
 		mem.UnlockBootVector()
-	case message.Subject == common.MESSAGE_GLOBAL_CPU_MODESWITCH:
-		mem.HandleMemoryMapSwitch(message.Data[0])
 	}
 }
 
 func (mem *MemoryAccessController) GetPortMap() *bus.DevicePortMap {
-	return nil
+	return &bus.DevicePortMap{
+		Mappings: []bus.PortMapping{bus.ReadWrite(bus.Port(0x0092), mem)}, // System control port A (fast A20)
+	}
 }
 
-func (controller *MemoryAccessController) ReadAddr8(addr uint16) uint8 {
-	//TODO implement me
-	panic("implement me")
+func (mem *MemoryAccessController) ReadAddr8(addr uint16) uint8 {
+	return mem.systemControlPortA
 }
 
 func (mem *MemoryAccessController) WriteAddr8(addr uint16, data uint8) {
-	//TODO implement me
-	panic("implement me")
-}
+	// bit 0 going high is a fast reset
+	reset := data&0x01 != 0 && mem.systemControlPortA&0x01 == 0
+	mem.systemControlPortA = data
 
-func (mem *MemoryAccessController) HandleMemoryMapSwitch(modeSwitch byte) {
-	switch {
-	case modeSwitch == common.REAL_MODE:
-		mem.memoryAccessProvider = &RealModeAccessProvider{mem}
+	mem.updateA20()
+	if reset {
+		mem.bus.Signals().Reset.Drive(true)
 	}
 }
 
-func (controller *MemoryAccessController) SetBus(bus *bus.Bus) {
-	controller.bus = bus
+// IsA20Enabled reports whether address line 20 is gated through. Either the 8042 or port 0x92 can enable it.
+func (mem *MemoryAccessController) IsA20Enabled() bool {
+	return mem.keyboardA20 || mem.systemControlPortA&0x02 != 0
 }
 
-func (mem *MemoryAccessController) ReadMemoryValue8(address uint32) (uint8, error) {
-	pntr, err := mem.memoryAccessProvider.ReadMemoryAddr8(address)
-	if err != nil {
-		return 0, err
-	}
-	if pntr == nil {
-		return 0, common.GeneralProtectionFault{}
-	}
-
-	return *pntr, nil
+// SetAddressBusWidth drops the address lines above the processor's, so that addresses past the
+// top of its address space wrap around to the bottom. The 8086 has 20 lines and no A20 gate to
+// speak of, the 286 and 386SX 24.
+func (mem *MemoryAccessController) SetAddressBusWidth(bits uint8) {
+	mem.busMask = uint32(uint64(1)<<bits - 1)
+	mem.updateA20()
 }
 
-func (mem *MemoryAccessController) ReadMemoryValue16(address uint32) (uint16, error) {
-	pntr, err := mem.memoryAccessProvider.ReadMemoryAddr16(address)
-	if err != nil {
-		return 0, err
-	}
-	if pntr == nil {
-		return 0, common.GeneralProtectionFault{}
+// updateA20 works out the mask every address goes through, from the A20 gate and the bus width
+func (mem *MemoryAccessController) updateA20() {
+	if mem.IsA20Enabled() {
+		mem.a20Mask = A20_ENABLED_MASK & mem.busMask
+	} else {
+		mem.a20Mask = A20_DISABLED_MASK & mem.busMask
 	}
+}
 
-	return *pntr, nil
+func (controller *MemoryAccessController) SetBus(bus *bus.Bus) {
+	controller.bus = bus
+	bus.Signals().A20.Subscribe(func(enabled bool) {
+		controller.keyboardA20 = enabled
+		controller.updateA20()
+	})
+	bus.Signals().MemoryConfig.Subscribe(controller.applyMemoryConfig)
 }
 
-func (mem *MemoryAccessController) ReadMemoryValue32(address uint32) (uint32, error) {
-	pntr, err := mem.memoryAccessProvider.ReadMemoryAddr32(address)
-	if err != nil {
-		return 0, err
-	}
-	if pntr == nil {
-		return 0, common.GeneralProtectionFault{}
-	}
+func (controller *MemoryAccessController) SaveState() interface{} {
+	state := *controller
+	return &state
+}
 
-	return *pntr, nil
+// RestoreState puts back the chipset memory configuration along with the rest of the state. The page
+// table is shared between checkpoints, so it is rebuilt from the restored configuration.
+func (controller *MemoryAccessController) RestoreState(state interface{}) {
+	*controller = *state.(*MemoryAccessController)
+	controller.applyMemoryConfig(controller.memoryConfig)
 }
 
-func (mem *MemoryAccessController) ReadMemoryPtr8(address uint32) (*uint8, error) {
-	return mem.memoryAccessProvider.ReadMemoryAddr8(address)
+// Addresses are gated through A20 first. Accesses within a ram or rom page are served from the
+// page directly; accesses that cross a page boundary, hit mmio or miss the page table take the slow path.
+
+func (mem *MemoryAccessController) ReadMemoryValue8(address uint32) (uint8, error) {
+	address &= mem.a20Mask
+	if index := address >> PAGE_SHIFT; index < uint32(len(mem.pages)) {
+		if data := mem.pages[index].read; data != nil {
+			return data[address&PAGE_MASK], nil
+		}
+	}
+	return mem.readSlow8(address)
 }
 
-func (mem *MemoryAccessController) ReadMemoryPtr16(address uint32) (*uint16, error) {
-	return mem.memoryAccessProvider.ReadMemoryAddr16(address)
+func (mem *MemoryAccessController) ReadMemoryValue16(address uint32) (uint16, error) {
+	address &= mem.a20Mask
+	if index, offset := address>>PAGE_SHIFT, address&PAGE_MASK; offset < PAGE_MASK && index < uint32(len(mem.pages)) {
+		if data := mem.pages[index].read; data != nil {
+			return binary.LittleEndian.Uint16(data[offset : offset+2]), nil
+		}
+	}
+	return mem.readSlow16(address)
 }
 
-func (mem *MemoryAccessController) ReadMemoryPtr32(address uint32) (*uint32, error) {
-	return mem.memoryAccessProvider.ReadMemoryAddr32(address)
+func (mem *MemoryAccessController) ReadMemoryValue32(address uint32) (uint32, error) {
+	address &= mem.a20Mask
+	if index, offset := address>>PAGE_SHIFT, address&PAGE_MASK; offset <= PAGE_SIZE-4 && index < uint32(len(mem.pages)) {
+		if data := mem.pages[index].read; data != nil {
+			return binary.LittleEndian.Uint32(data[offset : offset+4]), nil
+		}
+	}
+	return mem.readSlow32(address)
 }
 
 func (mem *MemoryAccessController) WriteMemoryAddr8(address uint32, value uint8) error {
-	return mem.memoryAccessProvider.WriteMemoryAddr8(address, value)
+	address &= mem.a20Mask
+	if index := address >> PAGE_SHIFT; index < uint32(len(mem.pages)) {
+		if data := mem.pages[index].write; data != nil {
+			data[address&PAGE_MASK] = value
+			return nil
+		}
+	}
+	return mem.writeSlow8(address, value)
 }
 
 func (mem *MemoryAccessController) WriteMemoryAddr16(address uint32, value uint16) error {
-	for i := uint32(0); i < 2; i++ {
-		err := mem.WriteMemoryAddr8(address+i, uint8(value>>uint32(i*8)&0xFF))
-		if err != nil {
-			return err
+	address &= mem.a20Mask
+	if index, offset := address>>PAGE_SHIFT, address&PAGE_MASK; offset < PAGE_MASK && index < uint32(len(mem.pages)) {
+		if data := mem.pages[index].write; data != nil {
+			binary.LittleEndian.PutUint16(data[offset:offset+2], value)
+			return nil
 		}
 	}
-
-	return nil
+	return mem.writeSlow16(address, value)
 }
 
 func (mem *MemoryAccessController) WriteMemoryAddr32(address uint32, value uint32) error {
-	for i := uint32(0); i < 4; i++ {
-		err := mem.WriteMemoryAddr8(address+i, uint8(value>>uint32(i*8)&0xFF))
-		if err != nil {
-			return err
+	address &= mem.a20Mask
+	if index, offset := address>>PAGE_SHIFT, address&PAGE_MASK; offset <= PAGE_SIZE-4 && index < uint32(len(mem.pages)) {
+		if data := mem.pages[index].write; data != nil {
+			binary.LittleEndian.PutUint32(data[offset:offset+4], value)
+			return nil
 		}
 	}
-
-	return nil
+	return mem.writeSlow32(address, value)
 }
 
 func (mem *MemoryAccessController) LockBootVector() {
@@ -169,8 +260,17 @@ func (mem *MemoryAccessController) UnlockBootVector() {
 	mem.resetVectorBaseAddr = 0x0
 }
 
-func (mem *MemoryAccessController) PeekNextBytes(addr uint32, numBytes uint32) []*uint8 {
-	return mem.memoryAccessProvider.ReadSequential(addr, numBytes)
+// PeekNextBytes reads up to numBytes from addr, stopping at the first address that faults
+func (mem *MemoryAccessController) PeekNextBytes(addr uint32, numBytes uint32) []uint8 {
+	buffer := make([]uint8, 0, numBytes)
+	for i := uint32(0); i < numBytes; i++ {
+		value, err := mem.ReadMemoryValue8(addr + i)
+		if err != nil {
+			break
+		}
+		buffer = append(buffer, value)
+	}
+	return buffer
 }
 
 func (mem *MemoryAccessController) SetSegmentOverride(override uint32) {
@@ -192,49 +292,3 @@ func (mem *MemoryAccessController) SetLockPrefix(enabled bool) {
 func (mem *MemoryAccessController) SetRepPrefix(enabled bool) {
 	mem.setRepPrefix = enabled
 }
-
-func (mem *MemoryAccessController) InitShadowBios() {
-	biosImage := *mem.biosImage
-	biosSize := len(biosImage)
-
-	// Copy the IVT (Interrupt Vector Table) to the first 1 KB of memory
-	for i := 0x0; i < 0x400; i++ {
-		if i < biosSize {
-			err := mem.WriteMemoryAddr8(uint32(i), biosImage[i])
-			if err != nil {
-				log.Printf("Error writing IVT: %v", err)
-			}
-		}
-	}
-
-	// Copy the BDA (BIOS Data Area) to memory
-	for i := 0x400; i < 0x500; i++ {
-		if i < biosSize {
-			err := mem.WriteMemoryAddr8(uint32(i), biosImage[i])
-			if err != nil {
-				log.Printf("Error writing BDA: %v", err)
-			}
-		}
-	}
-
-	// Shadow the main BIOS code
-	for i := 0; i < biosSize; i++ {
-		shadowAddr := 0xF0000 + uint32(i)
-		err := mem.WriteMemoryAddr8(shadowAddr, biosImage[i])
-		if err != nil {
-			log.Printf("Error shadowing BIOS: %v", err)
-		}
-	}
-
-	// Shadow the video BIOS (if present)
-	videoBiosSize := 0x4000 // Assuming a typical video BIOS size of 16 KB
-	for i := 0; i < videoBiosSize; i++ {
-		if i < len(*mem.videoBiosImage) {
-			shadowAddr := 0xC0000 + uint32(i)
-			err := mem.WriteMemoryAddr8(shadowAddr, (*mem.videoBiosImage)[i])
-			if err != nil {
-				log.Printf("Error shadowing video BIOS: %v", err)
-			}
-		}
-	}
-}
@@ -0,0 +1,79 @@
+package memmap
+
+import (
+	"fmt"
+)
+
+/*
+	Option ROMs
+	Adapter ROMs live between C0000 and DFFFF. Each starts with the 0x55AA signature
+	and its length in 512 byte blocks, and all of its bytes sum to zero. The system
+	BIOS finds them by scanning this area during POST and calls the entry point at
+	offset 3 of each.
+*/
+
+const OPTION_ROM_START = 0xC0000
+const OPTION_ROM_END = 0xE0000
+
+const OPTION_ROM_BLOCK_SIZE = 512
+
+// ValidateOptionRom checks the signature and checksum of an option rom image and returns the size its header declares
+func ValidateOptionRom(image []uint8) (uint32, error) {
+	if len(image) < 3 || image[0] != 0x55 || image[1] != 0xAA {
+		return 0, fmt.Errorf("missing 0x55AA option rom signature")
+	}
+
+	size := uint32(image[2]) * OPTION_ROM_BLOCK_SIZE
+	if size == 0 {
+		return 0, fmt.Errorf("option rom declares a size of 0")
+	}
+	if uint32(len(image)) < size {
+		return 0, fmt.Errorf("option rom declares %d bytes but the image is %d bytes", size, len(image))
+	}
+
+	var sum uint8
+	for _, b := range image[:size] {
+		sum += b
+	}
+	if sum != 0 {
+		return 0, fmt.Errorf("option rom checksum is %#02x, not 0", sum)
+	}
+	return size, nil
+}
+
+// CheckOptionRomAddress checks that an option rom can be mapped at start. ISA adapters put their
+// roms on any 2K boundary in C0000-DFFFF, but memory is decoded in 4K pages here, so only roms
+// starting on a page boundary are supported.
+func CheckOptionRomAddress(start uint32) error {
+	if start < OPTION_ROM_START || start >= OPTION_ROM_END {
+		return fmt.Errorf("option rom address %#05x is outside %#05x-%#05x", start, OPTION_ROM_START, OPTION_ROM_END-1)
+	}
+	if start&PAGE_MASK != 0 {
+		return fmt.Errorf("option rom address %#05x is not on a 4K boundary, roms on the other 2K boundaries aren't supported", start)
+	}
+	return nil
+}
+
+// MapOptionRom validates an option rom image and maps it at start, which CheckOptionRomAddress must accept
+func (mem *MemoryAccessController) MapOptionRom(name string, start uint32, image []uint8) error {
+	size, err := ValidateOptionRom(image)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := CheckOptionRomAddress(start); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	pages := (size + PAGE_MASK) &^ PAGE_MASK
+	if start+pages > OPTION_ROM_END {
+		return fmt.Errorf("%s: %#05x-%#05x runs past %#05x", name, start, start+pages-1, OPTION_ROM_END-1)
+	}
+
+	for addr := start; addr < start+pages; addr += PAGE_SIZE {
+		if region := mem.pages[addr>>PAGE_SHIFT].region; region != nil && region.Kind == REGION_ROM {
+			return fmt.Errorf("%s: overlaps %s at %#05x", name, region.Name, addr)
+		}
+	}
+
+	return mem.MapRom(name, start, pages, image[:size])
+}
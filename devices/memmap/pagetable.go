@@ -0,0 +1,304 @@
+package memmap
+
+import (
+	"fmt"
+	"github.com/andrewjc/threeatesix/common"
+	"github.com/andrewjc/threeatesix/devices/bus"
+)
+
+/*
+	Physical page table
+	The physical address space is decoded in 4K pages. Each page points at the
+	region that owns it and, for RAM and ROM, at the slice of memory that reads
+	and writes hit directly. Only MMIO pages go through callbacks.
+*/
+
+const PAGE_SHIFT = 12
+const PAGE_SIZE = 1 << PAGE_SHIFT
+const PAGE_MASK = PAGE_SIZE - 1
+
+type RegionKind uint8
+
+const (
+	REGION_UNMAPPED RegionKind = iota
+	REGION_RAM
+	REGION_ROM
+	REGION_MMIO
+)
+
+func (kind RegionKind) String() string {
+	switch kind {
+	case REGION_UNMAPPED:
+		return "unmapped"
+	case REGION_RAM:
+		return "ram"
+	case REGION_ROM:
+		return "rom"
+	case REGION_MMIO:
+		return "mmio"
+	default:
+		return fmt.Sprintf("RegionKind(%d)", uint8(kind))
+	}
+}
+
+// Region is a named range of the physical address space
+type Region struct {
+	Name  string
+	Kind  RegionKind
+	Start uint32
+	Size  uint32
+
+	// MMIO callbacks, called with the physical address
+	Read  func(addr uint32) uint8
+	Write func(addr uint32, value uint8)
+
+	rom []uint8 // contents of a rom region, kept so shadowing can be switched off again
+}
+
+type pageData = *[PAGE_SIZE]uint8
+
+type page struct {
+	region *Region
+	read   pageData // nil when reads are not backed by memory
+	write  pageData // nil when writes are not backed by memory
+}
+
+// MemoryRegionError is returned when a region is not page aligned or falls outside the page table
+type MemoryRegionError struct {
+	Name  string
+	Start uint32
+	Size  uint32
+}
+
+func (err MemoryRegionError) Error() string {
+	return fmt.Sprintf("memory region %s at %#08x size %#x is not page aligned or is outside the page table", err.Name, err.Start, err.Size)
+}
+
+func (mem *MemoryAccessController) checkRegion(name string, start uint32, size uint32) error {
+	if start&PAGE_MASK != 0 || size&PAGE_MASK != 0 || size == 0 || uint64(start)+uint64(size) > uint64(len(mem.pages))<<PAGE_SHIFT {
+		return MemoryRegionError{Name: name, Start: start, Size: size}
+	}
+	return nil
+}
+
+// MapRam maps ram over [start, start+len(ram)). Reads and writes go straight to the slice.
+func (mem *MemoryAccessController) MapRam(name string, start uint32, ram []uint8) error {
+	size := uint32(len(ram))
+	if err := mem.checkRegion(name, start, size); err != nil {
+		return err
+	}
+
+	region := &Region{Name: name, Kind: REGION_RAM, Start: start, Size: size}
+	for offset := uint32(0); offset < size; offset += PAGE_SIZE {
+		data := pageData(ram[offset : offset+PAGE_SIZE])
+		mem.pages[(start+offset)>>PAGE_SHIFT] = page{region: region, read: data, write: data}
+	}
+	return nil
+}
+
+// MapRom maps a copy of image over [start, start+size), padded with 0xFF. Writes fall
+// through to the ram underneath, if any, like the 82335 does before shadowing is set up.
+func (mem *MemoryAccessController) MapRom(name string, start uint32, size uint32, image []uint8) error {
+	if err := mem.checkRegion(name, start, size); err != nil {
+		return err
+	}
+
+	rom := make([]uint8, size)
+	for i := range rom {
+		rom[i] = 0xFF
+	}
+	copy(rom, image)
+
+	region := &Region{Name: name, Kind: REGION_ROM, Start: start, Size: size, rom: rom}
+	for offset := uint32(0); offset < size; offset += PAGE_SIZE {
+		mem.pages[(start+offset)>>PAGE_SHIFT] = page{region: region}
+	}
+	mem.setShadow(start, size, false, false)
+	mem.applyMemoryConfig(mem.memoryConfig)
+	return nil
+}
+
+// setShadow routes the rom pages in [start, start+size). Shadowed pages read from the ram underneath
+// instead of the rom, and read only pages drop writes instead of writing that ram.
+func (mem *MemoryAccessController) setShadow(start uint32, size uint32, shadow bool, readOnly bool) {
+	for addr := start; addr < start+size; addr += PAGE_SIZE {
+		p := &mem.pages[addr>>PAGE_SHIFT]
+		if p.region == nil || p.region.Kind != REGION_ROM {
+			continue
+		}
+
+		ram := mem.ramPage(addr)
+		offset := addr - p.region.Start
+		p.read = pageData(p.region.rom[offset : offset+PAGE_SIZE])
+		if shadow && ram != nil {
+			p.read = ram
+		}
+		p.write = ram
+		if readOnly {
+			p.write = nil
+		}
+	}
+}
+
+// setBaseMemorySize maps ram up to size and leaves the rest of the first 640K to the ISA bus
+func (mem *MemoryAccessController) setBaseMemorySize(size uint32) {
+	for addr := uint32(BASE_MEMORY_HOLE_START); addr < BASE_MEMORY_END; addr += PAGE_SIZE {
+		if addr < size {
+			data := mem.ramPage(addr)
+			mem.pages[addr>>PAGE_SHIFT] = page{region: mem.baseMemory, read: data, write: data}
+		} else {
+			mem.pages[addr>>PAGE_SHIFT] = page{region: &isaBus}
+		}
+	}
+}
+
+// setOpenBus leaves [start, start+size) to the ISA bus
+func (mem *MemoryAccessController) setOpenBus(start uint32, size uint32) {
+	for addr := start; addr < start+size; addr += PAGE_SIZE {
+		mem.pages[addr>>PAGE_SHIFT] = page{region: &isaBus}
+	}
+}
+
+// isaBus decodes addresses nothing on the board responds to, reads float high and writes are lost
+var isaBus = Region{Name: "isa bus", Kind: REGION_MMIO, Read: func(addr uint32) uint8 { return 0xFF }}
+
+// MapMmio routes accesses to [start, start+size) to callbacks
+func (mem *MemoryAccessController) MapMmio(name string, start uint32, size uint32, read func(addr uint32) uint8, write func(addr uint32, value uint8)) error {
+	if err := mem.checkRegion(name, start, size); err != nil {
+		return err
+	}
+
+	region := &Region{Name: name, Kind: REGION_MMIO, Start: start, Size: size, Read: read, Write: write}
+	for offset := uint32(0); offset < size; offset += PAGE_SIZE {
+		mem.pages[(start+offset)>>PAGE_SHIFT] = page{region: region}
+	}
+	return nil
+}
+
+// Unmap removes [start, start+size) from the address space, accesses to it fault
+func (mem *MemoryAccessController) Unmap(start uint32, size uint32) error {
+	if err := mem.checkRegion("unmapped", start, size); err != nil {
+		return err
+	}
+
+	for offset := uint32(0); offset < size; offset += PAGE_SIZE {
+		mem.pages[(start+offset)>>PAGE_SHIFT] = page{}
+	}
+	return nil
+}
+
+// ramPage returns the page of backing ram at a physical address, or nil when there is no ram there
+func (mem *MemoryAccessController) ramPage(addr uint32) pageData {
+	ram := *mem.backingRam
+	if uint64(addr)+PAGE_SIZE > uint64(len(ram)) {
+		return nil
+	}
+	return pageData(ram[addr : addr+PAGE_SIZE])
+}
+
+// GetRegion returns the region that decodes a physical address
+func (mem *MemoryAccessController) GetRegion(addr uint32) (Region, bool) {
+	index := addr >> PAGE_SHIFT
+	if index >= uint32(len(mem.pages)) || mem.pages[index].region == nil {
+		return Region{Name: "unmapped", Kind: REGION_UNMAPPED}, false
+	}
+	return *mem.pages[index].region, true
+}
+
+// GetMemoryMap describes the physical address space as the page table decodes it
+func (mem *MemoryAccessController) GetMemoryMap() []bus.MemoryWindow {
+	windows := make([]bus.MemoryWindow, 0)
+	var current *Region
+	for index := range mem.pages {
+		region := mem.pages[index].region
+		if region == nil {
+			current = nil
+			continue
+		}
+
+		start := uint32(index) << PAGE_SHIFT
+		if region == current {
+			windows[len(windows)-1].Size += PAGE_SIZE
+			continue
+		}
+		current = region
+		windows = append(windows, bus.MemoryWindow{Name: region.Name, Start: start, Size: PAGE_SIZE})
+	}
+	return windows
+}
+
+func (mem *MemoryAccessController) readSlow8(addr uint32) (uint8, error) {
+	index := addr >> PAGE_SHIFT
+	if index >= uint32(len(mem.pages)) {
+		return 0, common.GeneralProtectionFault{}
+	}
+
+	p := &mem.pages[index]
+	switch {
+	case p.read != nil:
+		return p.read[addr&PAGE_MASK], nil
+	case p.region != nil && p.region.Read != nil:
+		return p.region.Read(addr), nil
+	default:
+		return 0, common.GeneralProtectionFault{}
+	}
+}
+
+func (mem *MemoryAccessController) writeSlow8(addr uint32, value uint8) error {
+	index := addr >> PAGE_SHIFT
+	if index >= uint32(len(mem.pages)) {
+		return common.GeneralProtectionFault{}
+	}
+
+	p := &mem.pages[index]
+	switch {
+	case p.write != nil:
+		p.write[addr&PAGE_MASK] = value
+	case p.region == nil:
+		return common.GeneralProtectionFault{}
+	case p.region.Write != nil:
+		p.region.Write(addr, value)
+	}
+	// writes to rom with no ram underneath are dropped
+	return nil
+}
+
+// readSlow16 and the other wide slow paths split accesses that cross a page or hit mmio into bytes
+
+func (mem *MemoryAccessController) readSlow16(addr uint32) (uint16, error) {
+	b1, err := mem.ReadMemoryValue8(addr)
+	if err != nil {
+		return 0, err
+	}
+	b2, err := mem.ReadMemoryValue8(addr + 1)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(b2)<<8 | uint16(b1), nil
+}
+
+func (mem *MemoryAccessController) readSlow32(addr uint32) (uint32, error) {
+	w1, err := mem.ReadMemoryValue16(addr)
+	if err != nil {
+		return 0, err
+	}
+	w2, err := mem.ReadMemoryValue16(addr + 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(w2)<<16 | uint32(w1), nil
+}
+
+func (mem *MemoryAccessController) writeSlow16(addr uint32, value uint16) error {
+	if err := mem.WriteMemoryAddr8(addr, uint8(value)); err != nil {
+		return err
+	}
+	return mem.WriteMemoryAddr8(addr+1, uint8(value>>8))
+}
+
+func (mem *MemoryAccessController) writeSlow32(addr uint32, value uint32) error {
+	if err := mem.WriteMemoryAddr16(addr, uint16(value)); err != nil {
+		return err
+	}
+	return mem.WriteMemoryAddr16(addr+2, uint16(value>>16))
+}
@@ -0,0 +1,156 @@
+package monitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	Reverse debugger
+	The monitor drives a DebugTarget (the machine) forwards and backwards in time.
+	The machine keeps periodic checkpoints and counts executed instructions, so
+	stepping back means restoring an earlier checkpoint and re-executing forward.
+*/
+
+type DebugTarget interface {
+	GetInstructionCount() uint64
+	GetCodePointer() uint32
+	StepForward(count uint64) error
+	ReverseStep(count uint64) error
+
+	// ReverseContinue runs backwards until the code pointer satisfies isBreakpoint,
+	// returning false if the start of the recorded history was reached instead
+	ReverseContinue(isBreakpoint func(addr uint32) bool) (bool, error)
+}
+
+var ErrNoDebugTarget = errors.New("no debug target attached")
+
+func (device *HardwareMonitor) AttachDebugTarget(target DebugTarget) {
+	device.debugTarget = target
+}
+
+func (device *HardwareMonitor) SetBreakpoint(addr uint32) {
+	device.breakpoints[addr] = true
+}
+
+func (device *HardwareMonitor) ClearBreakpoint(addr uint32) {
+	delete(device.breakpoints, addr)
+}
+
+func (device *HardwareMonitor) IsBreakpoint(addr uint32) bool {
+	return device.breakpoints[addr]
+}
+
+func (device *HardwareMonitor) HasBreakpoints() bool {
+	return len(device.breakpoints) > 0
+}
+
+func (device *HardwareMonitor) ReverseStep(count uint64) error {
+	if device.debugTarget == nil {
+		return ErrNoDebugTarget
+	}
+	return device.debugTarget.ReverseStep(count)
+}
+
+func (device *HardwareMonitor) ReverseContinue() (bool, error) {
+	if device.debugTarget == nil {
+		return false, ErrNoDebugTarget
+	}
+	return device.debugTarget.ReverseContinue(device.IsBreakpoint)
+}
+
+// RunConsole reads debugger commands until the user continues or quits. It
+// returns true if the machine should resume running.
+func (device *HardwareMonitor) RunConsole(in io.Reader, out io.Writer) bool {
+	if device.debugTarget == nil {
+		fmt.Fprintln(out, ErrNoDebugTarget)
+		return false
+	}
+
+	scanner := bufio.NewScanner(in)
+	device.printLocation(out)
+	for {
+		fmt.Fprint(out, "(monitor) ")
+		if !scanner.Scan() {
+			return false
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "reverse-step", "rs":
+			count, err := parseCount(fields)
+			if err == nil {
+				err = device.ReverseStep(count)
+			}
+			device.printResult(out, err)
+		case "reverse-continue", "rc":
+			hit, err := device.ReverseContinue()
+			if err == nil && !hit {
+				fmt.Fprintln(out, "Reached the start of the recorded history")
+			}
+			device.printResult(out, err)
+		case "step", "s":
+			count, err := parseCount(fields)
+			if err == nil {
+				err = device.debugTarget.StepForward(count)
+			}
+			device.printResult(out, err)
+		case "break", "b":
+			if addr, err := parseAddress(fields); err != nil {
+				fmt.Fprintln(out, err)
+			} else {
+				device.SetBreakpoint(addr)
+			}
+		case "delete", "d":
+			if addr, err := parseAddress(fields); err != nil {
+				fmt.Fprintln(out, err)
+			} else {
+				device.ClearBreakpoint(addr)
+			}
+		case "where", "w":
+			device.printLocation(out)
+		case "devices":
+			device.WriteDeviceMap(out)
+		case "continue", "c":
+			return true
+		case "quit", "q":
+			return false
+		default:
+			fmt.Fprintln(out, "Commands: reverse-step [n], reverse-continue, step [n], break <addr>, delete <addr>, where, devices, continue, quit")
+		}
+	}
+}
+
+func (device *HardwareMonitor) printResult(out io.Writer, err error) {
+	if err != nil {
+		fmt.Fprintln(out, err)
+	}
+	device.printLocation(out)
+}
+
+func (device *HardwareMonitor) printLocation(out io.Writer) {
+	fmt.Fprintf(out, "instruction %d at %s\n", device.debugTarget.GetInstructionCount(), device.symbols.Format(device.debugTarget.GetCodePointer()))
+}
+
+func parseCount(fields []string) (uint64, error) {
+	if len(fields) < 2 {
+		return 1, nil
+	}
+	return strconv.ParseUint(fields[1], 0, 64)
+}
+
+func parseAddress(fields []string) (uint32, error) {
+	if len(fields) < 2 {
+		return 0, errors.New("missing address")
+	}
+	addr, err := strconv.ParseUint(fields[1], 0, 32)
+	return uint32(addr), err
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
+	"io"
 	"log"
 )
 
@@ -13,19 +14,31 @@ type HardwareMonitor struct {
 	logCpuInstructions bool
 	logDebugMessage    bool
 	instructionLog     []string
+
+	debugTarget DebugTarget
+	breakpoints map[uint32]bool
+	symbols     *SymbolTable
 }
 
+// GetPortMap claims the POST diagnostic ports, like a POST card plugged into the machine
 func (device *HardwareMonitor) GetPortMap() *bus.DevicePortMap {
-	return nil
+	return &bus.DevicePortMap{
+		Mappings: []bus.PortMapping{
+			bus.ReadWrite(bus.Port(0x0080), device),
+			bus.ReadWrite(bus.Port(0x0084), device),
+		},
+	}
 }
 
 func (device *HardwareMonitor) ReadAddr8(addr uint16) uint8 {
-	//TODO implement me
-	panic("implement me")
+	return 0x00
 }
 
 func (device *HardwareMonitor) WriteAddr8(addr uint16, data uint8) {
-
+	// 0x00 writes are used as an I/O delay rather than as a post code
+	if addr == 0x0080 && data > 0x00 {
+		log.Printf("BIOS POST: %#02x - %s", data, common.BiosPostCodeToString(data))
+	}
 }
 
 const MAX_LOG_LENGTH = 64
@@ -35,6 +48,8 @@ func NewHardwareMonitor() *HardwareMonitor {
 	device.logCpuInstructions = false
 	device.logDebugMessage = true
 	device.instructionLog = make([]string, 0)
+	device.breakpoints = make(map[uint32]bool)
+	device.symbols = NewSymbolTable()
 
 	return device
 }
@@ -49,16 +64,51 @@ func (device *HardwareMonitor) SetDeviceBusId(id uint32) {
 
 func (device *HardwareMonitor) SetBus(bus *bus.Bus) {
 	device.bus = bus
+
+	// only subscribe to the logs that are enabled, so the processor can skip building the others
+	if device.logCpuInstructions {
+		bus.Signals().InstructionLog.Subscribe(device.printLog)
+	}
+	if device.logDebugMessage {
+		bus.Signals().DebugLog.Subscribe(device.printLog)
+	}
+}
+
+func (device *HardwareMonitor) printLog(message string) {
+	log.Output(4, fmt.Sprintf("[%#04x] %s", device.busId, message))
 }
 
 func (device *HardwareMonitor) OnReceiveMessage(message bus.BusMessage) {
-	if device.logCpuInstructions && message.Subject == common.MESSAGE_GLOBAL_CPU_INSTRUCTION_LOG {
-		log.Output(4, fmt.Sprintf("[%#04x] %s", device.busId, message.Data))
-	} else if device.logDebugMessage && message.Subject == common.MESSAGE_GLOBAL_DEBUG_MESSAGE_LOG {
-		log.Output(4, fmt.Sprintf("[%#04x] %s", device.busId, message.Data))
-	}
 }
 
 func (device *HardwareMonitor) GetInstructionLog() []string {
 	return device.instructionLog
 }
+
+func (device *HardwareMonitor) GetSymbols() *SymbolTable {
+	return device.symbols
+}
+
+// LoadSymbols adds the symbols in filename, relocated to the linear address base
+func (device *HardwareMonitor) LoadSymbols(filename string, base uint32) error {
+	return device.symbols.LoadFile(filename, base)
+}
+
+// WriteDeviceMap lists the devices on the bus with the ports and memory they decode
+func (device *HardwareMonitor) WriteDeviceMap(out io.Writer) {
+	for _, info := range device.bus.Devices() {
+		fmt.Fprintf(out, "%-10s id=%#06x %T\n", info.Name, info.Id, info.Device)
+		for _, mapping := range info.Ports {
+			access := "rw"
+			if mapping.Read == nil {
+				access = "w"
+			} else if mapping.Write == nil {
+				access = "r"
+			}
+			fmt.Fprintf(out, "  port %-13s %s\n", mapping.Ports, access)
+		}
+		for _, window := range info.Memory {
+			fmt.Fprintf(out, "  mem  %s\n", window)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Symbol table
+	Maps linear addresses to names so that traces and core dumps can show
+	function+offset. Symbols can be loaded from NASM map files, plain
+	"addr name" lists (addresses may also be written seg:off) or ELF binaries.
+*/
+
+type Symbol struct {
+	Addr uint32
+	Name string
+}
+
+type SymbolTable struct {
+	symbols []Symbol // kept sorted by address
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{symbols: make([]Symbol, 0)}
+}
+
+func (table *SymbolTable) Len() int {
+	return len(table.symbols)
+}
+
+func (table *SymbolTable) Add(addr uint32, name string) {
+	i := sort.Search(len(table.symbols), func(i int) bool { return table.symbols[i].Addr >= addr })
+	table.symbols = append(table.symbols, Symbol{})
+	copy(table.symbols[i+1:], table.symbols[i:])
+	table.symbols[i] = Symbol{Addr: addr, Name: name}
+}
+
+// Lookup returns the closest symbol at or below addr and the offset of addr from it
+func (table *SymbolTable) Lookup(addr uint32) (Symbol, uint32, bool) {
+	i := sort.Search(len(table.symbols), func(i int) bool { return table.symbols[i].Addr > addr })
+	if i == 0 {
+		return Symbol{}, 0, false
+	}
+	symbol := table.symbols[i-1]
+	return symbol, addr - symbol.Addr, true
+}
+
+// Format renders addr as function+offset, or as a raw linear address when no symbol covers it
+func (table *SymbolTable) Format(addr uint32) string {
+	symbol, offset, ok := table.Lookup(addr)
+	if !ok {
+		return fmt.Sprintf("%#05x", addr)
+	}
+	if offset == 0 {
+		return symbol.Name
+	}
+	return fmt.Sprintf("%s+%#x", symbol.Name, offset)
+}
+
+// LoadFile detects the format of a symbol file and adds its symbols, relocated by base
+func (table *SymbolTable) LoadFile(filename string, base uint32) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte(elf.ELFMAG)):
+		return table.LoadElf(bytes.NewReader(data), base)
+	case bytes.Contains(data[:min(len(data), 256)], []byte("NASM Map file")):
+		return table.LoadNasmMap(bytes.NewReader(data), base)
+	default:
+		return table.LoadAddressList(bytes.NewReader(data), base)
+	}
+}
+
+// LoadNasmMap reads the symbol sections of a map file written by nasm's [map symbols] directive
+func (table *SymbolTable) LoadNasmMap(r io.Reader, base uint32) error {
+	scanner := bufio.NewScanner(r)
+	inSymbols := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "-- ") {
+			inSymbols = strings.HasPrefix(line, "-- Symbols")
+			continue
+		}
+		if !inSymbols || line == "" || strings.HasPrefix(line, "----") || strings.HasPrefix(line, "Real") {
+			continue
+		}
+
+		// Real  Virtual  Name
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			return fmt.Errorf("bad nasm map line %q: %w", line, err)
+		}
+		table.Add(base+uint32(addr), fields[2])
+	}
+	return scanner.Err()
+}
+
+// LoadAddressList reads "addr name" lines. Blank lines and lines starting with # or ; are skipped.
+func (table *SymbolTable) LoadAddressList(r io.Reader, base uint32) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("bad symbol line %q", line)
+		}
+		addr, err := parseSymbolAddress(fields[0])
+		if err != nil {
+			return fmt.Errorf("bad symbol line %q: %w", line, err)
+		}
+		table.Add(base+addr, fields[1])
+	}
+	return scanner.Err()
+}
+
+// LoadElf adds the function and untyped symbols of an ELF binary
+func (table *SymbolTable) LoadElf(r io.ReaderAt, base uint32) error {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	symbols, err := file.Symbols()
+	if err != nil {
+		return err
+	}
+
+	for _, symbol := range symbols {
+		kind := elf.ST_TYPE(symbol.Info)
+		if symbol.Name == "" || symbol.Section == elf.SHN_UNDEF || (kind != elf.STT_FUNC && kind != elf.STT_NOTYPE) {
+			continue
+		}
+		table.Add(base+uint32(symbol.Value), symbol.Name)
+	}
+	return nil
+}
+
+func parseSymbolAddress(s string) (uint32, error) {
+	if segment, offset, ok := strings.Cut(s, ":"); ok {
+		seg, err := strconv.ParseUint(strings.TrimPrefix(segment, "0x"), 16, 16)
+		if err != nil {
+			return 0, err
+		}
+		off, err := strconv.ParseUint(strings.TrimPrefix(offset, "0x"), 16, 32)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(seg)<<4 + uint32(off), nil
+	}
+
+	addr, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+	return uint32(addr), err
+}
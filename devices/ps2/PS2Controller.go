@@ -1,8 +1,8 @@
 package ps2
 
 import (
-	"github.com/andrewjc/threeatesix/common"
 	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/replay"
 	"log"
 )
 
@@ -23,9 +23,9 @@ type Ps2Controller struct {
 	auxiliaryBufferFull  bool
 	timeout              bool
 	parityError          bool
-	systemControlPort    uint8
+	systemControlPort    uint8 // port 0x61
 	inputPort            uint8
-	outputPort           uint8
+	outputPort           uint8 // bit 0 is the system reset line (active low), bit 1 the A20 gate
 	testInputs           uint8
 
 	commandByte        uint8
@@ -40,7 +40,6 @@ type Ps2Controller struct {
 	refreshCycleToggle   bool
 	ioChannelCheck       bool
 	ioChannelCheckStatus bool
-	keyboardA20          bool
 	outputRegisterFull   bool
 	inputRegisterFull    bool
 	clockGate2           bool
@@ -48,6 +47,8 @@ type Ps2Controller struct {
 
 	endpoint   Ps2Device
 	a20Enabled bool
+
+	journal *replay.Journal
 }
 
 type Ps2Device interface {
@@ -59,8 +60,10 @@ type Ps2Device interface {
 
 func (controller *Ps2Controller) GetPortMap() *bus.DevicePortMap {
 	return &bus.DevicePortMap{
-		ReadPorts:  []uint16{0x60, 0x61, 0x64},
-		WritePorts: []uint16{0x60, 0x61, 0x64},
+		Mappings: []bus.PortMapping{
+			bus.ReadWrite(bus.Ports(0x60, 0x61), controller),
+			bus.ReadWrite(bus.Port(0x64), controller),
+		},
 	}
 }
 
@@ -134,32 +137,13 @@ func (controller *Ps2Controller) resetController() {
 	controller.inputBuffer = 0
 	controller.outputBuffer = 0
 	controller.systemControlPort = 0
+	controller.outputPort = OUTPUT_PORT_SYSTEM_RESET
 	controller.a20Enabled = false
-	controller.keyboardA20 = false
-	controller.updateOutputPort()
 	controller.updateSystemControlPort()
-
-	log.Println("PS/2 Controller: System Reset requested")
 }
 
-func (controller *Ps2Controller) updateOutputPort() {
-	// Update the output port based on current state
-	var outputPort uint8 = 0
-	if controller.a20Enabled {
-		outputPort |= 0x02
-	}
-	if controller.keyboardA20 {
-		outputPort |= 0x01
-	}
-	if controller.keyboardEnabled {
-		outputPort |= 0x04
-	}
-	if controller.mouseEnabled {
-		outputPort |= 0x08
-	}
-
-	controller.outputPort = outputPort
-}
+const OUTPUT_PORT_SYSTEM_RESET = 0x01 // held high while the processor runs
+const OUTPUT_PORT_A20_GATE = 0x02
 
 func (controller *Ps2Controller) GetBus() *bus.Bus {
 	return controller.bus
@@ -169,6 +153,27 @@ func (controller *Ps2Controller) SetBus(bus *bus.Bus) {
 	controller.bus = bus
 }
 
+type ps2ControllerState struct {
+	controller Ps2Controller
+	endpoint   interface{}
+}
+
+func (controller *Ps2Controller) SaveState() interface{} {
+	state := &ps2ControllerState{controller: *controller}
+	if endpoint, ok := controller.endpoint.(bus.Checkpointable); ok {
+		state.endpoint = endpoint.SaveState()
+	}
+	return state
+}
+
+func (controller *Ps2Controller) RestoreState(state interface{}) {
+	saved := state.(*ps2ControllerState)
+	*controller = saved.controller
+	if endpoint, ok := controller.endpoint.(bus.Checkpointable); ok && saved.endpoint != nil {
+		endpoint.RestoreState(saved.endpoint)
+	}
+}
+
 func (controller *Ps2Controller) WriteDataPort(value uint8) {
 	if controller.expectingParameter {
 		controller.handleCommandParameter(value)
@@ -281,17 +286,19 @@ func (controller *Ps2Controller) WriteCommandRegister(value uint8) {
 		controller.port1_enabled = false
 	case 0xAE: // Enable first PS/2 port
 		controller.port1_enabled = true
-	case 0xF0: // Pulse output line
-		// Implement pulse output line logic if needed
-	case 0xFE: // Resend
-		controller.resetController()
-	case 0xFF: // Reset
-		controller.resetController()
-		controller.BufferOutputData(0xFA) // ACK
 	case 0xD0: // Read Output Port
 		controller.BufferOutputData(controller.ReadOutputPort())
 	case 0xD1: // Write Output Port
 		controller.expectingParameter = true
+	case 0xDD: // Disable A20
+		controller.WriteOutputPort(controller.outputPort &^ OUTPUT_PORT_A20_GATE)
+	case 0xDF: // Enable A20
+		controller.WriteOutputPort(controller.outputPort | OUTPUT_PORT_A20_GATE)
+	case 0xF0, 0xF1, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7, 0xF8, 0xF9, 0xFA, 0xFB, 0xFC, 0xFD, 0xFE, 0xFF: // Pulse output lines
+		// the low nibble masks output port bits 0-3, a clear bit is pulsed low. Only the reset line is wired.
+		if value&OUTPUT_PORT_SYSTEM_RESET == 0 {
+			controller.handleSystemReset()
+		}
 	default:
 		log.Printf("Unknown PS2 controller command: [%#02x]", value)
 	}
@@ -322,7 +329,29 @@ func (controller *Ps2Controller) ConnectDevice(device Ps2Device) {
 	controller.endpoint = device
 }
 
+func (controller *Ps2Controller) SetJournal(journal *replay.Journal) {
+	controller.journal = journal
+}
+
 func (controller *Ps2Controller) BufferInputData(data uint8) {
+	if controller.journal != nil {
+		data = uint8(controller.journal.Sample(replay.EVENT_KEYBOARD_INPUT, uint64(data)))
+	}
+	controller.receiveInputData(data)
+}
+
+// ReplayInputData delivers the keyboard bytes the journal recorded for the current step that the
+// keyboard didn't send itself, so a replay reproduces keystrokes without any live input
+func (controller *Ps2Controller) ReplayInputData() {
+	if controller.journal == nil {
+		return
+	}
+	for _, data := range controller.journal.Pending(replay.EVENT_KEYBOARD_INPUT) {
+		controller.receiveInputData(uint8(data))
+	}
+}
+
+func (controller *Ps2Controller) receiveInputData(data uint8) {
 	controller.inputBuffer = data
 	controller.DisableDataPortReadyForWrite()
 	controller.EnableDataPortReadyForRead()
@@ -373,12 +402,6 @@ func (controller *Ps2Controller) updateSystemControlPort() {
 
 	// Restore the preserved lower 4 bits
 	controller.systemControlPort |= preservedBits
-
-	if controller.a20Enabled {
-		controller.systemControlPort |= 0x02
-	} else {
-		controller.systemControlPort &= ^uint8(0x02)
-	}
 }
 
 func (controller *Ps2Controller) WriteSystemControlPort(data uint8) {
@@ -392,22 +415,6 @@ func (controller *Ps2Controller) WriteSystemControlPort(data uint8) {
 	controller.speakerData = data&0x02 != 0
 	controller.clockGate2 = data&0x01 != 0
 
-	// Toggle speaker if bit 1 changes
-	if (data & 0x02) != (controller.systemControlPort & 0x02) {
-		// Implement any speaker toggling logic here if needed
-	}
-
-	// Handle system reset if bit 0 is set (System Reset line)
-	if data&0x01 != 0 {
-		controller.handleSystemReset()
-	}
-
-	newA20Status := data&0x02 != 0
-	if newA20Status != controller.a20Enabled {
-		controller.a20Enabled = newA20Status
-		controller.handleA20Change()
-	}
-
 	// Update the system control port for reading
 	controller.updateSystemControlPort()
 }
@@ -434,33 +441,22 @@ func (controller *Ps2Controller) ReadInputPort() uint8 {
 }
 
 func (controller *Ps2Controller) ReadOutputPort() uint8 {
-	var outputPort uint8 = 0
-
-	if controller.a20Enabled {
-		outputPort |= 0x02 // Set bit 1 if A20 is enabled
-	}
-	if controller.keyboardA20 {
-		outputPort |= 0x01 // Set bit 0 if keyboard A20 is enabled
-	}
-
-	if controller.keyboardEnabled {
-		outputPort |= 0x04 // Set bit 2 if keyboard is enabled
-	}
-
-	if controller.mouseEnabled {
-		outputPort |= 0x08 // Set bit 3 if mouse is enabled
-	}
-
-	return outputPort
+	return controller.outputPort
 }
 
 func (controller *Ps2Controller) WriteOutputPort(data uint8) {
-	controller.a20Enabled = (data & 0x02) != 0
-	controller.keyboardA20 = (data & 0x01) != 0
+	// writing 0 to the reset line pulses it, it reads back high once the processor restarts
+	controller.outputPort = data | OUTPUT_PORT_SYSTEM_RESET
 
-	controller.updateOutputPort()
+	a20Enabled := data&OUTPUT_PORT_A20_GATE != 0
+	if a20Enabled != controller.a20Enabled {
+		controller.a20Enabled = a20Enabled
+		controller.handleA20Change()
+	}
 
-	controller.outputPort = data
+	if data&OUTPUT_PORT_SYSTEM_RESET == 0 {
+		controller.handleSystemReset()
+	}
 }
 
 func (controller *Ps2Controller) ReadTestInputs() uint8 {
@@ -477,15 +473,7 @@ func (controller *Ps2Controller) performSelfTest() {
 }
 
 func (controller *Ps2Controller) triggerInterrupt() {
-	interruptMessage := bus.BusMessage{
-		Subject: common.MESSAGE_INTERRUPT_RAISE,
-		Sender:  controller.busId,
-		Data:    []byte{byte(1)}, // IRQ 1 for keyboard
-	}
-	err := controller.bus.SendMessageSingle(common.MODULE_INTERRUPT_CONTROLLER_1, interruptMessage)
-	if err != nil {
-		log.Printf("PS/2 Controller: Error sending interrupt request message: %v", err)
-	}
+	controller.bus.Signals().IRQ[1].Drive(true) // IRQ 1 for keyboard
 }
 
 func (controller *Ps2Controller) ResetKeyboard() {
@@ -513,11 +501,10 @@ func (controller *Ps2Controller) EnableIRQ1() {
 }
 
 func (controller *Ps2Controller) handleSystemReset() {
-	// Implement system reset logic here
 	log.Println("PS/2 Controller: System Reset requested")
-	// You might want to trigger a system-wide reset or specific PS/2 controller reset
-	controller.resetController()
+	controller.bus.Signals().Reset.Drive(true)
 }
 
 func (controller *Ps2Controller) handleA20Change() {
+	controller.bus.Signals().A20.Drive(controller.a20Enabled)
 }
@@ -0,0 +1,337 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+/*
+	Input journal
+	Records every nondeterministic input that enters the machine (keyboard bytes,
+	RTC reads and host time samples) against the machine step counter, so that a
+	recorded run can be replayed bit-for-bit.
+*/
+
+type Mode uint8
+
+const (
+	MODE_OFF Mode = iota
+	MODE_RECORD
+	MODE_REPLAY
+)
+
+type EventKind uint8
+
+const (
+	EVENT_KEYBOARD_INPUT EventKind = iota + 1
+	EVENT_RTC_READ
+	EVENT_HOST_TIME
+)
+
+// eventKinds sizes the per kind replay cursors
+const eventKinds = EVENT_HOST_TIME + 1
+
+type Event struct {
+	Step  uint64
+	Kind  EventKind
+	Value uint64
+}
+
+const journalMagic = "386J"
+const journalVersion = 1
+
+// maxJournalEvents bounds the event count a journal file can claim, so that a corrupt one is
+// rejected rather than allocated for
+const maxJournalEvents = 1 << 26
+
+type Journal struct {
+	mode   Mode
+	step   uint64
+	events []Event
+
+	// cursors are where each kind of input is up to in events. Kinds are replayed independently
+	// since a keyboard byte no live device asked for is only delivered at the end of its step.
+	cursors [eventKinds]int
+
+	lastHostTime int64
+	diverged     bool
+
+	// set while a recording journal is re-enacting steps it already recorded
+	// after being rewound to a checkpoint
+	reenacting   bool
+	reenactUntil uint64
+}
+
+// Mark is a position in the journal that can be rewound to
+type Mark struct {
+	step         uint64
+	cursors      [eventKinds]int
+	lastHostTime int64
+}
+
+func NewJournal() *Journal {
+	return &Journal{mode: MODE_OFF, events: make([]Event, 0)}
+}
+
+func NewRecorder() *Journal {
+	return &Journal{mode: MODE_RECORD, events: make([]Event, 0)}
+}
+
+// NewReplayer loads a journal previously written by Save and returns it in replay mode
+func NewReplayer(r io.Reader) (*Journal, error) {
+	events, err := readEvents(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{mode: MODE_REPLAY, events: events}, nil
+}
+
+func (j *Journal) GetMode() Mode {
+	return j.mode
+}
+
+func (j *Journal) GetStep() uint64 {
+	return j.step
+}
+
+func (j *Journal) GetEvents() []Event {
+	return j.events
+}
+
+// Diverged reports whether the replayed machine asked for an input the journal did not expect
+func (j *Journal) Diverged() bool {
+	return j.diverged
+}
+
+// Advance moves the journal onto the next machine step
+func (j *Journal) Advance() {
+	j.step++
+	if j.reenacting && j.step >= j.reenactUntil {
+		j.reenacting = false
+	}
+}
+
+// Mark returns the current position of the journal for use with Rewind
+func (j *Journal) Mark() Mark {
+	cursors := j.cursors
+	if j.mode == MODE_RECORD && !j.reenacting {
+		for kind := range cursors {
+			cursors[kind] = len(j.events)
+		}
+	}
+	return Mark{step: j.step, cursors: cursors, lastHostTime: j.lastHostTime}
+}
+
+// Rewind moves the journal back to a previous mark. A recording journal replays
+// what it has already recorded until it catches up with the furthest step reached,
+// so re-executing from a checkpoint sees exactly the same inputs as the first time.
+func (j *Journal) Rewind(mark Mark) {
+	if j.mode == MODE_RECORD && !j.reenacting {
+		// drop anything sampled by a step that never completed
+		for len(j.events) > 0 && j.events[len(j.events)-1].Step >= j.step {
+			j.events = j.events[:len(j.events)-1]
+		}
+		j.reenacting = true
+		j.reenactUntil = j.step
+	}
+
+	j.step = mark.step
+	j.cursors = mark.cursors
+	j.lastHostTime = mark.lastHostTime
+
+	if j.reenacting && j.step >= j.reenactUntil {
+		j.reenacting = false
+	}
+}
+
+// Replaying reports whether inputs come from the journal rather than the live devices, either
+// from a loaded journal or while a recording re-enacts steps after a rewind
+func (j *Journal) Replaying() bool {
+	return j.mode == MODE_REPLAY || j.reenacting
+}
+
+// next is the index of the next event of kind still to be replayed
+func (j *Journal) next(kind EventKind) (int, bool) {
+	for i := j.cursors[kind]; i < len(j.events); i++ {
+		if j.events[i].Kind == kind {
+			j.cursors[kind] = i
+			return i, true
+		}
+	}
+	j.cursors[kind] = len(j.events)
+	return 0, false
+}
+
+// Sample passes a nondeterministic input through the journal. When recording, the
+// live value is stored and returned. When replaying, the recorded value is returned instead.
+func (j *Journal) Sample(kind EventKind, live uint64) uint64 {
+	switch {
+	case j.Replaying():
+		i, ok := j.next(kind)
+		if !ok {
+			j.divergence(kind, "journal exhausted")
+			return live
+		}
+		event := j.events[i]
+		if event.Step != j.step {
+			j.divergence(kind, fmt.Sprintf("next one recorded at step %d", event.Step))
+			return live
+		}
+		j.cursors[kind] = i + 1
+		return event.Value
+	case j.mode == MODE_RECORD:
+		j.events = append(j.events, Event{Step: j.step, Kind: kind, Value: live})
+	}
+
+	return live
+}
+
+// HostTime returns the host time a device should act on. Only samples the device
+// commits with HostTimeConsumed are journaled, so a replay returns the last
+// consumed time for every step that did not consume one.
+func (j *Journal) HostTime(live int64) int64 {
+	if !j.Replaying() {
+		return live
+	}
+
+	if i, ok := j.next(EVENT_HOST_TIME); ok && j.events[i].Step == j.step {
+		j.cursors[EVENT_HOST_TIME] = i + 1
+		j.lastHostTime = int64(j.events[i].Value)
+		return j.lastHostTime
+	}
+
+	return j.lastHostTime
+}
+
+// Pending returns the values of kind recorded at the current step that no live device has
+// sampled, and consumes them. Inputs that arrive on their own, like keystrokes, are delivered from
+// these when there is no live source to ask for them.
+func (j *Journal) Pending(kind EventKind) []uint64 {
+	if !j.Replaying() {
+		return nil
+	}
+
+	var values []uint64
+	for {
+		i, ok := j.next(kind)
+		if !ok || j.events[i].Step > j.step {
+			return values
+		}
+		if j.events[i].Step < j.step {
+			j.divergence(kind, fmt.Sprintf("input recorded at step %d was never delivered", j.events[i].Step))
+		} else {
+			values = append(values, j.events[i].Value)
+		}
+		j.cursors[kind] = i + 1
+	}
+}
+
+// HostTimeConsumed marks a host time sample as having changed device state
+func (j *Journal) HostTimeConsumed(t int64) {
+	if j.mode == MODE_RECORD && !j.reenacting {
+		j.events = append(j.events, Event{Step: j.step, Kind: EVENT_HOST_TIME, Value: uint64(t)})
+	}
+	j.lastHostTime = t
+}
+
+func (j *Journal) divergence(kind EventKind, reason string) {
+	if !j.diverged {
+		log.Printf("Replay diverged at step %d on input kind %d: %s", j.step, kind, reason)
+	}
+	j.diverged = true
+}
+
+// Save writes the recorded events in the journal file format
+func (j *Journal) Save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.WriteString(journalMagic); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(journalVersion); err != nil {
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) error {
+		n := binary.PutUvarint(buf, v)
+		_, err := bw.Write(buf[:n])
+		return err
+	}
+
+	if err := writeUvarint(uint64(len(j.events))); err != nil {
+		return err
+	}
+
+	// steps are delta encoded to keep long recordings small
+	var previousStep uint64
+	for _, event := range j.events {
+		if err := writeUvarint(event.Step - previousStep); err != nil {
+			return err
+		}
+		if err := bw.WriteByte(byte(event.Kind)); err != nil {
+			return err
+		}
+		if err := writeUvarint(event.Value); err != nil {
+			return err
+		}
+		previousStep = event.Step
+	}
+
+	return bw.Flush()
+}
+
+func readEvents(r io.Reader) ([]Event, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(journalMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read journal header: %w", err)
+	}
+	if string(header[:len(journalMagic)]) != journalMagic {
+		return nil, errors.New("not an input journal")
+	}
+	if header[len(journalMagic)] != journalVersion {
+		return nil, fmt.Errorf("unsupported journal version %d", header[len(journalMagic)])
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal event count: %w", err)
+	}
+	if count > maxJournalEvents {
+		return nil, fmt.Errorf("journal claims %d events, more than the %d allowed", count, maxJournalEvents)
+	}
+
+	// the slice grows as events are actually read, a truncated file can't claim memory it doesn't hold
+	events := make([]Event, 0)
+	var step uint64
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal event %d: %w", i, err)
+		}
+		kind, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal event %d: %w", i, err)
+		}
+		if kind < byte(EVENT_KEYBOARD_INPUT) || kind > byte(EVENT_HOST_TIME) {
+			return nil, fmt.Errorf("journal event %d has unknown kind %d", i, kind)
+		}
+		value, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal event %d: %w", i, err)
+		}
+		if step+delta < step {
+			return nil, fmt.Errorf("journal event %d overflows the step counter", i)
+		}
+		step += delta
+		events = append(events, Event{Step: step, Kind: EventKind(kind), Value: value})
+	}
+
+	return events, nil
+}
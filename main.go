@@ -1,7 +1,14 @@
 package main
 
 import (
+	"flag"
+	"github.com/andrewjc/threeatesix/devices/io"
 	"github.com/andrewjc/threeatesix/pc"
+	stdio "io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
 )
 
 /*
@@ -9,11 +16,137 @@ import (
 */
 
 func main() {
+	recordFile := flag.String("record", "", "record nondeterministic inputs to this journal file")
+	replayFile := flag.String("replay", "", "replay nondeterministic inputs from this journal file")
+	symbolFile := flag.String("symbols", "", "symbol map (NASM map, addr name list or ELF) for traces and core dumps")
+	symbolBase := flag.Uint("symbols-base", 0, "linear address the symbol map is relocated to")
+	profileFolded := flag.String("profile-folded", "", "write a folded stack guest profile for flamegraph tools to this file")
+	profilePprof := flag.String("profile-pprof", "", "write a pprof guest profile to this file")
+	profileHandlers := flag.String("profile-handlers", "", "write a pprof profile of opcode handler executions and host time to this file")
+	tracePorts := flag.String("trace-ports", "", "trace IN/OUT on these ports, e.g. 0x60-0x64,0x80 or all")
+	tracePortsJson := flag.String("trace-ports-json", "", "write the port trace to this file as JSON lines instead of the log")
+	unhandledPorts := flag.String("unhandled-ports", "", "policy for ports no device handles, e.g. log,0x200-0x3ff=openbus (fatal, log or openbus)")
+	reverse := flag.Bool("reverse", false, "keep checkpoints so the monitor can reverse-step after a cpu fault")
+	machineFile := flag.String("machine", "", "machine description (YAML or JSON), e.g. machines/at386sx.yaml")
+	ramMegabytes := flag.Uint("ram", 0, "installed ram in MB, overrides the machine description")
+	var optionRoms []pc.OptionRomConfig
+	flag.Func("option-rom", "map an option rom as filename@address, e.g. bios/ide_xt.bin@0xC8000 (repeatable)", func(s string) error {
+		rom, err := pc.ParseOptionRom(s)
+		if err == nil {
+			optionRoms = append(optionRoms, rom)
+		}
+		return err
+	})
+	flag.Parse()
 
-	machine := pc.NewPc()
+	config := pc.DefaultMachineConfig()
+	if *machineFile != "" {
+		var err error
+		if config, err = pc.LoadMachineConfig(*machineFile); err != nil {
+			log.Fatalf("Failed to load machine description: %s", err)
+		}
+	}
+	if *ramMegabytes != 0 {
+		config.RAMBytes = pc.ByteSize(min(*ramMegabytes<<20, math.MaxUint32))
+	}
+	config.OptionRoms = append(config.OptionRoms, optionRoms...)
 
-	machine.LoadBios()
-	machine.Power()
+	machine, err := pc.NewPcWithConfig(config)
+	if err != nil {
+		log.Fatalf("Invalid machine configuration: %s", err)
+	}
+	if err := machine.LoadBios(); err != nil {
+		log.Fatalf("%s", err)
+	}
 
+	if *symbolFile != "" {
+		if err := machine.LoadSymbols(*symbolFile, uint32(*symbolBase)); err != nil {
+			log.Fatalf("Failed to load symbols: %s", err)
+		}
+	}
+
+	if *unhandledPorts != "" {
+		if err := machine.GetIOPortController().ConfigureUnhandledPortPolicies(*unhandledPorts); err != nil {
+			log.Fatalf("Invalid unhandled port policy: %s", err)
+		}
+	}
+
+	if *tracePorts != "" {
+		var ranges []io.PortRange
+		if *tracePorts != "all" {
+			var err error
+			if ranges, err = io.ParsePortRanges(*tracePorts); err != nil {
+				log.Fatalf("Invalid port trace ranges: %s", err)
+			}
+		}
+
+		sink := io.LogPortTraceSink
+		if *tracePortsJson != "" {
+			f, err := os.Create(*tracePortsJson)
+			if err != nil {
+				log.Fatalf("Failed to create port trace: %s", err)
+			}
+			defer f.Close()
+			sink = io.NewJsonPortTraceSink(f)
+		}
+		machine.GetIOPortController().EnablePortTrace(sink, ranges...)
+	}
+
+	if *replayFile != "" {
+		f, err := os.Open(*replayFile)
+		if err != nil {
+			log.Fatalf("Failed to open replay journal: %s", err)
+		}
+		err = machine.LoadReplay(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to load replay journal: %s", err)
+		}
+	} else if *recordFile != "" {
+		machine.StartRecording()
+	}
+
+	if *reverse {
+		machine.EnableReverseExecution()
+	}
+
+	if *profileFolded != "" || *profilePprof != "" || *profileHandlers != "" {
+		machine.EnableProfiler()
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		machine.Stop()
+	}()
+
+	if err := machine.Power(); err != nil {
+		log.Fatalf("Failed to power on: %s", err)
+	}
+
+	if *recordFile != "" && *replayFile == "" {
+		writeOutput(*recordFile, machine.SaveRecording)
+	}
+
+	cpu := machine.GetPrimaryCpu()
+	writeOutput(*profileFolded, cpu.WriteFoldedStacks)
+	writeOutput(*profilePprof, cpu.WriteGuestPprof)
+	writeOutput(*profileHandlers, cpu.WriteHandlerPprof)
 }
 
+func writeOutput(filename string, write func(w stdio.Writer) error) {
+	if filename == "" {
+		return
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %s", filename, err)
+	}
+	defer f.Close()
+
+	if err := write(f); err != nil {
+		log.Fatalf("Failed to write %s: %s", filename, err)
+	}
+}
@@ -0,0 +1,240 @@
+package pc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/devices/memmap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Machine configuration
+	Everything that differs between one virtual machine and the next is set here
+	before the machine is built. A configuration can be loaded from a YAML or JSON
+	machine description so machine profiles can be kept alongside the BIOS images.
+*/
+
+// DefaultRAMBytes - the amount of ram installed when the configuration doesn't say
+const DefaultRAMBytes = 32 << 20
+
+// MaxRAMBytes - the most ram a virtual machine can be configured with
+const MaxRAMBytes = 2 << 30
+
+// RAMGranularity - installed ram must be a multiple of this
+const RAMGranularity = 64 << 10
+
+// CPU models a machine description can ask for, 80386 being the DX
+const CPU_8086 = "8086"
+const CPU_80286 = "80286"
+const CPU_80386SX = "80386sx"
+const CPU_80386 = "80386"
+
+// Video adapters a machine description can ask for
+const VIDEO_CGA = "cga"
+
+type MachineConfig struct {
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	CPU        string            `json:"cpu,omitempty" yaml:"cpu,omitempty"`
+	Bios       string            `json:"bios,omitempty" yaml:"bios,omitempty"`
+	RAMBytes   ByteSize          `json:"ram" yaml:"ram"` // installed ram, including the 384K behind the 640K-1M hole
+	OptionRoms []OptionRomConfig `json:"option_roms" yaml:"option_roms"`
+	Video      string            `json:"video,omitempty" yaml:"video,omitempty"`
+	FPU        bool              `json:"fpu" yaml:"fpu"` // fit an 80287/80387 math coprocessor, 286 and 386 machines only
+}
+
+// OptionRomConfig is an adapter rom image and the 4K aligned address in C0000-DFFFF it is mapped at.
+// Machine descriptions write it the same way as the command line, filename@address.
+type OptionRomConfig struct {
+	Filename string
+	Address  uint32
+}
+
+// ByteSize is an amount of memory, written in a machine description as a byte count or with a K, M or G suffix
+type ByteSize uint32
+
+func DefaultMachineConfig() MachineConfig {
+	return MachineConfig{
+		CPU:        CPU_80386,
+		Bios:       BiosFilename,
+		RAMBytes:   DefaultRAMBytes,
+		OptionRoms: []OptionRomConfig{{Filename: VideoBiosFilename, Address: memmap.VIDEO_BIOS_START}},
+		Video:      VIDEO_CGA,
+		FPU:        true,
+	}
+}
+
+// LoadMachineConfig reads a machine description, as JSON if the file ends in .json and YAML otherwise.
+// Anything the description leaves out keeps its default.
+func LoadMachineConfig(filename string) (MachineConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return MachineConfig{}, err
+	}
+
+	config := DefaultMachineConfig()
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&config)
+	}
+	if err != nil {
+		return MachineConfig{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return MachineConfig{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// cpuModel is the processor model the configured cpu names
+func (config MachineConfig) cpuModel() intel8086.CpuModel {
+	switch config.CPU {
+	case CPU_8086:
+		return intel8086.CPU_MODEL_8086
+	case CPU_80286:
+		return intel8086.CPU_MODEL_80286
+	case CPU_80386SX:
+		return intel8086.CPU_MODEL_80386SX
+	}
+	return intel8086.CPU_MODEL_80386DX
+}
+
+// ParseOptionRom parses an option rom given as filename@address, e.g. bios/ide_xt.bin@0xC8000
+func ParseOptionRom(s string) (OptionRomConfig, error) {
+	filename, address, ok := strings.Cut(s, "@")
+	if !ok || filename == "" {
+		return OptionRomConfig{}, fmt.Errorf("option rom %q is not filename@address", s)
+	}
+	addr, err := strconv.ParseUint(address, 0, 32)
+	if err != nil {
+		return OptionRomConfig{}, fmt.Errorf("bad option rom address %q: %w", address, err)
+	}
+	return OptionRomConfig{Filename: filename, Address: uint32(addr)}, nil
+}
+
+func (rom OptionRomConfig) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%s@%#x", rom.Filename, rom.Address)), nil
+}
+
+func (rom *OptionRomConfig) UnmarshalText(text []byte) error {
+	parsed, err := ParseOptionRom(string(text))
+	if err != nil {
+		return err
+	}
+	*rom = parsed
+	return nil
+}
+
+// ParseByteSize parses a size such as 1048576, 640K, 4M or 1G
+func ParseByteSize(s string) (ByteSize, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(number, "K"):
+		shift = 10
+	case strings.HasSuffix(number, "M"):
+		shift = 20
+	case strings.HasSuffix(number, "G"):
+		shift = 30
+	}
+	if shift != 0 {
+		number = number[:len(number)-1]
+	}
+
+	value, err := strconv.ParseUint(number, 0, 32)
+	if err != nil || value<<shift > 0xFFFFFFFF {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return ByteSize(value << shift), nil
+}
+
+func (size ByteSize) String() string {
+	switch {
+	case size != 0 && size%(1<<20) == 0:
+		return fmt.Sprintf("%dM", size>>20)
+	case size != 0 && size%(1<<10) == 0:
+		return fmt.Sprintf("%dK", size>>10)
+	default:
+		return strconv.FormatUint(uint64(size), 10)
+	}
+}
+
+func (size ByteSize) MarshalText() ([]byte, error) {
+	return []byte(size.String()), nil
+}
+
+func (size *ByteSize) UnmarshalText(text []byte) error {
+	parsed, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*size = parsed
+	return nil
+}
+
+// UnmarshalJSON takes a size either as a JSON number or a string with a suffix
+func (size *ByteSize) UnmarshalJSON(data []byte) error {
+	if unquoted, err := strconv.Unquote(string(data)); err == nil {
+		data = []byte(unquoted)
+	}
+	return size.UnmarshalText(data)
+}
+
+func (config MachineConfig) Validate() error {
+	if config.RAMBytes < 1<<20 || config.RAMBytes > MaxRAMBytes {
+		return fmt.Errorf("ram size %d is outside 1MB-%dMB", config.RAMBytes, MaxRAMBytes>>20)
+	}
+	if config.RAMBytes%RAMGranularity != 0 {
+		return fmt.Errorf("ram size %d is not a multiple of %dK", config.RAMBytes, RAMGranularity>>10)
+	}
+
+	switch config.CPU {
+	case "", CPU_8086, CPU_80286, CPU_80386SX, CPU_80386:
+	default:
+		return fmt.Errorf("unknown cpu model %q", config.CPU)
+	}
+	if addressBits := config.cpuModel().AddressBits(); uint64(config.RAMBytes) > 1<<addressBits {
+		return fmt.Errorf("ram size %d is more than the %s can address", config.RAMBytes, config.cpuModel())
+	}
+	// the 80387 stands in for an 80287 on a 286, but nothing emulates the 8087
+	if config.FPU && config.cpuModel() == intel8086.CPU_MODEL_8086 {
+		return fmt.Errorf("the %s takes an 8087 coprocessor, which is not emulated, so fpu must be false", config.cpuModel())
+	}
+
+	for _, rom := range config.OptionRoms {
+		if err := memmap.CheckOptionRomAddress(rom.Address); err != nil {
+			return fmt.Errorf("%s: %w", rom.Filename, err)
+		}
+	}
+
+	switch config.Video {
+	case "", VIDEO_CGA:
+	default:
+		return fmt.Errorf("unknown video adapter %q", config.Video)
+	}
+	return nil
+}
+
+// biosFilename is the bios image to boot, falling back to BiosFilename when the configuration doesn't say
+func (config MachineConfig) biosFilename() string {
+	if config.Bios == "" {
+		return BiosFilename
+	}
+	return config.Bios
+}
+
+// extendedMemoryKB is the ram above 1MB as the BIOS reports it, capped at what the CMOS can hold
+func (config MachineConfig) extendedMemoryKB() uint16 {
+	return uint16(min((uint32(config.RAMBytes)-1<<20)>>10, 0xFFFF))
+}
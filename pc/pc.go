@@ -7,6 +7,7 @@ import (
 	"github.com/andrewjc/threeatesix/devices/cga"
 	"github.com/andrewjc/threeatesix/devices/cmos"
 	"github.com/andrewjc/threeatesix/devices/hid/kb"
+	"github.com/andrewjc/threeatesix/devices/intel80387"
 	"github.com/andrewjc/threeatesix/devices/intel8086"
 	"github.com/andrewjc/threeatesix/devices/intel82335"
 	"github.com/andrewjc/threeatesix/devices/intel8237"
@@ -16,20 +17,24 @@ import (
 	"github.com/andrewjc/threeatesix/devices/memmap"
 	"github.com/andrewjc/threeatesix/devices/monitor"
 	"github.com/andrewjc/threeatesix/devices/ps2"
-	"io/ioutil"
+	"github.com/andrewjc/threeatesix/devices/replay"
+	stdio "io"
 	"log"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 )
 
 type romimages struct {
 	bios []byte
-	vga  []byte
 }
 
 // PersonalComputer represents the virtual PC being emulated
 type PersonalComputer struct {
+	config MachineConfig
+
 	cpu             *intel8086.CpuCore
-	mathCoProcessor *intel8086.CpuCore
+	mathCoProcessor *intel80387.Intel80387
 
 	bus *bus.Bus
 
@@ -51,48 +56,120 @@ type PersonalComputer struct {
 	highIntegrationInterfaceDevice *intel82335.Intel82335
 	dmaController                  *intel8237.Intel8237
 	dmaController2                 *intel8237.Intel8237
+
+	journal       *replay.Journal
+	stopRequested atomic.Bool
+
+	reverseExecution bool
+	checkpoints      []*machineCheckpoint
 }
 
-// BiosFilename - name of the bios image the virtual machine will boot up
+// BiosFilename - name of the bios image the virtual machine boots when the configuration doesn't say
 const BiosFilename = "bios/ami386.bin"
 const VideoBiosFilename = "bios/vgabios.bin"
 
-// MaxRAMBytes - the amount of ram installed in this virtual machine
-const MaxRAMBytes = 0x1E84800 //32 million (32mb)
-//const MaxRAMBytes = 0xF42400 //8mb
-//const MaxRAMBytes = 0x100000000 //4GB
-
-func (pc *PersonalComputer) Power() {
+func (pc *PersonalComputer) Power() error {
 	// do stuff
 	log.SetFlags(log.Lshortfile)
 
-	pc.cpu.Init(pc.bus)
-	pc.mathCoProcessor.Init(pc.bus)
+	if err := pc.cpu.Init(pc.bus); err != nil {
+		return err
+	}
 
 	// hack a hard drive into cmos settings
 	pc.cmos.WriteAddr8(0x70, 0x12)
 	pc.cmos.WriteAddr8(0x71, 0x01)
 
+	// the instruction count the monitor last resumed at, so a breakpoint
+	// does not fire again on the instruction it stopped on
+	resumedAt := ^uint64(0)
+
 	for {
-		if pc.cpu.GetIP() == 0x0 {
-			log.Printf("Instruction pointer is 0, halting")
+		if pc.stopRequested.Load() {
+			log.Printf("Stop requested, halting")
+			break
+		}
+
+		if stopped, reason := pc.cpu.Stopped(); stopped {
+			log.Printf("CPU %s, halting", reason)
 			break
-		} //loop until instruction pointer equals 0
+		}
+
+		if !pc.reverseExecution {
+			pc.step()
+			continue
+		}
+
+		count := pc.cpu.GetInstructionCount()
+		if count != resumedAt && pc.hardwareMonitor.IsBreakpoint(pc.cpu.GetCurrentCodePointer()) {
+			if !pc.hardwareMonitor.RunConsole(os.Stdin, os.Stdout) {
+				break
+			}
+			resumedAt = pc.cpu.GetInstructionCount()
+			continue
+		}
+
+		if fault := pc.stepRecoverable(); fault != nil {
+			log.Printf("CPU fault at instruction %d: %v", count, fault)
+			if !pc.hardwareMonitor.RunConsole(os.Stdin, os.Stdout) {
+				break
+			}
+			resumedAt = pc.cpu.GetInstructionCount()
+		}
+	}
+	return nil
+}
 
-		pc.cpu.Step()
-		//pc.mathCoProcessor.Step()
-		pc.programmableIntervalTimer.Step()
+func (pc *PersonalComputer) step() {
+	if pc.reverseExecution {
+		pc.checkpointIfDue()
 	}
+
+	pc.cpu.Step()
+	pc.programmableIntervalTimer.Step()
+	pc.ps2Controller.ReplayInputData()
+	pc.journal.Advance()
+}
+
+// stepRecoverable runs a single step, returning whatever the cpu panicked with
+// instead of taking the process down
+func (pc *PersonalComputer) stepRecoverable() (fault interface{}) {
+	defer func() {
+		fault = recover()
+	}()
+
+	pc.step()
+	return nil
+}
+
+// Stop asks the power loop to halt after the current step
+func (pc *PersonalComputer) Stop() {
+	pc.stopRequested.Store(true)
 }
 
+// NewPc builds a machine with the default configuration, which can't fail short of a wiring bug, so it panics instead
 func NewPc() *PersonalComputer {
-	pc := &PersonalComputer{}
+	pc, err := NewPcWithConfig(DefaultMachineConfig())
+	if err != nil {
+		panic(fmt.Sprintf("failed to build machine: %s", err))
+	}
+	return pc
+}
+
+func NewPcWithConfig(config MachineConfig) (*PersonalComputer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	pc := &PersonalComputer{config: config}
 
 	pc.bus = bus.NewDeviceBus()
-	pc.ram = make([]byte, MaxRAMBytes)
+	pc.ram = make([]byte, config.RAMBytes)
 	pc.rom = romimages{}
-	pc.cpu = intel8086.New80386CPU()
-	pc.mathCoProcessor = intel8086.New80287MathCoProcessor()
+	pc.cpu = intel8086.NewCPU(config.cpuModel())
+	if config.FPU {
+		pc.mathCoProcessor = intel80387.NewIntel80387()
+	}
 
 	pc.programmableInterruptController1 = intel8259a.NewIntel8259a() //pic1
 	pc.programmableInterruptController2 = intel8259a.NewIntel8259a() //pic2
@@ -108,46 +185,121 @@ func NewPc() *PersonalComputer {
 
 	pc.cgaController = cga.NewMotorola6845()
 	pc.cmos = cmos.NewMotorola146818()
+	pc.cmos.SetMemorySize(memmap.BASE_MEMORY_END>>10, config.extendedMemoryKB())
 
-	pc.memController = memmap.NewMemoryController(&pc.ram, &pc.rom.bios, &pc.rom.vga)
+	var err error
+	if pc.memController, err = memmap.NewMemoryController(&pc.ram, &pc.rom.bios); err != nil {
+		return nil, err
+	}
 
 	pc.ioPortController = io.NewIOPortController()
 
-	pc.memController.SetBus(pc.bus)
-	pc.ioPortController.SetBus(pc.bus)
-
 	pc.ps2Controller = ps2.CreatePS2Controller()
-	pc.ps2Controller.SetBus(pc.bus)
 
 	pc.hardwareMonitor = monitor.NewHardwareMonitor()
 
-	pc.bus.RegisterDevice(pc.hardwareMonitor, common.MODULE_DEBUG_MONITOR)
+	devices := []struct {
+		device     bus.BusDevice
+		deviceType bus.DeviceType
+	}{
+		{pc.hardwareMonitor, common.MODULE_DEBUG_MONITOR},
+
+		{pc.cpu, common.MODULE_PRIMARY_PROCESSOR},
+		{pc.programmableInterruptController1, common.MODULE_INTERRUPT_CONTROLLER_1},
+		{pc.programmableInterruptController2, common.MODULE_INTERRUPT_CONTROLLER_2},
+		{pc.programmableIntervalTimer, common.MODULE_PIT},
+		{pc.highIntegrationInterfaceDevice, common.MODULE_INTEL_82335},
+		{pc.cgaController, common.MODULE_CGA},
+		{pc.cmos, common.MODULE_CMOS},
+		{pc.dmaController, common.MODULE_DMA_CONTROLLER},
+		{pc.dmaController2, common.MODULE_DMA_CONTROLLER_2},
+
+		{pc.memController, common.MODULE_MEMORY_ACCESS_CONTROLLER},
+		{pc.ioPortController, common.MODULE_IO_PORT_ACCESS_CONTROLLER},
+
+		{pc.ps2Controller, common.MODULE_PS2_CONTROLLER},
+	}
+	for _, d := range devices {
+		if err := pc.bus.RegisterDevice(d.device, d.deviceType); err != nil {
+			return nil, fmt.Errorf("failed to register device: %w", err)
+		}
+	}
+	if pc.mathCoProcessor != nil {
+		if err := pc.bus.RegisterDevice(pc.mathCoProcessor, common.MODULE_MATH_CO_PROCESSOR); err != nil {
+			return nil, fmt.Errorf("failed to register device: %w", err)
+		}
+	}
 
-	pc.bus.RegisterDevice(pc.cpu, common.MODULE_PRIMARY_PROCESSOR)
-	pc.bus.RegisterDevice(pc.mathCoProcessor, common.MODULE_MATH_CO_PROCESSOR)
-	pc.bus.RegisterDevice(pc.programmableInterruptController1, common.MODULE_INTERRUPT_CONTROLLER_1)
-	pc.bus.RegisterDevice(pc.programmableInterruptController2, common.MODULE_INTERRUPT_CONTROLLER_2)
-	pc.bus.RegisterDevice(pc.programmableIntervalTimer, common.MODULE_PIT)
-	pc.bus.RegisterDevice(pc.highIntegrationInterfaceDevice, common.MODULE_INTEL_82335)
-	pc.bus.RegisterDevice(pc.cgaController, common.MODULE_CGA)
-	pc.bus.RegisterDevice(pc.cmos, common.MODULE_CMOS)
-	pc.bus.RegisterDevice(pc.dmaController, common.MODULE_DMA_CONTROLLER)
-	pc.bus.RegisterDevice(pc.dmaController2, common.MODULE_DMA_CONTROLLER_2)
+	pc.ps2Controller.ConnectDevice(kb.NewPs2Keyboard())
 
-	pc.bus.RegisterDevice(pc.memController, common.MODULE_MEMORY_ACCESS_CONTROLLER)
-	pc.bus.RegisterDevice(pc.ioPortController, common.MODULE_IO_PORT_ACCESS_CONTROLLER)
+	pc.setJournal(replay.NewJournal())
 
-	pc.bus.RegisterDevice(pc.ps2Controller, common.MODULE_PS2_CONTROLLER)
+	return pc, nil
+}
 
-	pc.ps2Controller.ConnectDevice(kb.NewPs2Keyboard())
+func (pc *PersonalComputer) GetConfig() MachineConfig {
+	return pc.config
+}
 
-	return pc
+func (pc *PersonalComputer) setJournal(journal *replay.Journal) {
+	// checkpoints hold a position in the old journal and cannot be rewound into a new one
+	pc.checkpoints = nil
+
+	pc.journal = journal
+	pc.programmableIntervalTimer.SetJournal(journal)
+	pc.ps2Controller.SetJournal(journal)
+	pc.cmos.SetJournal(journal)
+}
+
+// StartRecording journals every nondeterministic input from this point on
+func (pc *PersonalComputer) StartRecording() {
+	pc.setJournal(replay.NewRecorder())
+}
+
+// SaveRecording writes the inputs journaled since StartRecording
+func (pc *PersonalComputer) SaveRecording(w stdio.Writer) error {
+	return pc.journal.Save(w)
+}
+
+// LoadReplay feeds a previously saved journal back into the machine instead of live inputs
+func (pc *PersonalComputer) LoadReplay(r stdio.Reader) error {
+	journal, err := replay.NewReplayer(r)
+	if err != nil {
+		return err
+	}
+	pc.setJournal(journal)
+	return nil
+}
+
+func (pc *PersonalComputer) GetJournal() *replay.Journal {
+	return pc.journal
+}
+
+// LoadSymbols loads a symbol map (NASM map, "addr name" list or ELF binary) used to
+// render addresses as function+offset in traces and core dumps. base is added to every
+// symbol, e.g. 0xF0000 for a map of a BIOS assembled at offset 0.
+func (pc *PersonalComputer) LoadSymbols(filename string, base uint32) error {
+	return pc.hardwareMonitor.LoadSymbols(filename, base)
+}
+
+// EnableProfiler counts executions per opcode, address, call stack and far call target
+func (pc *PersonalComputer) EnableProfiler() *intel8086.Profiler {
+	return pc.cpu.EnableProfiler()
 }
 
 func (pc *PersonalComputer) GetPrimaryCpu() *intel8086.CpuCore {
 	return pc.cpu
 }
 
+// GetMathCoProcessor returns the 80387, or nil if the machine was built without a coprocessor
+func (pc *PersonalComputer) GetMathCoProcessor() *intel80387.Intel80387 {
+	return pc.mathCoProcessor
+}
+
+func (pc *PersonalComputer) GetIOPortController() *io.IOPortAccessController {
+	return pc.ioPortController
+}
+
 func (pc *PersonalComputer) GetMemoryController() *memmap.MemoryAccessController {
 	return pc.memController
 }
@@ -156,21 +308,43 @@ func (pc *PersonalComputer) GetBus() *bus.Bus {
 	return pc.bus
 }
 
-func (pc *PersonalComputer) LoadBios() {
-
-	biosData, err := ioutil.ReadFile(BiosFilename)
+// LoadBios loads the bios image and option roms the machine configuration names
+func (pc *PersonalComputer) LoadBios() error {
+	biosData, err := os.ReadFile(pc.config.biosFilename())
 	if err != nil {
-		fmt.Printf("Failed to load BIOS: %s\n", err)
-		os.Exit(1) // Consider handling this more softly, perhaps returning an error
+		return fmt.Errorf("failed to load BIOS: %w", err)
+	}
+	if err := pc.LoadBiosImage(biosData); err != nil {
+		return fmt.Errorf("failed to load BIOS %s: %w", pc.config.biosFilename(), err)
 	}
 
-	pc.rom.bios = biosData
+	for _, rom := range pc.config.OptionRoms {
+		if err := pc.LoadOptionRom(rom.Filename, rom.Address); err != nil {
+			return fmt.Errorf("failed to load option ROM: %w", err)
+		}
+	}
+	return nil
+}
 
-	videoBiosData, err := ioutil.ReadFile(VideoBiosFilename)
+// LoadBiosImage validates a bios image and maps it at the top of the first megabyte
+func (pc *PersonalComputer) LoadBiosImage(image []byte) error {
+	if err := memmap.ValidateBiosRom(image); err != nil {
+		return err
+	}
+	pc.rom.bios = image
+	return pc.memController.MapBiosRom()
+}
+
+// LoadOptionRom maps an option rom image at address for the BIOS to find during POST
+func (pc *PersonalComputer) LoadOptionRom(filename string, address uint32) error {
+	image, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Printf("Failed to load Video BIOS: %s\n", err)
-		os.Exit(1) // Consider handling this more softly, perhaps returning an error
+		return err
 	}
+	return pc.LoadOptionRomImage(filepath.Base(filename), address, image)
+}
 
-	pc.rom.vga = videoBiosData
+// LoadOptionRomImage maps an option rom image held in memory at address
+func (pc *PersonalComputer) LoadOptionRomImage(name string, address uint32, image []byte) error {
+	return pc.memController.MapOptionRom(name, address, image)
 }
@@ -0,0 +1,201 @@
+package pc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/replay"
+)
+
+/*
+	Reverse execution
+	Checkpoints of the whole machine are taken every CheckpointInterval
+	instructions. Going backwards restores the nearest earlier checkpoint and
+	re-executes forward to the target instruction, with the input journal
+	re-enacting whatever it recorded so the second run is identical to the first.
+*/
+
+// CheckpointInterval - number of instructions between machine checkpoints
+const CheckpointInterval = 100000
+
+// MaxCheckpoints - number of checkpoints kept before the oldest is discarded
+const MaxCheckpoints = 64
+
+const checkpointPageSize = 0x1000
+
+type machineCheckpoint struct {
+	instructionCount uint64
+	journal          replay.Mark
+	devices          []interface{}
+
+	// ram is stored per page, with unchanged pages shared with the previous checkpoint
+	ramPages [][]byte
+}
+
+// EnableReverseExecution starts taking checkpoints so the monitor can step backwards
+func (pc *PersonalComputer) EnableReverseExecution() {
+	if pc.journal.GetMode() == replay.MODE_OFF {
+		// re-execution is only deterministic if the inputs are journaled
+		pc.setJournal(replay.NewRecorder())
+	}
+	pc.reverseExecution = true
+	pc.checkpoints = nil
+	pc.hardwareMonitor.AttachDebugTarget(pc)
+}
+
+func (pc *PersonalComputer) checkpointedDevices() []bus.Checkpointable {
+	devices := []bus.Checkpointable{
+		pc.cpu,
+		pc.programmableInterruptController1,
+		pc.programmableInterruptController2,
+		pc.programmableIntervalTimer,
+		pc.highIntegrationInterfaceDevice,
+		pc.dmaController,
+		pc.dmaController2,
+		pc.cgaController,
+		pc.cmos,
+		pc.memController,
+		pc.ps2Controller,
+	}
+	if pc.mathCoProcessor != nil {
+		devices = append(devices, pc.mathCoProcessor)
+	}
+	return devices
+}
+
+func (pc *PersonalComputer) checkpointIfDue() {
+	count := pc.cpu.GetInstructionCount()
+	if len(pc.checkpoints) > 0 && count < pc.checkpoints[len(pc.checkpoints)-1].instructionCount+CheckpointInterval {
+		return
+	}
+
+	checkpoint := &machineCheckpoint{
+		instructionCount: count,
+		journal:          pc.journal.Mark(),
+	}
+
+	for _, device := range pc.checkpointedDevices() {
+		checkpoint.devices = append(checkpoint.devices, device.SaveState())
+	}
+
+	var previousPages [][]byte
+	if len(pc.checkpoints) > 0 {
+		previousPages = pc.checkpoints[len(pc.checkpoints)-1].ramPages
+	}
+	for i, offset := 0, 0; offset < len(pc.ram); i, offset = i+1, offset+checkpointPageSize {
+		page := pc.ram[offset:min(offset+checkpointPageSize, len(pc.ram))]
+		if i < len(previousPages) && bytes.Equal(previousPages[i], page) {
+			checkpoint.ramPages = append(checkpoint.ramPages, previousPages[i])
+		} else {
+			checkpoint.ramPages = append(checkpoint.ramPages, bytes.Clone(page))
+		}
+	}
+
+	pc.checkpoints = append(pc.checkpoints, checkpoint)
+	if len(pc.checkpoints) > MaxCheckpoints {
+		pc.checkpoints = pc.checkpoints[1:]
+	}
+}
+
+func (pc *PersonalComputer) restoreCheckpoint(checkpoint *machineCheckpoint) {
+	for i, device := range pc.checkpointedDevices() {
+		device.RestoreState(checkpoint.devices[i])
+	}
+
+	for i, page := range checkpoint.ramPages {
+		copy(pc.ram[i*checkpointPageSize:], page)
+	}
+
+	pc.journal.Rewind(checkpoint.journal)
+}
+
+// seek restores the machine to the state it was in after target instructions
+func (pc *PersonalComputer) seek(target uint64) error {
+	var nearest *machineCheckpoint
+	for _, checkpoint := range pc.checkpoints {
+		if checkpoint.instructionCount <= target {
+			nearest = checkpoint
+		}
+	}
+	if nearest == nil {
+		return fmt.Errorf("instruction %d is before the oldest checkpoint", target)
+	}
+
+	pc.restoreCheckpoint(nearest)
+	for pc.cpu.GetInstructionCount() < target {
+		pc.step()
+	}
+
+	return nil
+}
+
+func (pc *PersonalComputer) GetInstructionCount() uint64 {
+	return pc.cpu.GetInstructionCount()
+}
+
+func (pc *PersonalComputer) GetCodePointer() uint32 {
+	return pc.cpu.GetCurrentCodePointer()
+}
+
+// StepForward executes count instructions, stopping early if the cpu faults
+func (pc *PersonalComputer) StepForward(count uint64) error {
+	for i := uint64(0); i < count; i++ {
+		if fault := pc.stepRecoverable(); fault != nil {
+			return fmt.Errorf("cpu fault: %v", fault)
+		}
+	}
+	return nil
+}
+
+// ReverseStep moves the machine back by count instructions
+func (pc *PersonalComputer) ReverseStep(count uint64) error {
+	if !pc.reverseExecution {
+		return errors.New("reverse execution is not enabled")
+	}
+
+	current := pc.cpu.GetInstructionCount()
+	if count > current {
+		count = current
+	}
+	return pc.seek(current - count)
+}
+
+// ReverseContinue moves the machine back to the most recent instruction whose
+// address satisfies isBreakpoint, or to the oldest checkpoint if there is none
+func (pc *PersonalComputer) ReverseContinue(isBreakpoint func(addr uint32) bool) (bool, error) {
+	if !pc.reverseExecution {
+		return false, errors.New("reverse execution is not enabled")
+	}
+	if len(pc.checkpoints) == 0 {
+		return false, errors.New("no checkpoints have been taken")
+	}
+
+	current := pc.cpu.GetInstructionCount()
+	end := current
+
+	// search each checkpoint window, newest first, for the last breakpoint hit
+	for i := len(pc.checkpoints) - 1; i >= 0; i-- {
+		checkpoint := pc.checkpoints[i]
+		if checkpoint.instructionCount >= end {
+			continue
+		}
+
+		pc.restoreCheckpoint(checkpoint)
+
+		hit, found := uint64(0), false
+		for pc.cpu.GetInstructionCount() < end {
+			if isBreakpoint(pc.cpu.GetCurrentCodePointer()) {
+				hit, found = pc.cpu.GetInstructionCount(), true
+			}
+			pc.step()
+		}
+
+		if found {
+			return true, pc.seek(hit)
+		}
+		end = checkpoint.instructionCount
+	}
+
+	return false, pc.seek(pc.checkpoints[0].instructionCount)
+}
@@ -0,0 +1,85 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_A20DisabledWrapsAtOneMegabyte(t *testing.T) {
+	testPc := setupRegisterPc(t)
+	mem := testPc.GetMemoryController()
+	core := testPc.GetPrimaryCpu()
+
+	assert.False(t, mem.IsA20Enabled())
+	assert.NoError(t, mem.WriteMemoryAddr8(0x10, 0x5A))
+
+	// FFFF:0020 is linear 0x100010, which wraps to 0x10
+	address := core.SegmentAddressToLinearAddress(intel8086.RealModeSegment(0xFFFF), 0x20)
+	assert.Equal(t, uint32(0x100010), address)
+	value, err := mem.ReadMemoryValue8(address)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x5A), value)
+
+	// a word at the top of the first megabyte wraps too
+	assert.NoError(t, mem.WriteMemoryAddr16(0xFFFFF, 0x1234))
+	b, err := mem.ReadMemoryValue8(0x0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x12), b)
+}
+
+func Test_A20EnabledByKeyboardController(t *testing.T) {
+	testPc := setupRegisterPc(t)
+	mem := testPc.GetMemoryController()
+	ports := testPc.GetIOPortController()
+
+	// write output port with A20 set and the reset line held high
+	ports.WriteAddr8(0x64, 0xD1)
+	ports.WriteAddr8(0x60, 0x03)
+	assert.True(t, mem.IsA20Enabled())
+
+	assert.NoError(t, mem.WriteMemoryAddr8(0x10, 0x11))
+	assert.NoError(t, mem.WriteMemoryAddr8(0x100010, 0x22))
+	low, _ := mem.ReadMemoryValue8(0x10)
+	high, _ := mem.ReadMemoryValue8(0x100010)
+	assert.Equal(t, uint8(0x11), low)
+	assert.Equal(t, uint8(0x22), high)
+
+	ports.WriteAddr8(0x64, 0xD0)
+	assert.Equal(t, uint8(0x03), ports.ReadAddr8(0x60))
+
+	ports.WriteAddr8(0x64, 0xDD)
+	assert.False(t, mem.IsA20Enabled())
+	high, _ = mem.ReadMemoryValue8(0x100010)
+	assert.Equal(t, uint8(0x11), high)
+}
+
+func Test_A20EnabledBySystemControlPortA(t *testing.T) {
+	testPc := setupRegisterPc(t)
+	mem := testPc.GetMemoryController()
+	ports := testPc.GetIOPortController()
+
+	ports.WriteAddr8(0x92, 0x02)
+	assert.True(t, mem.IsA20Enabled())
+	assert.Equal(t, uint8(0x02), ports.ReadAddr8(0x92))
+
+	// port 0x61 is the speaker and timer gate, it doesn't touch A20
+	ports.WriteAddr8(0x61, 0x00)
+	assert.True(t, mem.IsA20Enabled())
+
+	ports.WriteAddr8(0x92, 0x00)
+	assert.False(t, mem.IsA20Enabled())
+}
+
+func Test_KeyboardControllerPulsesReset(t *testing.T) {
+	testPc := setupRegisterPc(t)
+	core := testPc.GetPrimaryCpu()
+	ports := testPc.GetIOPortController()
+
+	core.SetCS(0x1000)
+	core.SetIP(0x0100)
+	ports.WriteAddr8(0x64, 0xFE)
+
+	assert.Equal(t, uint16(0xF000), core.GetRegisters().CS.Selector)
+	assert.Equal(t, uint16(0xFFF0), *core.GetRegisters().IP())
+}
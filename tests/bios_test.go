@@ -0,0 +1,98 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/common"
+	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/devices/memmap"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// buildBiosImage returns a blank bios image of size bytes with a far jump at the reset vector
+func buildBiosImage(size int) []uint8 {
+	image := make([]uint8, size)
+	image[size-memmap.BIOS_RESET_VECTOR_OFFSET] = 0xEA
+	return image
+}
+
+func Test_ValidateBiosRom(t *testing.T) {
+	assert.NoError(t, memmap.ValidateBiosRom(buildBiosImage(0x2000)))
+	assert.NoError(t, memmap.ValidateBiosRom(buildBiosImage(0x20000)))
+
+	assert.Error(t, memmap.ValidateBiosRom(buildBiosImage(0x1000)))
+	assert.Error(t, memmap.ValidateBiosRom(buildBiosImage(0x40000)))
+	assert.Error(t, memmap.ValidateBiosRom(buildBiosImage(0x3000)))
+	assert.Error(t, memmap.ValidateBiosRom(make([]uint8, 0x10000)))
+}
+
+func Test_SmallBiosImageIsMirrored(t *testing.T) {
+	ram := make([]uint8, 1<<20)
+	bios := buildBiosImage(0x2000)
+	mem, err := memmap.NewMemoryController(&ram, &bios)
+	assert.NoError(t, err)
+
+	for _, addr := range []uint32{0xF1FF0, 0xFDFF0, 0xFFFF0} {
+		value, err := mem.ReadMemoryValue8(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, uint8(0xEA), value)
+	}
+}
+
+func Test_LoadBiosImage(t *testing.T) {
+	testPc := pc.NewPc()
+	mem := testPc.GetMemoryController()
+
+	assert.Error(t, testPc.LoadBiosImage(make([]uint8, 0x10000)))
+
+	// a 128K image reaches down to E0000 with its reset vector still at FFFF0
+	image := buildBiosImage(0x20000)
+	image[0] = 0x12
+	assert.NoError(t, testPc.LoadBiosImage(image))
+	value, _ := mem.ReadMemoryValue8(0xE0000)
+	assert.Equal(t, uint8(0x12), value)
+	value, _ = mem.ReadMemoryValue8(0xFFFF0)
+	assert.Equal(t, uint8(0xEA), value)
+
+	// replacing it with a 64K image gives E0000 back to the ISA bus
+	assert.NoError(t, testPc.LoadBiosImage(buildBiosImage(0x10000)))
+	region, _ := mem.GetRegion(0xE0000)
+	assert.Equal(t, "isa bus", region.Name)
+	region, _ = mem.GetRegion(0xF0000)
+	assert.Equal(t, "bios rom", region.Name)
+}
+
+func Test_LoadBiosReturnsErrors(t *testing.T) {
+	config := pc.DefaultMachineConfig()
+	config.Bios = "missing.bin"
+	testPc, err := pc.NewPcWithConfig(config)
+	assert.NoError(t, err)
+	assert.Error(t, testPc.LoadBios())
+
+	config.Bios = "../bios/vgabios.bin"
+	testPc, err = pc.NewPcWithConfig(config)
+	assert.NoError(t, err)
+	assert.Error(t, testPc.LoadBios())
+
+	config.Bios = "../bios/ami386.bin"
+	config.OptionRoms = []pc.OptionRomConfig{{Filename: "../bios/pcxtbios.bin", Address: 0xC8000}}
+	testPc, err = pc.NewPcWithConfig(config)
+	assert.NoError(t, err)
+	assert.Error(t, testPc.LoadBios())
+
+	config.OptionRoms = []pc.OptionRomConfig{{Filename: "../bios/vgabios.bin", Address: 0xC0000}}
+	testPc, err = pc.NewPcWithConfig(config)
+	assert.NoError(t, err)
+	assert.NoError(t, testPc.LoadBios())
+}
+
+func Test_MissingDeviceIsAnError(t *testing.T) {
+	deviceBus := bus.NewDeviceBus()
+
+	_, err := deviceBus.FindSingleDevice(common.MODULE_MEMORY_ACCESS_CONTROLLER)
+	assert.ErrorIs(t, err, bus.DeviceNotFoundError{DeviceType: common.MODULE_MEMORY_ACCESS_CONTROLLER})
+	assert.Error(t, deviceBus.SendMessageToAll(common.MODULE_CMOS, bus.BusMessage{}))
+
+	assert.Error(t, intel8086.New80386CPU().Init(deviceBus))
+}
@@ -23,11 +23,8 @@ func TestINSTR_JMP_NEAR_REL16(t *testing.T) {
 	core, mem := setupCpuCore()
 
 	// Set initial IP value
-	core.GetRegisters().IP = 0x1000
-	core.GetRegisters().CS = intel8086.SegmentRegister{
-		Base:  0x1000,
-		Limit: 0x1000,
-	}
+	*core.GetRegisters().IP() = 0x1000
+	core.GetRegisters().CS = intel8086.RealModeSegment(0x1000)
 
 	// Set the instruction
 	mem.WriteMemoryAddr8(core.GetCurrentCodePointer(), 0xE9)
@@ -37,7 +34,7 @@ func TestINSTR_JMP_NEAR_REL16(t *testing.T) {
 	intel8086.INSTR_JMP_NEAR_REL16(core)
 
 	// Assert the expected results
-	assert.Equal(t, uint16(0x1008), core.GetRegisters().IP)
-	assert.Equal(t, uint32(0x1000), core.GetRegisters().CS.Base)
+	assert.Equal(t, uint16(0x1008), *core.GetRegisters().IP())
+	assert.Equal(t, uint16(0x1000), core.GetRegisters().CS.Selector)
 
 }
@@ -0,0 +1,38 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_BacktraceInsideAnInterruptHandler(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xE8, 0xFD, 0x00, // call 0x200
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.ESP() = 0x100
+
+	// 0x200: int 0x21, and its handler at 1000:0300: nop, iret
+	memory.WriteMemoryAddr8(0x10200, 0xCD)
+	memory.WriteMemoryAddr8(0x10201, 0x21)
+	memory.WriteMemoryAddr8(0x10300, 0x90)
+	memory.WriteMemoryAddr8(0x10301, 0xCF)
+	memory.WriteMemoryAddr16(0x21*4, 0x300)
+	memory.WriteMemoryAddr16(0x21*4+2, 0x1000)
+
+	core.Step()
+	core.Step()
+	core.Step()
+	assert.Equal(t, []string{
+		"0x10300 (interrupt, returns to 0x10202)",
+		"0x10200 (called from 0x10100)",
+	}, core.Backtrace())
+
+	core.Step()
+	assert.Equal(t, uint16(0x202), *registers.IP())
+	assert.Equal(t, []string{"0x10200 (called from 0x10100)"}, core.Backtrace(), "IRET pops the interrupt frame")
+}
@@ -0,0 +1,73 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_MachineProfilesLoad(t *testing.T) {
+	profiles, _ := filepath.Glob("../machines/*")
+	assert.NotEmpty(t, profiles)
+
+	for _, profile := range profiles {
+		config, err := pc.LoadMachineConfig(profile)
+		assert.NoError(t, err, profile)
+		_, err = pc.NewPcWithConfig(config)
+		assert.NoError(t, err, profile)
+	}
+
+	config, err := pc.LoadMachineConfig("../machines/xt.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "bios/pcxtbios.bin", config.Bios)
+	assert.Equal(t, pc.ByteSize(1<<20), config.RAMBytes)
+	assert.Equal(t, []pc.OptionRomConfig{{Filename: "bios/ide_xt.bin", Address: 0xC8000}}, config.OptionRoms)
+	assert.Equal(t, pc.CPU_8086, config.CPU)
+	assert.False(t, config.FPU)
+
+	config, err = pc.LoadMachineConfig("../machines/at386dx.json")
+	assert.NoError(t, err)
+	assert.Equal(t, pc.ByteSize(32<<20), config.RAMBytes)
+	assert.True(t, config.FPU)
+}
+
+func Test_MachineConfigDefaults(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "small.yaml")
+	assert.NoError(t, os.WriteFile(filename, []byte("ram: 2048K\n"), 0o644))
+
+	config, err := pc.LoadMachineConfig(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, pc.ByteSize(2<<20), config.RAMBytes)
+	assert.Equal(t, pc.BiosFilename, config.Bios)
+	assert.Equal(t, pc.DefaultMachineConfig().OptionRoms, config.OptionRoms)
+
+	filename = filepath.Join(t.TempDir(), "bytes.json")
+	assert.NoError(t, os.WriteFile(filename, []byte(`{"ram": 4194304, "option_roms": []}`), 0o644))
+	config, err = pc.LoadMachineConfig(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, pc.ByteSize(4<<20), config.RAMBytes)
+	assert.Empty(t, config.OptionRoms)
+}
+
+func Test_InvalidMachineConfig(t *testing.T) {
+	for name, description := range map[string]string{
+		"unknown field":  "ram: 4M\nsound: adlib\n",
+		"bad ram":        "ram: lots\n",
+		"bad cpu":        "cpu: z80\n",
+		"ram past cpu":   "cpu: \"80286\"\nram: 32M\n",
+		"bad video":      "video: hercules\n",
+		"bad rom":        "option_roms: [bios/vgabios.bin]\n",
+		"2K aligned rom": "option_roms: [bios/ide_xt.bin@0xC8800]\n",
+		"8087":           "cpu: \"8086\"\nram: 1M\n",
+		"floppy":         "floppies: [{image: bios/bios.bin}]\n",
+		"hard disk":      "disks: [{image: bios/bios.bin}]\n",
+		"serial port":    "serial: [{port: COM1, backend: stdio}]\n",
+	} {
+		filename := filepath.Join(t.TempDir(), "machine.yaml")
+		assert.NoError(t, os.WriteFile(filename, []byte(description), 0o644))
+		_, err := pc.LoadMachineConfig(filename)
+		assert.Error(t, err, name)
+	}
+}
@@ -17,7 +17,7 @@ func Test_INSTR_JCXZ_SHORT_REL8(t *testing.T) {
 		name        string
 		instruction []uint8
 		cxValue     uint16
-		expectedIP  uint16
+		expectedIP  uint32
 	}{
 		// TODO: Add test cases.
 
@@ -35,10 +35,10 @@ func Test_INSTR_JCXZ_SHORT_REL8(t *testing.T) {
 			testPc.GetPrimaryCpu().SetIP(0x100)
 
 			for x := 0; x < len(tt.instruction); x++ {
-				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), tt.instruction[x])
+				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), tt.instruction[x])
 			}
 
-			testPc.GetPrimaryCpu().GetRegisters().CX = tt.cxValue
+			*testPc.GetPrimaryCpu().GetRegisters().CX() = tt.cxValue
 
 			testPc.GetPrimaryCpu().Step()
 
@@ -55,7 +55,7 @@ func Test_INSTR_JZ_SHORT_REL8(t *testing.T) {
 		name        string
 		instruction []uint8
 		zeroFlag    bool
-		expectedIP  uint16
+		expectedIP  uint32
 	}{
 		// TODO: Add test cases.
 		{"TestJZ_SHORT_REL8_ZeroFlag", []uint8{0x74, 0xee}, true, 0x00f0},
@@ -72,7 +72,7 @@ func Test_INSTR_JZ_SHORT_REL8(t *testing.T) {
 			testPc.GetPrimaryCpu().SetIP(0x100)
 
 			for x := 0; x < len(tt.instruction); x++ {
-				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), tt.instruction[x])
+				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), tt.instruction[x])
 			}
 
 			testPc.GetPrimaryCpu().SetFlag(intel8086.ZeroFlag, tt.zeroFlag)
@@ -107,10 +107,10 @@ func Test_LOD_INSTRUCTIONS(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			testPc.GetPrimaryCpu().SetCS(0x0)
 			testPc.GetPrimaryCpu().SetIP(0x100)
-			testPc.GetPrimaryCpu().GetRegisters().CX = tt.cxValue
+			*testPc.GetPrimaryCpu().GetRegisters().CX() = tt.cxValue
 
 			for x := 0; x < len(tt.instruction); x++ {
-				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), tt.instruction[x])
+				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), tt.instruction[x])
 			}
 
 			testPc.GetPrimaryCpu().Step()
@@ -142,7 +142,7 @@ func Test_BufferInitTest_INSTRUCTIONS(t *testing.T) {
 			testPc.GetPrimaryCpu().SetIP(0x100)
 
 			for x := 0; x < len(tt.instruction); x++ {
-				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), tt.instruction[x])
+				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), tt.instruction[x])
 			}
 
 			testPc.GetPrimaryCpu().Step()
@@ -168,11 +168,11 @@ func Test_INSTR_JMP_CALL_CLI_STC(t *testing.T) {
 			[]uint8{0xE8, 0x08, 0x00}, // CALL 0008 (Relative call)
 			func(pc *pc.PersonalComputer) {
 				pc.GetPrimaryCpu().SetIP(0x2000)
-				pc.GetPrimaryCpu().GetRegisters().SP = 0xFFFE
+				*pc.GetPrimaryCpu().GetRegisters().SP() = 0xFFFE
 			},
 			func(pc *pc.PersonalComputer) error {
-				if pc.GetPrimaryCpu().GetIP() != 0x200B || pc.GetPrimaryCpu().GetRegisters().SP != 0xFFFC {
-					return fmt.Errorf("CALL NEAR REL16 failed: expected IP=0x200B and SP=0xFFFC, got IP=0x%04X and SP=0x%04X", pc.GetPrimaryCpu().GetIP(), pc.GetPrimaryCpu().GetRegisters().SP)
+				if pc.GetPrimaryCpu().GetIP() != 0x200B || *pc.GetPrimaryCpu().GetRegisters().SP() != 0xFFFC {
+					return fmt.Errorf("CALL NEAR REL16 failed: expected IP=0x200B and SP=0xFFFC, got IP=0x%04X and SP=0x%04X", pc.GetPrimaryCpu().GetIP(), *pc.GetPrimaryCpu().GetRegisters().SP())
 				}
 				return nil
 			},
@@ -189,7 +189,7 @@ func Test_INSTR_JMP_CALL_CLI_STC(t *testing.T) {
 			testPc.GetPrimaryCpu().SetCS(0x0)
 
 			for i, instr := range tt.instructions {
-				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(i)), instr)
+				testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(i)), instr)
 			}
 
 			testPc.GetPrimaryCpu().Step()
@@ -206,7 +206,7 @@ func Test_INSTR_JMP_FAR_m16(t *testing.T) {
 		name       string
 		setupFunc  func(*pc.PersonalComputer)
 		expectedCS uint32
-		expectedIP uint16
+		expectedIP uint32
 	}{
 		{
 			name: "Test_JMP_FAR_m16_SimpleJump",
@@ -0,0 +1,110 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// setupDebugPc builds on setupRegisterPc with the interrupt 1 handler at 1000:0300, the stack at
+// 3000:0100 and DS at 0x2000
+func setupDebugPc(t *testing.T, handler []uint8, code ...uint8) *pc.PersonalComputer {
+	testPc := setupRegisterPc(t, code...)
+	registers := testPc.GetPrimaryCpu().GetRegisters()
+	memory := testPc.GetMemoryController()
+	for i, b := range handler {
+		memory.WriteMemoryAddr8(0x10300+uint32(i), b)
+	}
+	memory.WriteMemoryAddr16(0x4, 0x300)
+	memory.WriteMemoryAddr16(0x6, 0x1000)
+
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	registers.DS = intel8086.RealModeSegment(0x2000)
+	*registers.ESP() = 0x100
+	return testPc
+}
+
+func Test_TrapFlagSingleStepsThroughInt1(t *testing.T) {
+	testPc := setupDebugPc(t, []uint8{0xCF}, // iret
+		0xB8, 0x01, 0x00, // mov ax, 1
+		0x40, // inc ax
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	registers.SetFlag(intel8086.TrapFlag, true)
+
+	core.Step()
+	assert.Equal(t, uint16(1), *registers.AX())
+	assert.Equal(t, uint16(0x300), *registers.IP(), "the trap follows the instruction")
+	assert.False(t, registers.GetFlag(intel8086.TrapFlag), "the handler isn't single stepped")
+	assert.NotZero(t, registers.DR6&intel8086.DR6_BS)
+	returnIP, _ := memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x103), returnIP)
+
+	core.Step()
+	assert.Equal(t, uint16(0x103), *registers.IP())
+	assert.True(t, registers.GetFlag(intel8086.TrapFlag))
+
+	core.Step()
+	assert.Equal(t, uint16(2), *registers.AX())
+	assert.Equal(t, uint16(0x300), *registers.IP())
+	returnIP, _ = memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x104), returnIP)
+}
+
+func Test_ExecuteBreakpointFaultsBeforeTheInstruction(t *testing.T) {
+	testPc := setupDebugPc(t, []uint8{
+		0x66, 0x31, 0xDB, // xor ebx, ebx
+		0x0F, 0x23, 0xFB, // mov dr7, ebx
+		0xCF, // iret
+	},
+		0xB8, 0x01, 0x00, // mov ax, 1
+		0x40, // inc ax
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	registers.DR0 = 0x10103
+	registers.DR7 = 0x1
+
+	core.Step()
+	core.Step()
+	assert.Equal(t, uint16(1), *registers.AX(), "the breakpoint hits before inc runs")
+	assert.Equal(t, uint16(0x300), *registers.IP())
+	assert.Equal(t, uint32(0x1), registers.DR6&0xF)
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	assert.Zero(t, registers.DR7, "the handler disabled the breakpoint")
+	assert.Equal(t, uint16(2), *registers.AX())
+	assert.Equal(t, uint16(0x104), *registers.IP())
+}
+
+func Test_DataWriteBreakpointTrapsAfterTheWrite(t *testing.T) {
+	testPc := setupDebugPc(t, []uint8{0xCF}, // iret
+		0x8B, 0x1E, 0x11, 0x00, // mov bx, [0x11]
+		0xA2, 0x11, 0x00, // mov [0x11], al
+		0x90, // nop
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	*registers.EAX() = 0x5A
+
+	// breakpoint 1 watches writes to the word at linear 0x20010
+	registers.DR1 = 0x20010
+	registers.DR7 = 0x4 | intel8086.DR7_RW_WRITE<<20 | 0x1<<22
+
+	core.Step()
+	assert.Equal(t, uint16(0x104), *registers.IP(), "reads don't hit a write breakpoint")
+
+	core.Step()
+	assert.Equal(t, uint16(0x300), *registers.IP())
+	assert.Equal(t, uint32(0x2), registers.DR6&0xF)
+	written, _ := memory.ReadMemoryValue8(0x20011)
+	assert.Equal(t, uint8(0x5A), written)
+	returnIP, _ := memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x107), returnIP)
+}
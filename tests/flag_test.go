@@ -10,7 +10,7 @@ func Test_SetFlag(t *testing.T) {
 
 	tests := []struct {
 		name         string
-		flagMask     uint16
+		flagMask     uint32
 		setTestValue bool
 	}{
 		// TODO: Add test cases.
@@ -0,0 +1,204 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel80387"
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func readFloat64(testPc *pc.PersonalComputer, addr uint32) float64 {
+	memory := testPc.GetMemoryController()
+	low, _ := memory.ReadMemoryValue32(addr)
+	high, _ := memory.ReadMemoryValue32(addr + 4)
+	return math.Float64frombits(uint64(high)<<32 | uint64(low))
+}
+
+func Test_FpuProbe(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xDB, 0xE3, // fninit
+		0xDD, 0x3E, 0x00, 0x05, // fnstsw [0x500]
+		0xD9, 0x3E, 0x02, 0x05, // fnstcw [0x502]
+		0xDF, 0xE0, // fnstsw ax
+	)
+	core := testPc.GetPrimaryCpu()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr16(0x500, 0xFFFF)
+	*core.GetRegisters().AX() = 0xFFFF
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	status, _ := memory.ReadMemoryValue16(0x500)
+	control, _ := memory.ReadMemoryValue16(0x502)
+	assert.Equal(t, uint16(0), status)
+	assert.Equal(t, uint16(0x037F), control)
+	assert.Equal(t, uint16(0), *core.GetRegisters().AX())
+	assert.Equal(t, uint16(0xFFFF), testPc.GetMathCoProcessor().TagWord())
+}
+
+func Test_FpuArithmetic(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xD9, 0x06, 0x10, 0x05, // fld dword [0x510]
+		0xDF, 0x06, 0x14, 0x05, // fild word [0x514]
+		0xDE, 0xC9, // fmulp st(1), st
+		0xD9, 0xFA, // fsqrt
+		0xDD, 0x1E, 0x20, 0x05, // fstp qword [0x520]
+		0xD9, 0xE8, // fld1
+		0xDE, 0x36, 0x14, 0x05, // fidiv word [0x514]
+		0xDD, 0x1E, 0x28, 0x05, // fstp qword [0x528]
+	)
+	core := testPc.GetPrimaryCpu()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr32(0x510, math.Float32bits(1.5))
+	memory.WriteMemoryAddr16(0x514, 6)
+
+	for i := 0; i < 8; i++ {
+		core.Step()
+	}
+	assert.Equal(t, 3.0, readFloat64(testPc, 0x520))
+	assert.Equal(t, 1.0/6, readFloat64(testPc, 0x528))
+
+	fpu := testPc.GetMathCoProcessor()
+	assert.Equal(t, uint16(0xFFFF), fpu.TagWord(), "everything pushed was popped")
+	assert.Equal(t, uint16(intel80387.STATUS_PE), fpu.StatusWord()&intel80387.STATUS_EXCEPTIONS, "a sixth is inexact")
+}
+
+func Test_FpuExtendedRoundTrip(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xDB, 0x2E, 0x30, 0x05, // fld tbyte [0x530]
+		0xDB, 0x3E, 0x40, 0x05, // fstp tbyte [0x540]
+		0xD9, 0xEB, // fldpi
+		0xDB, 0x3E, 0x50, 0x05, // fstp tbyte [0x550]
+	)
+	core := testPc.GetPrimaryCpu()
+	memory := testPc.GetMemoryController()
+	// a value with all 64 significand bits in use, which a double can't hold
+	memory.WriteMemoryAddr32(0x530, 0x89ABCDEF)
+	memory.WriteMemoryAddr32(0x534, 0xF1234567)
+	memory.WriteMemoryAddr16(0x538, 0xC00A)
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	for offset := uint32(0); offset < 10; offset++ {
+		stored, _ := memory.ReadMemoryValue8(0x540 + offset)
+		loaded, _ := memory.ReadMemoryValue8(0x530 + offset)
+		assert.Equal(t, loaded, stored, "byte %d", offset)
+	}
+
+	significand, _ := memory.ReadMemoryValue32(0x554)
+	exponent, _ := memory.ReadMemoryValue16(0x558)
+	assert.Equal(t, uint32(0xC90FDAA2), significand)
+	assert.Equal(t, uint16(0x4000), exponent)
+}
+
+func Test_FpuSine(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xD9, 0xEB, // fldpi
+		0xDE, 0x36, 0x14, 0x05, // fidiv word [0x514]
+		0xD9, 0xFE, // fsin
+		0xDD, 0x1E, 0x20, 0x05, // fstp qword [0x520]
+	)
+	core := testPc.GetPrimaryCpu()
+	testPc.GetMemoryController().WriteMemoryAddr16(0x514, 6)
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	assert.InDelta(t, 0.5, readFloat64(testPc, 0x520), 1e-15)
+	assert.Equal(t, uint16(0), testPc.GetMathCoProcessor().StatusWord()&intel80387.STATUS_C2)
+}
+
+func Test_FpuZeroDivideRaisesIrq13(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xD9, 0x2E, 0x10, 0x05, // fldcw [0x510]
+		0xD9, 0xE8, // fld1
+		0xD9, 0xEE, // fldz
+		0xDE, 0xF9, // fdivp st(1), st
+		0xB0, 0x00, // mov al, 0
+		0xE6, 0xF0, // out 0xf0, al
+	)
+	core := testPc.GetPrimaryCpu()
+	fpu := testPc.GetMathCoProcessor()
+	// zero divide unmasked
+	testPc.GetMemoryController().WriteMemoryAddr16(0x510, 0x037B)
+
+	irq13 := false
+	testPc.GetBus().Signals().IRQ[13].Subscribe(func(level bool) {
+		irq13 = level
+	})
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	assert.True(t, irq13)
+	assert.Equal(t, uint16(intel80387.STATUS_ZE|intel80387.STATUS_ES), fpu.StatusWord()&(intel80387.STATUS_EXCEPTIONS|intel80387.STATUS_ES))
+
+	// the unmasked exception leaves the operands alone
+	st0, _ := fpu.ST(0)
+	st1, _ := fpu.ST(1)
+	assert.True(t, st0.IsZero())
+	assert.Equal(t, intel80387.Float80{SignExponent: 0x3FFF, Significand: 1 << 63}, st1)
+
+	core.Step()
+	core.Step()
+	assert.False(t, irq13, "writing port F0 clears the error latch")
+}
+
+func Test_FpuErrorRaisesMfWithNumericErrorEnabled(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xD9, 0x2E, 0x10, 0x05, // fldcw [0x510]
+		0xD9, 0xE8, // fld1
+		0xD9, 0xE0, // fchs
+		0xD9, 0xFA, // fsqrt
+		0x9B, // fwait
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	// invalid operation unmasked
+	memory.WriteMemoryAddr16(0x510, 0x037E)
+	memory.WriteMemoryAddr16(intel8086.EXCEPTION_MF*4, 0x0040)
+	memory.WriteMemoryAddr16(intel8086.EXCEPTION_MF*4+2, 0x0500)
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.SP() = 0x0100
+	registers.CR0 |= intel8086.CR0_NE
+	testPc.GetMathCoProcessor().SetNativeErrorReporting(true)
+
+	irq13 := false
+	testPc.GetBus().Signals().IRQ[13].Subscribe(func(level bool) {
+		irq13 = level
+	})
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	assert.True(t, testPc.GetMathCoProcessor().ErrorPending(), "the square root of -1 is invalid")
+	assert.Equal(t, uint16(0x010A), *registers.IP())
+
+	core.Step()
+	assert.False(t, irq13)
+	assert.Equal(t, uint16(0x0500), registers.CS.Selector)
+	assert.Equal(t, uint16(0x0040), *registers.IP())
+	returnAddr, _ := memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x010A), returnAddr, "#MF returns to the waiting instruction")
+}
+
+func Test_EscRaisesNmWhenEmulated(t *testing.T) {
+	testPc := setupRegisterPc(t, 0xD9, 0xE8) // fld1
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr16(intel8086.EXCEPTION_NM*4, 0x0040)
+	memory.WriteMemoryAddr16(intel8086.EXCEPTION_NM*4+2, 0x0500)
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.SP() = 0x0100
+	registers.CR0 |= intel8086.CR0_EM
+
+	core.Step()
+	assert.Equal(t, uint16(0x0500), registers.CS.Selector)
+	assert.Equal(t, uint16(0xFFFF), testPc.GetMathCoProcessor().TagWord())
+}
@@ -0,0 +1,63 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_FetchPastCodeSegmentLimitRaisesGP(t *testing.T) {
+	testPc := setupRegisterPc(t, 0xB8, 0x34, 0x12) // mov ax, 0x1234
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	// the immediate runs one byte past the end of the code segment
+	registers.CS.Limit = 0x0101
+	memory.WriteMemoryAddr16(13*4, 0x0040)
+	memory.WriteMemoryAddr16(13*4+2, 0x0500)
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.SP() = 0x0100
+
+	core.Step()
+	assert.Equal(t, uint16(0), *registers.AX())
+	assert.Equal(t, uint16(0x0500), registers.CS.Selector)
+	assert.Equal(t, uint32(0x0040), core.GetIP())
+
+	returnAddr, _ := memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x0100), returnAddr)
+}
+
+func Test_InstructionPointerIs32Bit(t *testing.T) {
+	testPc := setupRegisterPc(t)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	cs := intel8086.RealModeSegment(0)
+	cs.Limit = 0xFFFFFFFF
+	cs.SetDefault32Bit(true)
+	registers.CS = cs
+	core.SetIP(0x00020000)
+	for i, b := range []uint8{0xE9, 0x00, 0x00, 0x01, 0x00} { // jmp rel32 +0x10000
+		testPc.GetMemoryController().WriteMemoryAddr8(0x20000+uint32(i), b)
+	}
+
+	core.Step()
+	assert.Equal(t, uint32(0x00030005), core.GetIP())
+	assert.Equal(t, uint32(0x00030005), core.GetCurrentCodePointer())
+}
+
+func Test_HltWithInterruptsDisabledStopsTheCpu(t *testing.T) {
+	testPc := setupRegisterPc(t, 0xFA, 0xF4) // cli, hlt
+	core := testPc.GetPrimaryCpu()
+
+	core.Step()
+	stopped, _ := core.Stopped()
+	assert.False(t, stopped)
+
+	core.Step()
+	stopped, reason := core.Stopped()
+	assert.True(t, stopped)
+	assert.Equal(t, "halted with interrupts disabled", reason)
+	assert.Equal(t, uint32(0x0102), core.GetIP())
+}
@@ -0,0 +1,150 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/common"
+	"github.com/andrewjc/threeatesix/devices/memmap"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setupMemoryController(t testing.TB) *memmap.MemoryAccessController {
+	return setupRegisterPc(t).GetMemoryController()
+}
+
+func Test_MemoryAccessAcrossPageBoundary(t *testing.T) {
+	mem := setupMemoryController(t)
+
+	assert.NoError(t, mem.WriteMemoryAddr32(0x1FFE, 0x11223344))
+	value, err := mem.ReadMemoryValue32(0x1FFE)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x11223344), value)
+
+	word, err := mem.ReadMemoryValue16(0x1FFF)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x2233), word)
+
+	b, err := mem.ReadMemoryValue8(0x2000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x22), b)
+}
+
+func Test_BiosRomIsReadOnly(t *testing.T) {
+	mem := setupMemoryController(t)
+
+	region, ok := mem.GetRegion(0xFFFF0)
+	assert.True(t, ok)
+	assert.Equal(t, memmap.REGION_ROM, region.Kind)
+
+	// an empty rom reads as open bus and writes land in the ram underneath
+	assert.NoError(t, mem.WriteMemoryAddr16(0xFFFF0, 0x1234))
+	value, err := mem.ReadMemoryValue16(0xFFFF0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0xFFFF), value)
+}
+
+func Test_MmioRegionCallbacks(t *testing.T) {
+	mem := setupMemoryController(t)
+
+	registers := make(map[uint32]uint8)
+	err := mem.MapMmio("test", 0xD0000, memmap.PAGE_SIZE,
+		func(addr uint32) uint8 { return registers[addr] },
+		func(addr uint32, value uint8) { registers[addr] = value })
+	assert.NoError(t, err)
+
+	assert.NoError(t, mem.WriteMemoryAddr16(0xD0010, 0xBEEF))
+	assert.Equal(t, uint8(0xEF), registers[0xD0010])
+	assert.Equal(t, uint8(0xBE), registers[0xD0011])
+
+	value, err := mem.ReadMemoryValue16(0xD0010)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0xBEEF), value)
+
+	assert.Error(t, mem.MapMmio("unaligned", 0xD0010, memmap.PAGE_SIZE, nil, nil))
+}
+
+func Test_UnmappedMemoryFaults(t *testing.T) {
+	mem := setupMemoryController(t)
+
+	assert.NoError(t, mem.Unmap(0xD0000, 0x10000))
+	_, err := mem.ReadMemoryValue8(0xD1234)
+	assert.ErrorIs(t, err, common.GeneralProtectionFault{})
+	assert.Error(t, mem.WriteMemoryAddr8(0xD1234, 1))
+
+	_, err = mem.ReadMemoryValue32(0xFFFFFF00)
+	assert.Error(t, err)
+}
+
+func Benchmark_MemoryReadWrite16(b *testing.B) {
+	mem := setupMemoryController(b)
+
+	for i := 0; i < b.N; i++ {
+		addr := uint32(i*2) & 0xFFFF
+		value, _ := mem.ReadMemoryValue16(addr)
+		_ = mem.WriteMemoryAddr16(addr, value+1)
+	}
+}
+
+func Benchmark_MemoryReadWrite32(b *testing.B) {
+	mem := setupMemoryController(b)
+
+	for i := 0; i < b.N; i++ {
+		addr := uint32(i*4) & 0xFFFF
+		value, _ := mem.ReadMemoryValue32(addr)
+		_ = mem.WriteMemoryAddr32(addr, value+1)
+	}
+}
+
+func readCmos(testPc *pc.PersonalComputer, register uint8) uint8 {
+	testPc.GetIOPortController().WriteAddr8(0x70, register)
+	return testPc.GetIOPortController().ReadAddr8(0x71)
+}
+
+func Test_ConfigurableRamSize(t *testing.T) {
+	for _, megabytes := range []uint32{1, 4, 16, 64} {
+		config := pc.DefaultMachineConfig()
+		config.RAMBytes = pc.ByteSize(megabytes << 20)
+		testPc, err := pc.NewPcWithConfig(config)
+		assert.NoError(t, err)
+		mem := testPc.GetMemoryController()
+		testPc.GetIOPortController().WriteAddr8(0x92, 0x02) // A20 on so the top of ram doesn't wrap
+
+		assert.Equal(t, uint16(640), uint16(readCmos(testPc, 0x16))<<8|uint16(readCmos(testPc, 0x15)))
+		extendedKB := uint16((megabytes - 1) << 10)
+		assert.Equal(t, extendedKB, uint16(readCmos(testPc, 0x18))<<8|uint16(readCmos(testPc, 0x17)))
+		assert.Equal(t, extendedKB, uint16(readCmos(testPc, 0x31))<<8|uint16(readCmos(testPc, 0x30)))
+
+		top := megabytes<<20 - 4
+		if megabytes > 1 {
+			assert.NoError(t, mem.WriteMemoryAddr32(top, 0xCAFEF00D))
+			value, err := mem.ReadMemoryValue32(top)
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(0xCAFEF00D), value)
+		}
+		_, err = mem.ReadMemoryValue8(megabytes << 20)
+		assert.Error(t, err)
+	}
+}
+
+func Test_UpperMemoryAreaIsReserved(t *testing.T) {
+	mem := setupMemoryController(t)
+
+	region, _ := mem.GetRegion(0xB8000)
+	assert.Equal(t, "video ram", region.Name)
+	assert.NoError(t, mem.WriteMemoryAddr16(0xB8000, 0x0741))
+	value, _ := mem.ReadMemoryValue16(0xB8000)
+	assert.Equal(t, uint16(0x0741), value)
+
+	// nothing answers in the upper memory blocks
+	assert.NoError(t, mem.WriteMemoryAddr8(0xD0000, 0x12))
+	b, err := mem.ReadMemoryValue8(0xD0000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0xFF), b)
+}
+
+func Test_InvalidRamSize(t *testing.T) {
+	_, err := pc.NewPcWithConfig(pc.MachineConfig{RAMBytes: 512 << 10})
+	assert.Error(t, err)
+	_, err = pc.NewPcWithConfig(pc.MachineConfig{RAMBytes: 1<<20 + 1000})
+	assert.Error(t, err)
+}
@@ -0,0 +1,245 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// setupModelPc is setupRegisterPc for a machine with the given cpu model, and 4M of ram and a
+// coprocessor unless it is an 8086
+func setupModelPc(t *testing.T, cpu string, code ...uint8) *pc.PersonalComputer {
+	config := pc.DefaultMachineConfig()
+	config.CPU = cpu
+	config.RAMBytes = 4 << 20
+	if cpu == pc.CPU_8086 {
+		config.RAMBytes = 1 << 20
+		config.FPU = false
+	}
+	return setupConfigPc(t, config, code...)
+}
+
+func Test_CpuDetectionSeesFlagsUpperBits(t *testing.T) {
+	code := []uint8{
+		0x9C,             // pushf
+		0x58,             // pop ax
+		0x25, 0xFF, 0x0F, // and ax, 0x0fff
+		0x50,             // push ax
+		0x9D,             // popf
+		0x9C,             // pushf
+		0x5B,             // pop bx
+		0x0D, 0x00, 0xF0, // or ax, 0xf000
+		0x50, // push ax
+		0x9D, // popf
+		0x9C, // pushf
+		0x59, // pop cx
+	}
+	for cpu, expected := range map[string][2]uint16{
+		pc.CPU_8086:    {0xF000, 0xF000},
+		pc.CPU_80286:   {0x0000, 0x0000},
+		pc.CPU_80386SX: {0x0000, 0x7000},
+		pc.CPU_80386:   {0x0000, 0x7000},
+	} {
+		core := setupModelPc(t, cpu, code...).GetPrimaryCpu()
+		registers := core.GetRegisters()
+		for i := 0; i < 12; i++ {
+			core.Step()
+		}
+		assert.Equal(t, expected[0], *registers.BX()&0xF000, cpu)
+		assert.Equal(t, expected[1], *registers.CX()&0xF000, cpu)
+	}
+}
+
+func Test_PushSpAndResetSignatureFollowModel(t *testing.T) {
+	for cpu, signature := range map[string]uint16{
+		pc.CPU_8086:    0,
+		pc.CPU_80286:   0,
+		pc.CPU_80386SX: 0x2308,
+		pc.CPU_80386:   0x0308,
+	} {
+		core := setupModelPc(t, cpu,
+			0x54, // push sp
+			0x58, // pop ax
+		).GetPrimaryCpu()
+		registers := core.GetRegisters()
+		assert.Equal(t, signature, *registers.DX(), cpu)
+
+		sp := *registers.SP()
+		core.Step()
+		core.Step()
+		if cpu == pc.CPU_8086 {
+			assert.Equal(t, sp-2, *registers.AX(), "the 8086 pushes the decremented SP")
+		} else {
+			assert.Equal(t, sp, *registers.AX(), cpu)
+		}
+	}
+}
+
+func Test_AddressBusWidthWrapsPhysicalAddresses(t *testing.T) {
+	for cpu, wrap := range map[string]uint32{
+		pc.CPU_8086:  1 << 20,
+		pc.CPU_80286: 1 << 24,
+	} {
+		testPc := setupModelPc(t, cpu)
+		memory := testPc.GetMemoryController()
+		testPc.GetIOPortController().WriteAddr8(0x92, 0x02) // fast A20
+		memory.WriteMemoryAddr8(wrap+0x10, 0xAB)
+		value, _ := memory.ReadMemoryValue8(0x10)
+		assert.Equal(t, uint8(0xAB), value, cpu)
+	}
+
+	testPc := setupModelPc(t, pc.CPU_80386)
+	memory := testPc.GetMemoryController()
+	testPc.GetIOPortController().WriteAddr8(0x92, 0x02)
+	memory.WriteMemoryAddr8(0x100010, 0xCD)
+	value, _ := memory.ReadMemoryValue8(0x10)
+	assert.NotEqual(t, uint8(0xCD), value, "a 386 reaches extended memory")
+}
+
+func Test_80286SmswAndLoadall(t *testing.T) {
+	testPc := setupModelPc(t, pc.CPU_80286,
+		0x0F, 0x01, 0xE0, // smsw ax
+		0x0F, 0x05, // loadall
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	core.Step()
+	assert.Equal(t, uint16(0xFFF0), *registers.AX(), "the 286's unused MSW bits read as ones")
+
+	memory.WriteMemoryAddr16(0x818, 0x0046) // FLAGS
+	memory.WriteMemoryAddr16(0x81A, 0x0010) // IP
+	memory.WriteMemoryAddr16(0x822, 0x2000) // CS
+	memory.WriteMemoryAddr16(0x834, 0x1234) // AX
+	memory.WriteMemoryAddr32(0x83C, 0x9B300000)
+	memory.WriteMemoryAddr16(0x840, 0xFFFF) // CS cache, base 0x300000
+	memory.WriteMemoryAddr32(0x848, 0x93400000)
+	memory.WriteMemoryAddr16(0x84C, 0x0FFF) // DS cache, base 0x400000
+	core.Step()
+	assert.Equal(t, uint16(0x1234), *registers.AX())
+	assert.Equal(t, uint16(0x2000), registers.CS.Selector)
+	assert.Equal(t, uint32(0x300000), registers.CS.Base, "the caches needn't match the selectors")
+	assert.Equal(t, uint32(0x400000), registers.DS.Base)
+	assert.Equal(t, uint32(0x0FFF), registers.DS.Limit)
+	assert.Equal(t, uint16(0x10), *registers.IP())
+	assert.Equal(t, uint32(0x0046), registers.EFLAGS)
+}
+
+func Test_8086PopsCsForOpcode0F(t *testing.T) {
+	core := setupModelPc(t, pc.CPU_8086,
+		0xB8, 0x00, 0x20, // mov ax, 0x2000
+		0x50, // push ax
+		0x0F, // pop cs
+	).GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	core.Step()
+	core.Step()
+	core.Step()
+	assert.Equal(t, uint16(0x2000), registers.CS.Selector)
+	assert.Equal(t, uint32(0x20000), registers.CS.Base)
+	assert.Equal(t, uint16(0x105), *registers.IP())
+}
+
+func Test_80286RaisesUdFor386Opcodes(t *testing.T) {
+	for name, code := range map[string][]uint8{
+		"operand size prefix": {0x66, 0x40},       // inc eax
+		"address size prefix": {0x67, 0x8B, 0x03}, // mov ax, [ebx]
+		"fs prefix":           {0x64, 0x8B, 0x07}, // mov ax, fs:[bx]
+		"movzx":               {0x0F, 0xB6, 0xC3}, // movzx ax, bl
+	} {
+		testPc := setupModelPc(t, pc.CPU_80286, code...)
+		core := testPc.GetPrimaryCpu()
+		registers := core.GetRegisters()
+		memory := testPc.GetMemoryController()
+		registers.SS = intel8086.RealModeSegment(0x3000)
+		*registers.ESP() = 0x100
+		memory.WriteMemoryAddr16(intel8086.EXCEPTION_UD*4, 0x300)
+		memory.WriteMemoryAddr16(intel8086.EXCEPTION_UD*4+2, 0x1000)
+
+		core.Step()
+		assert.Equal(t, uint16(0x300), *registers.IP(), name)
+		returnIP, _ := memory.ReadMemoryValue16(0x300FA)
+		assert.Equal(t, uint16(0x100), returnIP, "#UD points at the instruction, "+name)
+	}
+
+	core := setupModelPc(t, pc.CPU_80386, 0x66, 0x40).GetPrimaryCpu()
+	*core.GetRegisters().EAX() = 0xFFFF
+	core.Step()
+	assert.Equal(t, uint32(0x10000), *core.GetRegisters().EAX(), "a 386 runs it")
+}
+
+func Test_8086RunsThe186OpcodesAsAliases(t *testing.T) {
+	core := setupModelPc(t, pc.CPU_8086,
+		0x61, 0x02, // jno +2, the 186's popa
+		0x90, 0x90,
+		0x66, 0x10, // jbe +0x10, a 386 prefix
+	).GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	core.Step()
+	assert.Equal(t, uint16(0x104), *registers.IP())
+	core.Step()
+	assert.Equal(t, uint16(0x106), *registers.IP(), "jbe isn't taken with CF and ZF clear")
+
+	testPc := setupModelPc(t, pc.CPU_8086,
+		0xC1, // ret, the 186's shift by imm8
+	)
+	core = testPc.GetPrimaryCpu()
+	registers = core.GetRegisters()
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.ESP() = 0xFE
+	testPc.GetMemoryController().WriteMemoryAddr16(0x300FE, 0x1234)
+
+	core.Step()
+	assert.Equal(t, uint16(0x1234), *registers.IP())
+	assert.Equal(t, uint16(0x100), *registers.SP())
+}
+
+func Test_CoprocessorIsAMachineOption(t *testing.T) {
+	for _, machine := range []struct {
+		cpu string
+		fpu bool
+	}{
+		{pc.CPU_8086, false},
+		{pc.CPU_80286, false},
+		{pc.CPU_80286, true},
+		{pc.CPU_80386SX, false},
+		{pc.CPU_80386SX, true},
+		{pc.CPU_80386, false},
+		{pc.CPU_80386, true},
+	} {
+		config := pc.DefaultMachineConfig()
+		config.CPU = machine.cpu
+		config.RAMBytes = 1 << 20
+		config.FPU = machine.fpu
+
+		// the usual check: FNSTSW only clears the word if there is a coprocessor to store it
+		testPc := setupConfigPc(t, config,
+			0xDB, 0xE3, // fninit
+			0xDD, 0x3E, 0x00, 0x02, // fnstsw [0x200]
+		)
+		core := testPc.GetPrimaryCpu()
+		core.GetRegisters().DS = intel8086.RealModeSegment(0x2000)
+		memory := testPc.GetMemoryController()
+		memory.WriteMemoryAddr16(0x20200, 0x5A5A)
+
+		core.Step()
+		core.Step()
+		status, _ := memory.ReadMemoryValue16(0x20200)
+		assert.Equal(t, machine.fpu, testPc.GetMathCoProcessor() != nil, machine.cpu)
+		if machine.fpu {
+			assert.Equal(t, uint16(0), status, machine.cpu)
+		} else {
+			assert.Equal(t, uint16(0x5A5A), status, machine.cpu)
+		}
+	}
+
+	config := pc.DefaultMachineConfig()
+	config.CPU = pc.CPU_8086
+	config.RAMBytes = 1 << 20
+	_, err := pc.NewPcWithConfig(config)
+	assert.ErrorContains(t, err, "8087")
+}
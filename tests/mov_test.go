@@ -17,7 +17,7 @@ func Test_MovTests(t *testing.T) {
 	instructions := []uint8{0xb8, 0x00, 0x90, 0x8E, 0xD8}
 
 	for x := 0; x < len(instructions); x++ {
-		testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), instructions[x])
+		testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), instructions[x])
 	}
 
 	for {
@@ -40,7 +40,7 @@ func Test_MovDecodeOperandSizeOverridePrefix(t *testing.T) {
 	instructions := []uint8{0x66, 0x25, 0xFF, 0xFF, 0xFF, 0x9F}
 
 	for x := 0; x < len(instructions); x++ {
-		testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), instructions[x])
+		testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), instructions[x])
 	}
 
 	for {
@@ -0,0 +1,154 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_OperandSizePrefixIn16BitCode(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0x66, 0x05, 0x78, 0x56, 0x34, 0x12, // add eax, 0x12345678
+		0x05, 0x01, 0x00, // add ax, 1
+		0x66, 0x89, 0xC3, // mov ebx, eax
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	*registers.EAX() = 0x0000FFFF
+
+	core.Step()
+	assert.Equal(t, uint32(0x12355677), *registers.EAX())
+	assert.Equal(t, uint16(0x0106), *registers.IP())
+
+	core.Step()
+	assert.Equal(t, uint32(0x12355678), *registers.EAX())
+
+	core.Step()
+	assert.Equal(t, uint32(0x12355678), *registers.EBX())
+	assert.Equal(t, uint16(0x010C), *registers.IP())
+}
+
+func Test_16BitAddressingSegments(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0x8B, 0x00, // mov ax, [bx+si]
+		0x8B, 0x4E, 0x02, // mov cx, [bp+2]
+		0x26, 0x8B, 0x17, // mov dx, es:[bx]
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	registers.DS = intel8086.RealModeSegment(0x2000)
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	registers.ES = intel8086.RealModeSegment(0x4000)
+	*registers.BX() = 0x0010
+	*registers.SI() = 0x0004
+	*registers.BP() = 0x0020
+	memory.WriteMemoryAddr16(0x20014, 0xBEEF)
+	memory.WriteMemoryAddr16(0x30022, 0xCAFE)
+	memory.WriteMemoryAddr16(0x40010, 0xF00D)
+
+	core.Step()
+	assert.Equal(t, uint16(0xBEEF), *registers.AX())
+
+	core.Step()
+	assert.Equal(t, uint16(0xCAFE), *registers.CX())
+
+	core.Step()
+	assert.Equal(t, uint16(0xF00D), *registers.DX())
+}
+
+func Test_AddressSizePrefixUsesSib(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0x67, 0x8B, 0x44, 0x4B, 0x04, // mov ax, [ebx+ecx*2+4]
+		0x67, 0x8D, 0x14, 0x4B, // lea dx, [ebx+ecx*2]
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	registers.DS = intel8086.RealModeSegment(0x2000)
+	*registers.EBX() = 0x0100
+	*registers.ECX() = 0x0008
+	testPc.GetMemoryController().WriteMemoryAddr16(0x20114, 0x1234)
+
+	core.Step()
+	assert.Equal(t, uint16(0x1234), *registers.AX())
+	assert.Equal(t, uint16(0x0105), *registers.IP())
+
+	core.Step()
+	assert.Equal(t, uint16(0x0110), *registers.DX())
+}
+
+func Test_32BitCodeSegmentDefaults(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xB8, 0x78, 0x56, 0x34, 0x12, // mov eax, 0x12345678
+		0x66, 0xB8, 0xCD, 0xAB, // mov ax, 0xabcd
+		0xE9, 0x10, 0x00, 0x00, 0x00, // jmp rel32 +0x10
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	registers.CS.SetDefault32Bit(true)
+	assert.True(t, core.Is32BitOperand())
+
+	core.Step()
+	assert.Equal(t, uint32(0x12345678), *registers.EAX())
+	assert.Equal(t, uint32(0x0105), *registers.EIP())
+
+	core.Step()
+	assert.Equal(t, uint32(0x1234ABCD), *registers.EAX())
+	assert.Equal(t, uint32(0x0109), *registers.EIP())
+
+	core.Step()
+	assert.Equal(t, uint32(0x011E), *registers.EIP())
+}
+
+func Test_Group3WordOperations(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xF7, 0xF3, // div bx
+		0x66, 0xF7, 0xE3, // mul ebx
+		0xF7, 0xD8, // neg ax
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	*registers.DX() = 0x0001
+	*registers.AX() = 0x0004
+	*registers.BX() = 2
+	core.Step()
+	assert.Equal(t, uint16(0x8002), *registers.AX())
+	assert.Equal(t, uint16(0), *registers.DX())
+
+	*registers.EAX() = 0x80000000
+	*registers.EBX() = 4
+	core.Step()
+	assert.Equal(t, uint32(0), *registers.EAX())
+	assert.Equal(t, uint32(2), *registers.EDX())
+	assert.True(t, registers.GetFlag(intel8086.CarryFlag))
+
+	*registers.AX() = 1
+	core.Step()
+	assert.Equal(t, uint16(0xFFFF), *registers.AX())
+	assert.True(t, registers.GetFlag(intel8086.CarryFlag))
+}
+
+func Test_DivideByZeroRaisesInterrupt0(t *testing.T) {
+	testPc := setupRegisterPc(t, 0xF6, 0xF3) // div bl
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	memory.WriteMemoryAddr16(0x0000, 0x0040)
+	memory.WriteMemoryAddr16(0x0002, 0x0500)
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.SP() = 0x0100
+	*registers.AX() = 0x1234
+	*registers.BL() = 0
+
+	core.Step()
+	assert.Equal(t, uint16(0x0500), registers.CS.Selector)
+	assert.Equal(t, uint16(0x0040), *registers.IP())
+	assert.Equal(t, uint16(0x1234), *registers.AX())
+
+	returnAddr, _ := memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x0100), returnAddr)
+}
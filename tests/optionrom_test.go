@@ -0,0 +1,97 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/memmap"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// buildOptionRom returns a valid option rom of blocks 512 byte blocks
+func buildOptionRom(blocks uint8) []uint8 {
+	image := make([]uint8, int(blocks)*memmap.OPTION_ROM_BLOCK_SIZE)
+	image[0], image[1], image[2] = 0x55, 0xAA, blocks
+	image[3] = 0xCB // retf
+
+	var sum uint8
+	for _, b := range image {
+		sum += b
+	}
+	image[len(image)-1] = -sum
+	return image
+}
+
+func Test_ValidateOptionRom(t *testing.T) {
+	size, err := memmap.ValidateOptionRom(buildOptionRom(4))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2048), size)
+
+	badChecksum := buildOptionRom(4)
+	badChecksum[10]++
+	_, err = memmap.ValidateOptionRom(badChecksum)
+	assert.Error(t, err)
+
+	badSignature := buildOptionRom(4)
+	badSignature[1] = 0x55
+	_, err = memmap.ValidateOptionRom(badSignature)
+	assert.Error(t, err)
+
+	_, err = memmap.ValidateOptionRom(buildOptionRom(4)[:1024])
+	assert.Error(t, err)
+}
+
+func Test_MapOptionRom(t *testing.T) {
+	mem := setupMemoryController(t)
+
+	assert.NoError(t, mem.MapOptionRom("test rom", 0xC8000, buildOptionRom(4)))
+	signature, err := mem.ReadMemoryValue16(0xC8000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0xAA55), signature)
+
+	// the rest of the page past the declared size floats high
+	b, _ := mem.ReadMemoryValue8(0xC8800)
+	assert.Equal(t, uint8(0xFF), b)
+
+	assert.Error(t, mem.MapOptionRom("overlapping", 0xC8000, buildOptionRom(4)))
+	err = mem.MapOptionRom("2K aligned", 0xC8800, buildOptionRom(4))
+	assert.ErrorContains(t, err, "not on a 4K boundary")
+	assert.Error(t, mem.MapOptionRom("outside", 0xE0000, buildOptionRom(4)))
+}
+
+func Test_LoadOptionRomImage(t *testing.T) {
+	testPc := pc.NewPc()
+	mem := testPc.GetMemoryController()
+
+	assert.NoError(t, testPc.LoadOptionRom("../bios/ide_xt.bin", 0xC8000))
+	region, ok := mem.GetRegion(0xC9000)
+	assert.True(t, ok)
+	assert.Equal(t, "ide_xt.bin", region.Name)
+	assert.Equal(t, memmap.REGION_ROM, region.Kind)
+
+	assert.Error(t, testPc.LoadOptionRom("../bios/pcxtbios.bin", 0xD0000))
+
+	rom, err := pc.ParseOptionRom("../bios/ide_xt.bin@0xC8000")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0xC8000), rom.Address)
+	_, err = pc.ParseOptionRom("../bios/ide_xt.bin")
+	assert.Error(t, err)
+}
+
+func Test_AdapterRomShadow(t *testing.T) {
+	testPc := pc.NewPc()
+	mem := testPc.GetMemoryController()
+	assert.NoError(t, mem.MapOptionRom("test rom", 0xC8000, buildOptionRom(8)))
+
+	// a BIOS shadows the rom by copying it onto itself, then switching reads to ram
+	for addr := uint32(0xC8000); addr < 0xC9000; addr++ {
+		b, _ := mem.ReadMemoryValue8(addr)
+		assert.NoError(t, mem.WriteMemoryAddr8(addr, b))
+	}
+	assert.NoError(t, mem.WriteMemoryAddr8(0xC8003, 0x90))
+	testPc.GetIOPortController().WriteAddr16(0x22, 0x0208)
+
+	b, _ := mem.ReadMemoryValue8(0xC8003)
+	assert.Equal(t, uint8(0x90), b)
+	signature, _ := mem.ReadMemoryValue16(0xC8000)
+	assert.Equal(t, uint16(0xAA55), signature)
+}
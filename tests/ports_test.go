@@ -0,0 +1,84 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/common"
+	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/devices/cmos"
+	"github.com/andrewjc/threeatesix/devices/intel82C54"
+	"github.com/andrewjc/threeatesix/devices/io"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_UnhandledPortPolicy(t *testing.T) {
+	testPc := pc.NewPc()
+	ports := testPc.GetIOPortController()
+
+	assert.NoError(t, ports.ConfigureUnhandledPortPolicies("fatal,0x200-0x3ff=openbus"))
+	assert.Equal(t, uint8(0xFF), ports.ReadAddr8(0x279))
+
+	assert.Error(t, ports.ConfigureUnhandledPortPolicies("0x200=explode"))
+}
+
+func Test_PortTraceFilter(t *testing.T) {
+	testPc := pc.NewPc()
+	testPc.GetPrimaryCpu().Init(testPc.GetBus())
+	ports := testPc.GetIOPortController()
+	ports.SetDefaultUnhandledPortPolicy(io.PORT_POLICY_OPEN_BUS)
+
+	traced := make([]io.PortAccess, 0)
+	ranges, err := io.ParsePortRanges("0x40-0x43,0x300")
+	assert.NoError(t, err)
+	ports.EnablePortTrace(func(access io.PortAccess) { traced = append(traced, access) }, ranges...)
+
+	ports.WriteAddr8(0x43, 0x36)
+	ports.ReadAddr8(0x300)
+	ports.ReadAddr8(0x301)
+
+	assert.Len(t, traced, 2)
+	assert.Equal(t, io.PORT_WRITE, traced[0].Direction)
+	assert.Equal(t, uint16(0x43), traced[0].Port)
+	assert.Equal(t, uint32(0x36), traced[0].Value)
+	assert.Equal(t, "pit.0", traced[0].Device)
+	assert.Equal(t, uint32(0xF000), traced[0].CS)
+	assert.Equal(t, uint32(0xFFF0), traced[0].IP)
+	assert.Equal(t, "unhandled", traced[1].Device)
+	assert.Equal(t, uint32(0xFF), traced[1].Value)
+}
+
+func Test_PortRegistrationConflict(t *testing.T) {
+	deviceBus := bus.NewDeviceBus()
+	assert.NoError(t, deviceBus.RegisterDevice(intel82C54.NewIntel82C54(), common.MODULE_PIT))
+
+	err := deviceBus.RegisterDevice(intel82C54.NewIntel82C54(), common.MODULE_PIT)
+	var conflict *bus.PortConflictError
+	assert.ErrorAs(t, err, &conflict)
+	assert.Equal(t, uint16(0x40), conflict.Port)
+	assert.Equal(t, "pit.0", conflict.Existing)
+	assert.Equal(t, "pit.1", conflict.Device)
+
+	// a device that only writes a port can share it with one that only reads it
+	assert.NoError(t, deviceBus.RegisterDevice(cmos.NewMotorola146818(), common.MODULE_CMOS))
+	assert.NotNil(t, deviceBus.GetPortWriteRoute(0x70))
+	assert.Nil(t, deviceBus.GetPortReadRoute(0x70))
+}
+
+func Test_WidePortAccessIsSplit(t *testing.T) {
+	testPc := pc.NewPc()
+	ports := testPc.GetIOPortController()
+
+	traced := make([]io.PortAccess, 0)
+	ports.EnablePortTrace(func(access io.PortAccess) { traced = append(traced, access) })
+
+	ports.WriteAddr32(0xC0, 0x11223344)
+
+	assert.Len(t, traced, 4)
+	for i, access := range traced {
+		assert.Equal(t, uint16(0xC0+i), access.Port)
+		assert.Equal(t, uint8(1), access.Width)
+		assert.Equal(t, "dma2.0", access.Device)
+	}
+	assert.Equal(t, uint32(0x44), traced[0].Value)
+	assert.Equal(t, uint32(0x11), traced[3].Value)
+}
@@ -0,0 +1,66 @@
+package tests_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func Test_ProfilerCountsOpcodesAndAddresses(t *testing.T) {
+	// INC AX; INC AX; CLC
+	code := []uint8{0x40, 0x40, 0xF8}
+	testPc := setupRegisterPc(t, code...)
+	core := testPc.GetPrimaryCpu()
+
+	profiler := testPc.EnableProfiler()
+	for range code {
+		core.Step()
+	}
+
+	assert.Equal(t, uint64(3), profiler.GetInstructionCount())
+	assert.Equal(t, uint64(2), profiler.GetOpcodeCount(0x40, false))
+	assert.Equal(t, uint64(1), profiler.GetOpcodeCount(0xF8, false))
+	assert.Equal(t, uint64(1), profiler.GetAddressCounts()[0x10101])
+
+	var folded bytes.Buffer
+	assert.NoError(t, core.WriteFoldedStacks(&folded))
+	assert.Equal(t, "0x10100 1\n0x10101 1\n0x10102 1\n", folded.String())
+
+	var report bytes.Buffer
+	assert.NoError(t, core.WriteHandlerReport(&report))
+	assert.Contains(t, report.String(), "INSTR_INC")
+	assert.Contains(t, report.String(), "INSTR_CLC")
+
+	var profile bytes.Buffer
+	assert.NoError(t, core.WriteGuestPprof(&profile))
+	zr, err := gzip.NewReader(&profile)
+	assert.NoError(t, err)
+	raw, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, raw)
+}
+
+func Test_ProfilerCountsFarCallsIntoTheSameSegment(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0x9A, 0x00, 0x02, 0x00, 0x10, // call 1000:0200
+	)
+	core := testPc.GetPrimaryCpu()
+	core.GetRegisters().SS = intel8086.RealModeSegment(0x3000)
+	*core.GetRegisters().ESP() = 0x100
+	testPc.GetMemoryController().WriteMemoryAddr8(0x10200, 0x90) // nop
+
+	profiler := testPc.EnableProfiler()
+	core.Step()
+	core.Step()
+	assert.Equal(t, map[uint32]uint64{0x10200: 1}, profiler.GetFarCallCounts())
+
+	core.DisableProfiler()
+	var output bytes.Buffer
+	assert.Error(t, core.WriteFoldedStacks(&output))
+	assert.Error(t, core.WriteGuestPprof(&output))
+	assert.Error(t, core.WriteHandlerPprof(&output))
+	assert.Error(t, core.WriteHandlerReport(&output))
+}
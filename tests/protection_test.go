@@ -0,0 +1,179 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// setupRing3Pc builds on setupTaskPc with ring 3 code and data segments at 0x30 and 0x38, and a
+// ring 3 286 call gate at 0x40 to 0x08:0x300 copying one parameter. The ring 0 code loads DS and
+// makes a far return to the ring 3 code at 0x33:0x120, whose stack is 0x3B:0x200. Ring 0 runs on
+// the stack 0x10:0x1000 from the TSS.
+func setupRing3Pc(t *testing.T, code ...uint8) *pc.PersonalComputer {
+	testPc := setupTaskPc(t,
+		0xB8, 0x10, 0x00, // mov ax, 0x10
+		0x8E, 0xD8, // mov ds, ax
+		0x6A, 0x3B, // push 0x3b
+		0x68, 0x00, 0x02, // push 0x200
+		0x6A, 0x33, // push 0x33
+		0x68, 0x20, 0x01, // push 0x120
+		0xCB, // retf
+	)
+	registers := testPc.GetPrimaryCpu().GetRegisters()
+	memory := testPc.GetMemoryController()
+	for i, b := range code {
+		memory.WriteMemoryAddr8(0x10120+uint32(i), b)
+	}
+
+	writeDescriptor(testPc, 0x830, 0x10000, 0xFFFF, 0xFA, 0x00)
+	writeDescriptor(testPc, 0x838, 0x40000, 0xFFFF, 0xF2, 0x00)
+	memory.WriteMemoryAddr32(0x840, 0x00080300)
+	memory.WriteMemoryAddr32(0x844, 0x0000E401)
+	registers.GDTR = intel8086.DescriptorTableRegister{Base: 0x800, Limit: 0x47}
+
+	memory.WriteMemoryAddr32(0x2004, 0x1000) // ESP0
+	memory.WriteMemoryAddr32(0x2008, 0x10)   // SS0
+	return testPc
+}
+
+func Test_CallGateSwitchesToRing0StackAndRetfReturnsToRing3(t *testing.T) {
+	testPc := setupRing3Pc(t,
+		0x6A, 0x55, // push 0x55
+		0x9A, 0x00, 0x00, 0x43, 0x00, // call 0x43:0
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr8(0x10300, 0xCA) // retf 2
+	memory.WriteMemoryAddr16(0x10301, 2)
+
+	for i := 0; i < 9; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint16(0x33), registers.CS.Selector, "the far return drops to ring 3")
+	assert.Equal(t, uint32(0x120), *registers.EIP())
+	assert.Equal(t, uint16(0x3B), registers.SS.Selector)
+	assert.Equal(t, uint32(0x40000), registers.SS.Base)
+	assert.Equal(t, uint16(0x200), *registers.SP())
+	assert.Equal(t, uint16(0), registers.DS.Selector, "ring 3 can't keep the ring 0 data segment")
+
+	core.Step()
+	core.Step()
+	assert.Equal(t, uint16(0x08), registers.CS.Selector, "the call gate enters ring 0")
+	assert.Equal(t, uint32(0x300), *registers.EIP())
+	assert.Equal(t, uint16(0x10), registers.SS.Selector)
+	assert.Equal(t, uint16(0xFF6), *registers.SP())
+	expected := []uint16{0x127, 0x33, 0x55, 0x1FE, 0x3B}
+	for i, value := range expected {
+		pushed, _ := memory.ReadMemoryValue16(0x30FF6 + uint32(i)*2)
+		assert.Equal(t, value, pushed, "frame word %d", i)
+	}
+
+	core.Step()
+	assert.Equal(t, uint16(0x33), registers.CS.Selector)
+	assert.Equal(t, uint32(0x127), *registers.EIP())
+	assert.Equal(t, uint16(0x3B), registers.SS.Selector)
+	assert.Equal(t, uint16(0x200), *registers.SP(), "the parameter is released from both stacks")
+}
+
+func Test_Ring3LoadOfRing0DataFaultsOnRing0Stack(t *testing.T) {
+	testPc := setupRing3Pc(t,
+		0xB8, 0x10, 0x00, // mov ax, 0x10
+		0x8E, 0xD8, // mov ds, ax
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr32(0xA00+13*8, 0x00080300)
+	memory.WriteMemoryAddr32(0xA00+13*8+4, 0x00008E00)
+	registers.IDTR = intel8086.DescriptorTableRegister{Base: 0xA00, Limit: 0x7F}
+
+	for i := 0; i < 11; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint16(0x08), registers.CS.Selector)
+	assert.Equal(t, uint32(0x300), *registers.EIP())
+	assert.Equal(t, uint16(0x10), registers.SS.Selector)
+	assert.Equal(t, uint32(0xFE8), *registers.ESP())
+
+	expected := []uint32{0x10, 0x123, 0x33}
+	for i, value := range expected {
+		pushed, _ := memory.ReadMemoryValue32(0x30FE8 + uint32(i)*4)
+		assert.Equal(t, value, pushed, "frame dword %d", i)
+	}
+	outerSS, _ := memory.ReadMemoryValue32(0x30FFC)
+	assert.Equal(t, uint32(0x3B), outerSS)
+}
+
+func Test_ProtectionInstructionsReportDescriptorRights(t *testing.T) {
+	testPc := setupTaskPc(t,
+		0x0F, 0x03, 0xC3, // lsl ax, bx
+		0x0F, 0x02, 0xCB, // lar cx, bx
+		0x0F, 0x00, 0xE3, // verr bx
+		0x63, 0xDA, // arpl dx, bx
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	core.Step()
+	core.Step()
+	*registers.EBX() = 0x18
+	*registers.EDX() = 0x30
+
+	core.Step()
+	assert.True(t, registers.GetFlag(intel8086.ZeroFlag))
+	assert.Equal(t, uint16(0x67), *registers.AX())
+
+	core.Step()
+	assert.True(t, registers.GetFlag(intel8086.ZeroFlag))
+	assert.Equal(t, uint16(0x8B00), *registers.CX(), "LTR marked the TSS busy")
+
+	core.Step()
+	assert.False(t, registers.GetFlag(intel8086.ZeroFlag), "a TSS can't be read as data")
+
+	*registers.EBX() = 0x3B
+	core.Step()
+	assert.True(t, registers.GetFlag(intel8086.ZeroFlag))
+	assert.Equal(t, uint16(0x33), *registers.DX())
+}
+
+func Test_Ring3CantSwitchToARing0Task(t *testing.T) {
+	for _, transfer := range []struct {
+		name     string
+		code     []uint8
+		selector uint16
+		gateDPL  uint8
+	}{
+		{"jmp to the TSS", []uint8{0xEA, 0x00, 0x00, 0x20, 0x00}, 0x20, 0},                  // jmp 0x20:0
+		{"call through a ring 0 task gate", []uint8{0x9A, 0x00, 0x00, 0x2B, 0x00}, 0x28, 0}, // call 0x2b:0
+		{"call through a ring 3 task gate", []uint8{0x9A, 0x00, 0x00, 0x2B, 0x00}, 0x28, 3},
+	} {
+		testPc := setupRing3Pc(t, transfer.code...)
+		core := testPc.GetPrimaryCpu()
+		registers := core.GetRegisters()
+		memory := testPc.GetMemoryController()
+		memory.WriteMemoryAddr8(0x82D, 0x85|transfer.gateDPL<<5) // the task gate's access byte
+		memory.WriteMemoryAddr32(0xA00+13*8, 0x00080300)
+		memory.WriteMemoryAddr32(0xA00+13*8+4, 0x00008E00)
+		registers.IDTR = intel8086.DescriptorTableRegister{Base: 0xA00, Limit: 0x7F}
+
+		for i := 0; i < 10; i++ {
+			core.Step()
+		}
+		if transfer.gateDPL == 3 {
+			assert.Equal(t, uint16(0x20), registers.TR.Selector, transfer.name)
+			assert.Equal(t, uint32(0x200), *registers.EIP(), transfer.name)
+			assert.Equal(t, uint32(0x1234), *registers.EAX(), transfer.name)
+			continue
+		}
+		assert.Equal(t, uint16(0x18), registers.TR.Selector, transfer.name)
+		assert.Equal(t, uint16(0x08), registers.CS.Selector, transfer.name)
+		assert.Equal(t, uint32(0x300), *registers.EIP(), transfer.name)
+		errorCode, _ := memory.ReadMemoryValue32(0x30FE8)
+		assert.Equal(t, uint32(transfer.selector), errorCode, transfer.name)
+		returnAddress, _ := memory.ReadMemoryValue32(0x30FEC)
+		assert.Equal(t, uint32(0x120), returnAddress, transfer.name, "the fault is raised at the far transfer")
+	}
+}
@@ -0,0 +1,97 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// setupConfigPc builds a machine from config with its cpu initialised and running code at 1000:0100.
+// The other test machines build on it.
+func setupConfigPc(t testing.TB, config pc.MachineConfig, code ...uint8) *pc.PersonalComputer {
+	testPc, err := pc.NewPcWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := testPc.GetPrimaryCpu()
+	if err := core.Init(testPc.GetBus()); err != nil {
+		t.Fatal(err)
+	}
+	testPc.GetMemoryController().UnlockBootVector()
+
+	core.GetRegisters().CS = intel8086.RealModeSegment(0x1000)
+	*core.GetRegisters().IP() = 0x0100
+	for i, b := range code {
+		testPc.GetMemoryController().WriteMemoryAddr8(core.GetCurrentCodePointer()+uint32(i), b)
+	}
+	return testPc
+}
+
+// setupRegisterPc is setupConfigPc for the default machine
+func setupRegisterPc(t testing.TB, code ...uint8) *pc.PersonalComputer {
+	return setupConfigPc(t, pc.DefaultMachineConfig(), code...)
+}
+
+func Test_RegisterViewsShareStorage(t *testing.T) {
+	registers := setupRegisterPc(t).GetPrimaryCpu().GetRegisters()
+
+	*registers.EAX() = 0x12345678
+	assert.Equal(t, uint16(0x5678), *registers.AX())
+	assert.Equal(t, uint8(0x56), *registers.AH())
+	assert.Equal(t, uint8(0x78), *registers.AL())
+
+	*registers.AH() = 0xAB
+	assert.Equal(t, uint32(0x1234AB78), *registers.EAX())
+
+	*registers.SP() = 0xFFFE
+	assert.Equal(t, uint32(0xFFFE), *registers.ESP())
+
+	*registers.EIP() = 0x00011234
+	assert.Equal(t, uint16(0x1234), *registers.IP())
+}
+
+func Test_ByteRegisterWritesAreVisibleInWordRegister(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xB0, 0x12, // mov al, 0x12
+		0xB4, 0x34, // mov ah, 0x34
+		0x40, // inc ax
+	)
+	core := testPc.GetPrimaryCpu()
+	*core.GetRegisters().EAX() = 0xFFFF0000
+
+	core.Step()
+	core.Step()
+	assert.Equal(t, uint16(0x3412), *core.GetRegisters().AX())
+
+	core.Step()
+	assert.Equal(t, uint8(0x13), *core.GetRegisters().AL())
+	assert.Equal(t, uint32(0xFFFF3413), *core.GetRegisters().EAX())
+}
+
+func Test_DivideUsesAccumulatorViews(t *testing.T) {
+	testPc := setupRegisterPc(t, 0xF6, 0xF3) // div bl
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+
+	*registers.AX() = 0x0107
+	*registers.BL() = 2
+	core.Step()
+	assert.Equal(t, uint8(0x83), *registers.AL())
+	assert.Equal(t, uint8(1), *registers.AH())
+}
+
+func Test_SetRegisterWritesThroughToRegisterFile(t *testing.T) {
+	core := setupRegisterPc(t).GetPrimaryCpu()
+
+	_, err := core.SetRegister16(3, 0xBEEF)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0xBE), *core.GetRegisters().BH())
+
+	_, err = core.SetRegister32(1, 0xCAFE0102)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x02), *core.GetRegisters().CL())
+	value, name, _ := core.GetRegister32(core.GetRegisters().ECX())
+	assert.Equal(t, uint32(0xCAFE0102), value)
+	assert.Equal(t, "ECX", name)
+}
@@ -0,0 +1,45 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/common"
+	"github.com/andrewjc/threeatesix/devices/bus"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_StableDeviceIds(t *testing.T) {
+	first := pc.NewPc().GetBus().Devices()
+	second := pc.NewPc().GetBus().Devices()
+
+	assert.Equal(t, len(first), len(second))
+	for i := range first {
+		assert.Equal(t, first[i].Id, second[i].Id)
+		assert.Equal(t, first[i].Name, second[i].Name)
+	}
+
+	pic, err := pc.NewPc().GetBus().FindSingleDevice(common.MODULE_INTERRUPT_CONTROLLER_2)
+	assert.NoError(t, err)
+	assert.Equal(t, bus.DeviceId(common.MODULE_INTERRUPT_CONTROLLER_2, 0), pic.GetDeviceBusId())
+}
+
+func Test_DeviceRegistryIntrospection(t *testing.T) {
+	deviceBus := pc.NewPc().GetBus()
+
+	pit, ok := deviceBus.FindDeviceByName("pit.0")
+	assert.True(t, ok)
+	assert.Equal(t, bus.DeviceType(common.MODULE_PIT), pit.Type)
+	assert.Equal(t, bus.Ports(0x40, 0x42), pit.Ports[0].Ports)
+	assert.Nil(t, pit.Ports[1].Read)
+
+	_, ok = deviceBus.FindDeviceByName("pit.1")
+	assert.False(t, ok)
+
+	windows := deviceBus.MemoryMap()
+	assert.Equal(t, "video ram", windows[1].Name)
+	assert.Equal(t, "bios rom", windows[3].Name)
+	assert.Equal(t, uint32(0xFFFFF), windows[3].End())
+	for i := 1; i < len(windows); i++ {
+		assert.False(t, windows[i-1].Overlaps(windows[i]))
+	}
+}
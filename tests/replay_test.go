@@ -0,0 +1,118 @@
+package tests_test
+
+import (
+	"bytes"
+	"github.com/andrewjc/threeatesix/devices/replay"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_ReplayJournalRoundTrip(t *testing.T) {
+
+	recorder := replay.NewRecorder()
+
+	recorder.Sample(replay.EVENT_KEYBOARD_INPUT, 0x1C)
+	recorder.Advance()
+	recorder.Advance()
+	recorder.Sample(replay.EVENT_RTC_READ, 0x59)
+	recorder.HostTime(1000)
+	recorder.HostTimeConsumed(1000)
+	recorder.Advance()
+	recorder.HostTimeConsumed(170000)
+
+	var buffer bytes.Buffer
+	err := recorder.Save(&buffer)
+	assert.NoError(t, err)
+
+	replayer, err := replay.NewReplayer(&buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, recorder.GetEvents(), replayer.GetEvents())
+
+	// live values are ignored in favour of the journal
+	assert.Equal(t, uint64(0x1C), replayer.Sample(replay.EVENT_KEYBOARD_INPUT, 0xFF))
+	assert.Equal(t, int64(0), replayer.HostTime(5))
+	replayer.Advance()
+	assert.Equal(t, int64(0), replayer.HostTime(99999999))
+	replayer.Advance()
+	assert.Equal(t, uint64(0x59), replayer.Sample(replay.EVENT_RTC_READ, 0x00))
+	assert.Equal(t, int64(1000), replayer.HostTime(99999999))
+	replayer.Advance()
+	assert.Equal(t, int64(170000), replayer.HostTime(5))
+	assert.False(t, replayer.Diverged())
+
+	// an input the journal never saw is a divergence
+	replayer.Sample(replay.EVENT_KEYBOARD_INPUT, 0x01)
+	assert.True(t, replayer.Diverged())
+}
+
+func Test_ReplayJournalRewindReenactsRecording(t *testing.T) {
+
+	journal := replay.NewRecorder()
+
+	mark := journal.Mark()
+	journal.Sample(replay.EVENT_KEYBOARD_INPUT, 0x1C)
+	journal.Advance()
+	journal.Sample(replay.EVENT_RTC_READ, 0x30)
+	journal.Advance()
+
+	journal.Rewind(mark)
+
+	// the already recorded inputs win over live ones until the journal catches up
+	assert.Equal(t, uint64(0x1C), journal.Sample(replay.EVENT_KEYBOARD_INPUT, 0x01))
+	journal.Advance()
+	assert.Equal(t, uint64(0x30), journal.Sample(replay.EVENT_RTC_READ, 0x02))
+	journal.Advance()
+
+	// and then it records again
+	assert.Equal(t, uint64(0x03), journal.Sample(replay.EVENT_RTC_READ, 0x03))
+	assert.Len(t, journal.GetEvents(), 3)
+	assert.False(t, journal.Diverged())
+}
+
+func Test_ReplayJournalRejectsCorruptFiles(t *testing.T) {
+
+	var buffer bytes.Buffer
+	recorder := replay.NewRecorder()
+	recorder.Sample(replay.EVENT_KEYBOARD_INPUT, 0x1C)
+	recorder.Advance()
+	recorder.Sample(replay.EVENT_RTC_READ, 0x59)
+	assert.NoError(t, recorder.Save(&buffer))
+	journal := buffer.Bytes()
+
+	for name, corrupt := range map[string][]byte{
+		"truncated header":  journal[:3],
+		"truncated events":  journal[:len(journal)-1],
+		"huge event count":  append([]byte("386J\x01"), 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01),
+		"unknown kind":      {'3', '8', '6', 'J', 1, 1, 0, 0x7F, 0},
+		"overflowing steps": {'3', '8', '6', 'J', 1, 2, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, 1, 0, 1, 1, 0},
+	} {
+		_, err := replay.NewReplayer(bytes.NewReader(corrupt))
+		assert.Error(t, err, name)
+	}
+}
+
+func Test_ReplayDeliversKeystrokesWithoutLiveInput(t *testing.T) {
+
+	// a keystroke the 8042 received during step 1
+	recorder := replay.NewRecorder()
+	recorder.Advance()
+	recorder.Sample(replay.EVENT_KEYBOARD_INPUT, 0x1C)
+	var buffer bytes.Buffer
+	assert.NoError(t, recorder.Save(&buffer))
+
+	testPc := setupRegisterPc(t,
+		0xE4, 0x64, // in al, 0x64
+		0x88, 0xC3, // mov bl, al
+		0x90,       // nop
+		0xE4, 0x64, // in al, 0x64
+	)
+	assert.NoError(t, testPc.LoadReplay(&buffer))
+	registers := testPc.GetPrimaryCpu().GetRegisters()
+
+	// nothing in the machine sends a byte, the journal does
+	assert.NoError(t, testPc.StepForward(4))
+	assert.Zero(t, *registers.BL()&0x01, "the output buffer is empty before the recorded step")
+	assert.Equal(t, uint8(0x01), *registers.AL()&0x01, "the recorded byte arrived")
+	assert.False(t, testPc.GetJournal().Diverged())
+	assert.Empty(t, testPc.GetJournal().Pending(replay.EVENT_KEYBOARD_INPUT))
+}
@@ -0,0 +1,54 @@
+package tests_test
+
+import (
+	"bytes"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setupReversiblePc(t *testing.T) *pc.PersonalComputer {
+	// a run of INC AX instructions
+	testPc := setupRegisterPc(t, bytes.Repeat([]uint8{0x40}, 32)...)
+	*testPc.GetPrimaryCpu().GetRegisters().AX() = 0
+
+	testPc.EnableReverseExecution()
+	return testPc
+}
+
+func Test_ReverseStep(t *testing.T) {
+	testPc := setupReversiblePc(t)
+	core := testPc.GetPrimaryCpu()
+
+	assert.NoError(t, testPc.StepForward(10))
+	assert.Equal(t, uint16(10), *core.GetRegisters().AX())
+	assert.Equal(t, uint64(10), testPc.GetInstructionCount())
+
+	assert.NoError(t, testPc.ReverseStep(3))
+	assert.Equal(t, uint16(7), *core.GetRegisters().AX())
+	assert.Equal(t, uint16(0x0107), *core.GetRegisters().IP())
+	assert.Equal(t, uint64(7), testPc.GetInstructionCount())
+
+	// running forward again from the rewound state gives the same result
+	assert.NoError(t, testPc.StepForward(3))
+	assert.Equal(t, uint16(10), *core.GetRegisters().AX())
+}
+
+func Test_ReverseContinue(t *testing.T) {
+	testPc := setupReversiblePc(t)
+	core := testPc.GetPrimaryCpu()
+	breakpoint := uint32(0x10000 + 0x0104)
+
+	assert.NoError(t, testPc.StepForward(12))
+
+	hit, err := testPc.ReverseContinue(func(addr uint32) bool { return addr == breakpoint })
+	assert.NoError(t, err)
+	assert.True(t, hit)
+	assert.Equal(t, breakpoint, core.GetCurrentCodePointer())
+	assert.Equal(t, uint16(4), *core.GetRegisters().AX())
+
+	hit, err = testPc.ReverseContinue(func(addr uint32) bool { return addr == breakpoint })
+	assert.NoError(t, err)
+	assert.False(t, hit)
+	assert.Equal(t, uint64(0), testPc.GetInstructionCount())
+}
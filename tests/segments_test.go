@@ -0,0 +1,123 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// writeDescriptor writes a segment descriptor with a byte granular limit, or a page granular
+// one when flags has the G bit
+func writeDescriptor(testPc *pc.PersonalComputer, addr uint32, base uint32, limit uint32, access uint8, flags uint8) {
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr32(addr, limit&0xFFFF|base<<16)
+	memory.WriteMemoryAddr32(addr+4, base>>16&0xFF|uint32(access)<<8|limit&0xF0000|uint32(flags)<<16|base&0xFF000000)
+}
+
+func Test_RealModeSegmentLoadKeepsCachedLimit(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0x0F, 0x01, 0x16, 0x00, 0x09, // lgdt [0x900]
+		0x0F, 0x20, 0xC0, // mov eax, cr0
+		0x66, 0x83, 0xC8, 0x01, // or eax, 1
+		0x0F, 0x22, 0xC0, // mov cr0, eax
+		0xB8, 0x08, 0x00, // mov ax, 8
+		0x8E, 0xD8, // mov ds, ax
+		0x66, 0x83, 0xE0, 0xFE, // and eax, ~1
+		0x0F, 0x22, 0xC0, // mov cr0, eax
+		0xB8, 0x00, 0x00, // mov ax, 0
+		0x8E, 0xD8, // mov ds, ax
+		0x67, 0x8B, 0x03, // mov ax, [ebx]
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	memory.WriteMemoryAddr16(0x900, 0x0F)
+	memory.WriteMemoryAddr32(0x902, 0x800)
+	writeDescriptor(testPc, 0x808, 0, 0xFFFFF, 0x92, 0x80)
+	memory.WriteMemoryAddr16(0x20000, 0x5A5A)
+	*registers.EBX() = 0x20000
+
+	for i := 0; i < 6; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint32(0x800), registers.GDTR.Base)
+	assert.Equal(t, uint16(0x08), registers.DS.Selector)
+	assert.Equal(t, uint32(0), registers.DS.Base)
+	assert.Equal(t, uint32(0xFFFFFFFF), registers.DS.Limit)
+
+	accessByte, _ := memory.ReadMemoryValue8(0x80D)
+	assert.Equal(t, uint8(0x93), accessByte, "loading a segment marks its descriptor accessed")
+
+	for i := 0; i < 4; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint32(0), registers.CR0&intel8086.CR0_PE)
+	assert.Equal(t, uint16(0), registers.DS.Selector)
+	assert.Equal(t, uint32(0xFFFFFFFF), registers.DS.Limit)
+
+	core.Step()
+	assert.Equal(t, uint16(0x5A5A), *registers.AX())
+}
+
+func Test_RealModeLimitViolationRaisesGP(t *testing.T) {
+	testPc := setupRegisterPc(t, 0x67, 0x8B, 0x03) // mov ax, [ebx]
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	memory.WriteMemoryAddr16(13*4, 0x0040)
+	memory.WriteMemoryAddr16(13*4+2, 0x0500)
+	registers.SS = intel8086.RealModeSegment(0x3000)
+	*registers.SP() = 0x0100
+	*registers.EBX() = 0x20000
+	*registers.AX() = 0x1234
+
+	core.Step()
+	assert.Equal(t, uint16(0x0500), registers.CS.Selector)
+	assert.Equal(t, uint32(0x5000), registers.CS.Base)
+	assert.Equal(t, uint16(0x0040), *registers.IP())
+	assert.Equal(t, uint16(0x1234), *registers.AX())
+
+	returnAddr, _ := memory.ReadMemoryValue16(0x300FA)
+	assert.Equal(t, uint16(0x0100), returnAddr, "the fault returns to the faulting instruction")
+}
+
+func Test_ProtectedModeSegmentNotPresentFault(t *testing.T) {
+	testPc := setupRegisterPc(t,
+		0xB8, 0x10, 0x00, // mov ax, 0x10
+		0x8E, 0xD8, // mov ds, ax
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	writeDescriptor(testPc, 0x810, 0x40000, 0xFFFF, 0x12, 0x00)
+	writeDescriptor(testPc, 0x818, 0x10000, 0xFFFF, 0x9A, 0x00)
+	registers.GDTR = intel8086.DescriptorTableRegister{Base: 0x800, Limit: 0x1F}
+
+	// a 386 interrupt gate for #NP to 0x18:0x200
+	memory.WriteMemoryAddr32(0xA00+11*8, 0x00180200)
+	memory.WriteMemoryAddr32(0xA00+11*8+4, 0x00008E00)
+	registers.IDTR = intel8086.DescriptorTableRegister{Base: 0xA00, Limit: 0x7F}
+
+	registers.CR0 |= intel8086.CR0_PE
+	*registers.SP() = 0x0100
+	previousDS := registers.DS
+
+	core.Step()
+	core.Step()
+	assert.Equal(t, previousDS, registers.DS)
+	assert.Equal(t, uint16(0x18), registers.CS.Selector)
+	assert.Equal(t, uint32(0x10000), registers.CS.Base)
+	assert.Equal(t, uint32(0x200), *registers.EIP())
+	assert.Equal(t, uint16(0xF0), *registers.SP())
+
+	errorCode, _ := memory.ReadMemoryValue32(0xF0)
+	returnAddr, _ := memory.ReadMemoryValue32(0xF4)
+	returnCS, _ := memory.ReadMemoryValue32(0xF8)
+	assert.Equal(t, uint32(0x10), errorCode)
+	assert.Equal(t, uint32(0x103), returnAddr)
+	assert.Equal(t, uint32(0x1000), returnCS)
+}
@@ -0,0 +1,78 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel82335"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setupShadowPc(t *testing.T) *pc.PersonalComputer {
+	testPc := setupRegisterPc(t)
+
+	rom := make([]uint8, 0x10000)
+	rom[0x1234] = 0xAA
+	assert.NoError(t, testPc.GetMemoryController().MapRom("bios rom", 0xF0000, 0x10000, rom))
+	return testPc
+}
+
+func Test_BiosShadowRouting(t *testing.T) {
+	testPc := setupShadowPc(t)
+	mem := testPc.GetMemoryController()
+	ports := testPc.GetIOPortController()
+
+	// with the rom enabled, reads come from rom and writes go to the shadow ram underneath
+	assert.NoError(t, mem.WriteMemoryAddr8(0xF1234, 0x55))
+	value, _ := mem.ReadMemoryValue8(0xF1234)
+	assert.Equal(t, uint8(0xAA), value)
+
+	ports.WriteAddr16(0x22, intel82335.MCR_RESET_VALUE|1<<intel82335.MCR_BIOS_ROM_ENABLE)
+	assert.Equal(t, uint16(0x0009), ports.ReadAddr16(0x22))
+	value, _ = mem.ReadMemoryValue8(0xF1234)
+	assert.Equal(t, uint8(0x55), value)
+
+	// write protected shadow
+	ports.WriteAddr8(0x22, 0x0B)
+	assert.NoError(t, mem.WriteMemoryAddr8(0xF1234, 0x66))
+	value, _ = mem.ReadMemoryValue8(0xF1234)
+	assert.Equal(t, uint8(0x55), value)
+
+	ports.WriteAddr8(0x22, 0x08)
+	value, _ = mem.ReadMemoryValue8(0xF1234)
+	assert.Equal(t, uint8(0xAA), value)
+}
+
+func Test_BaseMemoryHole(t *testing.T) {
+	testPc := setupShadowPc(t)
+	mem := testPc.GetMemoryController()
+	ports := testPc.GetIOPortController()
+
+	assert.NoError(t, mem.WriteMemoryAddr16(0x90000, 0x1234))
+
+	// 512K base memory leaves 80000-9FFFF to the ISA bus
+	ports.WriteAddr16(0x22, 0x0000)
+	value, err := mem.ReadMemoryValue16(0x90000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0xFFFF), value)
+	assert.NoError(t, mem.WriteMemoryAddr16(0x90000, 0x5678))
+
+	region, _ := mem.GetRegion(0x90000)
+	assert.Equal(t, "isa bus", region.Name)
+
+	ports.WriteAddr16(0x22, intel82335.MCR_RESET_VALUE)
+	value, _ = mem.ReadMemoryValue16(0x90000)
+	assert.Equal(t, uint16(0x1234), value)
+}
+
+func Test_ShadowConfigSurvivesReverseStep(t *testing.T) {
+	testPc := setupReversiblePc(t)
+	mem := testPc.GetMemoryController()
+
+	assert.NoError(t, testPc.StepForward(2))
+	testPc.GetIOPortController().WriteAddr16(0x22, 0x0000)
+	assert.NoError(t, testPc.StepForward(2))
+
+	assert.NoError(t, testPc.ReverseStep(3))
+	region, _ := mem.GetRegion(0x90000)
+	assert.Equal(t, "conventional ram", region.Name)
+}
@@ -0,0 +1,92 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setupInterruptPc(t *testing.T) *pc.PersonalComputer {
+	// STI followed by INC AX instructions
+	testPc := setupRegisterPc(t, 0xFB, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40, 0x40)
+	memory := testPc.GetMemoryController()
+
+	// IRQ 0 handler at 2000:0300
+	memory.WriteMemoryAddr16(0x08*4, 0x0300)
+	memory.WriteMemoryAddr16(0x08*4+2, 0x2000)
+
+	// ICW1-ICW4 with the primary controller based at vector 0x08, then unmask IRQ 0 only
+	ports := testPc.GetIOPortController()
+	ports.WriteAddr8(0x20, 0x11)
+	ports.WriteAddr8(0x21, 0x08)
+	ports.WriteAddr8(0x21, 0x04)
+	ports.WriteAddr8(0x21, 0x01)
+	ports.WriteAddr8(0x21, 0xFE)
+
+	return testPc
+}
+
+func Test_IrqLineDeliversInterrupt(t *testing.T) {
+	testPc := setupInterruptPc(t)
+	core := testPc.GetPrimaryCpu()
+
+	testPc.GetBus().Signals().IRQ[0].Drive(true)
+
+	// STI only takes effect after the next instruction
+	core.Step()
+	assert.Equal(t, uint16(0x0101), *core.GetRegisters().IP())
+	core.Step()
+
+	assert.Equal(t, uint16(0x2000), core.GetRegisters().CS.Selector)
+	assert.Equal(t, uint16(0x0300), *core.GetRegisters().IP())
+	assert.Equal(t, uint16(1), *core.GetRegisters().AX())
+
+	// the return address is on the stack
+	ip, _ := testPc.GetMemoryController().ReadMemoryValue16(uint32(*core.GetRegisters().SP()))
+	assert.Equal(t, uint16(0x0102), ip)
+
+	// IRQ 0 is in service until the handler sends an EOI
+	ports := testPc.GetIOPortController()
+	ports.WriteAddr8(0x20, 0x0B)
+	assert.Equal(t, uint8(0x01), ports.ReadAddr8(0x20))
+	ports.WriteAddr8(0x20, 0x20)
+	ports.WriteAddr8(0x20, 0x0B)
+	assert.Equal(t, uint8(0x00), ports.ReadAddr8(0x20))
+}
+
+func Test_MaskedIrqIsNotDelivered(t *testing.T) {
+	testPc := setupInterruptPc(t)
+	core := testPc.GetPrimaryCpu()
+
+	testPc.GetBus().Signals().IRQ[1].Drive(true)
+	core.Step()
+	core.Step()
+
+	assert.Equal(t, uint16(0x1000), core.GetRegisters().CS.Selector)
+	assert.Equal(t, uint16(0x0102), *core.GetRegisters().IP())
+}
+
+func Test_HltWaitsForInterrupt(t *testing.T) {
+	testPc := setupInterruptPc(t)
+	core := testPc.GetPrimaryCpu()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr8(core.GetCurrentCodePointer()+1, 0xF4) // hlt
+
+	core.Step()
+	core.Step()
+	assert.Equal(t, uint16(0x0102), *core.GetRegisters().IP())
+
+	// nothing to wake it yet, but interrupts are enabled so it hasn't stopped for good
+	core.Step()
+	assert.Equal(t, uint16(0x0102), *core.GetRegisters().IP())
+	stopped, _ := core.Stopped()
+	assert.False(t, stopped)
+
+	testPc.GetBus().Signals().IRQ[0].Drive(true)
+	core.Step()
+	assert.Equal(t, uint16(0x2000), core.GetRegisters().CS.Selector)
+	assert.Equal(t, uint16(0x0300), *core.GetRegisters().IP())
+
+	ip, _ := memory.ReadMemoryValue16(uint32(*core.GetRegisters().SP()))
+	assert.Equal(t, uint16(0x0102), ip, "the handler returns to the instruction after hlt")
+}
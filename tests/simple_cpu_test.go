@@ -18,10 +18,10 @@ func Test_DoCpuTest(t *testing.T) {
 	instructions := []uint8{0xf, 0x20, 0xc0, 0x66, 0x25, 0xff, 0xff, 0xff, 0x9f, 0xf, 0x22, 0xc0, 0xff, 0xe7, 0xf, 0x1, 0xe0}
 
 	for x := 0; x < len(instructions); x++ {
-		testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint16(x)), instructions[x])
+		testPc.GetMemoryController().WriteMemoryAddr8(uint32(testPc.GetPrimaryCpu().GetIP()+uint32(x)), instructions[x])
 	}
 
-	var tmp uint16
+	var tmp uint32
 	for {
 		if testPc.GetPrimaryCpu().GetIP() == 0 {
 			break
@@ -0,0 +1,44 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/monitor"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const nasmMap = `
+- NASM Map file ---------------------------------------------------------------
+
+Source file:  post.asm
+Output file:  post.bin
+
+-- Symbols --------------------------------------------------------------------
+
+---- Section .text ------------------------------------------------------------
+
+Real              Virtual           Name
+               0                 0  reset
+              40                40  post_start
+             120               120  post_memtest
+`
+
+func Test_SymbolTableNasmMap(t *testing.T) {
+	table := monitor.NewSymbolTable()
+	assert.NoError(t, table.LoadNasmMap(strings.NewReader(nasmMap), 0xF0000))
+
+	assert.Equal(t, 3, table.Len())
+	assert.Equal(t, "post_start", table.Format(0xF0040))
+	assert.Equal(t, "post_start+0x12", table.Format(0xF0052))
+	assert.Equal(t, "post_memtest+0x100", table.Format(0xF0220))
+	assert.Equal(t, "0xeffff", table.Format(0xEFFFF))
+}
+
+func Test_SymbolTableAddressList(t *testing.T) {
+	table := monitor.NewSymbolTable()
+	list := "# bios entry points\nF000:E05B post\n0xFE6F2 int19_boot\n"
+	assert.NoError(t, table.LoadAddressList(strings.NewReader(list), 0))
+
+	assert.Equal(t, "post+0x5", table.Format(0xFE060))
+	assert.Equal(t, "int19_boot", table.Format(0xFE6F2))
+}
@@ -0,0 +1,135 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// setupTaskPc builds a protected mode machine with two 386 TSSs, the one at 0x18 for the running
+// task and the one at 0x20 for a task that starts at 0x08:0x200 with EAX=0x1234. 0x28 is a task
+// gate for the second task. The code starts by loading CS and TR.
+func setupTaskPc(t *testing.T, code ...uint8) *pc.PersonalComputer {
+	testPc := setupRegisterPc(t, append([]uint8{
+		0xEA, 0x05, 0x01, 0x08, 0x00, // jmp 0x08:0x105
+		0x0F, 0x00, 0xD8, // ltr ax
+	}, code...)...)
+	registers := testPc.GetPrimaryCpu().GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	writeDescriptor(testPc, 0x808, 0x10000, 0xFFFF, 0x9A, 0x00)
+	writeDescriptor(testPc, 0x810, 0x30000, 0xFFFF, 0x92, 0x00)
+	writeDescriptor(testPc, 0x818, 0x2000, 0x67, 0x89, 0x00)
+	writeDescriptor(testPc, 0x820, 0x2100, 0x67, 0x89, 0x00)
+	memory.WriteMemoryAddr32(0x828, 0x00200000)
+	memory.WriteMemoryAddr32(0x82C, 0x00008500)
+	registers.GDTR = intel8086.DescriptorTableRegister{Base: 0x800, Limit: 0x2F}
+
+	memory.WriteMemoryAddr32(0x2120, 0x200)  // EIP
+	memory.WriteMemoryAddr32(0x2124, 0x0002) // EFLAGS
+	memory.WriteMemoryAddr32(0x2128, 0x1234) // EAX
+	memory.WriteMemoryAddr32(0x2138, 0x80)   // ESP
+	for i, selector := range []uint32{0x10, 0x08, 0x10, 0x10, 0x10, 0x10} {
+		memory.WriteMemoryAddr32(0x2148+uint32(i)*4, selector)
+	}
+
+	registers.CR0 |= intel8086.CR0_PE
+	*registers.EAX() = 0x18
+	return testPc
+}
+
+func Test_CallToTssNestsTaskAndIretReturns(t *testing.T) {
+	testPc := setupTaskPc(t,
+		0xBB, 0x10, 0x00, // mov bx, 0x10
+		0x8E, 0xD3, // mov ss, bx
+		0x9A, 0x00, 0x00, 0x20, 0x00, // call 0x20:0
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+	memory.WriteMemoryAddr8(0x10200, 0xCF) // iret
+	profiler := testPc.EnableProfiler()
+
+	for i := 0; i < 5; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint16(0x20), registers.TR.Selector)
+	assert.Equal(t, uint32(0x200), *registers.EIP())
+	assert.Equal(t, uint32(0x1234), *registers.EAX())
+	assert.Empty(t, profiler.GetFarCallCounts(), "a task switch isn't a far call")
+	assert.Len(t, core.Backtrace(), 1)
+	assert.Equal(t, uint32(0x30000), registers.SS.Base)
+	assert.True(t, registers.GetFlag(intel8086.NestedTaskFlag))
+	assert.NotZero(t, registers.CR0&intel8086.CR0_TS, "a task switch sets TS")
+
+	backLink, _ := memory.ReadMemoryValue16(0x2100)
+	savedEIP, _ := memory.ReadMemoryValue32(0x2020)
+	savedEAX, _ := memory.ReadMemoryValue32(0x2028)
+	assert.Equal(t, uint16(0x18), backLink)
+	assert.Equal(t, uint32(0x112), savedEIP, "the caller resumes after the call")
+	assert.Equal(t, uint32(0x18), savedEAX)
+	callerAccess, _ := memory.ReadMemoryValue8(0x81D)
+	calleeAccess, _ := memory.ReadMemoryValue8(0x825)
+	assert.Equal(t, uint8(0x8B), callerAccess, "a nesting task stays busy")
+	assert.Equal(t, uint8(0x8B), calleeAccess)
+
+	core.Step()
+	assert.Equal(t, uint16(0x18), registers.TR.Selector)
+	assert.Equal(t, uint32(0x112), *registers.EIP())
+	assert.Equal(t, uint32(0x18), *registers.EAX())
+	assert.Empty(t, core.Backtrace(), "the IRET back to the caller unwinds the nested task")
+	assert.False(t, registers.GetFlag(intel8086.NestedTaskFlag))
+	calleeAccess, _ = memory.ReadMemoryValue8(0x825)
+	assert.Equal(t, uint8(0x89), calleeAccess, "the task returned from is no longer busy")
+	calleeFlags, _ := memory.ReadMemoryValue32(0x2124)
+	assert.Zero(t, calleeFlags&intel8086.NestedTaskFlag)
+}
+
+func Test_JmpThroughTaskGateDoesNotNest(t *testing.T) {
+	testPc := setupTaskPc(t,
+		0xEA, 0x00, 0x00, 0x28, 0x00, // jmp 0x28:0
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	for i := 0; i < 3; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint16(0x20), registers.TR.Selector)
+	assert.Equal(t, uint32(0x200), *registers.EIP())
+	assert.False(t, registers.GetFlag(intel8086.NestedTaskFlag))
+
+	backLink, _ := memory.ReadMemoryValue16(0x2100)
+	assert.Equal(t, uint16(0), backLink)
+	previousAccess, _ := memory.ReadMemoryValue8(0x81D)
+	assert.Equal(t, uint8(0x89), previousAccess, "the task jumped away from is no longer busy")
+}
+
+func Test_ExceptionThroughTaskGatePushesErrorCode(t *testing.T) {
+	testPc := setupTaskPc(t,
+		0x8E, 0xDB, // mov ds, bx
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	// #GP is a task gate for the second task
+	memory.WriteMemoryAddr32(0xA00+13*8, 0x00200000)
+	memory.WriteMemoryAddr32(0xA00+13*8+4, 0x00008500)
+	registers.IDTR = intel8086.DescriptorTableRegister{Base: 0xA00, Limit: 0x7F}
+	*registers.EBX() = 0x40
+
+	for i := 0; i < 3; i++ {
+		core.Step()
+	}
+	assert.Equal(t, uint16(0x20), registers.TR.Selector)
+	assert.True(t, registers.GetFlag(intel8086.NestedTaskFlag))
+	assert.Equal(t, uint32(0x7C), *registers.ESP())
+	errorCode, _ := memory.ReadMemoryValue32(0x3007C)
+	assert.Equal(t, uint32(0x40), errorCode)
+
+	savedEIP, _ := memory.ReadMemoryValue32(0x2020)
+	assert.Equal(t, uint32(0x108), savedEIP, "the faulting instruction is restarted on return")
+}
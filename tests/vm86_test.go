@@ -0,0 +1,97 @@
+package tests_test
+
+import (
+	"github.com/andrewjc/threeatesix/devices/intel8086"
+	"github.com/andrewjc/threeatesix/pc"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// setupVirtual8086Pc builds on setupTaskPc with an IRETD into virtual 8086 mode at 2000:0000, with
+// the given IOPL bits and the V86 stack at 4000:0100. #GP goes to a ring 0 monitor at 0x08:0x300,
+// which runs on the ring 0 stack 0x10:0x1000 from the TSS.
+func setupVirtual8086Pc(t *testing.T, iopl uint32, code ...uint8) *pc.PersonalComputer {
+	testPc := setupTaskPc(t, 0x66, 0xCF) // iretd
+	registers := testPc.GetPrimaryCpu().GetRegisters()
+	memory := testPc.GetMemoryController()
+	for i, b := range code {
+		memory.WriteMemoryAddr8(0x20000+uint32(i), b)
+	}
+
+	memory.WriteMemoryAddr32(0x2004, 0x1000) // ESP0
+	memory.WriteMemoryAddr32(0x2008, 0x10)   // SS0
+	memory.WriteMemoryAddr32(0xA00+13*8, 0x00080300)
+	memory.WriteMemoryAddr32(0xA00+13*8+4, 0x00008E00)
+	registers.IDTR = intel8086.DescriptorTableRegister{Base: 0xA00, Limit: 0x7F}
+
+	frame := []uint32{0, 0x2000, intel8086.VirtualModeFlag | iopl | 0x0002, 0x100, 0x4000, 0x5000, 0x6000, 0, 0}
+	for i, value := range frame {
+		memory.WriteMemoryAddr32(0x600+uint32(i)*4, value)
+	}
+	*registers.ESP() = 0x600
+	return testPc
+}
+
+func Test_IretdEntersVirtual8086ModeAndCliTraps(t *testing.T) {
+	testPc := setupVirtual8086Pc(t, 0, 0xFA) // cli
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	for i := 0; i < 3; i++ {
+		core.Step()
+	}
+	assert.True(t, registers.GetFlag(intel8086.VirtualModeFlag))
+	assert.Equal(t, uint32(0x20000), registers.CS.Base)
+	assert.Equal(t, uint32(0), *registers.EIP())
+	assert.Equal(t, uint32(0x40000), registers.SS.Base)
+	assert.Equal(t, uint32(0x60000), registers.DS.Base)
+	assert.Equal(t, uint32(0x100), *registers.ESP())
+
+	core.Step()
+	assert.False(t, registers.GetFlag(intel8086.VirtualModeFlag), "the monitor runs in protected mode")
+	assert.Equal(t, uint16(0x08), registers.CS.Selector)
+	assert.Equal(t, uint32(0x300), *registers.EIP())
+	assert.Equal(t, uint16(0x10), registers.SS.Selector)
+	assert.Equal(t, uint32(0xFD8), *registers.ESP())
+	assert.Equal(t, uint16(0), registers.DS.Selector)
+
+	expected := []uint32{0, 0, 0x2000, 0, 0x100, 0x4000, 0x5000, 0x6000, 0, 0}
+	for i, value := range expected {
+		pushed, _ := memory.ReadMemoryValue32(0x30FD8 + uint32(i)*4)
+		if i == 3 {
+			assert.NotZero(t, pushed&intel8086.VirtualModeFlag, "the pushed EFLAGS has VM set")
+			continue
+		}
+		assert.Equal(t, value, pushed, "frame dword %d", i)
+	}
+}
+
+func Test_Virtual8086PortAccessFollowsIoBitmap(t *testing.T) {
+	testPc := setupVirtual8086Pc(t, intel8086.IoPrivilegeLevelFlag,
+		0xE4, 0x60, // in al, 0x60
+		0xFA,       // cli
+		0xE4, 0x61, // in al, 0x61
+	)
+	core := testPc.GetPrimaryCpu()
+	registers := core.GetRegisters()
+	memory := testPc.GetMemoryController()
+
+	// the bitmap follows the TSS's fixed fields and traps port 0x61 only
+	writeDescriptor(testPc, 0x818, 0x2000, 0x88, 0x89, 0x00)
+	memory.WriteMemoryAddr16(0x2066, 0x68)
+	memory.WriteMemoryAddr8(0x2068+0x61/8, 0x02)
+
+	for i := 0; i < 5; i++ {
+		core.Step()
+	}
+	assert.True(t, registers.GetFlag(intel8086.VirtualModeFlag))
+	assert.Equal(t, uint32(3), *registers.EIP())
+	assert.False(t, registers.GetFlag(intel8086.InterruptFlag), "CLI runs at IOPL 3")
+
+	core.Step()
+	assert.Equal(t, uint16(0x08), registers.CS.Selector)
+	assert.Equal(t, uint32(0x300), *registers.EIP())
+	faultingIP, _ := memory.ReadMemoryValue32(0x30FDC)
+	assert.Equal(t, uint32(3), faultingIP)
+}